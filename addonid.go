@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errAddonIDNotAllowed = errors.New("requested add-on id is not allowed for this token")
+
+// requestedAddonID returns the add-on id requested in the addon_id form
+// value or, when it is absent, in the addon_id query parameter
+func requestedAddonID(r *http.Request) string {
+	if r.MultipartForm != nil && len(r.MultipartForm.Value["addon_id"]) > 0 {
+		return strings.TrimSpace(r.MultipartForm.Value["addon_id"][0])
+	}
+	return strings.TrimSpace(r.URL.Query().Get("addon_id"))
+}
+
+// allowedAddonID checks that the requested add-on id matches one of the
+// allowed add-on id patterns of auth and returns it. Tokens without
+// AllowedAddonIDs ignore the request and sign their AddonID.
+func allowedAddonID(auth authorization, requested string) (string, error) {
+	if len(auth.AllowedAddonIDs) == 0 || requested == "" {
+		return "", nil
+	}
+	for _, pattern := range auth.AllowedAddonIDs {
+		// the patterns are checked when the configuration is loaded
+		if matched, _ := path.Match(pattern, requested); matched {
+			return requested, nil
+		}
+	}
+	return "", errors.Wrapf(errAddonIDNotAllowed, "add-on id %q", requested)
+}
+
+// validateAddonIDPattern returns an error for add-on id patterns that
+// are empty or malformed globs
+func validateAddonIDPattern(pattern string) error {
+	if pattern == "" || strings.ContainsAny(pattern, " \t\r\n") {
+		return errors.Errorf("invalid allowed add-on id %q", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.Errorf("invalid allowed add-on id %q: %v", pattern, err)
+	}
+	return nil
+}
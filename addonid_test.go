@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerAddonID(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[0].AllowedAddonIDs = []string{"*@team.example.com", "release-*"}
+	useTestConf(t, testConf)
+
+	testcases := []struct {
+		name            string
+		token           string
+		fields          map[string]string
+		expectedStatus  int
+		expectedAddonID string
+	}{
+		{"add-on id matching a glob", testConf.Authorizations[0].ClientToken, map[string]string{"addon_id": "tools@team.example.com"}, http.StatusCreated, "tools@team.example.com"},
+		{"add-on id matching a prefix", testConf.Authorizations[0].ClientToken, map[string]string{"addon_id": "release-2025"}, http.StatusCreated, "release-2025"},
+		{"no add-on id", testConf.Authorizations[0].ClientToken, nil, http.StatusCreated, "myaddon@allizom.org"},
+		{"add-on id of another team", testConf.Authorizations[0].ClientToken, map[string]string{"addon_id": "tools@other.example.com"}, http.StatusForbidden, ""},
+		{"tokens without allowed add-on ids ignore it", testConf.Authorizations[1].ClientToken, map[string]string{"addon_id": "tools@other.example.com"}, http.StatusCreated, "mycoseaddon@allizom.org"},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []struct {
+				Options xpiOptions
+			}
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					if err := json.NewDecoder(req.Body).Decode(&upstreamRequests); err != nil {
+						t.Fatal(err)
+					}
+					return newSignedFileResponse(newSignedXPI(t, "manifest.json", xpiPKCS7SignaturePath, xpiCOSESignaturePath)), nil
+				})
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequestWithFields(t, tt.token, newSignedXPI(t, "manifest.json"), tt.fields))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusCreated {
+				var body errorResponse
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code != "addon_id_not_allowed" {
+					t.Fatalf("returned %+v (%v) expected the addon_id_not_allowed code", body, err)
+				}
+				return
+			}
+			if len(upstreamRequests) != 1 || upstreamRequests[0].Options.ID != tt.expectedAddonID {
+				t.Fatalf("upstream received %+v expected add-on id %q", upstreamRequests, tt.expectedAddonID)
+			}
+		})
+	}
+}
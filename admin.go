@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// redactedValue replaces secrets in the /__config__ output
+const redactedValue = "[redacted]"
+
+// redactedAuthorization is an authorization as returned by the
+// /__config__ endpoint. Its client token and hawk key are always set
+// to redactedValue and it has no field for the client token hash, so
+// none of them are copied into the response.
+type redactedAuthorization struct {
+	ClientToken         string   `json:"client_token"`
+	Key                 string   `json:"key"`
+	User                string   `json:"user"`
+	Signer              string   `json:"signer"`
+	AddonID             string   `json:"addon_id,omitempty"`
+	AddonPKCS7Digest    string   `json:"addon_pkcs7_digest,omitempty"`
+	AddonCOSEAlgorithms []string `json:"addon_cose_algorithms,omitempty"`
+	AddonPKCS7Digests   []string `json:"addon_pkcs7_digests,omitempty"`
+	RateLimit           int      `json:"rate_limit,omitempty"`
+	MaxConcurrent       int      `json:"max_concurrent,omitempty"`
+	MaxUploadBytes      int64    `json:"max_upload_bytes,omitempty"`
+	MaxOutputBytes      int64    `json:"max_output_bytes,omitempty"`
+	AllowedCIDRs        []string `json:"allowed_cidrs,omitempty"`
+	AllowRequestOptions bool     `json:"allow_request_options,omitempty"`
+	UpstreamPath        string   `json:"upstream_path,omitempty"`
+	SignatureType       string   `json:"signature_type"`
+	Disabled            bool     `json:"disabled,omitempty"`
+	AllowURLInput       bool     `json:"allow_url_input,omitempty"`
+	AllowedInputHosts   []string `json:"allowed_input_hosts,omitempty"`
+	AllowCache          bool     `json:"allow_cache,omitempty"`
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
+	AllowedSigners      []string `json:"allowed_signers,omitempty"`
+	AllowRawResponse    bool     `json:"allow_raw_response,omitempty"`
+	AllowDetached       bool     `json:"allow_detached,omitempty"`
+	RequireTimestamp    bool     `json:"require_timestamp,omitempty"`
+	VerifyAPK           bool     `json:"verify_apk,omitempty"`
+	RequiredHeaders     []string `json:"required_headers,omitempty"`
+	AllowedKeyIDs       []string `json:"allowed_keyids,omitempty"`
+	DisableResponseGzip bool     `json:"disable_response_gzip,omitempty"`
+	AllowedAddonIDs     []string `json:"allowed_addon_ids,omitempty"`
+	AllowCOSEOverride   bool     `json:"allow_cose_override,omitempty"`
+	AllowValidityWindow bool     `json:"allow_validity_window,omitempty"`
+	AllowOutputOptions  bool     `json:"allow_output_options,omitempty"`
+	Deduplicate         bool     `json:"deduplicate,omitempty"`
+	UpstreamTimeout     string   `json:"upstream_timeout,omitempty"`
+	RequireNonce        bool     `json:"require_nonce,omitempty"`
+	MaxPriority         string   `json:"max_priority,omitempty"`
+	ValidFrom           string   `json:"valid_from,omitempty"`
+	ValidUntil          string   `json:"valid_until,omitempty"`
+}
+
+func redactAuthorization(auth authorization) redactedAuthorization {
+	redacted := redactedAuthorization{
+		ClientToken:         redactedValue,
+		Key:                 redactedValue,
+		User:                auth.User,
+		Signer:              auth.Signer,
+		AddonID:             auth.AddonID,
+		AddonPKCS7Digest:    auth.AddonPKCS7Digest,
+		AddonCOSEAlgorithms: auth.AddonCOSEAlgorithms,
+		AddonPKCS7Digests:   auth.AddonPKCS7Digests,
+		RateLimit:           auth.RateLimit,
+		MaxConcurrent:       auth.MaxConcurrent,
+		MaxUploadBytes:      auth.MaxUploadBytes,
+		MaxOutputBytes:      auth.MaxOutputBytes,
+		AllowedCIDRs:        auth.AllowedCIDRs,
+		AllowRequestOptions: auth.AllowRequestOptions,
+		UpstreamPath:        auth.UpstreamPath,
+		SignatureType:       auth.signatureType(),
+		Disabled:            auth.Disabled,
+		AllowURLInput:       auth.AllowURLInput,
+		AllowedInputHosts:   auth.AllowedInputHosts,
+		AllowCache:          auth.AllowCache,
+		AllowedContentTypes: auth.AllowedContentTypes,
+		AllowedSigners:      auth.AllowedSigners,
+		AllowRawResponse:    auth.AllowRawResponse,
+		AllowDetached:       auth.AllowDetached,
+		RequireTimestamp:    auth.RequireTimestamp,
+		VerifyAPK:           auth.VerifyAPK,
+		RequiredHeaders:     auth.RequiredHeaders,
+		AllowedKeyIDs:       auth.AllowedKeyIDs,
+		DisableResponseGzip: auth.DisableResponseGzip,
+		AllowedAddonIDs:     auth.AllowedAddonIDs,
+		AllowCOSEOverride:   auth.AllowCOSEOverride,
+		AllowValidityWindow: auth.AllowValidityWindow,
+		AllowOutputOptions:  auth.AllowOutputOptions,
+		Deduplicate:         auth.Deduplicate,
+		RequireNonce:        auth.RequireNonce,
+		MaxPriority:         auth.MaxPriority,
+	}
+	if auth.UpstreamTimeout > 0 {
+		redacted.UpstreamTimeout = auth.UpstreamTimeout.String()
+	}
+	if !auth.ValidFrom.IsZero() {
+		redacted.ValidFrom = auth.ValidFrom.Format(time.RFC3339)
+	}
+	if !auth.ValidUntil.IsZero() {
+		redacted.ValidUntil = auth.ValidUntil.Format(time.RFC3339)
+	}
+	return redacted
+}
+
+// isAdmin returns whether the request presents the configured admin
+// token. It is always false when no admin token is configured.
+func isAdmin(r *http.Request, adminToken string) bool {
+	if adminToken == "" {
+		return false
+	}
+	token, err := clientToken(r)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// configResponse is returned by /__config__. Total is the number of
+// authorizations matching the filters, of which Authorizations are the
+// page starting at Offset.
+type configResponse struct {
+	Authorizations []redactedAuthorization `json:"authorizations"`
+	Total          int                     `json:"total"`
+	Offset         int                     `json:"offset"`
+	Limit          int                     `json:"limit,omitempty"`
+}
+
+// configQuery are the filters and page of a /__config__ request, all
+// optional. A zero limit returns every authorization from offset.
+type configQuery struct {
+	user, signer  string
+	offset, limit int
+}
+
+func parseConfigQuery(r *http.Request) (q configQuery, err error) {
+	values := r.URL.Query()
+	q.user, q.signer = values.Get("user"), values.Get("signer")
+	for name, dst := range map[string]*int{"offset": &q.offset, "limit": &q.limit} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		*dst, err = strconv.Atoi(value)
+		if err != nil || *dst < 0 {
+			return q, fmt.Errorf("%s %q is not a non-negative integer", name, value)
+		}
+	}
+	return q, nil
+}
+
+// page returns the redacted authorizations of stored matching q
+func (q configQuery) page(stored []authorization) configResponse {
+	resp := configResponse{Authorizations: []redactedAuthorization{}, Offset: q.offset, Limit: q.limit}
+	for _, auth := range stored {
+		if (q.user != "" && auth.User != q.user) || (q.signer != "" && auth.Signer != q.signer) {
+			continue
+		}
+		if resp.Total >= q.offset && (q.limit == 0 || len(resp.Authorizations) < q.limit) {
+			resp.Authorizations = append(resp.Authorizations, redactAuthorization(auth))
+		}
+		resp.Total++
+	}
+	return resp
+}
+
+// configHandler returns the loaded authorizations with their secrets
+// redacted, optionally filtered by ?user= and ?signer= and paginated
+// with ?offset= and ?limit=. Requests without the admin token get the
+// same 404 as an unknown path so the endpoint isn't advertised.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	c := currentConf()
+	if r.Method != http.MethodGet || !isAdmin(r, c.AdminToken) {
+		notFoundHandler(w, r)
+		return
+	}
+	q, err := parseConfigQuery(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, errorResponse{
+			Error:     err.Error(),
+			Code:      "invalid_request",
+			RequestID: getRequestID(r),
+		})
+		return
+	}
+	body, err := json.Marshal(q.page(c.tokenStore().Authorizations()))
+	if err != nil {
+		log.Errorf("failed to marshal config: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// reloadResponse is returned by /__reload__ after a successful reload
+type reloadResponse struct {
+	ConfigSHA256 string `json:"config_sha256"`
+}
+
+// reloadHandler reloads the configuration file like a SIGHUP and
+// returns the SHA256 of the file now live. An invalid configuration is
+// returned as a 400 and the previous one stays live. Requests without
+// the admin token get a 404 like configHandler.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !isAdmin(r, currentConf().AdminToken) {
+		notFoundHandler(w, r)
+		return
+	}
+	log.Infof("reload requested over HTTP, reloading configuration from %s", cfgFile)
+	newConf, err := reloadConf()
+	if err != nil {
+		log.Errorf("failed to reload configuration, keeping the current one: %v", err)
+		writeErrorResponse(w, r, http.StatusBadRequest, errorResponse{
+			Error:     err.Error(),
+			Code:      "invalid_config",
+			RequestID: getRequestID(r),
+		})
+		return
+	}
+	log.Infof("configuration reloaded from %s", cfgFile)
+	body, err := json.Marshal(reloadResponse{ConfigSHA256: newConf.fileSHA256})
+	if err != nil {
+		log.Errorf("failed to marshal reload response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestConfigHandler(t *testing.T) {
+	const adminToken = "0a6bf3e5d0c44a1f8e9b7c2d6f5a4e3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f"
+	c := currentConf()
+	c.AdminToken = adminToken
+	useTestConf(t, c)
+
+	notFound := []struct {
+		name   string
+		method string
+		token  string
+	}{
+		{"no token", "GET", ""},
+		{"wrong token", "GET", c.Authorizations[0].ClientToken},
+		{"wrong method", "POST", adminToken},
+	}
+	for _, tt := range notFound {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://localhost:8080/__config__", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+			w := httptest.NewRecorder()
+			configHandler(w, req)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusNotFound)
+			}
+		})
+	}
+
+	t.Run("admin token", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost:8080/__config__", nil)
+		req.Header.Set("Authorization", adminToken)
+		w := httptest.NewRecorder()
+		configHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusOK)
+		}
+		body := w.Body.String()
+		for _, auth := range c.Authorizations {
+			if strings.Contains(body, auth.ClientToken) || strings.Contains(body, auth.Key) {
+				t.Fatalf("response contains a secret of user %s signer %s", auth.User, auth.Signer)
+			}
+		}
+		var resp struct {
+			Authorizations []redactedAuthorization `json:"authorizations"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Authorizations) != len(c.Authorizations) {
+			t.Fatalf("returned %d authorizations expected %d", len(resp.Authorizations), len(c.Authorizations))
+		}
+		got := resp.Authorizations[1]
+		if got.Signer != c.Authorizations[1].Signer || got.AddonID != c.Authorizations[1].AddonID ||
+			strings.Join(got.AddonCOSEAlgorithms, ",") != strings.Join(c.Authorizations[1].AddonCOSEAlgorithms, ",") {
+			t.Fatalf("unexpected redacted authorization %+v", got)
+		}
+		if got.ClientToken != redactedValue || got.Key != redactedValue {
+			t.Fatalf("secrets were not redacted in %+v", got)
+		}
+	})
+
+	t.Run("disabled without admin token", func(t *testing.T) {
+		c.AdminToken = ""
+		setConf(c)
+		req := httptest.NewRequest("GET", "http://localhost:8080/__config__", nil)
+		w := httptest.NewRecorder()
+		configHandler(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestConfigHandlerPagination(t *testing.T) {
+	const adminToken = "0a6bf3e5d0c44a1f8e9b7c2d6f5a4e3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f"
+	c := currentConf()
+	c.AdminToken = adminToken
+	c.tokens, c.fileTokens = nil, nil
+	c.Authorizations = nil
+	for i := 0; i < 5; i++ {
+		for _, user := range []string{"alice", "bob"} {
+			auth := currentConf().Authorizations[2]
+			auth.User = user
+			auth.Signer = fmt.Sprintf("signer-%d", i)
+			c.Authorizations = append(c.Authorizations, auth)
+		}
+	}
+	useTestConf(t, c)
+
+	get := func(query string) (*httptest.ResponseRecorder, configResponse) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "http://localhost:8080/__config__"+query, nil)
+		req.Header.Set("Authorization", adminToken)
+		w := httptest.NewRecorder()
+		configHandler(w, req)
+		var resp configResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(w.Body.String(), c.Authorizations[0].ClientToken) || strings.Contains(w.Body.String(), c.Authorizations[0].Key) {
+				t.Fatalf("response to %q contains a secret", query)
+			}
+		}
+		return w, resp
+	}
+
+	for _, tt := range []struct {
+		query           string
+		expectedTotal   int
+		expectedSigners []string
+	}{
+		{"", 10, nil},
+		{"?limit=3", 10, []string{"signer-0", "signer-0", "signer-1"}},
+		{"?offset=8&limit=3", 10, []string{"signer-4", "signer-4"}},
+		{"?offset=10", 10, []string{}},
+		{"?offset=20&limit=5", 10, []string{}},
+		{"?user=bob&offset=1&limit=2", 5, []string{"signer-1", "signer-2"}},
+		{"?signer=signer-3", 2, []string{"signer-3", "signer-3"}},
+		{"?user=bob&signer=signer-3", 1, []string{"signer-3"}},
+		{"?user=carol", 0, []string{}},
+	} {
+		w, resp := get(tt.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q returned %d %s expected a 200", tt.query, w.Code, w.Body.String())
+		}
+		if resp.Total != tt.expectedTotal {
+			t.Errorf("%q returned a total of %d expected %d", tt.query, resp.Total, tt.expectedTotal)
+		}
+		if tt.expectedSigners == nil {
+			if len(resp.Authorizations) != tt.expectedTotal {
+				t.Errorf("%q returned %d authorizations expected all of them", tt.query, len(resp.Authorizations))
+			}
+			continue
+		}
+		var signers []string
+		for _, auth := range resp.Authorizations {
+			signers = append(signers, auth.Signer)
+			if auth.ClientToken != redactedValue || auth.Key != redactedValue {
+				t.Fatalf("%q did not redact the secrets of %+v", tt.query, auth)
+			}
+		}
+		if strings.Join(signers, ",") != strings.Join(tt.expectedSigners, ",") {
+			t.Errorf("%q returned signers %v expected %v", tt.query, signers, tt.expectedSigners)
+		}
+	}
+
+	for _, query := range []string{"?limit=-1", "?offset=one", "?limit=1.5"} {
+		if w, _ := get(query); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_request") {
+			t.Errorf("%q returned %d %s expected a 400 invalid_request", query, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	const adminToken = "0a6bf3e5d0c44a1f8e9b7c2d6f5a4e3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f"
+	origCfgFile := cfgFile
+	t.Cleanup(func() { cfgFile = origCfgFile })
+	c := currentConf()
+	c.AdminToken = adminToken
+	useTestConf(t, c)
+
+	validConf := []byte(`autograph_base_url: http://localhost:8000/
+admin_token: ` + adminToken + `
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`)
+	cfgFile = t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(cfgFile, validConf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := func(method, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:8080/__reload__", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		reloadHandler(w, req)
+		return w
+	}
+
+	notFound := []struct {
+		name   string
+		method string
+		token  string
+	}{
+		{"no token", "POST", ""},
+		{"wrong token", "POST", c.Authorizations[0].ClientToken},
+		{"wrong method", "GET", adminToken},
+	}
+	for _, tt := range notFound {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := reload(tt.method, tt.token); w.Code != http.StatusNotFound {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusNotFound)
+			}
+			if currentConf().fileSHA256 != c.fileSHA256 {
+				t.Fatal("configuration was reloaded without the admin token")
+			}
+		})
+	}
+
+	expectedSHA256 := fmt.Sprintf("%x", sha256.Sum256(validConf))
+	t.Run("valid config", func(t *testing.T) {
+		w := reload("POST", adminToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		var resp reloadResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ConfigSHA256 != expectedSHA256 {
+			t.Fatalf("returned config hash %q expected %q", resp.ConfigSHA256, expectedSHA256)
+		}
+		if _, err := authorize("3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4"); err != nil {
+			t.Fatalf("reloaded token is not live: %v", err)
+		}
+	})
+
+	t.Run("concurrent reloads", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if w := reload("POST", adminToken); w.Code != http.StatusOK {
+					t.Errorf("returned unexpected status %v expected %v", w.Code, http.StatusOK)
+				}
+			}()
+		}
+		wg.Wait()
+		if got := currentConf().fileSHA256; got != expectedSHA256 {
+			t.Fatalf("live config hash %q expected %q", got, expectedSHA256)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		err := ioutil.WriteFile(cfgFile, []byte("autograph_base_url: http://localhost:8000/\nauthorizations:\n    - client_token: tooshort\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := reload("POST", adminToken)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusBadRequest)
+		}
+		if !strings.Contains(w.Body.String(), `"code":"invalid_config"`) {
+			t.Fatalf("unexpected error response %s", w.Body.String())
+		}
+		if got := currentConf().fileSHA256; got != expectedSHA256 {
+			t.Fatal("previous config was not kept live after a failed reload")
+		}
+	})
+}
+
+func Test_loadAndValidateConfAdminTokenCollision(t *testing.T) {
+	const token = "3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4"
+	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tokenField := range map[string]string{
+		"plaintext token": "client_token: " + token,
+		"hashed token":    "client_token_hash: " + string(hash),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := t.TempDir() + "/autograph-edge.yaml"
+			err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+admin_token: `+token+`
+authorizations:
+    - `+tokenField+`
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = loadAndValidateConf(path, "")
+			if err == nil || !strings.Contains(err.Error(), "admin token is also the client token") {
+				t.Fatalf("loadAndValidateConf() with the admin token as a %s returned error %v", name, err)
+			}
+		})
+	}
+}
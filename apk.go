@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errInvalidSignedAPK = errors.New("autograph returned a malformed signed APK")
+
+const (
+	// apkSigningBlockMagic ends the APK Signing Block of the v2 and
+	// later signature schemes, which is right before the central
+	// directory
+	apkSigningBlockMagic = "APK Sig Block 42"
+
+	// zipEOCDSignature starts the end of central directory record
+	zipEOCDSignature = "PK\x05\x06"
+	zipEOCDLength    = 22
+	zipMaxCommentLen = 1<<16 - 1
+)
+
+// verifyAPKSignature checks that a signed APK returned by autograph is a
+// valid ZIP whose files all match their checksums and that it carries a
+// v1 signature block or a v2 APK Signing Block, so that a corrupted APK
+// is never returned to the client
+func verifyAPKSignature(signedAPK []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(signedAPK), int64(len(signedAPK)))
+	if err != nil {
+		return errors.Wrap(errInvalidSignedAPK, err.Error())
+	}
+	hasV1 := false
+	for _, f := range zr.File {
+		if isAPKSignatureBlock(f.Name) {
+			hasV1 = true
+		}
+		// reading the files checks their CRC32
+		rc, err := f.Open()
+		if err != nil {
+			return errors.Wrapf(errInvalidSignedAPK, "%s: %v", f.Name, err)
+		}
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return errors.Wrapf(errInvalidSignedAPK, "%s: %v", f.Name, err)
+		}
+	}
+	if !hasV1 && !hasAPKSigningBlock(signedAPK) {
+		return errors.Wrap(errInvalidSignedAPK, "missing signature block")
+	}
+	return nil
+}
+
+// isAPKSignatureBlock returns whether name is the signature block file
+// of a v1 (JAR) signed APK
+func isAPKSignatureBlock(name string) bool {
+	dir, file := path.Split(name)
+	if dir != "META-INF/" {
+		return false
+	}
+	switch strings.ToUpper(path.Ext(file)) {
+	case ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return false
+}
+
+// hasAPKSigningBlock returns whether the magic of an APK Signing Block
+// precedes the central directory of apk
+func hasAPKSigningBlock(apk []byte) bool {
+	searchStart := len(apk) - zipEOCDLength - zipMaxCommentLen
+	if searchStart < 0 {
+		searchStart = 0
+	}
+	eocd := bytes.LastIndex(apk[searchStart:], []byte(zipEOCDSignature))
+	if eocd < 0 || searchStart+eocd+zipEOCDLength > len(apk) {
+		return false
+	}
+	eocd += searchStart
+	cdOffset := int64(binary.LittleEndian.Uint32(apk[eocd+16 : eocd+20]))
+	if cdOffset < int64(len(apkSigningBlockMagic)) || cdOffset > int64(eocd) {
+		return false
+	}
+	return string(apk[cdOffset-int64(len(apkSigningBlockMagic)):cdOffset]) == apkSigningBlockMagic
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+)
+
+// newV2SignedAPK returns an APK of names with the magic of an APK
+// Signing Block inserted before its central directory
+func newV2SignedAPK(t *testing.T, names ...string) []byte {
+	apk := newSignedXPI(t, names...)
+	eocd := bytes.LastIndex(apk, []byte(zipEOCDSignature))
+	cdOffset := binary.LittleEndian.Uint32(apk[eocd+16:])
+	var v2 bytes.Buffer
+	v2.Write(apk[:cdOffset])
+	v2.WriteString(apkSigningBlockMagic)
+	v2.Write(apk[cdOffset:])
+	signed := v2.Bytes()
+	binary.LittleEndian.PutUint32(signed[eocd+len(apkSigningBlockMagic)+16:], cdOffset+uint32(len(apkSigningBlockMagic)))
+	return signed
+}
+
+func Test_verifyAPKSignature(t *testing.T) {
+	fixture := readFixture(t, "integration_test/test.apk")
+	tests := []struct {
+		name    string
+		apk     []byte
+		wantErr bool
+	}{
+		{"v1 signed fixture", fixture, false},
+		{"truncated fixture", fixture[:len(fixture)/2], true},
+		{"fixture missing its end of central directory", fixture[:len(fixture)-10], true},
+		{"v2 signed apk", newV2SignedAPK(t, "AndroidManifest.xml", "classes.dex"), false},
+		{"unsigned apk", newSignedXPI(t, "AndroidManifest.xml", "classes.dex", "META-INF/MANIFEST.MF"), true},
+		{"not a zip", []byte("signed"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyAPKSignature(tt.apk)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyAPKSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errInvalidSignedAPK) {
+				t.Fatalf("verifyAPKSignature() returned %v expected %v", err, errInvalidSignedAPK)
+			}
+		})
+	}
+}
+
+func TestSigHandlerVerifyAPK(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].VerifyAPK = true
+	useTestConf(t, testConf)
+	fixture := readFixture(t, "integration_test/test.apk")
+
+	t.Run("returns valid apks", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(fixture), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusCreated || !bytes.Equal(w.Body.Bytes(), fixture) {
+			t.Fatalf("returned %d and %d bytes expected a 201 with the signed apk", w.Code, w.Body.Len())
+		}
+	})
+
+	t.Run("rejects truncated apks", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(fixture[:len(fixture)/2]), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusBadGateway)
+		}
+		var body errorResponse
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != "invalid_signed_apk" {
+			t.Fatalf("unexpected code %q expected invalid_signed_apk", body.Code)
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAuditMaxBytes   = 100 << 20
+	defaultAuditMaxBackups = 5
+	defaultAuditTimeout    = 5 * time.Second
+
+	// auditQueueLength bounds the records waiting to be written, over
+	// which they are dropped rather than block the signing requests
+	auditQueueLength = 1024
+)
+
+// auditConfig configures the audit trail of the signing requests, kept
+// apart from the operational logs. It is disabled when neither a file
+// nor a URL is set.
+type auditConfig struct {
+	// File appends each record as a line of JSON to this path
+	File string `yaml:"file"`
+
+	// MaxBytes rotates the file when a record would grow it over this
+	// size. Defaults to 100MiB.
+	MaxBytes int64 `yaml:"max_bytes"`
+
+	// MaxBackups is the number of rotated files kept, as File.1 for
+	// the most recent to File.<MaxBackups>. Defaults to 5.
+	MaxBackups int `yaml:"max_backups"`
+
+	// URL posts each record as JSON to this http or https endpoint
+	URL string `yaml:"url"`
+
+	// Timeout bounds posting a record to URL. Defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (ac auditConfig) enabled() bool {
+	return ac.File != "" || ac.URL != ""
+}
+
+func (ac auditConfig) validate() error {
+	if ac.File != "" && ac.URL != "" {
+		return fmt.Errorf("only one of audit file and audit url can be set")
+	}
+	if ac.MaxBytes < 0 || ac.MaxBackups < 0 || ac.Timeout < 0 {
+		return fmt.Errorf("audit settings %+v cannot be negative", ac)
+	}
+	if ac.URL != "" {
+		u, err := url.Parse(ac.URL)
+		if err != nil {
+			return fmt.Errorf("invalid audit url %q: %v", ac.URL, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("audit url %q is not an http or https URL", ac.URL)
+		}
+	}
+	return nil
+}
+
+// auditRecord is written for each authorized signing request once it
+// has completed
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id"`
+	User         string    `json:"user"`
+	Signer       string    `json:"signer"`
+	InputSHA256  string    `json:"input_sha256,omitempty"`
+	OutputSHA256 string    `json:"output_sha256,omitempty"`
+	Status       int       `json:"status"`
+
+	// Metadata are the values of the audit metadata headers sent
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// auditSink stores audit records
+type auditSink interface {
+	write(record auditRecord) error
+}
+
+// newAuditSink returns the sink of the configured file or URL
+func newAuditSink(ac auditConfig) (auditSink, error) {
+	if ac.URL != "" {
+		return &httpAuditSink{url: ac.URL, client: &http.Client{Timeout: ac.Timeout}}, nil
+	}
+	return newFileAuditSink(ac.File, ac.MaxBytes, ac.MaxBackups)
+}
+
+// auditLogger writes the audit records to its sink in the background,
+// so that a slow or failing sink does not delay the signing responses
+type auditLogger struct {
+	sink    auditSink
+	records chan auditRecord
+	done    chan struct{}
+
+	// mu guards closed, so that requests outliving the shutdown grace
+	// period don't send to the closed queue
+	mu     sync.RWMutex
+	closed bool
+}
+
+// auditor writes the audit records when an audit sink is configured.
+// It is set at startup and not changed by reloads.
+var auditor *auditLogger
+
+func newAuditLogger(sink auditSink) *auditLogger {
+	a := &auditLogger{
+		sink:    sink,
+		records: make(chan auditRecord, auditQueueLength),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(a.done)
+		for record := range a.records {
+			if err := a.sink.write(record); err != nil {
+				auditErrorsTotal.Inc()
+				log.Errorf("AUDIT FAILURE: failed to write the audit record of request %s by %s: %v", record.RequestID, record.User, err)
+			}
+		}
+	}()
+	return a
+}
+
+// record queues record to be written. It does nothing when a is nil,
+// and drops the record with an error when the queue is full or a is
+// closed.
+func (a *auditLogger) record(record auditRecord) {
+	if a == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		auditErrorsTotal.Inc()
+		log.Errorf("AUDIT FAILURE: audit log is closed, dropped the audit record of request %s by %s", record.RequestID, record.User)
+		return
+	}
+	select {
+	case a.records <- record:
+	default:
+		auditErrorsTotal.Inc()
+		log.Errorf("AUDIT FAILURE: audit queue is full, dropped the audit record of request %s by %s", record.RequestID, record.User)
+	}
+}
+
+// close writes the queued records and stops a
+func (a *auditLogger) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.records)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+// fileAuditSink appends the records to a file as lines of JSON and
+// rotates it by size. It is not safe for concurrent use, which the
+// single writer of auditLogger doesn't need.
+type fileAuditSink struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func newFileAuditSink(path string, maxBytes int64, maxBackups int) (*fileAuditSink, error) {
+	s := &fileAuditSink{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat the audit file: %v", err)
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileAuditSink) write(record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate renames the audit file to path.1, shifting the older backups
+// and dropping the oldest, then opens a new file
+func (s *fileAuditSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return fmt.Errorf("failed to close the audit file: %v", err)
+	}
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil {
+			return fmt.Errorf("failed to remove the full audit file: %v", err)
+		}
+		return s.open()
+	}
+	for i := s.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate the audit file: %v", err)
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate the audit file: %v", err)
+	}
+	return s.open()
+}
+
+// httpAuditSink posts each record as JSON to an endpoint
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpAuditSink) write(record auditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeAuditSink passes the written records to its channel
+type fakeAuditSink struct {
+	records chan auditRecord
+	err     error
+}
+
+func (s *fakeAuditSink) write(record auditRecord) error {
+	s.records <- record
+	return s.err
+}
+
+func useTestAuditSink(t *testing.T, sink auditSink) {
+	origAuditor := auditor
+	auditor = newAuditLogger(sink)
+	t.Cleanup(func() {
+		auditor.close()
+		auditor = origAuditor
+	})
+}
+
+func TestSigHandlerAudit(t *testing.T) {
+	sink := &fakeAuditSink{records: make(chan auditRecord, 10)}
+	useTestAuditSink(t, sink)
+	auth := currentConf().Authorizations[2]
+
+	// unauthorized requests are not audited
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, strings.Repeat("a", 64), []byte("unsigned")))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("returned unexpected status %v expected 401", w.Code)
+	}
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	w = httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, auth.ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case record := <-sink.records:
+		expected := auditRecord{
+			Time:         record.Time,
+			RequestID:    record.RequestID,
+			User:         "alice",
+			Signer:       "testapp-android",
+			InputSHA256:  fmt.Sprintf("%x", sha256.Sum256([]byte("unsigned"))),
+			OutputSHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("signed"))),
+			Status:       http.StatusCreated,
+		}
+		if !reflect.DeepEqual(record, expected) {
+			t.Fatalf("audited %+v expected %+v", record, expected)
+		}
+		if time.Since(record.Time) > time.Minute {
+			t.Fatalf("audited unexpected time %s", record.Time)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("signing request was not audited")
+	}
+}
+
+func Test_auditLoggerErrors(t *testing.T) {
+	errorsBefore := testutil.ToFloat64(auditErrorsTotal)
+	sink := &fakeAuditSink{records: make(chan auditRecord, 1), err: fmt.Errorf("disk full")}
+	a := newAuditLogger(sink)
+	a.record(auditRecord{User: "alice"})
+	a.close()
+	// records after close are dropped rather than panic
+	a.record(auditRecord{User: "alice"})
+	if got := testutil.ToFloat64(auditErrorsTotal) - errorsBefore; got != 2 {
+		t.Fatalf("counted %v audit errors expected 2", got)
+	}
+}
+
+func Test_fileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line, _ := json.Marshal(auditRecord{User: "alice"})
+	// each file holds two records
+	s, err := newFileAuditSink(path, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := s.write(auditRecord{User: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, records := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(string(b), "\n"); got != records {
+			t.Fatalf("%s has %d records expected %d", name, got, records)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("kept more than 2 backups: %v", err)
+	}
+}
+
+func Test_httpAuditSink(t *testing.T) {
+	received := make(chan auditRecord, 1)
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var record auditRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			t.Error(err)
+		}
+		received <- record
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	s, err := newAuditSink(auditConfig{URL: server.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.write(auditRecord{User: "alice", Status: http.StatusCreated}); err != nil {
+		t.Fatal(err)
+	}
+	if record := <-received; record.User != "alice" || record.Status != http.StatusCreated {
+		t.Fatalf("posted %+v expected the record of alice", record)
+	}
+
+	status = http.StatusInternalServerError
+	if err := s.write(auditRecord{User: "alice"}); err == nil {
+		t.Fatal("expected an error when the endpoint fails")
+	}
+	<-received
+}
+
+func Test_auditConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		config  auditConfig
+		wantErr bool
+	}{
+		{auditConfig{File: "/var/log/audit.log"}, false},
+		{auditConfig{URL: "https://audit.example.com/records"}, false},
+		{auditConfig{File: "/var/log/audit.log", URL: "https://audit.example.com/records"}, true},
+		{auditConfig{URL: "audit.example.com"}, true},
+		{auditConfig{File: "/var/log/audit.log", MaxBytes: -1}, true},
+	} {
+		if err := tt.config.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() of %+v error = %v, wantErr %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSigHandlerAuditMetadata(t *testing.T) {
+	testConf := currentConf()
+	testConf.AuditMetadataHeaders = []string{"X-Meta-Ticket", "x-meta-release"}
+	testConf.MaxAuditMetadataBytes = 16
+	useTestConf(t, testConf)
+	sink := &fakeAuditSink{records: make(chan auditRecord, 10)}
+	useTestAuditSink(t, sink)
+	auth := testConf.Authorizations[2]
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		for name := range req.Header {
+			if isMetadataHeader(name) {
+				t.Errorf("forwarded metadata header %s to autograph", name)
+			}
+		}
+		return newSignedFileResponse([]byte("signed")), nil
+	})
+	req := newMultipartSignRequest(t, auth.ClientToken, []byte("unsigned"))
+	req.Header.Set("X-Meta-Ticket", "BUG-1234")
+	req.Header.Set("X-Meta-Release", "v1.2.3")
+	req.Header.Set("X-Meta-Unlisted", "ignored")
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v: %s", w.Code, w.Body.String())
+	}
+	select {
+	case record := <-sink.records:
+		expected := map[string]string{"X-Meta-Ticket": "BUG-1234", "X-Meta-Release": "v1.2.3"}
+		if !reflect.DeepEqual(record.Metadata, expected) {
+			t.Fatalf("audited metadata %v expected %v", record.Metadata, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("signing request was not audited")
+	}
+
+	req = newMultipartSignRequest(t, auth.ClientToken, []byte("unsigned"))
+	req.Header.Set("X-Meta-Ticket", strings.Repeat("a", 17))
+	w = httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_metadata") {
+		t.Fatalf("returned %d %s for a long metadata value expected a 400 invalid_metadata", w.Code, w.Body.String())
+	}
+}
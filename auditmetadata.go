@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errInvalidMetadata = errors.New("metadata header is too long")
+
+// metadataHeaderPrefix starts the names of the headers clients tag
+// their signing requests with for the audit trail
+const metadataHeaderPrefix = "X-Meta-"
+
+// defaultMaxAuditMetadataBytes bounds the value of each metadata
+// header, enough for a ticket ID or release name
+const defaultMaxAuditMetadataBytes = 256
+
+// isMetadataHeader returns whether name is an X-Meta-* header
+func isMetadataHeader(name string) bool {
+	return strings.HasPrefix(http.CanonicalHeaderKey(name), metadataHeaderPrefix)
+}
+
+// auditMetadata returns the values of the metadata headers of names
+// sent with r, keyed by their canonical name, or an error naming the
+// first one over maxBytes. They are only audited and logged, and never
+// forwarded to autograph or used to sign.
+func auditMetadata(r *http.Request, names []string, maxBytes int) (map[string]string, error) {
+	var metadata map[string]string
+	for _, name := range names {
+		value := strings.TrimSpace(r.Header.Get(name))
+		if value == "" {
+			continue
+		}
+		if len(value) > maxBytes {
+			return nil, errors.Wrapf(errInvalidMetadata, "header %s is over %d bytes", http.CanonicalHeaderKey(name), maxBytes)
+		}
+		if metadata == nil {
+			metadata = make(map[string]string, len(names))
+		}
+		metadata[http.CanonicalHeaderKey(name)] = value
+	}
+	return metadata, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// validateBackendWeights checks that weights has a positive weight for
+// each of the base URLs, or is empty
+func validateBackendWeights(baseURLs []string, weights []int) error {
+	if len(weights) == 0 {
+		return nil
+	}
+	if len(weights) != len(baseURLs) {
+		return fmt.Errorf("got %d autograph base url weights for %d base urls", len(weights), len(baseURLs))
+	}
+	for i, weight := range weights {
+		if weight < 1 {
+			return fmt.Errorf("weight %d of autograph base url %s must be positive", weight, baseURLs[i])
+		}
+	}
+	return nil
+}
+
+// weightedBackends spreads the signing requests between the upstream
+// backends in proportion to their weights, with the smooth weighted
+// round-robin of nginx so that a heavier backend doesn't get its share
+// in bursts
+type weightedBackends struct {
+	sync.Mutex
+
+	// key identifies the backends and weights of current, which is
+	// reset when a reload changes them
+	key     string
+	current []int
+}
+
+var backendSelector = &weightedBackends{}
+
+// order returns the base URLs starting with the next backend of the
+// round-robin, followed by the others in order to fail over to. Base
+// URLs without weights are returned as is.
+func (wb *weightedBackends) order(baseURLs []string, weights []int) []string {
+	if len(weights) != len(baseURLs) || len(baseURLs) < 2 {
+		return baseURLs
+	}
+	key := fmt.Sprintf("%s %v", strings.Join(baseURLs, " "), weights)
+	wb.Lock()
+	if wb.key != key {
+		wb.key = key
+		wb.current = make([]int, len(weights))
+	}
+	total, next := 0, 0
+	for i, weight := range weights {
+		wb.current[i] += weight
+		total += weight
+		if wb.current[i] > wb.current[next] {
+			next = i
+		}
+	}
+	wb.current[next] -= total
+	wb.Unlock()
+
+	ordered := make([]string, 0, len(baseURLs))
+	ordered = append(ordered, baseURLs[next:]...)
+	return append(ordered, baseURLs[:next]...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func Test_weightedBackendsDistribution(t *testing.T) {
+	wb := &weightedBackends{}
+	baseURLs := []string{"http://a/", "http://b/", "http://c/"}
+	weights := []int{5, 3, 2}
+
+	var mu sync.Mutex
+	picks := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				ordered := wb.order(baseURLs, weights)
+				if len(ordered) != len(baseURLs) {
+					t.Errorf("order() returned %v expected all of %v", ordered, baseURLs)
+					return
+				}
+				mu.Lock()
+				picks[ordered[0]]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// smooth weighted round-robin is exact over each round of 10 picks
+	for i, baseURL := range baseURLs {
+		if expected := weights[i] * 1000; picks[baseURL] != expected {
+			t.Errorf("picked %s %d times expected %d", baseURL, picks[baseURL], expected)
+		}
+	}
+}
+
+func Test_weightedBackendsOrder(t *testing.T) {
+	wb := &weightedBackends{}
+	baseURLs := []string{"http://a/", "http://b/", "http://c/"}
+	if ordered := wb.order(baseURLs, nil); !reflect.DeepEqual(ordered, baseURLs) {
+		t.Fatalf("order() without weights returned %v expected %v", ordered, baseURLs)
+	}
+	wb.order(baseURLs, []int{1, 1, 1})
+	// the failover backends follow the picked one in order
+	if ordered := wb.order(baseURLs, []int{1, 1, 1}); !reflect.DeepEqual(ordered, []string{"http://b/", "http://c/", "http://a/"}) {
+		t.Fatalf("order() returned %v expected b, c then a", ordered)
+	}
+}
+
+func Test_validateBackendWeights(t *testing.T) {
+	baseURLs := []string{"http://a/", "http://b/"}
+	for _, tt := range []struct {
+		weights []int
+		wantErr bool
+	}{
+		{nil, false},
+		{[]int{3, 1}, false},
+		{[]int{3}, true},
+		{[]int{3, 0}, true},
+	} {
+		if err := validateBackendWeights(baseURLs, tt.weights); (err != nil) != tt.wantErr {
+			t.Errorf("validateBackendWeights(%v) error = %v, wantErr %v", tt.weights, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCallAutographWeightedFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	var mu sync.Mutex
+	upCalls := 0
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upCalls++
+		mu.Unlock()
+		resp := newSignedFileResponse([]byte("signed"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer up.Close()
+
+	testConf := currentConf()
+	testConf.BaseURLs = upstreamURLs{down.URL + "/", up.URL + "/"}
+	testConf.BaseURLWeights = []int{1, 1}
+	testConf.UpstreamMaxAttempts = 1
+	useTestConf(t, testConf)
+
+	// the requests picking the down backend fail over to the other one
+	for i := 0; i < 4; i++ {
+		signed, err := callAutograph(context.Background(), testConf.Authorizations[0], signingParams{}, []byte("unsigned"), "")
+		if err != nil {
+			t.Fatalf("callAutograph() %d returned error: %v", i, err)
+		}
+		if !bytes.Equal(signed, []byte("signed")) {
+			t.Fatalf("callAutograph() %d returned %q expected %q", i, signed, "signed")
+		}
+	}
+	if upCalls != 4 {
+		t.Fatalf("up backend received %d calls expected 4", upCalls)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxFormMemory is the maximum size of a multipart form kept in memory,
+// the rest is stored in temporary files. It is the default of FormFile.
+const maxFormMemory = 32 << 20
+
+// defaultMaxBatchParts is the default maximum number of files of
+// a batch signing request
+const defaultMaxBatchParts = 10
+
+var (
+	errTooManyBatchParts  = errors.New("too many files in batch signing request")
+	errDuplicateBatchPart = errors.New("files of a batch signing request must have distinct part names")
+	errBatchDryRun        = errors.New("dry runs are not supported for batch signing requests")
+	errBatchRaw           = errors.New("raw responses are not supported for batch signing requests")
+	errBatchDetached      = errors.New("detached signatures are not supported for batch signing requests")
+	errInvalidTarPartName = errors.New("part name cannot be a tar archive entry")
+)
+
+// tarContentType is the Accept value of the batch signing requests
+// returning a tar archive of the signed files instead of a manifest
+const tarContentType = "application/x-tar"
+
+// tarManifestName is the entry of the batch manifest in the tar
+// archive, which has the results without the signed files
+const tarManifestName = "manifest.json"
+
+// isBatchRequest parses the multipart form of r within the multipart
+// limits of c and returns whether it uploads more than one file, which
+// are then signed as a batch. It returns an error for batches of more
+// than the max batch parts files or with two files in the same part.
+func isBatchRequest(r *http.Request, c configuration) (bool, error) {
+	err := parseLimitedMultipartForm(r, c.multipartLimits())
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return false, formError(err)
+	}
+	if r.MultipartForm == nil {
+		return false, nil
+	}
+	var parts int
+	for _, files := range r.MultipartForm.File {
+		parts += len(files)
+	}
+	if parts < 2 {
+		return false, nil
+	}
+	if parts > c.MaxBatchParts {
+		return true, errors.Wrapf(errTooManyBatchParts, "got %d files, the maximum is %d", parts, c.MaxBatchParts)
+	}
+	for name, files := range r.MultipartForm.File {
+		if len(files) > 1 {
+			return true, errors.Wrapf(errDuplicateBatchPart, "part %q has %d files", name, len(files))
+		}
+	}
+	return true, nil
+}
+
+// batchManifest is returned to batch signing requests. It maps the part
+// names of the uploaded files to their signed file or error.
+type batchManifest struct {
+	RequestID string                     `json:"request_id"`
+	Files     map[string]batchPartResult `json:"files"`
+}
+
+// batchPartResult is the result of signing one file of a batch. Status
+// is the status a single signing request of the file would get.
+type batchPartResult struct {
+	Status   int    `json:"status"`
+	Filename string `json:"filename,omitempty"`
+
+	// SignedFile is set for file signing tokens, and Signature is
+	// the JSON signature of data signing tokens
+	SignedFile []byte          `json:"signed_file,omitempty"`
+	Signature  json.RawMessage `json:"signature,omitempty"`
+
+	Error          string `json:"error,omitempty"`
+	Code           string `json:"code,omitempty"`
+	UpstreamStatus int    `json:"upstream_status,omitempty"`
+}
+
+// signBatch signs each file of a batch request in turn and returns the
+// manifest of their results. It is a 201 when they were all signed, and
+// a 207 when some failed.
+func signBatch(w http.ResponseWriter, r *http.Request, auth authorization, params signingParams, xff string) {
+	logger := getLogger(r)
+	names := make([]string, 0, len(r.MultipartForm.File))
+	for name := range r.MultipartForm.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c := currentConf()
+	asTar := acceptsValue(r.Header.Get("Accept"), tarContentType)
+	status := http.StatusCreated
+	manifest := batchManifest{RequestID: getRequestID(r), Files: make(map[string]batchPartResult, len(names))}
+	queueKey := upstreamQueueKeyOf(auth, requestPriority(r, auth))
+	for _, name := range names {
+		var result batchPartResult
+		if asTar && !isTarEntryName(name) {
+			result = newBatchPartError(errInvalidTarPartName)
+		} else {
+			result = signBatchPart(r.Context(), c, auth, params, queueKey, r.MultipartForm.File[name][0], xff)
+		}
+		if result.Status != http.StatusCreated {
+			status = http.StatusMultiStatus
+		}
+		logger.WithFields(log.Fields{
+			"user":   auth.User,
+			"part":   name,
+			"status": result.Status,
+			"error":  result.Code,
+		}).Info("signed batch file")
+		manifest.Files[name] = result
+	}
+	if asTar {
+		writeBatchTar(w, r, status, names, manifest)
+		return
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		logger.Error(err)
+		writeSigningError(w, r, errInternal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// signBatchPart signs the uploaded file fh like sigHandler signs a single
+// file, going through the response cache, circuit breaker and upstream
+// limit of the signer, queued with queueKey when the limit is reached
+func signBatchPart(ctx context.Context, c configuration, auth authorization, params signingParams, queueKey upstreamQueueKey, fh *multipart.FileHeader, xff string) batchPartResult {
+	input, err := readBatchPart(fh)
+	if err != nil {
+		return newBatchPartError(err)
+	}
+	sigType := auth.signatureType()
+	if detected := detectSignatureType(input); sigType != signatureTypeData && detected != "" && detected != sigType {
+		result := newBatchPartError(errSignatureTypeMismatch)
+		result.Error = signatureTypeMismatchMessage(detected, sigType)
+		return result
+	}
+	if err = auth.allowsInput(fh.Header.Get("Content-Type"), input); err != nil {
+		return newBatchPartError(err)
+	}
+
+	var cacheKey string
+	if auth.AllowCache {
+		cacheKey, err = responseCacheKey(auth, params, input)
+		if err != nil {
+			return newBatchPartError(errInternal)
+		}
+		if signed, ok := signedResponses.get(cacheKey); ok {
+			responseCacheRequestsTotal.WithLabelValues("hit").Inc()
+			return newBatchPartSigned(auth, fh, signed)
+		}
+		responseCacheRequestsTotal.WithLabelValues("miss").Inc()
+	}
+
+	if c.CircuitBreakerThreshold > 0 && !breakers.allow(auth.Signer, c.CircuitBreakerCooldown) {
+		return newBatchPartError(errCircuitOpen)
+	}
+	release, err := upstreamSlots.acquire(ctx, c.MaxConcurrentUpstream, c.UpstreamQueue, queueKey)
+	if err != nil {
+		if c.CircuitBreakerThreshold > 0 {
+			breakers.record(auth.Signer, errUpstreamBusy, c.CircuitBreakerThreshold)
+		}
+		return newBatchPartError(errUpstreamBusy)
+	}
+	defer release()
+
+	upstreamCtx, upstreamSpan := tracer().Start(ctx, "autograph", trace.WithSpanKind(trace.SpanKindClient))
+	upstreamSpan.SetAttributes(attribute.String("signer", auth.Signer))
+	var signed bytes.Buffer
+	err = signingWorkers.run(upstreamCtx, func(ctx context.Context) error {
+		_, err := streamAutograph(ctx, auth, params, input, xff, &signed, nil)
+		return err
+	})
+	endSpan(upstreamSpan, err)
+	if c.CircuitBreakerThreshold > 0 {
+		breakers.record(auth.Signer, err, c.CircuitBreakerThreshold)
+	}
+	if err != nil {
+		return newBatchPartError(err)
+	}
+	lastSuccessfulSign.record(auth.Signer, time.Now())
+	if cacheKey != "" {
+		signedResponses.add(cacheKey, signed.Bytes(), c.ResponseCache.TTL, c.ResponseCache.MaxBytes)
+	}
+	return newBatchPartSigned(auth, fh, signed.Bytes())
+}
+
+func readBatchPart(fh *multipart.FileHeader) ([]byte, error) {
+	fd, err := fh.Open()
+	if err != nil {
+		return nil, errors.Wrap(errInvalidInput, err.Error())
+	}
+	defer fd.Close()
+	input, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, errors.Wrap(errInvalidInput, err.Error())
+	}
+	return input, nil
+}
+
+func newBatchPartSigned(auth authorization, fh *multipart.FileHeader, signed []byte) batchPartResult {
+	if auth.signatureType() == signatureTypeData {
+		return batchPartResult{Status: http.StatusCreated, Signature: signed}
+	}
+	return batchPartResult{
+		Status:     http.StatusCreated,
+		Filename:   signedFilename(auth, fh.Filename),
+		SignedFile: signed,
+	}
+}
+
+// newBatchPartError returns the result of a file of a batch that failed
+// with err, with the status and code sigHandler would return for it
+func newBatchPartError(err error) batchPartResult {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		status, resp := upstreamStatusErrorResponse(statusErr, "")
+		return batchPartResult{Status: status, Error: resp.Error, Code: resp.Code, UpstreamStatus: resp.UpstreamStatus}
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		err = errUpstreamTimeout
+	case errors.Is(err, errInvalidInput), errors.Is(err, errSignatureTypeMismatch), errors.Is(err, errContentTypeNotAllowed),
+		errors.Is(err, errIncompleteXPISignature), errors.Is(err, errInvalidSignedAPK), errors.Is(err, errCircuitOpen),
+		errors.Is(err, errUpstreamBusy), errors.Is(err, errInternal), errors.Is(err, errInvalidTarPartName):
+	default:
+		err = errUpstreamFailed
+	}
+	ec := lookupErrorCode(err)
+	return batchPartResult{Status: ec.status, Error: ec.err.Error(), Code: ec.code}
+}
+
+// isTarEntryName returns whether the part name of a batch file can name
+// its entry in the tar archive, which must not escape the directory it
+// is extracted to nor replace the manifest
+func isTarEntryName(name string) bool {
+	return name != "" && name != tarManifestName && path.Clean(name) == name &&
+		!path.IsAbs(name) && name != ".." && !strings.HasPrefix(name, "../") && !strings.Contains(name, "\\")
+}
+
+// writeBatchTar streams a tar archive of the signed files of a batch,
+// each under its part name, and of its manifest without the signed
+// files as manifest.json
+func writeBatchTar(w http.ResponseWriter, r *http.Request, status int, names []string, manifest batchManifest) {
+	logger := getLogger(r)
+	results := batchManifest{RequestID: manifest.RequestID, Files: make(map[string]batchPartResult, len(manifest.Files))}
+	for name, result := range manifest.Files {
+		result.SignedFile, result.Signature = nil, nil
+		results.Files[name] = result
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		logger.Error(err)
+		writeSigningError(w, r, errInternal)
+		return
+	}
+	w.Header().Set("Content-Type", tarContentType)
+	w.WriteHeader(status)
+	tw := tar.NewWriter(w)
+	modTime := time.Now().UTC()
+	for _, name := range names {
+		result := manifest.Files[name]
+		if result.Status != http.StatusCreated {
+			continue
+		}
+		signed := result.SignedFile
+		if result.Signature != nil {
+			signed = result.Signature
+		}
+		if err = writeTarEntry(tw, name, signed, modTime); err != nil {
+			logger.Errorf("failed to write the tar entry of part %q: %v", name, err)
+			return
+		}
+	}
+	if err = writeTarEntry(tw, tarManifestName, body, modTime); err != nil {
+		logger.Errorf("failed to write the tar manifest: %v", err)
+		return
+	}
+	if err = tw.Close(); err != nil {
+		logger.Errorf("failed to close the tar archive: %v", err)
+	}
+}
+
+func writeTarEntry(tw *tar.Writer, name string, content []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(content)),
+		Mode:     0644,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
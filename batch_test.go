@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+// newBatchSignRequest returns a signing request uploading each of files,
+// keyed by part name, as a file of the same name
+func newBatchSignRequest(t *testing.T, token string, files map[string][]byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		fw, err := mw.CreateFormFile(name, name+".bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(content)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", token)
+	return req
+}
+
+func decodeBatchManifest(t *testing.T, w *httptest.ResponseRecorder) batchManifest {
+	var manifest batchManifest
+	if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+		t.Fatalf("failed to decode batch manifest %s: %v", w.Body.String(), err)
+	}
+	return manifest
+}
+
+func TestSigHandlerBatch(t *testing.T) {
+	token := currentConf().Authorizations[0].ClientToken
+
+	t.Run("all signed", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		gomock.InOrder(
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed a")), nil),
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed b")), nil),
+		)
+		w := httptest.NewRecorder()
+		sigHandler(w, newBatchSignRequest(t, token, map[string][]byte{"a": []byte("a"), "b": []byte("b")}))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, http.StatusCreated, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("returned unexpected content type %q", ct)
+		}
+		manifest := decodeBatchManifest(t, w)
+		for name, expected := range map[string]string{"a": "signed a", "b": "signed b"} {
+			got := manifest.Files[name]
+			if got.Status != http.StatusCreated || string(got.SignedFile) != expected || got.Filename != name+".bin" {
+				t.Fatalf("unexpected result for part %s: %+v", name, got)
+			}
+		}
+	})
+
+	t.Run("mixed success and failure", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		gomock.InOrder(
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed a")), nil),
+			clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadRequest, "invalid xpi"), nil),
+		)
+		w := httptest.NewRecorder()
+		sigHandler(w, newBatchSignRequest(t, token, map[string][]byte{
+			"a": []byte("a"),
+			"b": []byte("b"),
+			// rejected without calling autograph
+			"c": readFixture(t, "integration_test/test.apk"),
+		}))
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, http.StatusMultiStatus, w.Body.String())
+		}
+		manifest := decodeBatchManifest(t, w)
+		if len(manifest.Files) != 3 {
+			t.Fatalf("returned %d results expected 3", len(manifest.Files))
+		}
+		if a := manifest.Files["a"]; a.Status != http.StatusCreated || string(a.SignedFile) != "signed a" {
+			t.Fatalf("unexpected result for part a: %+v", a)
+		}
+		b := manifest.Files["b"]
+		if b.Status != http.StatusUnprocessableEntity || b.Code != "upstream_rejected" || b.UpstreamStatus != http.StatusBadRequest ||
+			!strings.Contains(b.Error, "invalid xpi") || b.SignedFile != nil {
+			t.Fatalf("unexpected result for part b: %+v", b)
+		}
+		if c := manifest.Files["c"]; c.Status != http.StatusBadRequest || c.Code != "signature_type_mismatch" {
+			t.Fatalf("unexpected result for part c: %+v", c)
+		}
+	})
+
+	t.Run("data signatures", func(t *testing.T) {
+		testConf := currentConf()
+		testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+		testConf.Authorizations[2].SignatureType = signatureTypeData
+		useTestConf(t, testConf)
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+			return newAutographResponse(http.StatusCreated, `[{"ref":"1","signer_id":"normandy","signature":"c2ln"}]`), nil
+		}).Times(2)
+		w := httptest.NewRecorder()
+		sigHandler(w, newBatchSignRequest(t, testConf.Authorizations[2].ClientToken, map[string][]byte{"a": []byte("a"), "b": []byte("b")}))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, http.StatusCreated, w.Body.String())
+		}
+		for name, got := range decodeBatchManifest(t, w).Files {
+			if !strings.Contains(string(got.Signature), `"signature":"c2ln"`) || got.SignedFile != nil {
+				t.Fatalf("unexpected result for part %s: %+v", name, got)
+			}
+		}
+	})
+
+	t.Run("tar archive", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		gomock.InOrder(
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed a")), nil),
+			clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadRequest, "invalid xpi"), nil),
+		)
+		req := newBatchSignRequest(t, token, map[string][]byte{
+			"a": []byte("a"),
+			"b": []byte("b"),
+			// rejected without calling autograph
+			"../c": []byte("c"),
+		})
+		req.Header.Set("Accept", "application/x-tar")
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		if w.Code != http.StatusMultiStatus || w.Header().Get("Content-Type") != "application/x-tar" {
+			t.Fatalf("returned unexpected status %v and content type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+
+		entries := map[string][]byte{}
+		tr := tar.NewReader(w.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries[hdr.Name] = content
+		}
+		if len(entries) != 2 || string(entries["a"]) != "signed a" {
+			t.Fatalf("archive has entries %v expected a and the manifest", entries)
+		}
+		var manifest batchManifest
+		if err := json.Unmarshal(entries["manifest.json"], &manifest); err != nil {
+			t.Fatalf("failed to decode the manifest entry %s: %v", entries["manifest.json"], err)
+		}
+		if a := manifest.Files["a"]; a.Status != http.StatusCreated || a.Filename != "a.bin" || a.SignedFile != nil {
+			t.Fatalf("unexpected manifest of part a: %+v", a)
+		}
+		if b := manifest.Files["b"]; b.Status != http.StatusUnprocessableEntity || b.Code != "upstream_rejected" {
+			t.Fatalf("unexpected manifest of part b: %+v", b)
+		}
+		if c := manifest.Files["../c"]; c.Status != http.StatusBadRequest || c.Code != "invalid_part_name" {
+			t.Fatalf("unexpected manifest of part ../c: %+v", c)
+		}
+	})
+
+	rejected := []struct {
+		name         string
+		files        map[string][]byte
+		dryRun       bool
+		expectedCode string
+	}{
+		{"too many files", map[string][]byte{"a": nil, "b": nil, "c": nil}, false, "too_many_batch_parts"},
+		{"dry run", map[string][]byte{"a": nil, "b": nil}, true, "invalid_request"},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			testConf := currentConf()
+			testConf.MaxBatchParts = 2
+			useTestConf(t, testConf)
+			useMockAutographClient(t)
+			req := newBatchSignRequest(t, token, tt.files)
+			if tt.dryRun {
+				req.URL.RawQuery = "dryrun=true"
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"`+tt.expectedCode+`"`) {
+				t.Fatalf("returned unexpected response %v %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_isBatchRequest(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i := 0; i < 2; i++ {
+		fw, err := mw.CreateFormFile("input", "input")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("unsigned"))
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if _, err := isBatchRequest(req, currentConf()); err == nil || !strings.Contains(err.Error(), errDuplicateBatchPart.Error()) {
+		t.Fatalf("isBatchRequest() with two files in a part returned %v", err)
+	}
+
+	single := newMultipartSignRequest(t, "", []byte("unsigned"))
+	if batch, err := isBatchRequest(single, currentConf()); batch || err != nil {
+		t.Fatalf("isBatchRequest() of a single file = %v, %v", batch, err)
+	}
+}
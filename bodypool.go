@@ -0,0 +1,34 @@
+package main
+
+import "sync"
+
+// defaultBodyBufferSize is around the size of a typical extension, so
+// most uploads are read into a reused buffer
+const defaultBodyBufferSize = 1 << 20
+
+// bodyBuffers are the buffers of body_buffer_size the uploads are read
+// into, reused across requests to save their allocation
+var bodyBuffers sync.Pool
+
+// getBodyBuffer returns a buffer of n bytes and the func to call once
+// it is no longer used. Inputs over size are allocated directly and
+// left to the garbage collector.
+func getBodyBuffer(n, size int64) (buf []byte, release func()) {
+	if n > size {
+		return make([]byte, n), func() {}
+	}
+	bp, _ := bodyBuffers.Get().(*[]byte)
+	if bp == nil || int64(cap(*bp)) < n {
+		// the pool is empty or holds a buffer of a smaller size
+		// before a reload
+		b := make([]byte, size)
+		bp = &b
+	}
+	buf = (*bp)[:n]
+	return buf, func() {
+		// zero the bytes of this request so they can't leak into
+		// the input of another one
+		clear(buf)
+		bodyBuffers.Put(bp)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_getBodyBuffer(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		buf, release := getBodyBuffer(1000, 4096)
+		if len(buf) != 1000 {
+			t.Fatalf("returned a buffer of %d bytes expected 1000", len(buf))
+		}
+		// buffers reused from the pool must not hold a previous input
+		if !bytes.Equal(buf, make([]byte, len(buf))) {
+			t.Fatal("returned a buffer holding the bytes of a previous request")
+		}
+		copy(buf, bytes.Repeat([]byte("secret"), 200))
+		release()
+	}
+
+	buf, release := getBodyBuffer(8192, 4096)
+	if len(buf) != 8192 {
+		t.Fatalf("returned a buffer of %d bytes expected 8192", len(buf))
+	}
+	release()
+}
+
+func BenchmarkReadInput(b *testing.B) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("input", "input")
+	if err != nil {
+		b.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte("a"), 512<<10))
+	mw.Close()
+
+	origConf := currentConf()
+	b.Cleanup(func() { setConf(origConf) })
+	for _, bm := range []struct {
+		name           string
+		bodyBufferSize int64
+	}{
+		{"pooled", defaultBodyBufferSize},
+		// smaller than the input so it is always allocated
+		{"direct", 1},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			c := origConf
+			c.BodyBufferSize = bm.bodyBufferSize
+			setConf(c)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "http://localhost:8080/sign", bytes.NewReader(body.Bytes()))
+				req.Header.Set("Content-Type", mw.FormDataContentType())
+				_, release, err := readInput(context.Background(), req, c.Authorizations[0], c.MaxUploadBytes, sha256.New())
+				if err != nil {
+					b.Fatal(err)
+				}
+				release()
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// circuitBreaker tracks the consecutive upstream failures of a signer
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// probing is set while the single request allowed through a
+	// half-open breaker is in flight
+	probing bool
+}
+
+// circuitBreakers holds a circuit breaker per autograph signer. A breaker
+// opens after threshold consecutive failures and rejects requests for
+// the signer until cooldown has passed, then lets a single probe request
+// through and closes again if it succeeds.
+type circuitBreakers struct {
+	sync.Mutex
+	breakers map[string]*circuitBreaker
+
+	// now returns the current time and can be replaced in tests
+	now func() time.Time
+}
+
+var breakers = newCircuitBreakers()
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{
+		breakers: make(map[string]*circuitBreaker),
+		now:      time.Now,
+	}
+}
+
+func (cb *circuitBreakers) get(signer string) *circuitBreaker {
+	b, ok := cb.breakers[signer]
+	if !ok {
+		b = &circuitBreaker{state: breakerClosed}
+		cb.breakers[signer] = b
+	}
+	return b
+}
+
+// allow returns whether a request for signer can be sent upstream
+func (cb *circuitBreakers) allow(signer string, cooldown time.Duration) bool {
+	cb.Lock()
+	defer cb.Unlock()
+
+	b := cb.get(signer)
+	switch b.state {
+	case breakerOpen:
+		if cb.now().Sub(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record updates the breaker of signer with the result of an upstream call
+func (cb *circuitBreakers) record(signer string, err error, threshold int) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	b := cb.get(signer)
+	b.probing = false
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	if !isBreakerFailure(err) {
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= threshold {
+		b.state = breakerOpen
+		b.openedAt = cb.now()
+	}
+}
+
+// states returns the state of the breaker of each signer
+// that has been called
+func (cb *circuitBreakers) states() map[string]string {
+	cb.Lock()
+	defer cb.Unlock()
+
+	states := make(map[string]string, len(cb.breakers))
+	for signer, b := range cb.breakers {
+		states[signer] = string(b.state)
+	}
+	return states
+}
+
+// isBreakerFailure returns whether an error calling autograph indicates
+// the signer is broken upstream. Clients disconnecting and autograph
+// rejecting the content of a request are not the signer's fault, and
+// neither is the edge running out of upstream slots. Autograph rate
+// limiting the edge is backpressure rather than an outage.
+func isBreakerFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errUpstreamBusy) {
+		return false
+	}
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) && (statusErr.rejectsInput() || statusErr.StatusCode == http.StatusTooManyRequests) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mozilla-services/autograph-edge/mock_main"
+)
+
+func Test_circuitBreakers(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cb := newCircuitBreakers()
+	cb.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !cb.allow("broken", time.Minute) {
+			t.Fatalf("allow() rejected request %d under the threshold", i)
+		}
+		cb.record("broken", errUpstreamFailed, 3)
+	}
+	if cb.allow("broken", time.Minute) {
+		t.Fatal("allow() accepted a request with an open breaker")
+	}
+	if !cb.allow("working", time.Minute) {
+		t.Fatal("allow() rejected a request for a different signer")
+	}
+	if cb.states()["broken"] != "open" {
+		t.Fatalf("unexpected breaker state %q expected open", cb.states()["broken"])
+	}
+
+	now = now.Add(time.Minute)
+	if !cb.allow("broken", time.Minute) {
+		t.Fatal("allow() rejected the half-open probe")
+	}
+	if cb.allow("broken", time.Minute) {
+		t.Fatal("allow() accepted a second request while probing")
+	}
+	cb.record("broken", errUpstreamFailed, 3)
+	if cb.allow("broken", time.Minute) {
+		t.Fatal("allow() accepted a request after a failed probe")
+	}
+
+	now = now.Add(time.Minute)
+	if !cb.allow("broken", time.Minute) {
+		t.Fatal("allow() rejected the half-open probe")
+	}
+	cb.record("broken", nil, 3)
+	if cb.states()["broken"] != "closed" {
+		t.Fatalf("unexpected breaker state %q expected closed", cb.states()["broken"])
+	}
+}
+
+func Test_isBreakerFailure(t *testing.T) {
+	testcases := []struct {
+		err      error
+		expected bool
+	}{
+		{errUpstreamFailed, true},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{errUpstreamBusy, false},
+		{&upstreamStatusError{StatusCode: http.StatusBadGateway}, true},
+		{&upstreamStatusError{StatusCode: http.StatusBadRequest}, false},
+		{&upstreamStatusError{StatusCode: http.StatusRequestEntityTooLarge}, false},
+		{&upstreamStatusError{StatusCode: http.StatusUnauthorized}, true},
+		{&upstreamStatusError{StatusCode: http.StatusForbidden}, true},
+	}
+	for i, testcase := range testcases {
+		if got := isBreakerFailure(testcase.err); got != testcase.expected {
+			t.Errorf("testcase %d: isBreakerFailure(%v) returned %t expected %t", i, testcase.err, got, testcase.expected)
+		}
+	}
+}
+
+func TestSigHandlerCircuitBreaker(t *testing.T) {
+	origBreakers := breakers
+	breakers = newCircuitBreakers()
+	defer func() { breakers = origBreakers }()
+
+	c := currentConf()
+	c.UpstreamMaxAttempts = 1
+	c.CircuitBreakerThreshold = 2
+	c.CircuitBreakerCooldown = time.Hour
+	useTestConf(t, c)
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		return newAutographResponse(http.StatusInternalServerError, "oops"), nil
+	}).Times(2)
+
+	auth := c.Authorizations[0]
+	expected := []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable}
+	for i, status := range expected {
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, auth.ClientToken, []byte("foobarbaz1234abcd")))
+		if w.Code != status {
+			t.Fatalf("request %d returned unexpected status %v expected %v", i, w.Code, status)
+		}
+	}
+
+	ctrl := gomock.NewController(t)
+	heartbeatMock := mock_main.NewMockheartbeatRequester(ctrl)
+	heartbeatMock.EXPECT().Get(gomock.Any()).Return(newAutographResponse(http.StatusOK, "{}"), nil)
+	w := httptest.NewRecorder()
+	heartbeatHandler(heartbeatMock)(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+	var st heartbeat
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.CircuitBreakers[auth.Signer] != "open" {
+		t.Fatalf("unexpected heartbeat breaker states %v expected %s open", st.CircuitBreakers, auth.Signer)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// configSummary is the effective configuration printed by -checkconfig,
+// with the secrets of the authorizations redacted
+type configSummary struct {
+	ConfigSHA256   string                  `json:"config_sha256"`
+	BaseURLs       upstreamURLs            `json:"autograph_base_urls"`
+	Authorizations []redactedAuthorization `json:"authorizations"`
+}
+
+// checkConfig loads and validates the configuration at path like at
+// startup and writes its redacted summary to out, so configuration
+// changes can be checked without starting the server
+func checkConfig(path, baseURLOverride string, out io.Writer) error {
+	c, err := loadAndValidateConf(path, baseURLOverride)
+	if err != nil {
+		return err
+	}
+	summary := configSummary{ConfigSHA256: c.fileSHA256, BaseURLs: c.BaseURLs}
+	for _, auth := range c.tokenStore().Authorizations() {
+		summary.Authorizations = append(summary.Authorizations, redactAuthorization(auth))
+	}
+	body, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(body, '\n'))
+	return err
+}
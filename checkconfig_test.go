@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_checkConfig(t *testing.T) {
+	var out bytes.Buffer
+	if err := checkConfig("./autograph-edge.yaml", "", &out); err != nil {
+		t.Fatalf("checkConfig() of the example config returned error: %v", err)
+	}
+	var summary configSummary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("checkConfig() printed invalid JSON %q: %v", out.String(), err)
+	}
+	if len(summary.Authorizations) != len(currentConf().Authorizations) || summary.ConfigSHA256 == "" {
+		t.Fatalf("checkConfig() printed unexpected summary %+v", summary)
+	}
+	for _, auth := range currentConf().Authorizations {
+		if strings.Contains(out.String(), auth.ClientToken) || strings.Contains(out.String(), auth.Key) {
+			t.Fatalf("checkConfig() printed the secrets of user %s", auth.User)
+		}
+	}
+
+	path := t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+authorizations:
+    - client_token: tooshort
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := checkConfig(path, "", &out); err == nil || out.Len() != 0 {
+		t.Fatalf("checkConfig() of an invalid config returned error %v and printed %q", err, out.String())
+	}
+}
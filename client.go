@@ -2,15 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/hawk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type signaturerequest struct {
@@ -19,6 +29,8 @@ type signaturerequest struct {
 	Options interface{}
 }
 
+// signatureresponse is a response of autograph. The signed_file of
+// file signatures is decoded as it is received by copySignedFile.
 type signatureresponse struct {
 	Ref        string `json:"ref"`
 	Type       string `json:"type"`
@@ -39,87 +51,412 @@ type xpiOptions struct {
 
 	// PKCS7Digest is a string required for /sign/file referring to algorithm to use for the PKCS7 signature digest
 	PKCS7Digest string `json:"pkcs7_digest"`
+
+	// COSEIssuer and COSESubject are optional hints of the issuer and
+	// subject of the COSE signatures
+	COSEIssuer  string `json:"cose_issuer,omitempty"`
+	COSESubject string `json:"cose_subject,omitempty"`
+}
+
+// signingParams are the parameters of a signing request that
+// the client chose within what its authorization permits
+type signingParams struct {
+	// COSEAlgorithms overrides the COSE algorithms of the
+	// authorization when set
+	COSEAlgorithms []string
+
+	// Options are autograph signing options set on top of the
+	// options of the authorization
+	Options map[string]interface{}
+
+	// Raw returns the autograph JSON response unmodified instead of
+	// the signed file
+	Raw bool
+
+	// Detached returns the signature of the input from the autograph
+	// data signing endpoint instead of the signed file
+	Detached bool
+
+	// KeyID overrides the signer of the authorization as the key id
+	// sent to autograph when set
+	KeyID string
+
+	// AddonID overrides the add-on id of the authorization when set
+	AddonID string
+
+	// PKCS7Digest overrides the default PKCS7 digest of the
+	// authorization when set
+	PKCS7Digest string
+
+	// COSEIssuer and COSESubject are passed to autograph in the
+	// add-on signing options when set
+	COSEIssuer  string
+	COSESubject string
+
+	// NotBefore and NotAfter are the validity window of the generated
+	// certificate passed to autograph in the signing options when set
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// Output is the output conversion passed to autograph in the
+	// signing options when set
+	Output string
+
+	// MaxAttempts lowers the number of times the request is sent to
+	// autograph when set, within the upstream max attempts
+	MaxAttempts int
+}
+
+// callAutograph signs body and returns the signed file
+func callAutograph(ctx context.Context, auth authorization, params signingParams, body []byte, xff string) (signedBody []byte, err error) {
+	var buf bytes.Buffer
+	_, err = streamAutograph(ctx, auth, params, body, xff, &buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// streamAutograph signs body and writes the signed file to w as it is
+// decoded from the autograph response, or the response itself for raw
+// requests. It returns the number of bytes written, which is non-zero
+// when an error happens mid-stream. The signer ID and x5u of the
+// response are recorded in meta when it is set.
+func streamAutograph(ctx context.Context, auth authorization, params signingParams, body []byte, xff string, w io.Writer, meta *upstreamMetadata) (n int64, err error) {
+	request, err := newSignatureRequest(auth, params, body)
+	if err != nil {
+		return
+	}
+	reqBody, err := json.Marshal([]signaturerequest{request})
+	if err != nil {
+		return
+	}
+
+	resp, err := doAutographRequest(ctx, auth, reqBody, xff, params.MaxAttempts)
+	if err != nil {
+		return
+	}
+	if resp == nil {
+		err = errAutographEmptyResponse
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("upstream_status", resp.StatusCode))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		// read the error before anything is written to w
+		var errBody []byte
+		errBody, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorLength))
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		statusErr := newUpstreamStatusError(resp.StatusCode, errBody)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		err = statusErr
+		return
+	}
+	if auth.MaxOutputBytes > 0 {
+		w = &outputLimitWriter{w: w, remaining: auth.MaxOutputBytes}
+	}
+	var verify func([]byte) error
+	if requestsCOSESignature(request) {
+		verify = verifyXPISignatures
+	} else if auth.VerifyAPK {
+		verify = verifyAPKSignature
+	}
+	if params.Raw && verify == nil {
+		return io.Copy(w, resp.Body)
+	}
+	if auth.signatureType() == signatureTypeData {
+		return copyDataSignature(w, resp.Body, meta)
+	}
+	if verify == nil {
+		return copySignedFile(w, resp.Body, meta)
+	}
+	// the signatures of XPIs with COSE signatures and of verified APKs
+	// are checked before they are returned, so they have to be buffered,
+	// up to what the max output bytes of the token allow
+	var raw []byte
+	var limit int64
+	if auth.MaxOutputBytes > 0 {
+		limit = maxBufferedResponseBytes(auth.MaxOutputBytes, params.Raw)
+	}
+	raw, err = readLimited(resp.Body, limit)
+	if err != nil {
+		return
+	}
+	var signedFile bytes.Buffer
+	_, err = copySignedFile(&signedFile, bytes.NewReader(raw), meta)
+	if err != nil {
+		return
+	}
+	err = verify(signedFile.Bytes())
+	if err != nil {
+		return
+	}
+	if params.Raw {
+		return io.Copy(w, bytes.NewReader(raw))
+	}
+	return io.Copy(w, &signedFile)
+}
+
+// dataSignature is returned to clients of data signing tokens
+type dataSignature struct {
+	Ref       string `json:"ref"`
+	SignerID  string `json:"signer_id"`
+	Signature string `json:"signature"`
+	PublicKey string `json:"public_key,omitempty"`
+
+	// X5U is the URL of the certificate chain of the signature
+	X5U string `json:"x5u,omitempty"`
 }
 
-func callAutograph(auth authorization, body []byte, xff string) (signedBody []byte, err error) {
-	var requests []signaturerequest
-	request := signaturerequest{
+// copyDataSignature writes the signature of the single data signature
+// response in the autograph JSON response r to w as JSON, recording
+// its signer ID and x5u in meta first when it is set
+func copyDataSignature(w io.Writer, r io.Reader, meta *upstreamMetadata) (int64, error) {
+	var responses []signatureresponse
+	err := json.NewDecoder(r).Decode(&responses)
+	if err != nil {
+		return 0, errors.Wrap(errAutographInvalidResponse, err.Error())
+	}
+	if len(responses) != 1 {
+		return 0, errAutographBadResponseCount
+	}
+	if responses[0].Signature == "" {
+		return 0, errAutographEmptyResponse
+	}
+	meta.set("signer_id", responses[0].SignerID)
+	meta.set("x5u", responses[0].X5U)
+	body, err := json.Marshal(dataSignature{
+		Ref:       responses[0].Ref,
+		SignerID:  responses[0].SignerID,
+		Signature: responses[0].Signature,
+		PublicKey: responses[0].PublicKey,
+		X5U:       responses[0].X5U,
+	})
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(body)
+	return int64(n), err
+}
+
+// newSignatureRequest returns the autograph signing request of body
+// for auth and the client chosen params
+func newSignatureRequest(auth authorization, params signingParams, body []byte) (request signaturerequest, err error) {
+	request = signaturerequest{
 		Input: base64.StdEncoding.EncodeToString(body),
 		KeyID: auth.Signer,
 	}
+	if params.KeyID != "" {
+		request.KeyID = params.KeyID
+	}
+	if params.AddonID != "" {
+		auth.AddonID = params.AddonID
+	}
 	if auth.AddonID != "" {
 		opt := xpiOptions{
 			ID:          auth.AddonID,
-			PKCS7Digest: "SHA1",
+			PKCS7Digest: defaultPKCS7Digest,
 		}
-		if auth.AddonPKCS7Digest != "" {
-			opt.PKCS7Digest = auth.AddonPKCS7Digest
+		if digests := auth.pkcs7Digests(); len(digests) > 0 {
+			opt.PKCS7Digest = digests[0]
+		}
+		if params.PKCS7Digest != "" {
+			opt.PKCS7Digest = params.PKCS7Digest
 		}
 		if len(auth.AddonCOSEAlgorithms) > 0 {
 			opt.COSEAlgorithms = auth.AddonCOSEAlgorithms
 		}
+		if len(params.COSEAlgorithms) > 0 {
+			opt.COSEAlgorithms = params.COSEAlgorithms
+		}
+		opt.COSEIssuer = params.COSEIssuer
+		opt.COSESubject = params.COSESubject
 		request.Options = opt
 	}
-	requests = append(requests, request)
-	reqBody, err := json.Marshal(requests)
+	request.Options, err = mergeOptions(request.Options, params.Options)
 	if err != nil {
 		return
 	}
-	rdr := bytes.NewReader(reqBody)
-	req, err := http.NewRequest(http.MethodPost, conf.BaseURL+"sign/file", rdr)
+	request.Options, err = mergeOptions(request.Options, validityWindowOptions(params))
 	if err != nil {
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
+	request.Options, err = mergeOptions(request.Options, outputOptions(params))
+	return
+}
+
+// requestsCOSESignature returns whether request signs an add-on with
+// both a PKCS7 and a COSE signature in the same call
+func requestsCOSESignature(request signaturerequest) bool {
+	switch opt := request.Options.(type) {
+	case xpiOptions:
+		return len(opt.COSEAlgorithms) > 0
+	case map[string]interface{}:
+		algs, _ := opt["cose_algorithms"].([]interface{})
+		return len(algs) > 0
+	}
+	return false
+}
+
+// defaultUpstreamPath is the path of the autograph signing endpoint
+// relative to its base URL
+const defaultUpstreamPath = "sign/file"
+
+// dataUpstreamPath is the path of the autograph data signing endpoint
+const dataUpstreamPath = "sign/data"
+
+// upstreamURL returns the URL of the signing endpoint of auth at the
+// autograph backend baseURL
+func upstreamURL(baseURL string, auth authorization) string {
+	if auth.UpstreamPath == "" {
+		if auth.signatureType() == signatureTypeData {
+			return baseURL + dataUpstreamPath
+		}
+		return baseURL + defaultUpstreamPath
+	}
+	return baseURL + strings.TrimPrefix(auth.UpstreamPath, "/")
+}
 
-	// make the hawk auth header
+// setHawkAuthorization makes the hawk auth header of req, sent for
+// auth with a body of type contentType by the autograph user returned
+// by hawkCredentials
+func setHawkAuthorization(req *http.Request, auth authorization, contentType string, body []byte) {
+	user, key := hawkCredentials(auth)
 	hawkAuth := hawk.NewRequestAuth(req,
 		&hawk.Credentials{
-			ID:   auth.User,
-			Key:  auth.Key,
+			ID:   user,
+			Key:  key,
 			Hash: sha256.New},
 		0)
 	hawkAuth.Ext = fmt.Sprintf("%d", time.Now().Nanosecond())
-	payloadhash := hawkAuth.PayloadHash("application/json")
-	payloadhash.Write(reqBody)
+	payloadhash := hawkAuth.PayloadHash(contentType)
+	payloadhash.Write(body)
 	hawkAuth.SetHash(payloadhash)
 	req.Header.Set("Authorization", hawkAuth.RequestHeader())
+}
+
+// newAutographRequest prepares a HAWK authenticated signing request
+// to the upstream autograph at baseURL
+func newAutographRequest(ctx context.Context, baseURL string, auth authorization, reqBody []byte, xff string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstreamURL(baseURL, auth), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setHawkAuthorization(req, auth, "application/json", reqBody)
+
+	// Copy the client headers listed in forward_headers, which can't
+	// replace any of the headers set below
+	setForwardedHeaders(ctx, req)
 
 	// Reuse the X-Forwarded-For received from the client over to
 	// autograph so we can trace requests back to client from its logs
 	req.Header.Set("X-Forwarded-For", xff)
 
-	// make the request
-	cli := &http.Client{}
-	resp, err := cli.Do(req)
-	if err != nil {
-		return
-	}
-	if resp == nil {
-		err = errAutographEmptyResponse
-		return
+	// Name the edge instance and the client in the autograph logs
+	setUpstreamHeaders(ctx, req)
+
+	// Forward the request ID so logs can be correlated across services
+	req.Header.Set("X-Request-ID", requestIDFromContext(ctx))
+
+	// and the trace context as a W3C traceparent when tracing is enabled
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, nil
+}
+
+// doAutographRequest sends a signing request to autograph. Each attempt
+// tries the upstream backends in order, starting from the one picked by
+// weighted round-robin when they have weights, until one of them does
+// not fail with a connection error or a 5xx. When all backends fail, the attempt
+// is retried with exponential backoff until the maximum number of
+// attempts is reached or the context deadline would be exceeded.
+// maxAttempts lowers the upstream max attempts when it is set.
+func doAutographRequest(ctx context.Context, auth authorization, reqBody []byte, xff string, maxAttempts int) (resp *http.Response, err error) {
+	c := currentConf()
+	if maxAttempts < 1 || maxAttempts > c.UpstreamMaxAttempts {
+		maxAttempts = c.UpstreamMaxAttempts
 	}
-	defer resp.Body.Close()
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
+	for attempt := 1; ; attempt++ {
+		backends := backendSelector.order(c.BaseURLs, c.BaseURLWeights)
+		for i, baseURL := range backends {
+			var req *http.Request
+			req, err = newAutographRequest(ctx, baseURL, auth, reqBody, xff)
+			if err != nil {
+				return nil, err
+			}
+			start := time.Now()
+			resp, err = autographClient.Do(req)
+			metrics.UpstreamDuration("sign", time.Since(start))
+			if !isRetryable(resp, err) || ctx.Err() != nil {
+				return
+			}
+			if i < len(backends)-1 {
+				log.Infof("autograph backend %s failed, failing over to %s", baseURL, backends[i+1])
+				drainAndClose(resp)
+			}
+		}
+		if attempt >= maxAttempts {
+			return
+		}
+
+		delay := backoffDelay(c.UpstreamRetryDelay, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return
+		}
+		drainAndClose(resp)
+		log.Infof("retrying autograph request in %s after attempt %d failed", delay, attempt)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	if resp.StatusCode != http.StatusCreated {
-		err = errAutographBadStatusCode
-		return
+}
+
+// drainAndClose discards the body of a response that will not be used
+func drainAndClose(resp *http.Response) {
+	if resp != nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
 	}
-	var responses []signatureresponse
-	err = json.Unmarshal(respBody, &responses)
+}
+
+// isRetryable returns whether a failed upstream call should be tried
+// again, which is the case for connection errors and 5xx responses. A
+// 429 is not, since retrying makes the rate limiting of autograph worse.
+func isRetryable(resp *http.Response, err error) bool {
 	if err != nil {
-		return
+		return true
 	}
-	if len(responses) != 1 {
-		err = errAutographBadResponseCount
-		return
+	if resp == nil {
+		return false
 	}
-	return base64.StdEncoding.DecodeString(responses[0].SignedFile)
+	return resp.StatusCode >= 500
 }
 
+// backoffDelay returns the delay to wait before the next attempt, which
+// doubles after every attempt and is randomized to spread out retries
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base << (attempt - 1)
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+type autographRequester interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// autographClient sends the signing requests to autograph
+var autographClient autographRequester = &http.Client{}
+
 type heartbeatRequester interface {
 	Get(string) (*http.Response, error)
 }
@@ -127,3 +464,14 @@ type heartbeatRequester interface {
 type heartbeatClient struct {
 	*http.Client
 }
+
+// Get requests url and times out after the heartbeat timeout of the
+// live configuration, unless the client has its own timeout
+func (c *heartbeatClient) Get(url string) (*http.Response, error) {
+	if c.Client.Timeout > 0 {
+		return c.Client.Get(url)
+	}
+	client := *c.Client
+	client.Timeout = currentConf().HeartbeatTimeout
+	return client.Get(url)
+}
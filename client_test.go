@@ -1,9 +1,323 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/mozilla-services/autograph-edge/mock_main"
+	"github.com/pkg/errors"
 )
 
 func TestCallAutograph(t *testing.T) {
 
 }
+
+// newAutographResponse returns an upstream response with the given
+// status code and body
+func newAutographResponse(status int, body string) *http.Response {
+	return &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+	}
+}
+
+// newSignedFileResponse returns a successful upstream response
+// containing signedFile
+func newSignedFileResponse(signedFile []byte) *http.Response {
+	return newAutographResponse(http.StatusCreated,
+		fmt.Sprintf(`[{"ref":"1","type":"xpi","signer_id":"extensions-ecdsa","signed_file":"%s"}]`,
+			base64.StdEncoding.EncodeToString(signedFile)))
+}
+
+// useMockAutographClient replaces the upstream autograph client with
+// a gomock for the duration of test t
+func useMockAutographClient(t *testing.T) *mock_main.MockautographRequester {
+	ctrl := gomock.NewController(t)
+	clientMock := mock_main.NewMockautographRequester(ctrl)
+	origClient := autographClient
+	autographClient = clientMock
+	t.Cleanup(func() {
+		autographClient = origClient
+		ctrl.Finish()
+	})
+	return clientMock
+}
+
+// useTestConf replaces the live configuration with c for the duration of test t
+func useTestConf(t *testing.T, c configuration) {
+	origConf := currentConf()
+	setConf(c)
+	t.Cleanup(func() { setConf(origConf) })
+}
+
+func TestCallAutographRetries(t *testing.T) {
+	testConf := currentConf()
+	testConf.UpstreamMaxAttempts = 3
+	testConf.UpstreamRetryDelay = time.Millisecond
+	useTestConf(t, testConf)
+	auth := testConf.Authorizations[0]
+
+	t.Run("retries 502 twice then succeeds", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		gomock.InOrder(
+			clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadGateway, "bad gateway"), nil),
+			clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadGateway, "bad gateway"), nil),
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil),
+		)
+		signed, err := callAutograph(context.Background(), auth, signingParams{}, []byte("unsigned"), "")
+		if err != nil {
+			t.Fatalf("callAutograph() returned error: %v", err)
+		}
+		if !bytes.Equal(signed, []byte("signed")) {
+			t.Fatalf("callAutograph() returned %q expected %q", signed, "signed")
+		}
+	})
+
+	t.Run("retries connection errors up to the max attempts", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(nil, fmt.Errorf("connection refused")).Times(3)
+		_, err := callAutograph(context.Background(), auth, signingParams{}, []byte("unsigned"), "")
+		if err == nil {
+			t.Fatal("callAutograph() did not return an error")
+		}
+	})
+
+	t.Run("does not retry 4xx", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadRequest, "bad request"), nil).Times(1)
+		_, err := callAutograph(context.Background(), auth, signingParams{}, []byte("unsigned"), "")
+		if !errors.Is(err, errAutographBadStatusCode) {
+			t.Fatalf("callAutograph() returned error %v expected %v", err, errAutographBadStatusCode)
+		}
+	})
+
+	t.Run("does not retry past the context deadline", func(t *testing.T) {
+		slowConf := testConf
+		slowConf.UpstreamRetryDelay = time.Hour
+		useTestConf(t, slowConf)
+
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadGateway, "bad gateway"), nil).Times(1)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := callAutograph(ctx, auth, signingParams{}, []byte("unsigned"), "")
+		if !errors.Is(err, errAutographBadStatusCode) {
+			t.Fatalf("callAutograph() returned error %v expected %v", err, errAutographBadStatusCode)
+		}
+	})
+}
+
+func Test_backoffDelay(t *testing.T) {
+	for attempt := 1; attempt <= 4; attempt++ {
+		max := 100 * time.Millisecond << (attempt - 1)
+		for i := 0; i < 100; i++ {
+			delay := backoffDelay(100*time.Millisecond, attempt)
+			if delay < max/2 || delay >= max {
+				t.Fatalf("backoffDelay() for attempt %d returned %s expected within [%s, %s)", attempt, delay, max/2, max)
+			}
+		}
+	}
+}
+
+func TestCallAutographFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sign/file" {
+			t.Errorf("backend received request for unexpected path %s", r.URL.Path)
+		}
+		resp := newSignedFileResponse([]byte("signed"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer up.Close()
+
+	testConf := currentConf()
+	testConf.BaseURLs = upstreamURLs{down.URL + "/", up.URL + "/"}
+	testConf.UpstreamMaxAttempts = 1
+	useTestConf(t, testConf)
+
+	signed, err := callAutograph(context.Background(), testConf.Authorizations[0], signingParams{}, []byte("unsigned"), "")
+	if err != nil {
+		t.Fatalf("callAutograph() returned error: %v", err)
+	}
+	if !bytes.Equal(signed, []byte("signed")) {
+		t.Fatalf("callAutograph() returned %q expected %q", signed, "signed")
+	}
+}
+
+// newSignedXPI returns a zip archive containing the given files
+func newSignedXPI(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(name))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCallAutographPKCS7AndCOSE(t *testing.T) {
+	// the second test authorization requests both PKCS7 and COSE signatures
+	auth := currentConf().Authorizations[1]
+
+	t.Run("both signatures applied", func(t *testing.T) {
+		signedXPI := newSignedXPI(t, "manifest.json", xpiPKCS7SignaturePath, xpiCOSESignaturePath)
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(signedXPI), nil).Times(1)
+		signed, err := callAutograph(context.Background(), auth, signingParams{}, []byte("unsigned"), "")
+		if err != nil {
+			t.Fatalf("callAutograph() returned error: %v", err)
+		}
+		if !bytes.Equal(signed, signedXPI) {
+			t.Fatal("callAutograph() did not return the signed XPI")
+		}
+	})
+
+	t.Run("only PKCS7 applied", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(newSignedXPI(t, "manifest.json", xpiPKCS7SignaturePath)), nil).Times(1)
+		signed, err := callAutograph(context.Background(), auth, signingParams{}, []byte("unsigned"), "")
+		if !errors.Is(err, errIncompleteXPISignature) {
+			t.Fatalf("callAutograph() returned error %v expected %v", err, errIncompleteXPISignature)
+		}
+		if signed != nil {
+			t.Fatal("callAutograph() returned a half-signed XPI")
+		}
+	})
+
+	t.Run("only COSE applied", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(newSignedXPI(t, "manifest.json", xpiCOSESignaturePath)), nil).Times(1)
+		_, err := callAutograph(context.Background(), auth, signingParams{}, []byte("unsigned"), "")
+		if !errors.Is(err, errIncompleteXPISignature) {
+			t.Fatalf("callAutograph() returned error %v expected %v", err, errIncompleteXPISignature)
+		}
+	})
+
+	t.Run("PKCS7 only authorization is not checked", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil).Times(1)
+		_, err := callAutograph(context.Background(), currentConf().Authorizations[0], signingParams{}, []byte("unsigned"), "")
+		if err != nil {
+			t.Fatalf("callAutograph() returned error: %v", err)
+		}
+	})
+}
+
+func TestCallAutographUpstreamPath(t *testing.T) {
+	testcases := []struct {
+		name         string
+		upstreamPath string
+		expectedURL  string
+	}{
+		{"default path", "", "http://localhost:8000/sign/file"},
+		{"overridden path", "v2/sign/file", "http://localhost:8000/v2/sign/file"},
+		{"overridden path with a leading slash", "/v2/sign/file", "http://localhost:8000/v2/sign/file"},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := currentConf().Authorizations[0]
+			auth.UpstreamPath = tt.upstreamPath
+			var requestedURL string
+			clientMock := useMockAutographClient(t)
+			clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+				requestedURL = req.URL.String()
+				return newSignedFileResponse([]byte("signed")), nil
+			})
+			_, err := callAutograph(context.Background(), auth, signingParams{}, []byte("unsigned"), "")
+			if err != nil {
+				t.Fatalf("callAutograph() returned error: %v", err)
+			}
+			if requestedURL != tt.expectedURL {
+				t.Fatalf("callAutograph() requested %s expected %s", requestedURL, tt.expectedURL)
+			}
+		})
+	}
+}
+
+func Test_validateUpstreamPath(t *testing.T) {
+	testcases := []struct {
+		upstreamPath string
+		wantErr      bool
+	}{
+		{"", false},
+		{"v2/sign/file", false},
+		{"/v2/sign/file", false},
+		{"sign/file?debug=1", true},
+		{"sign/file#frag", true},
+		{"sign/%zz", true},
+	}
+	for _, tt := range testcases {
+		err := validateUpstreamPath("https://autograph.example.com/", authorization{UpstreamPath: tt.upstreamPath})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateUpstreamPath(%q) returned error %v wantErr %t", tt.upstreamPath, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCallAutographDataSignature(t *testing.T) {
+	auth := authorization{
+		ClientToken:   "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+		Signer:        "normandy",
+		User:          "alice",
+		Key:           "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+		SignatureType: signatureTypeData,
+	}
+	var (
+		requestedURL string
+		requests     []map[string]interface{}
+	)
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		requestedURL = req.URL.String()
+		if err := json.NewDecoder(req.Body).Decode(&requests); err != nil {
+			t.Fatal(err)
+		}
+		return newAutographResponse(http.StatusCreated,
+			`[{"ref":"1","type":"contentsignature","signer_id":"normandy","signature":"c2lnbmF0dXJl","x5u":"https://example.com/chain.pem"}]`), nil
+	})
+
+	signed, err := callAutograph(context.Background(), auth, signingParams{}, []byte("some data"), "")
+	if err != nil {
+		t.Fatalf("callAutograph() returned error: %v", err)
+	}
+	if requestedURL != "http://localhost:8000/sign/data" {
+		t.Fatalf("callAutograph() requested %s expected http://localhost:8000/sign/data", requestedURL)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("upstream received %d signing requests expected 1", len(requests))
+	}
+	if requests[0]["input"] != base64.StdEncoding.EncodeToString([]byte("some data")) || requests[0]["keyid"] != "normandy" {
+		t.Fatalf("upstream received unexpected signing request %v", requests[0])
+	}
+	if requests[0]["Options"] != nil {
+		t.Fatalf("upstream received options %v for a data signature", requests[0]["Options"])
+	}
+
+	var sig dataSignature
+	if err := json.Unmarshal(signed, &sig); err != nil {
+		t.Fatalf("callAutograph() returned invalid JSON %q: %v", signed, err)
+	}
+	if sig.Signature != "c2lnbmF0dXJl" || sig.X5U != "https://example.com/chain.pem" || sig.SignerID != "normandy" {
+		t.Fatalf("callAutograph() returned unexpected signature %+v", sig)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errIPNotAllowed = errors.New("client IP is not allowed for this token")
+
+// clientIP returns the IP address of the client that sent r, using
+// the trusted proxies of the live configuration
+func clientIP(r *http.Request) (net.IP, error) {
+	return forwardedClientIP(r, currentConf().TrustedProxies)
+}
+
+// forwardedClientIP returns the IP address of the client that sent r.
+// The trustedProxies proxies closest to the edge are expected to have
+// each appended the address of their peer to X-Forwarded-For, so the
+// client is that many hops back from the connecting address. The
+// header is ignored when no proxies are trusted, so that clients of an
+// edge exposed directly cannot spoof their address, and the connecting
+// address is used when it is missing.
+func forwardedClientIP(r *http.Request, trustedProxies int) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	chain := []string{host}
+	if trustedProxies > 0 {
+		chain = nil
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(header, ",") {
+				addr = strings.TrimSpace(addr)
+				if addr != "" {
+					chain = append(chain, addr)
+				}
+			}
+		}
+		if len(chain) == 0 {
+			chain = []string{host}
+			trustedProxies = 0
+		} else {
+			chain = append(chain, host)
+		}
+	}
+
+	i := len(chain) - 1 - trustedProxies
+	if i < 0 {
+		return nil, fmt.Errorf("X-Forwarded-For has %d addresses, fewer than the %d trusted proxies", len(chain)-1, trustedProxies)
+	}
+	ip := net.ParseIP(chain[i])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client IP %q", chain[i])
+	}
+	return ip, nil
+}
+
+// allowsIP returns whether auth can be used from ip. Authorizations
+// without AllowedCIDRs can be used from anywhere.
+func (auth authorization) allowsIP(ip net.IP) bool {
+	if len(auth.AllowedCIDRs) == 0 {
+		return true
+	}
+	for _, cidr := range auth.AllowedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			// CIDRs are validated when the config is loaded
+			continue
+		}
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_forwardedClientIP(t *testing.T) {
+	testcases := []struct {
+		name           string
+		xff            string
+		trustedProxies int
+		expected       string
+		wantErr        bool
+	}{
+		{"no header", "", 0, "192.0.2.1", false},
+		{"no header with a trusted proxy", "", 1, "192.0.2.1", false},
+		{"header of an untrusted client", "203.0.113.7", 0, "192.0.2.1", false},
+		{"single hop", "203.0.113.7", 1, "203.0.113.7", false},
+		{"multiple hops with one trusted proxy", "198.51.100.3, 203.0.113.7", 1, "203.0.113.7", false},
+		{"multiple hops with two trusted proxies", "198.51.100.3, 203.0.113.7", 2, "198.51.100.3", false},
+		{"fewer hops than trusted proxies", "203.0.113.7", 2, "", true},
+		{"invalid address", "not-an-ip", 1, "", true},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+			req.RemoteAddr = "192.0.2.1:4321"
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			ip, err := forwardedClientIP(req, tt.trustedProxies)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("forwardedClientIP() returned error %v wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !ip.Equal(net.ParseIP(tt.expected)) {
+				t.Fatalf("forwardedClientIP() returned %s expected %s", ip, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_clientIP(t *testing.T) {
+	c := currentConf()
+	c.TrustedProxies = 1
+	useTestConf(t, c)
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	ip, err := clientIP(req)
+	if err != nil {
+		t.Fatalf("clientIP() returned error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("203.0.113.7")) {
+		t.Fatalf("clientIP() returned %s expected 203.0.113.7", ip)
+	}
+}
+
+func TestSigHandlerAllowedCIDRs(t *testing.T) {
+	c := currentConf()
+	c.TrustedProxies = 1
+	c.Authorizations = append([]authorization(nil), c.Authorizations...)
+	c.Authorizations[0].AllowedCIDRs = []string{"203.0.113.0/24"}
+	useTestConf(t, c)
+	token := c.Authorizations[0].ClientToken
+
+	testcases := []struct {
+		name           string
+		xff            string
+		expectedStatus int
+	}{
+		// allowed requests proceed and fail on the missing input
+		{"allowed client", "203.0.113.7", http.StatusBadRequest},
+		{"client outside the range", "198.51.100.3", http.StatusForbidden},
+		{"spoofed client behind the proxy", "203.0.113.7, 198.51.100.3", http.StatusForbidden},
+		{"missing X-Forwarded-For", "", http.StatusForbidden},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+			req.Header.Set("Authorization", token)
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// exitInvalidConfig is the exit code of an invalid configuration, the
+// EX_CONFIG of sysexits.h, so that orchestrators can tell it apart from
+// a crash
+const exitInvalidConfig = 78
+
+// configErrors reports the invalid authorizations of a configuration
+// with the first problem found in the rest of it
+type configErrors []error
+
+// newConfigErrors returns the errors of errs that aren't nil, or the
+// only one of them
+func newConfigErrors(errs ...error) error {
+	var set configErrors
+	for _, err := range errs {
+		if err != nil {
+			set = append(set, err)
+		}
+	}
+	switch len(set) {
+	case 0:
+		return nil
+	case 1:
+		return set[0]
+	}
+	return set
+}
+
+func (errs configErrors) Error() string {
+	return strings.Join(configProblems(errs), "\n")
+}
+
+// Unwrap lets errors.Is and errors.As match any of the errors
+func (errs configErrors) Unwrap() []error {
+	return errs
+}
+
+// configProblems flattens err into the messages of each of the
+// problems it reports
+func configProblems(err error) (problems []string) {
+	if multi, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range multi.Unwrap() {
+			problems = append(problems, configProblems(err)...)
+		}
+		return problems
+	}
+	return []string{err.Error()}
+}
+
+// formatConfigError returns the summary printed when the configuration
+// at path fails to load, listing each problem on its own line with the
+// continuation lines of the multi-line ones, like yaml errors, indented
+func formatConfigError(path string, err error) string {
+	problems := configProblems(err)
+	var b strings.Builder
+	noun := "problem"
+	if len(problems) > 1 {
+		noun = "problems"
+	}
+	fmt.Fprintf(&b, "autograph-edge: invalid configuration %s, %d %s:\n", path, len(problems), noun)
+	for _, problem := range problems {
+		fmt.Fprintf(&b, "  - %s\n", strings.ReplaceAll(strings.TrimSpace(problem), "\n", "\n    "))
+	}
+	return b.String()
+}
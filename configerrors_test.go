@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_formatConfigError(t *testing.T) {
+	path := t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+max_upload_bytes: -1
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: testapp-android
+      allowed_cidrs:
+          - 10.0.0.0/33
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadAndValidateConf(path, "")
+	if err == nil {
+		t.Fatal("loadAndValidateConf() returned no error")
+	}
+	var fieldErr *authFieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "allowed_cidrs" {
+		t.Fatalf("loadAndValidateConf() returned %v expected the invalid allowed_cidrs", err)
+	}
+	expected := "autograph-edge: invalid configuration " + path + ", 2 problems:\n" +
+		`  - error validating auth 0: invalid allowed_cidrs of the authorization of user "bob" for signer "testapp-android": invalid allowed CIDR "10.0.0.0/33": invalid CIDR address: 10.0.0.0/33` + "\n" +
+		"  - max upload bytes -1 is negative\n"
+	if got := formatConfigError(path, err); got != expected {
+		t.Fatalf("formatConfigError() returned:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	multiline := errors.New("yaml: unmarshal errors:\n  line 3: field nope not found")
+	expected = "autograph-edge: invalid configuration " + path + ", 1 problem:\n" +
+		"  - yaml: unmarshal errors:\n      line 3: field nope not found\n"
+	if got := formatConfigError(path, multiline); got != expected {
+		t.Fatalf("formatConfigError() returned:\n%s\nexpected:\n%s", got, expected)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// defaultMaxConnections keeps the accepted connections well under the
+// usual 4096 open files limit, leaving room for the upstream ones
+const defaultMaxConnections = 1024
+
+// limitListener accepts at most max connections at once. Connections
+// over the limit wait in the listen backlog until one is closed, and
+// all of them are counted in the openConnections gauge.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newLimitListener(l net.Listener, max int) *limitListener {
+	return &limitListener{
+		Listener: l,
+		slots:    make(chan struct{}, max),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	openConnections.Inc()
+	return &limitListenerConn{Conn: conn, release: l.release}, nil
+}
+
+func (l *limitListener) release() {
+	openConnections.Dec()
+	<-l.slots
+}
+
+// Close stops the listener, including Accept calls waiting for a slot
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitListenerConn gives its slot back once closed
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_limitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(inner, 2)
+	defer l.Close()
+	openBefore := testutil.ToFloat64(openConnections)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+
+	first, second := <-accepted, <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if open := testutil.ToFloat64(openConnections) - openBefore; open != 2 {
+		t.Fatalf("counted %v open connections expected 2", open)
+	}
+
+	// closing a connection twice gives a single slot back
+	first.Close()
+	first.Close()
+	select {
+	case third := <-accepted:
+		third.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting connection was not accepted once a slot was freed")
+	}
+	second.Close()
+	if open := testutil.ToFloat64(openConnections) - openBefore; open != 0 {
+		t.Fatalf("counted %v open connections expected 0", open)
+	}
+
+	l.Close()
+	select {
+	case _, ok := <-accepted:
+		if ok {
+			t.Fatal("accepted a connection after the listener was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return after the listener was closed")
+	}
+}
+
+func Test_limitListenerCloseWhileWaiting(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(inner, 1)
+	// take the only slot so that Accept waits for one
+	l.slots <- struct{}{}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Accept() of a closed listener returned %v expected %v", err, net.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept waiting for a slot did not return after the listener was closed")
+	}
+}
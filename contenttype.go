@@ -0,0 +1,105 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errContentTypeNotAllowed = errors.New("content type of the input is not allowed for this token")
+
+// signatureTypeContentTypes are the content types of the files told
+// apart by detectSignatureType
+var signatureTypeContentTypes = map[string]string{
+	signatureTypeXPI: "application/x-xpinstall",
+	signatureTypeAPK: "application/vnd.android.package-archive",
+}
+
+// genericContentType is sent by clients that don't know the type of
+// what they upload, like curl for most file extensions
+const genericContentType = "application/octet-stream"
+
+// declaredContentType returns the content type the client sent with
+// the uploaded input file of r, if any
+func declaredContentType(r *http.Request) string {
+	if r.MultipartForm == nil {
+		return ""
+	}
+	if files := r.MultipartForm.File["input"]; len(files) > 0 {
+		return files[0].Header.Get("Content-Type")
+	}
+	return ""
+}
+
+// inputContentTypes returns the media types of input: the one declared
+// by the client unless it is missing or the generic
+// application/octet-stream, and the one sniffed from the content
+func inputContentTypes(declared string, input []byte) []string {
+	var contentTypes []string
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err == nil && mediaType != genericContentType {
+		contentTypes = append(contentTypes, mediaType)
+	}
+	sniffed := sniffedContentType(input)
+	if len(contentTypes) == 0 || contentTypes[0] != sniffed {
+		contentTypes = append(contentTypes, sniffed)
+	}
+	return contentTypes
+}
+
+// sniffedContentType returns the media type detected from the content
+// of input
+func sniffedContentType(input []byte) string {
+	if contentType, ok := signatureTypeContentTypes[detectSignatureType(input)]; ok {
+		return contentType
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(input))
+	return mediaType
+}
+
+// allowsInput returns an error unless auth accepts both the declared
+// and the sniffed media types of input, so that a client can't get an
+// input past the check by declaring an allowed type
+func (auth authorization) allowsInput(declared string, input []byte) error {
+	if len(auth.AllowedContentTypes) == 0 {
+		return nil
+	}
+	for _, contentType := range inputContentTypes(declared, input) {
+		if err := auth.allowsContentType(contentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowsContentType returns an error unless auth accepts inputs of the
+// media type contentType. Tokens without allowed content types accept
+// any input, and an allowed type/* accepts all the subtypes of type.
+func (auth authorization) allowsContentType(contentType string) error {
+	if len(auth.AllowedContentTypes) == 0 {
+		return nil
+	}
+	for _, allowed := range auth.AllowedContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == contentType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*"))) {
+			return nil
+		}
+	}
+	return errors.Wrapf(errContentTypeNotAllowed, "got %q", contentType)
+}
+
+// validateContentType returns an error unless contentType is a media
+// type without parameters, or a type followed by /*
+func validateContentType(contentType string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return errors.Errorf("invalid allowed content type %q: %v", contentType, err)
+	}
+	parts := strings.Split(mediaType, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" || len(params) > 0 {
+		return errors.Errorf("invalid allowed content type %q, want a type/subtype without parameters", contentType)
+	}
+	return nil
+}
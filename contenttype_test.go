@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func Test_inputContentTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		declared string
+		input    []byte
+		expected []string
+	}{
+		{"declared and sniffed types", "application/json; charset=utf-8", []byte("{}"), []string{"application/json", "text/plain"}},
+		{"declared type matching the sniffed one", "application/x-xpinstall", readFixture(t, "integration_test/test.xpi"), []string{"application/x-xpinstall"}},
+		{"sniffed xpi", "", readFixture(t, "integration_test/test.xpi"), []string{"application/x-xpinstall"}},
+		{"sniffed apk for a generic type", "application/octet-stream", readFixture(t, "integration_test/test.apk"), []string{"application/vnd.android.package-archive"}},
+		{"sniffed zip", "", newSignedXPI(t, "readme.txt"), []string{"application/zip"}},
+		{"sniffed text", "invalid type", []byte("unsigned"), []string{"text/plain"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inputContentTypes(tt.declared, tt.input); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("inputContentTypes() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_allowsContentType(t *testing.T) {
+	auth := authorization{AllowedContentTypes: []string{"Application/X-XPInstall", "text/*"}}
+	for _, contentType := range []string{"application/x-xpinstall", "text/plain"} {
+		if err := auth.allowsContentType(contentType); err != nil {
+			t.Errorf("allowsContentType(%q) returned error: %v", contentType, err)
+		}
+	}
+	for _, contentType := range []string{"application/zip", "textual/plain", ""} {
+		if err := auth.allowsContentType(contentType); !errors.Is(err, errContentTypeNotAllowed) {
+			t.Errorf("allowsContentType(%q) returned %v expected errContentTypeNotAllowed", contentType, err)
+		}
+	}
+	if err := (authorization{}).allowsContentType("application/zip"); err != nil {
+		t.Errorf("token without allowed content types returned error: %v", err)
+	}
+}
+
+// newTypedSignRequest returns a signing request uploading input as the
+// multipart input file declared as contentType
+func newTypedSignRequest(t *testing.T, token, contentType string, input []byte) *http.Request {
+	if contentType == "" {
+		return newMultipartSignRequest(t, token, input)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="input"; filename="input"`)
+	header.Set("Content-Type", contentType)
+	pw, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Write(input)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", token)
+	return req
+}
+
+func TestSigHandlerAllowedContentTypes(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[0].AllowedContentTypes = []string{"application/x-xpinstall"}
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[0].ClientToken
+
+	tests := []struct {
+		name           string
+		declared       string
+		input          []byte
+		expectedStatus int
+	}{
+		{"allowed type", "", readFixture(t, "integration_test/test.xpi"), http.StatusCreated},
+		{"allowed declared type", "application/x-xpinstall", readFixture(t, "integration_test/test.xpi"), http.StatusCreated},
+		{"rejected type", "", []byte("unsigned"), http.StatusUnsupportedMediaType},
+		{"allowed declared type with rejected content", "application/x-xpinstall", []byte("unsigned"), http.StatusUnsupportedMediaType},
+		{"rejected declared type", "application/zip", readFixture(t, "integration_test/test.xpi"), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, newTypedSignRequest(t, token, tt.declared, tt.input))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusUnsupportedMediaType && !strings.Contains(w.Body.String(), `"code":"content_type_not_allowed"`) {
+				t.Fatalf("unexpected error response %s", w.Body.String())
+			}
+		})
+	}
+}
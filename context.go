@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"net/http"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type contextKey struct {
@@ -14,6 +16,9 @@ func (k *contextKey) String() string { return "github.com/mozilla-services/autog
 var (
 	// ctxReqID is the string identifier of a request ID in a context
 	contextKeyRequestID = contextKey{name: "reqID"}
+
+	// contextKeyLogger is the identifier of the request scoped logger in a context
+	contextKeyLogger = contextKey{name: "logger"}
 )
 
 // addToContext add the given key value pair to the given request's context
@@ -24,9 +29,24 @@ func addToContext(r *http.Request, key contextKey, value interface{}) *http.Requ
 
 // getRequestID retrieves an ID from the request context, or returns "-" is none is found
 func getRequestID(r *http.Request) string {
-	val, ok := r.Context().Value(contextKeyRequestID).(string)
+	return requestIDFromContext(r.Context())
+}
+
+// requestIDFromContext retrieves an ID from a context, or returns "-" is none is found
+func requestIDFromContext(ctx context.Context) string {
+	val, ok := ctx.Value(contextKeyRequestID).(string)
 	if ok {
 		return val
 	}
 	return "-"
 }
+
+// getLogger retrieves the request scoped logger from the request context,
+// or returns a logger without request fields if none is found
+func getLogger(r *http.Request) *log.Entry {
+	val, ok := r.Context().Value(contextKeyLogger).(*log.Entry)
+	if ok {
+		return val
+	}
+	return log.NewEntry(log.StandardLogger())
+}
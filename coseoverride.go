@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errCOSEOverrideNotAllowed = errors.New("COSE issuer and subject cannot be set for this token")
+	errInvalidCOSEOverride    = errors.New("invalid COSE issuer or subject")
+)
+
+// coseOverrideFields are the form fields of the COSE issuer and subject
+// hints forwarded to autograph in the options of the same name
+var coseOverrideFields = []string{"cose_issuer", "cose_subject"}
+
+// allowedCOSEOverride returns the COSE issuer and subject requested in
+// the cose_issuer and cose_subject form values. Fields that are sent
+// must not be blank, and only tokens with AllowCOSEOverride can send
+// them.
+func allowedCOSEOverride(auth authorization, r *http.Request) (issuer, subject string, err error) {
+	if r.MultipartForm == nil {
+		return "", "", nil
+	}
+	values := make(map[string]string, len(coseOverrideFields))
+	for _, field := range coseOverrideFields {
+		sent, ok := r.MultipartForm.Value[field]
+		if !ok {
+			continue
+		}
+		if !auth.AllowCOSEOverride {
+			return "", "", errors.Wrapf(errCOSEOverrideNotAllowed, "field %s", field)
+		}
+		if len(sent) != 1 || strings.TrimSpace(sent[0]) == "" {
+			return "", "", errors.Wrapf(errInvalidCOSEOverride, "field %s must be a single non-empty string", field)
+		}
+		values[field] = strings.TrimSpace(sent[0])
+	}
+	return values["cose_issuer"], values["cose_subject"], nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerCOSEOverride(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[1].AllowCOSEOverride = true
+	useTestConf(t, testConf)
+
+	testcases := []struct {
+		name            string
+		token           string
+		fields          map[string]string
+		expectedStatus  int
+		expectedCode    string
+		expectedOptions xpiOptions
+	}{
+		{
+			name:            "permitted issuer and subject",
+			token:           testConf.Authorizations[1].ClientToken,
+			fields:          map[string]string{"cose_issuer": "addons-pipeline", "cose_subject": "mycoseaddon@allizom.org"},
+			expectedStatus:  http.StatusCreated,
+			expectedOptions: xpiOptions{ID: "mycoseaddon@allizom.org", COSEAlgorithms: []string{"ES256"}, PKCS7Digest: "SHA256", COSEIssuer: "addons-pipeline", COSESubject: "mycoseaddon@allizom.org"},
+		},
+		{
+			name:            "permitted token without the fields",
+			token:           testConf.Authorizations[1].ClientToken,
+			expectedStatus:  http.StatusCreated,
+			expectedOptions: xpiOptions{ID: "mycoseaddon@allizom.org", COSEAlgorithms: []string{"ES256"}, PKCS7Digest: "SHA256"},
+		},
+		{
+			name:           "blank subject",
+			token:          testConf.Authorizations[1].ClientToken,
+			fields:         map[string]string{"cose_issuer": "addons-pipeline", "cose_subject": " "},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_cose_override",
+		},
+		{
+			name:           "forbidden for tokens without allow_cose_override",
+			token:          testConf.Authorizations[0].ClientToken,
+			fields:         map[string]string{"cose_issuer": "addons-pipeline"},
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   "cose_override_not_allowed",
+		},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []struct {
+				Options xpiOptions
+			}
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					if err := json.NewDecoder(req.Body).Decode(&upstreamRequests); err != nil {
+						t.Fatal(err)
+					}
+					return newSignedFileResponse(newSignedXPI(t, "manifest.json", xpiPKCS7SignaturePath, xpiCOSESignaturePath)), nil
+				})
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequestWithFields(t, tt.token, newSignedXPI(t, "manifest.json"), tt.fields))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusCreated {
+				var body errorResponse
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code != tt.expectedCode {
+					t.Fatalf("returned %+v (%v) expected the %s code", body, err, tt.expectedCode)
+				}
+				return
+			}
+			if len(upstreamRequests) != 1 {
+				t.Fatalf("upstream received %d requests expected 1", len(upstreamRequests))
+			}
+			if !reflect.DeepEqual(upstreamRequests[0].Options, tt.expectedOptions) {
+				t.Fatalf("upstream received options %+v expected %+v", upstreamRequests[0].Options, tt.expectedOptions)
+			}
+		})
+	}
+}
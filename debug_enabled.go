@@ -0,0 +1,7 @@
+//go:build debug
+
+package main
+
+// debugBuild is set by building with -tags debug, which the debug
+// endpoints require on top of their configuration
+const debugBuild = true
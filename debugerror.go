@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+)
+
+// debugErrorHandler returns the error envelope of the code query
+// parameter, like upstream_error, with its HTTP status, so that the
+// alerting and clients can be tested against every error. It is only
+// served by debug builds with debug_error_endpoint set.
+func debugErrorHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	for _, ec := range errorCodes {
+		if ec.code == code {
+			writeSigningError(w, r, ec.err)
+			return
+		}
+	}
+	if code == "internal_error" {
+		writeSigningError(w, r, errInternal)
+		return
+	}
+	notFoundHandler(w, r)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_debugErrorHandler(t *testing.T) {
+	expected := map[string]int{
+		"invalid_token":     http.StatusUnauthorized,
+		"upstream_error":    http.StatusBadGateway,
+		"payload_too_large": http.StatusRequestEntityTooLarge,
+		"timeout":           http.StatusGatewayTimeout,
+		"rate_limited":      http.StatusTooManyRequests,
+		"internal_error":    http.StatusInternalServerError,
+	}
+	for _, ec := range errorCodes {
+		if _, ok := expected[ec.code]; !ok {
+			expected[ec.code] = ec.status
+		}
+	}
+	for code, status := range expected {
+		w := httptest.NewRecorder()
+		debugErrorHandler(w, httptest.NewRequest("GET", "http://localhost:8080/__error__?code="+code, nil))
+		if w.Code != status {
+			t.Errorf("code %s returned status %v expected %v", code, w.Code, status)
+			continue
+		}
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("code %s returned an invalid envelope %q: %v", code, w.Body.String(), err)
+		}
+		if resp.Code != code || resp.Error == "" {
+			t.Errorf("code %s returned envelope %+v", code, resp)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	debugErrorHandler(w, httptest.NewRequest("GET", "http://localhost:8080/__error__?code=unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown code returned status %v expected %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func Test_prepareServerDoesNotServeDebugError(t *testing.T) {
+	if debugBuild {
+		t.Skip("debug builds can serve the debug error endpoint")
+	}
+	c := currentConf()
+	c.DebugErrorEndpoint = true
+	useTestConf(t, c)
+	w := httptest.NewRecorder()
+	prepareServer().Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/__error__?code=timeout", nil))
+	if w.Code == http.StatusGatewayTimeout {
+		t.Fatal("production build served the debug error endpoint")
+	}
+
+	path := t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+debug_error_endpoint: true
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAndValidateConf(path, ""); err == nil || !strings.Contains(err.Error(), "debug tag") {
+		t.Fatalf("loadAndValidateConf() of a production build with debug_error_endpoint returned %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var deduplicatedRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "autograph_edge_deduplicated_requests_total",
+		Help: "Number of signing requests that waited for the autograph call of a concurrent identical request by signer.",
+	},
+	[]string{"signer"},
+)
+
+// inflightGroup shares the autograph call of a signing request with the
+// identical requests arriving while it is in flight, like the Group of
+// golang.org/x/sync/singleflight. Unlike the response cache, nothing is
+// kept once the call completes.
+type inflightGroup struct {
+	sync.Mutex
+	calls map[string]*inflightCall
+}
+
+// inflightCall is the autograph call of a leading request, whose done
+// channel is closed once its signed file or error is set
+type inflightCall struct {
+	key  string
+	once sync.Once
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+var inflightSigns = &inflightGroup{calls: make(map[string]*inflightCall)}
+
+// join returns the call in flight for key and false, or registers a new
+// call that the caller leads and must finish, and true
+func (g *inflightGroup) join(key string) (call *inflightCall, leader bool) {
+	g.Lock()
+	defer g.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	call = &inflightCall{key: key, done: make(chan struct{})}
+	g.calls[key] = call
+	return call, true
+}
+
+// finish hands the signed file or error of call to the requests
+// waiting for it, the first time it is called. Requests arriving after
+// it lead a new call. It does nothing when call is nil.
+func (g *inflightGroup) finish(call *inflightCall, body []byte, err error) {
+	if call == nil {
+		return
+	}
+	call.once.Do(func() {
+		g.Lock()
+		if g.calls[call.key] == call {
+			delete(g.calls, call.key)
+		}
+		g.Unlock()
+		call.body, call.err = body, err
+		close(call.done)
+	})
+}
+
+// wait returns the signed file or error of call, or the error of ctx
+// when it is done first
+func (call *inflightCall) wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-call.done:
+		return call.body, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
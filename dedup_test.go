@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSigHandlerDeduplicate(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].Deduplicate = true
+	useTestConf(t, testConf)
+	signer := testConf.Authorizations[2].Signer
+	waitingBefore := testutil.ToFloat64(deduplicatedRequestsTotal.WithLabelValues(signer))
+
+	// the upstream call completes once the other requests are waiting
+	// for it
+	const requests = 8
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(deduplicatedRequestsTotal.WithLabelValues(signer))-waitingBefore < requests-1 {
+			if time.Now().After(deadline) {
+				t.Error("identical requests did not wait for the upstream call in flight")
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return newSignedFileResponse([]byte("signed")), nil
+	}).Times(1)
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, requests)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned")))
+		}(responses[i])
+	}
+	wg.Wait()
+	for i, w := range responses {
+		if w.Code != http.StatusCreated || !bytes.Equal(w.Body.Bytes(), []byte("signed")) {
+			t.Fatalf("request %d returned %d %q expected the shared signed file", i, w.Code, w.Body.String())
+		}
+	}
+
+	// requests arriving once the call completed lead a new one
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed again")), nil)
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusCreated || w.Body.String() != "signed again" {
+		t.Fatalf("returned %d %q expected a new signed file", w.Code, w.Body.String())
+	}
+}
+
+func TestSigHandlerDeduplicateSharesErrors(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].Deduplicate = true
+	useTestConf(t, testConf)
+	auth := testConf.Authorizations[2]
+	waitingBefore := testutil.ToFloat64(deduplicatedRequestsTotal.WithLabelValues(auth.Signer))
+
+	// lead the call of the request as a concurrent request would
+	key, err := responseCacheKey(auth, signingParams{}, []byte("unsigned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	call, leader := inflightSigns.join(key)
+	if !leader {
+		t.Fatal("join() of a new key did not lead the call")
+	}
+	useMockAutographClient(t)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, auth.ClientToken, []byte("unsigned")))
+		done <- w
+	}()
+	for testutil.ToFloat64(deduplicatedRequestsTotal.WithLabelValues(auth.Signer)) == waitingBefore {
+		time.Sleep(time.Millisecond)
+	}
+	inflightSigns.finish(call, nil, &upstreamStatusError{StatusCode: http.StatusBadRequest, Message: "invalid apk"})
+	if w := <-done; w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "upstream_rejected") {
+		t.Fatalf("returned %d %s expected the upstream_rejected error of the shared call", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errDetachedNotAllowed   = errors.New("detached signatures are not allowed for this token")
+	errDetachedNotSupported = errors.New("detached signatures are not supported for this signature type")
+)
+
+// isDetachedRequest returns whether r asks for the signature alone
+// instead of the signed file
+func isDetachedRequest(r *http.Request) bool {
+	detached, err := strconv.ParseBool(r.URL.Query().Get("detached"))
+	return err == nil && detached
+}
+
+// allowedDetached returns an error when auth can't return the detached
+// signature of a request with params. Tokens need AllowDetached, and
+// only add-ons without COSE signatures, which are part of the signed
+// file, and data have one: APK signatures are always embedded.
+func allowedDetached(auth authorization, params signingParams) error {
+	if !auth.AllowDetached {
+		return errDetachedNotAllowed
+	}
+	switch auth.signatureType() {
+	case signatureTypeData:
+		return nil
+	case signatureTypeXPI:
+		if len(auth.AddonCOSEAlgorithms) == 0 && len(params.COSEAlgorithms) == 0 {
+			return nil
+		}
+		return errors.Wrap(errDetachedNotSupported, "COSE signatures are embedded in the signed add-on")
+	}
+	return errors.Wrapf(errDetachedNotSupported, "%s signatures are embedded in the signed file", auth.signatureType())
+}
+
+// detachedAuthorization returns auth signing data, so that autograph
+// returns the signature of the input as a data signing token would
+// instead of a signed file. The upstream path of auth is dropped since
+// it overrides the file signing endpoint.
+func detachedAuthorization(auth authorization) authorization {
+	auth.SignatureType = signatureTypeData
+	auth.UpstreamPath = ""
+	return auth
+}
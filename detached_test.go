@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerDetached(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[0].AllowDetached = true
+	testConf.Authorizations[0].UpstreamPath = "v2/sign/file"
+	testConf.Authorizations[1].AllowDetached = true
+	useTestConf(t, testConf)
+
+	t.Run("returns the signature", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+			if !strings.HasSuffix(req.URL.Path, "/sign/data") {
+				t.Errorf("detached request was sent to %s expected the data signing endpoint", req.URL.Path)
+			}
+			return newAutographResponse(http.StatusCreated, `[{"ref":"1","type":"xpi","signer_id":"extensions-ecdsa","signature":"c2lnbmF0dXJl"}]`), nil
+		})
+		req := newMultipartSignRequest(t, testConf.Authorizations[0].ClientToken, []byte("unsigned"))
+		req.URL.RawQuery = "detached=true"
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get("Content-Type") != "application/json" || w.Header().Get("Content-Disposition") != "" {
+			t.Fatalf("returned content type %q and disposition %q expected JSON", w.Header().Get("Content-Type"), w.Header().Get("Content-Disposition"))
+		}
+		var sig dataSignature
+		if err := json.Unmarshal(w.Body.Bytes(), &sig); err != nil {
+			t.Fatal(err)
+		}
+		if sig.Signature != "c2lnbmF0dXJl" || sig.SignerID != "extensions-ecdsa" {
+			t.Fatalf("returned %+v expected the detached signature", sig)
+		}
+	})
+
+	for _, tt := range []struct {
+		name           string
+		auth           authorization
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"token without the flag", testConf.Authorizations[2], http.StatusForbidden, "detached_not_allowed"},
+		{"COSE signatures", testConf.Authorizations[1], http.StatusBadRequest, "detached_not_supported"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useMockAutographClient(t)
+			req := newMultipartSignRequest(t, tt.auth.ClientToken, []byte("unsigned"))
+			req.URL.RawQuery = "detached=true"
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			var body errorResponse
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.expectedStatus || body.Code != tt.expectedCode {
+				t.Fatalf("returned %d %q expected %d %q", w.Code, body.Code, tt.expectedStatus, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func Test_allowedDetached(t *testing.T) {
+	apk := currentConf().Authorizations[2]
+	apk.AllowDetached = true
+	if err := allowedDetached(apk, signingParams{}); err == nil {
+		t.Fatal("allowedDetached() of an apk token returned no error")
+	}
+	if field, _ := checkAuthFields(apk); field != "allow_detached" {
+		t.Fatalf("checkAuthFields() of an apk token allowing detached signatures failed on %q", field)
+	}
+	data := authorization{Signer: "data", SignatureType: signatureTypeData, AllowDetached: true}
+	if err := allowedDetached(data, signingParams{}); err != nil {
+		t.Fatalf("allowedDetached() of a data token returned %v", err)
+	}
+	xpi := authorization{Signer: "extensions-ecdsa", AddonID: "myaddon@allizom.org", AllowDetached: true}
+	if err := allowedDetached(xpi, signingParams{COSEAlgorithms: []string{"ES256"}}); err == nil {
+		t.Fatal("allowedDetached() of a request with COSE algorithms returned no error")
+	}
+}
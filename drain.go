@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// draining is set by POST /__drain__ to take the node out of the
+	// load balancer rotation while it keeps serving requests
+	draining atomic.Bool
+
+	// signingInFlight counts the signing requests being processed,
+	// whatever the metrics backend
+	signingInFlight atomic.Int64
+)
+
+// outOfRotation returns whether the heartbeats fail so that the load
+// balancers stop sending traffic, while draining or shutting down
+func outOfRotation() bool {
+	return draining.Load() || shuttingDown.Load()
+}
+
+// drainStatus is returned by /__drain__. Drained is set once a
+// draining node has no signing request in flight, and it can be
+// terminated.
+type drainStatus struct {
+	Draining bool  `json:"draining"`
+	InFlight int64 `json:"in_flight"`
+	Drained  bool  `json:"drained"`
+}
+
+// drainHandler starts draining the node on POST, making the heartbeats
+// fail while the signing requests are still served, and returns the
+// drain status on POST and GET. Requests without the admin token get a
+// 404 like configHandler.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodPost) || !isAdmin(r, currentConf().AdminToken) {
+		notFoundHandler(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && !draining.Swap(true) {
+		log.Infof("drain requested over HTTP, failing the heartbeats with %d signing requests in flight", signingInFlight.Load())
+	}
+	st := drainStatus{Draining: draining.Load(), InFlight: signingInFlight.Load()}
+	st.Drained = st.Draining && st.InFlight == 0
+	body, err := json.Marshal(st)
+	if err != nil {
+		log.Errorf("failed to marshal drain status: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestDrainHandler(t *testing.T) {
+	const adminToken = "0a6bf3e5d0c44a1f8e9b7c2d6f5a4e3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f"
+	testConf := currentConf()
+	testConf.AdminToken = adminToken
+	useTestConf(t, testConf)
+	t.Cleanup(func() { draining.Store(false) })
+
+	drain := func(method, token string) (*httptest.ResponseRecorder, drainStatus) {
+		t.Helper()
+		req := httptest.NewRequest(method, "http://localhost:8080/__drain__", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		drainHandler(w, req)
+		var st drainStatus
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, st
+	}
+	lbHeartbeat := func() int {
+		w := httptest.NewRecorder()
+		lbHeartbeatHandler(w, httptest.NewRequest("GET", "http://localhost:8080/__lbheartbeat__", nil))
+		return w.Code
+	}
+
+	for _, token := range []string{"", testConf.Authorizations[0].ClientToken} {
+		if w, _ := drain("POST", token); w.Code != http.StatusNotFound {
+			t.Fatalf("drain without the admin token returned %d expected a 404", w.Code)
+		}
+	}
+	if _, st := drain("GET", adminToken); st.Draining || st.Drained {
+		t.Fatalf("reported %+v before draining", st)
+	}
+	if lb := lbHeartbeat(); lb != http.StatusOK {
+		t.Fatalf("lbheartbeat returned %d before draining", lb)
+	}
+
+	// a signing request accepted before the drain is still in flight
+	release := make(chan struct{})
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		<-release
+		return newSignedFileResponse([]byte("signed")), nil
+	})
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned")))
+		done <- w
+	}()
+	for deadline := time.Now().Add(5 * time.Second); signingInFlight.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("signing request never started")
+		}
+	}
+
+	w, st := drain("POST", adminToken)
+	if w.Code != http.StatusOK || !st.Draining || st.InFlight != 1 || st.Drained {
+		t.Fatalf("drain returned %d %+v expected draining with 1 request in flight", w.Code, st)
+	}
+	// the heartbeat fails without checking the backends
+	hb := httptest.NewRecorder()
+	heartbeatHandler(nil)(hb, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+	if lb := lbHeartbeat(); lb != http.StatusServiceUnavailable || hb.Code != http.StatusServiceUnavailable {
+		t.Fatalf("heartbeats returned %d and %d while draining expected 503s", lb, hb.Code)
+	}
+
+	close(release)
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Fatalf("in-flight signing request returned %d %s while draining", w.Code, w.Body.String())
+	}
+	if _, st := drain("GET", adminToken); !st.Draining || st.InFlight != 0 || !st.Drained {
+		t.Fatalf("reported %+v expected drained once the request completed", st)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// expandEnv replaces the ${NAME} references in s with the value of the
+// environment variable NAME and $$ with a literal $. Other dollar signs,
+// like those of bcrypt hashes, are left as is. It returns an error when
+// a referenced variable is unset.
+func expandEnv(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[i+2:]
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", errors.Errorf("unterminated environment variable reference in %q", s[i:])
+			}
+			name := s[i+2 : i+end]
+			if !isEnvName(name) {
+				return "", errors.Errorf("invalid environment variable name %q", name)
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return "", errors.Errorf("environment variable %s is not set", name)
+			}
+			b.WriteString(value)
+			s = s[i+end+1:]
+		default:
+			b.WriteByte('$')
+			s = s[i+1:]
+		}
+	}
+}
+
+// isEnvName returns whether name is a valid environment variable name
+func isEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// expandConfigEnv expands the environment variable references of the
+// fields of c that hold secrets or upstream URLs, so they don't have to
+// be written to the configuration file
+func (c *configuration) expandConfigEnv() (err error) {
+	for i := range c.BaseURLs {
+		if c.BaseURLs[i], err = expandEnv(c.BaseURLs[i]); err != nil {
+			return errors.Wrap(err, "failed to expand autograph base url")
+		}
+	}
+	if c.AdminToken, err = expandEnv(c.AdminToken); err != nil {
+		return errors.Wrap(err, "failed to expand admin token")
+	}
+	if c.ServiceCredential.Key, err = expandEnv(c.ServiceCredential.Key); err != nil {
+		return errors.Wrap(err, "failed to expand service credential key")
+	}
+	for i := range c.Authorizations {
+		auth := &c.Authorizations[i]
+		if auth.ClientToken, err = expandEnv(auth.ClientToken); err != nil {
+			return errors.Wrapf(err, "failed to expand client token of authorization %d", i)
+		}
+		if auth.Key, err = expandEnv(auth.Key); err != nil {
+			return errors.Wrapf(err, "failed to expand hawk key of authorization %d", i)
+		}
+	}
+	return nil
+}
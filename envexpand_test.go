@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_expandEnv(t *testing.T) {
+	t.Setenv("EDGE_TEST_SECRET", "s3cret")
+	testcases := []struct {
+		input       string
+		expected    string
+		expectedErr string
+	}{
+		{"plain", "plain", ""},
+		{"${EDGE_TEST_SECRET}", "s3cret", ""},
+		{"http://${EDGE_TEST_SECRET}.example.com/", "http://s3cret.example.com/", ""},
+		{"$${EDGE_TEST_SECRET}", "${EDGE_TEST_SECRET}", ""},
+		{"cost$$", "cost$", ""},
+		{"$2a$10$N9qo8uLOickgx2ZMRZoMye", "$2a$10$N9qo8uLOickgx2ZMRZoMye", ""},
+		{"trailing $", "trailing $", ""},
+		{"${EDGE_TEST_UNSET}", "", "environment variable EDGE_TEST_UNSET is not set"},
+		{"${EDGE_TEST_SECRET", "", "unterminated"},
+		{"${1NVALID}", "", "invalid environment variable name"},
+	}
+	for _, testcase := range testcases {
+		got, err := expandEnv(testcase.input)
+		if testcase.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), testcase.expectedErr) {
+				t.Errorf("expandEnv(%q) returned error %v expected %q", testcase.input, err, testcase.expectedErr)
+			}
+			continue
+		}
+		if err != nil || got != testcase.expected {
+			t.Errorf("expandEnv(%q) = %q, %v expected %q", testcase.input, got, err, testcase.expected)
+		}
+	}
+}
+
+func Test_loadAndValidateConfExpandsEnv(t *testing.T) {
+	const token = "3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4"
+	t.Setenv("EDGE_TEST_CLIENT_TOKEN", token)
+	t.Setenv("EDGE_TEST_HAWK_KEY", "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu")
+	t.Setenv("EDGE_TEST_AUTOGRAPH_HOST", "localhost:8000")
+	path := t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://${EDGE_TEST_AUTOGRAPH_HOST}/
+authorizations:
+    - client_token: ${EDGE_TEST_CLIENT_TOKEN}
+      user: bob
+      key: ${EDGE_TEST_HAWK_KEY}
+      signer: extensions-ecdsa
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadAndValidateConf(path, "")
+	if err != nil {
+		t.Fatalf("loadAndValidateConf() returned error: %v", err)
+	}
+	if c.BaseURLs[0] != "http://localhost:8000/" {
+		t.Fatalf("loadAndValidateConf() base URL got %q", c.BaseURLs[0])
+	}
+	useTestConf(t, c)
+	auth, err := authorize(token)
+	if err != nil {
+		t.Fatalf("authorize() of the expanded token returned error: %v", err)
+	}
+	if auth.Key != "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu" {
+		t.Fatalf("authorize() returned unexpanded key %q", auth.Key)
+	}
+
+	t.Setenv("EDGE_TEST_CLIENT_TOKEN", "")
+	if err := os.Unsetenv("EDGE_TEST_CLIENT_TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAndValidateConf(path, ""); err == nil || !strings.Contains(err.Error(), "EDGE_TEST_CLIENT_TOKEN is not set") {
+		t.Fatalf("loadAndValidateConf() with an unset variable returned error %v", err)
+	}
+}
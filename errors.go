@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errMissingToken         = errors.New("missing authorization header")
+	errMalformedBearerToken = errors.New("malformed bearer token")
+	errRateLimited          = errors.New("rate limit exceeded")
+	errConcurrencyLimited   = errors.New("too many concurrent requests for this token")
+	errSignerDisabled       = errors.New("signer is temporarily disabled")
+	errPayloadTooLarge      = errors.New("request body too large")
+	errInvalidFormData      = errors.New("failed to read form data")
+	errInvalidInput         = errors.New("failed to read input")
+	errInvalidGzip          = errors.New("failed to decompress gzip request body")
+	errBodyReadTimeout      = errors.New("timed out reading the request body")
+	errChecksumMismatch     = errors.New("input does not match the X-Content-SHA256 header")
+	errInputURLNotAllowed   = errors.New("input url is not allowed for this token")
+	errInputURLFailed       = errors.New("failed to fetch input url")
+	errUpstreamFailed       = errors.New("failed to call autograph for signature")
+	errUpstreamTimeout      = errors.New("timed out waiting for autograph")
+	errUpstreamRejected     = errors.New("autograph rejected the request")
+	errUpstreamRateLimited  = errors.New("autograph is rate limiting requests")
+	errCircuitOpen          = errors.New("signer is temporarily unavailable after repeated upstream failures")
+	errUpstreamBusy         = errors.New("too many requests in flight to autograph")
+	errInternal             = errors.New("internal error")
+
+	errCOSEAlgorithmNotAllowed = errors.New("requested COSE algorithm is not allowed for this token")
+	errRawResponseNotAllowed   = errors.New("raw responses are not allowed for this token")
+	errSignatureTypeMismatch   = errors.New("input file type does not match the signature type of the token")
+)
+
+// errorResponse is the JSON envelope of the error responses
+// returned by the signing endpoint
+type errorResponse struct {
+	Error      string `json:"error"`
+	Code       string `json:"code"`
+	RequestID  string `json:"request_id"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+
+	// UpstreamStatus is the status code autograph responded with
+	// when the error comes from it
+	UpstreamStatus int `json:"upstream_status,omitempty"`
+}
+
+// errorCode is the HTTP status and stable code clients can
+// switch on for an error
+type errorCode struct {
+	err    error
+	status int
+	code   string
+}
+
+// errorCodes maps the sentinel errors of the signing endpoint to
+// their HTTP status and code
+var errorCodes = []errorCode{
+	{errInvalidMethod, http.StatusMethodNotAllowed, "invalid_method"},
+	{errGetOnly, http.StatusMethodNotAllowed, "invalid_method"},
+	{errMissingToken, http.StatusUnauthorized, "missing_token"},
+	{errInvalidToken, http.StatusUnauthorized, "invalid_token"},
+	{errTokenExpired, http.StatusUnauthorized, "token_expired"},
+	{errMalformedBearerToken, http.StatusUnauthorized, "invalid_token"},
+	{errMissingTimestamp, http.StatusUnauthorized, "missing_timestamp"},
+	{errInvalidTimestamp, http.StatusUnauthorized, "invalid_timestamp"},
+	{errStaleTimestamp, http.StatusUnauthorized, "stale_timestamp"},
+	{errRateLimited, http.StatusTooManyRequests, "rate_limited"},
+	{errConcurrencyLimited, http.StatusTooManyRequests, "concurrency_limited"},
+	{errSignerDisabled, http.StatusServiceUnavailable, "signer_disabled"},
+	{errSigningDisabled, http.StatusServiceUnavailable, "signing_disabled"},
+	{errMaintenance, http.StatusServiceUnavailable, "maintenance"},
+	{errCOSEAlgorithmNotAllowed, http.StatusForbidden, "cose_algorithm_not_allowed"},
+	{errPKCS7DigestNotAllowed, http.StatusForbidden, "pkcs7_digest_not_allowed"},
+	{errInvalidPKCS7Digest, http.StatusBadRequest, "invalid_pkcs7_digest"},
+	{errCOSEOverrideNotAllowed, http.StatusForbidden, "cose_override_not_allowed"},
+	{errInvalidCOSEOverride, http.StatusBadRequest, "invalid_cose_override"},
+	{errValidityWindowNotAllowed, http.StatusForbidden, "validity_window_not_allowed"},
+	{errInvalidValidityWindow, http.StatusBadRequest, "invalid_validity_window"},
+	{errOutputOptionNotAllowed, http.StatusForbidden, "output_option_not_allowed"},
+	{errUnsupportedOutputOption, http.StatusBadRequest, "unsupported_output_option"},
+	{errRawResponseNotAllowed, http.StatusForbidden, "raw_response_not_allowed"},
+	{errIPNotAllowed, http.StatusForbidden, "ip_not_allowed"},
+	{errSignerNotAllowed, http.StatusForbidden, "signer_not_allowed"},
+	{errKeyIDNotAllowed, http.StatusForbidden, "keyid_not_allowed"},
+	{errAddonIDNotAllowed, http.StatusForbidden, "addon_id_not_allowed"},
+	{errUpstreamSignerNotAllowed, http.StatusInternalServerError, "signer_misconfigured"},
+	{errPayloadTooLarge, http.StatusRequestEntityTooLarge, "payload_too_large"},
+	{errMissingBody, http.StatusBadRequest, "invalid_request"},
+	{errInvalidFormData, http.StatusBadRequest, "invalid_request"},
+	{errInvalidJSONRequest, http.StatusBadRequest, "invalid_request"},
+	{errInvalidInput, http.StatusBadRequest, "invalid_request"},
+	{errInvalidGzip, http.StatusBadRequest, "invalid_gzip"},
+	{errBodyReadTimeout, http.StatusRequestTimeout, "body_read_timeout"},
+	{errChecksumMismatch, http.StatusBadRequest, "checksum_mismatch"},
+	{errMissingRequiredHeader, http.StatusBadRequest, "missing_required_header"},
+	{errInvalidMetadata, http.StatusBadRequest, "invalid_metadata"},
+	{errInvalidMaxRetries, http.StatusBadRequest, "invalid_max_retries"},
+	{errSignatureTypeMismatch, http.StatusBadRequest, "signature_type_mismatch"},
+	{errContentTypeNotAllowed, http.StatusUnsupportedMediaType, "content_type_not_allowed"},
+	{errTooManyMultipartParts, http.StatusRequestEntityTooLarge, "too_many_multipart_parts"},
+	{errMultipartTooLarge, http.StatusRequestEntityTooLarge, "multipart_too_large"},
+	{errInvalidPartHeaders, http.StatusBadRequest, "invalid_part_headers"},
+	{errTooManyBatchParts, http.StatusBadRequest, "too_many_batch_parts"},
+	{errDuplicateBatchPart, http.StatusBadRequest, "duplicate_batch_part"},
+	{errBatchDryRun, http.StatusBadRequest, "invalid_request"},
+	{errBatchRaw, http.StatusBadRequest, "invalid_request"},
+	{errBatchDetached, http.StatusBadRequest, "invalid_request"},
+	{errDetachedNotAllowed, http.StatusForbidden, "detached_not_allowed"},
+	{errDetachedNotSupported, http.StatusBadRequest, "detached_not_supported"},
+	{errInvalidTarPartName, http.StatusBadRequest, "invalid_part_name"},
+	{errMissingNonce, http.StatusBadRequest, "missing_nonce"},
+	{errInvalidNonce, http.StatusBadRequest, "invalid_nonce"},
+	{errNonceReused, http.StatusConflict, "nonce_reused"},
+	{errInvalidIdempotencyKey, http.StatusBadRequest, "invalid_idempotency_key"},
+	{errIdempotencyKeyReused, http.StatusConflict, "idempotency_key_reused"},
+	{errIdempotencyKeyInProgress, http.StatusConflict, "idempotency_key_in_progress"},
+	{errInputURLNotAllowed, http.StatusForbidden, "input_url_not_allowed"},
+	{errInputURLFailed, http.StatusBadGateway, "input_url_failed"},
+	{errInvalidOptions, http.StatusBadRequest, "invalid_options"},
+	{errUpstreamFailed, http.StatusBadGateway, "upstream_error"},
+	{errUpstreamTimeout, http.StatusGatewayTimeout, "timeout"},
+	{errUpstreamRejected, http.StatusUnprocessableEntity, "upstream_rejected"},
+	{errUpstreamRateLimited, http.StatusTooManyRequests, "upstream_rate_limited"},
+	{errCircuitOpen, http.StatusServiceUnavailable, "circuit_open"},
+	{errOverloaded, http.StatusServiceUnavailable, "overloaded"},
+	{errUpstreamBusy, http.StatusServiceUnavailable, "upstream_busy"},
+	{errAutographBadStatusCode, http.StatusBadGateway, "upstream_error"},
+	{errAutographBadResponseCount, http.StatusBadGateway, "upstream_error"},
+	{errAutographEmptyResponse, http.StatusBadGateway, "upstream_error"},
+	{errIncompleteXPISignature, http.StatusBadGateway, "incomplete_signature"},
+	{errInvalidSignedAPK, http.StatusBadGateway, "invalid_signed_apk"},
+	{errOutputTooLarge, http.StatusBadGateway, "output_too_large"},
+	{errVerifyNotSupported, http.StatusBadRequest, "verify_not_supported"},
+	{errVerifyNotEnabled, http.StatusBadRequest, "verify_not_enabled"},
+}
+
+// lookupErrorCode returns the HTTP status and code of err, defaulting
+// to an internal error for errors missing from the errorCodes table
+func lookupErrorCode(err error) errorCode {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec
+		}
+	}
+	return errorCode{errInternal, http.StatusInternalServerError, "internal_error"}
+}
+
+// writeSigningError returns the JSON error envelope of err to the client
+func writeSigningError(w http.ResponseWriter, r *http.Request, err error) {
+	ec := lookupErrorCode(err)
+	if ec.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", wwwAuthenticate(err))
+	}
+	writeErrorResponse(w, r, ec.status, errorResponse{
+		Error:     ec.err.Error(),
+		Code:      ec.code,
+		RequestID: getRequestID(r),
+	})
+}
+
+// maxUpstreamErrorLength bounds the autograph error message relayed
+// to clients
+const maxUpstreamErrorLength = 1024
+
+// upstreamStatusError is returned when autograph responds to a
+// signing request with an unexpected status code
+type upstreamStatusError struct {
+	StatusCode int
+
+	// Message is the error autograph returned, if any
+	Message string
+
+	// RetryAfter is the number of seconds autograph asked to wait
+	// before retrying a 429, or 0 when it didn't say
+	RetryAfter int
+}
+
+func (e *upstreamStatusError) Error() string {
+	msg := errAutographBadStatusCode.Error() + ": " + http.StatusText(e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *upstreamStatusError) Unwrap() error {
+	return errAutographBadStatusCode
+}
+
+// rejectsInput returns whether autograph responded with a status
+// rejecting the content of the signing request. Other 4xx like a 401
+// or 403 for bad hawk credentials are edge misconfigurations.
+func (e *upstreamStatusError) rejectsInput() bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge,
+		http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// newUpstreamStatusError returns the error of an autograph response
+// with status code and body. Autograph errors are plain text, but a
+// JSON body with an error or message field is also understood.
+func newUpstreamStatusError(status int, body []byte) *upstreamStatusError {
+	var jsonErr struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	msg := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &jsonErr) == nil {
+		if jsonErr.Error != "" {
+			msg = jsonErr.Error
+		} else if jsonErr.Message != "" {
+			msg = jsonErr.Message
+		}
+	}
+	if len(msg) > maxUpstreamErrorLength {
+		msg = msg[:maxUpstreamErrorLength]
+	}
+	return &upstreamStatusError{StatusCode: status, Message: msg}
+}
+
+// parseRetryAfter returns the number of seconds to wait of a Retry-After
+// header value, either a number of seconds or an HTTP date, rounded up.
+// It is 0 when the value is missing or invalid.
+func parseRetryAfter(value string, now time.Time) int {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return seconds
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+	return retryAfterSeconds(date.Sub(now))
+}
+
+// writeUpstreamStatusError returns the error of an autograph response
+// to the client. When autograph rejected the content of the request its
+// message is relayed with a 422 so clients can tell a bad file from an
+// outage or a misconfiguration, which still get a 502. When autograph
+// rate limits the edge, clients get a 429 with its Retry-After so they
+// back off too.
+func writeUpstreamStatusError(w http.ResponseWriter, r *http.Request, statusErr *upstreamStatusError) {
+	status, resp := upstreamStatusErrorResponse(statusErr, getRequestID(r))
+	if resp.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(resp.RetryAfter))
+	}
+	writeErrorResponse(w, r, status, resp)
+}
+
+// upstreamStatusErrorResponse returns the status and error envelope
+// writeUpstreamStatusError returns for statusErr
+func upstreamStatusErrorResponse(statusErr *upstreamStatusError, requestID string) (int, errorResponse) {
+	if statusErr.StatusCode == http.StatusTooManyRequests {
+		ec := lookupErrorCode(errUpstreamRateLimited)
+		return ec.status, errorResponse{
+			Error:          ec.err.Error(),
+			Code:           ec.code,
+			RequestID:      requestID,
+			RetryAfter:     statusErr.RetryAfter,
+			UpstreamStatus: statusErr.StatusCode,
+		}
+	}
+	if !statusErr.rejectsInput() {
+		ec := lookupErrorCode(errUpstreamFailed)
+		return ec.status, errorResponse{
+			Error:          ec.err.Error(),
+			Code:           ec.code,
+			RequestID:      requestID,
+			UpstreamStatus: statusErr.StatusCode,
+		}
+	}
+	ec := lookupErrorCode(errUpstreamRejected)
+	msg := ec.err.Error()
+	if statusErr.Message != "" {
+		msg += ": " + statusErr.Message
+	}
+	return ec.status, errorResponse{
+		Error:          msg,
+		Code:           ec.code,
+		RequestID:      requestID,
+		UpstreamStatus: statusErr.StatusCode,
+	}
+}
+
+// writeSignatureTypeMismatch returns a 400 telling the client the input
+// looks like a detected file while the token signs sigType files
+func writeSignatureTypeMismatch(w http.ResponseWriter, r *http.Request, detected, sigType string) {
+	ec := lookupErrorCode(errSignatureTypeMismatch)
+	writeErrorResponse(w, r, ec.status, errorResponse{
+		Error:     signatureTypeMismatchMessage(detected, sigType),
+		Code:      ec.code,
+		RequestID: getRequestID(r),
+	})
+}
+
+func signatureTypeMismatchMessage(detected, sigType string) string {
+	return fmt.Sprintf("%s: the input looks like an %s but the token signs %s files", errSignatureTypeMismatch.Error(), detected, sigType)
+}
+
+// writeRateLimitResponse returns a 429 telling the client how many
+// seconds to wait before retrying
+func writeRateLimitResponse(w http.ResponseWriter, r *http.Request, retryAfterSeconds int) {
+	ec := lookupErrorCode(errRateLimited)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	writeErrorResponse(w, r, ec.status, errorResponse{
+		Error:      ec.err.Error(),
+		Code:       ec.code,
+		RequestID:  getRequestID(r),
+		RetryAfter: retryAfterSeconds,
+	})
+}
+
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, resp errorResponse) {
+	log.WithFields(log.Fields{
+		"code":  status,
+		"error": resp.Code,
+		"rid":   resp.RequestID,
+	}).Error(resp.Error)
+
+	// when nginx is in front of go, nginx requires that the entire
+	// request body is read before writing a response.
+	// https://github.com/golang/go/issues/15789
+	if r.Body != nil {
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Fatalf("failed to marshal error response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// authRealm is the realm of the WWW-Authenticate challenge of 401s
+const authRealm = "autograph-edge"
+
+// wwwAuthenticate returns the challenge of a 401 for err in the bearer
+// scheme, the only named scheme tokens can be sent with. As in RFC 6750,
+// the error is only set when a token was presented, and is
+// invalid_request when the token is valid but the request timestamp isn't.
+func wwwAuthenticate(err error) string {
+	if errors.Is(err, errMissingToken) {
+		return fmt.Sprintf("Bearer realm=%q", authRealm)
+	}
+	if errors.Is(err, errMissingTimestamp) || errors.Is(err, errInvalidTimestamp) || errors.Is(err, errStaleTimestamp) {
+		return fmt.Sprintf("Bearer realm=%q, error=\"invalid_request\"", authRealm)
+	}
+	return fmt.Sprintf("Bearer realm=%q, error=\"invalid_token\"", authRealm)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func Test_writeSigningError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:           "invalid token",
+			err:            errInvalidToken,
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "invalid_token",
+		},
+		{
+			name:           "payload too large",
+			err:            errPayloadTooLarge,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+			expectedCode:   "payload_too_large",
+		},
+		{
+			name:           "wrapped upstream error",
+			err:            errors.Wrap(errAutographBadStatusCode, "signing failed"),
+			expectedStatus: http.StatusBadGateway,
+			expectedCode:   "upstream_error",
+		},
+		{
+			name:           "unknown error",
+			err:            errors.New("spam"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   "internal_error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := addToContext(httptest.NewRequest("POST", "http://localhost:8080/sign", nil), contextKeyRequestID, "abcdef")
+			w := httptest.NewRecorder()
+			writeSigningError(w, req, tt.err)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+			if w.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("returned unexpected content type %q", w.Header().Get("Content-Type"))
+			}
+			var resp errorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tt.expectedCode {
+				t.Fatalf("returned unexpected code %q expected %q", resp.Code, tt.expectedCode)
+			}
+			if resp.RequestID != "abcdef" {
+				t.Fatalf("returned unexpected request_id %q expected %q", resp.RequestID, "abcdef")
+			}
+			if resp.Error == "" {
+				t.Fatal("returned an empty error message")
+			}
+		})
+	}
+}
+
+func Test_wwwAuthenticate(t *testing.T) {
+	testcases := []struct {
+		err      error
+		expected string
+	}{
+		{errMissingToken, `Bearer realm="autograph-edge"`},
+		{errors.Wrap(errMissingToken, "no Authorization header"), `Bearer realm="autograph-edge"`},
+		{errInvalidToken, `Bearer realm="autograph-edge", error="invalid_token"`},
+		{errMalformedBearerToken, `Bearer realm="autograph-edge", error="invalid_token"`},
+	}
+	for i, testcase := range testcases {
+		if got := wwwAuthenticate(testcase.err); got != testcase.expected {
+			t.Errorf("testcase %d: wwwAuthenticate(%v) returned %q expected %q", i, testcase.err, got, testcase.expected)
+		}
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		value    string
+		expected int
+	}{
+		{"", 0},
+		{"30", 30},
+		{" 5 ", 5},
+		{"-1", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, testcase := range testcases {
+		if got := parseRetryAfter(testcase.value, now); got != testcase.expected {
+			t.Errorf("parseRetryAfter(%q) returned %d expected %d", testcase.value, got, testcase.expected)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// filenameHeader optionally carries the name of the uploaded file,
+// returned in the Content-Disposition of the signed file
+const filenameHeader = "X-Filename"
+
+// inputFilename returns the name the client gave the file to sign, from
+// the filename header, the name of the uploaded file or the path of the
+// input URL, in that order. It is empty when none is set.
+func inputFilename(r *http.Request) string {
+	if name := r.Header.Get(filenameHeader); name != "" {
+		return name
+	}
+	if r.MultipartForm != nil {
+		if files := r.MultipartForm.File["input"]; len(files) > 0 && files[0].Filename != "" {
+			return files[0].Filename
+		}
+	}
+	if u, err := url.Parse(r.FormValue(inputURLField)); err == nil && u.Path != "" {
+		return path.Base(u.Path)
+	}
+	return ""
+}
+
+// sanitizeFilename returns the last element of name with control
+// characters removed, so it cannot point outside the download
+// directory of the client. It returns an empty string for names
+// left empty or made of dots.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimSpace(path.Base(name))
+	if strings.Trim(name, ".") == "" || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// signedFilename returns the name of the signed file of the input
+// named name, defaulting to one derived from the signer
+func signedFilename(auth authorization, name string) string {
+	name = sanitizeFilename(name)
+	if name != "" {
+		return name
+	}
+	signer := sanitizeFilename(auth.Signer)
+	if signer == "" {
+		signer = "signed"
+	}
+	return signer + "-signed." + auth.signatureType()
+}
+
+// contentDisposition returns the Content-Disposition header offering
+// the signed file as a download named filename
+func contentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func Test_sanitizeFilename(t *testing.T) {
+	testcases := []struct {
+		name     string
+		expected string
+	}{
+		{"app-release.apk", "app-release.apk"},
+		{"../../etc/cron.d/evil.xpi", "evil.xpi"},
+		{"..\\..\\evil.xpi", "evil.xpi"},
+		{"/abs/path/addon.xpi", "addon.xpi"},
+		{"new\r\nline\x00.xpi", "newline.xpi"},
+		{"..", ""},
+		{"../", ""},
+		{"", ""},
+	}
+	for _, testcase := range testcases {
+		if got := sanitizeFilename(testcase.name); got != testcase.expected {
+			t.Errorf("sanitizeFilename(%q) returned %q expected %q", testcase.name, got, testcase.expected)
+		}
+	}
+}
+
+// newNamedSignRequest returns a signing request uploading input
+// as a file named filename
+func newNamedSignRequest(t *testing.T, token, filename string, input []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("input", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(input)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", token)
+	return req
+}
+
+func TestSigHandlerContentDisposition(t *testing.T) {
+	auth := currentConf().Authorizations[2]
+	testcases := []struct {
+		name       string
+		uploadName string
+		header     string
+		expected   string
+	}{
+		{"uploaded file name", "app-release.apk", "", `attachment; filename=app-release.apk`},
+		{"header overrides the uploaded name", "input", "my app.apk", `attachment; filename="my app.apk"`},
+		{"path separators are stripped", "input", "../../app-release.apk", `attachment; filename=app-release.apk`},
+		{"default derived from the signer", "..", "", `attachment; filename=testapp-android-signed.apk`},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+
+			req := newNamedSignRequest(t, auth.ClientToken, testcase.uploadName, []byte("unsigned"))
+			if testcase.header != "" {
+				req.Header.Set(filenameHeader, testcase.header)
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusCreated)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != testcase.expected {
+				t.Fatalf("returned Content-Disposition %q expected %q", got, testcase.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// contextKeyForwardedHeaders is the identifier of the request headers
+// forwarded to autograph in a context
+var contextKeyForwardedHeaders = contextKey{name: "forwardedHeaders"}
+
+// hopByHopHeaders only apply to a single connection, so they are never
+// forwarded to autograph even when listed in forward_headers
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upstreamRequestHeaders are set by the edge on the signing requests to
+// autograph, so they can't be forwarded from the client
+var upstreamRequestHeaders = []string{
+	"Authorization",
+	"Content-Length",
+	"Content-Type",
+	"Host",
+	"Traceparent",
+	"Tracestate",
+	"User-Agent",
+	"X-Forwarded-For",
+	"X-Request-Id",
+}
+
+// isHopByHopHeader returns whether name is a hop-by-hop header, either
+// a standard one or one listed in the Connection header of r
+func isHopByHopHeader(r *http.Request, name string) bool {
+	if stringInSlice(name, hopByHopHeaders) {
+		return true
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(token)) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withForwardedHeaders returns r with the values of the headers of
+// names it was sent with in its context, to be copied onto the signing
+// requests to autograph. Hop-by-hop headers, audit metadata headers and
+// the auth header of the client token are always left out.
+func withForwardedHeaders(r *http.Request, names []string, authHeader string) *http.Request {
+	forwarded := http.Header{}
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if isHopByHopHeader(r, name) || name == http.CanonicalHeaderKey(authHeader) || stringInSlice(name, upstreamRequestHeaders) || isMetadataHeader(name) {
+			continue
+		}
+		for _, value := range r.Header.Values(name) {
+			forwarded.Add(name, value)
+		}
+	}
+	if len(forwarded) == 0 {
+		return r
+	}
+	return addToContext(r, contextKeyForwardedHeaders, forwarded)
+}
+
+// setForwardedHeaders copies the forwarded headers of ctx onto req
+func setForwardedHeaders(ctx context.Context, req *http.Request) {
+	forwarded, _ := ctx.Value(contextKeyForwardedHeaders).(http.Header)
+	for name, values := range forwarded {
+		req.Header[name] = append([]string(nil), values...)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerForwardHeaders(t *testing.T) {
+	testConf := currentConf()
+	testConf.ForwardHeaders = []string{"x-autograph-route", "Connection", "X-Hop"}
+	useTestConf(t, testConf)
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		if got := req.Header.Values("X-Autograph-Route"); len(got) != 2 || got[0] != "eu-west" || got[1] != "canary" {
+			t.Errorf("upstream received X-Autograph-Route %q expected both values", got)
+		}
+		for _, name := range []string{"X-Unlisted", "Connection", "X-Hop"} {
+			if got := req.Header.Get(name); got != "" {
+				t.Errorf("upstream received %s %q expected it not to be forwarded", name, got)
+			}
+		}
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "Hawk ") {
+			t.Errorf("upstream received Authorization %q expected a hawk header", req.Header.Get("Authorization"))
+		}
+		return newSignedFileResponse([]byte("signed")), nil
+	})
+	req := newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned"))
+	req.Header.Add("X-Autograph-Route", "eu-west")
+	req.Header.Add("X-Autograph-Route", "canary")
+	req.Header.Set("X-Unlisted", "secret")
+	// listed headers named in Connection are hop-by-hop too
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v: %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_loadAndValidateConfForwardHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		header  string
+		errPart string
+	}{
+		{"X-Autograph Route", "is not a valid header name"},
+		{"content-type", "is set by the edge"},
+		{"X-Edge-Token", "would forward the client tokens"},
+		{"X-Meta-Ticket", "is an audit metadata header"},
+	} {
+		path := t.TempDir() + "/autograph-edge.yaml"
+		err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+auth_header: X-Edge-Token
+forward_headers:
+    - `+tt.header+`
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: testapp-android
+`), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAndValidateConf(path, ""); err == nil || !strings.Contains(err.Error(), tt.errPart) {
+			t.Fatalf("loadAndValidateConf() forwarding %q returned error %v expected %q", tt.header, err, tt.errPart)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gzipBody decompresses a gzip encoded request body
+type gzipBody struct {
+	gz   *gzip.Reader
+	body io.ReadCloser
+}
+
+// newGzipBody returns a reader of the decompressed body, or an
+// error wrapping errInvalidGzip when the gzip header is malformed
+func newGzipBody(body io.ReadCloser) (*gzipBody, error) {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, errors.Wrap(errInvalidGzip, err.Error())
+	}
+	return &gzipBody{gz: gz, body: body}, nil
+}
+
+// Read wraps decompression errors with errInvalidGzip so they can be
+// told apart from other errors reading the request
+func (g *gzipBody) Read(p []byte) (int, error) {
+	n, err := g.gz.Read(p)
+	if err != nil && err != io.EOF {
+		err = errors.Wrap(errInvalidGzip, err.Error())
+	}
+	return n, err
+}
+
+func (g *gzipBody) Close() error {
+	g.gz.Close()
+	return g.body.Close()
+}
+
+// isGzipEncoded returns whether a Content-Encoding header
+// value is gzip
+func isGzipEncoded(contentEncoding string) bool {
+	return strings.EqualFold(strings.TrimSpace(contentEncoding), "gzip")
+}
+
+// acceptsGzip returns whether an Accept-Encoding header value lists
+// gzip without a zero quality
+func acceptsGzip(acceptEncoding string) bool {
+	return acceptsValue(acceptEncoding, "gzip")
+}
+
+// acceptsValue returns whether an Accept or Accept-Encoding header
+// value lists value, compared case-insensitively, without a zero
+// quality
+func acceptsValue(header, value string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), value) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
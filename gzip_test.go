@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// gzipSignRequest compresses the body of a multipart signing request
+func gzipSignRequest(t *testing.T, req *http.Request) *http.Request {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+
+	gzReq := httptest.NewRequest("POST", "http://localhost:8080/sign", &compressed)
+	gzReq.Header = req.Header.Clone()
+	gzReq.Header.Set("Content-Encoding", "gzip")
+	return gzReq
+}
+
+func TestSigHandlerGzipBody(t *testing.T) {
+	const token = "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547"
+
+	t.Run("gzip body is decompressed before signing", func(t *testing.T) {
+		var upstreamInput []byte
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+			var sigReqs []signaturerequest
+			err := json.NewDecoder(req.Body).Decode(&sigReqs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			upstreamInput, _ = base64.StdEncoding.DecodeString(sigReqs[0].Input)
+			return newSignedFileResponse([]byte("signed")), nil
+		})
+
+		w := httptest.NewRecorder()
+		sigHandler(w, gzipSignRequest(t, newMultipartSignRequest(t, token, []byte("unsigned"))))
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusCreated)
+		}
+		if !bytes.Equal(upstreamInput, []byte("unsigned")) {
+			t.Fatalf("upstream received input %q expected %q", upstreamInput, "unsigned")
+		}
+	})
+
+	t.Run("malformed gzip header is a bad request", func(t *testing.T) {
+		req := newMultipartSignRequest(t, token, []byte("unsigned"))
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusBadRequest)
+		}
+		var resp errorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Code != "invalid_gzip" {
+			t.Fatalf("returned unexpected code %q expected invalid_gzip", resp.Code)
+		}
+	})
+
+	t.Run("truncated gzip stream is a bad request", func(t *testing.T) {
+		req := gzipSignRequest(t, newMultipartSignRequest(t, token, bytes.Repeat([]byte("unsigned"), 1024)))
+		body, _ := ioutil.ReadAll(req.Body)
+		truncated := httptest.NewRequest("POST", "http://localhost:8080/sign", bytes.NewReader(body[:len(body)/2]))
+		truncated.Header = req.Header
+		w := httptest.NewRecorder()
+		sigHandler(w, truncated)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("decompressed size is limited", func(t *testing.T) {
+		testConf := currentConf()
+		testConf.MaxUploadBytes = 4096
+		useTestConf(t, testConf)
+
+		// compresses to far less than the limit
+		req := gzipSignRequest(t, newMultipartSignRequest(t, token, bytes.Repeat([]byte("a"), 1<<20)))
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusRequestEntityTooLarge)
+		}
+	})
+}
+
+func TestSigHandlerGzipResponse(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].DisableResponseGzip = true
+	useTestConf(t, testConf)
+	signed := bytes.Repeat([]byte("signed "), 1000)
+
+	t.Run("signed file is gzip compressed for clients accepting it", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(signed), nil)
+		req := newMultipartSignRequest(t, testConf.Authorizations[0].ClientToken, []byte("unsigned"))
+		req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned unexpected status %v: %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("returned headers %v expected a gzip encoding varying on Accept-Encoding", w.Header())
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("response is not gzip decodable: %v", err)
+		}
+		if !bytes.Equal(body, signed) {
+			t.Fatalf("decompressed %d bytes expected the %d of the signed file", len(body), len(signed))
+		}
+	})
+
+	for _, tt := range []struct {
+		name           string
+		token          string
+		acceptEncoding string
+	}{
+		{"clients not accepting gzip", testConf.Authorizations[0].ClientToken, ""},
+		{"gzip with a zero quality", testConf.Authorizations[0].ClientToken, "gzip;q=0"},
+		{"tokens disabling it", testConf.Authorizations[2].ClientToken, "gzip"},
+	} {
+		t.Run(tt.name+" get the signed file uncompressed", func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(signed), nil)
+			req := newMultipartSignRequest(t, tt.token, []byte("unsigned"))
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), signed) {
+				t.Fatalf("returned %d with headers %v expected the uncompressed signed file", w.Code, w.Header())
+			}
+		})
+	}
+}
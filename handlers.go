@@ -1,91 +1,868 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // sigHandler receives input body must
 // contain a base64 encoded file to sign, and the response body contains a base64 encoded
-// signed file. The Authorization header of the http request must contain a valid token.
+// signed file. The auth header of the http request must contain a valid token.
 func sigHandler(w http.ResponseWriter, r *http.Request) {
-	rid := getRequestID(r)
-	log.WithFields(log.Fields{
+	var (
+		auth            authorization
+		inputSize       int64
+		upstreamLatency time.Duration
+		requiredHeaders map[string]string
+		metadata        map[string]string
+		inputSha256     string
+		sw              *signedFileWriter
+	)
+	// continue the trace of the client, if it sent one
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, "sign", trace.WithSpanKind(trace.SpanKindServer))
+	// the deadline is moved once the token is known when it overrides
+	// the request timeout
+	start, spanCtx := time.Now(), ctx
+	ctx, cancel := context.WithTimeout(ctx, currentConf().RequestTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+	logger := getLogger(r)
+	dryRun := isDryRun(r)
+	if dryRun {
+		logger = logger.WithField("dry_run", true)
+	}
+	// bound the time a slow client can hold the connection sending
+	// its upload, which the request timeout doesn't interrupt
+	err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(currentConf().BodyReadTimeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Errorf("failed to set the body read deadline: %v", err)
+	}
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+	requestBody := &countingReadCloser{ReadCloser: r.Body}
+	r.Body = requestBody
+	metrics.InFlight(1)
+	signingInFlight.Add(1)
+	defer func() {
+		signingInFlight.Add(-1)
+		metrics.InFlight(-1)
+		metrics.SigningRequest(auth.Signer, recorder.status, dryRun)
+		metrics.PayloadSize(auth.Signer, requestBody.n, recorder.written)
+		fields := log.Fields{
+			"user":                auth.User,
+			"signer":              auth.Signer,
+			"input_size":          inputSize,
+			"request_bytes":       requestBody.n,
+			"response_bytes":      recorder.written,
+			"upstream_latency_ms": upstreamLatency.Milliseconds(),
+			"status":              recorder.status,
+		}
+		if len(requiredHeaders) > 0 {
+			fields["required_headers"] = requiredHeaders
+		}
+		if len(metadata) > 0 {
+			fields["metadata"] = metadata
+		}
+		logger.WithFields(fields).Info("request completed")
+		if threshold := currentConf().SlowRequestThreshold; threshold > 0 && upstreamLatency > threshold {
+			logger.WithFields(log.Fields{
+				"signer":              auth.Signer,
+				"upstream_latency_ms": upstreamLatency.Milliseconds(),
+				"threshold_ms":        threshold.Milliseconds(),
+				"request_id":          getRequestID(r),
+			}).Warn("slow upstream request")
+		}
+		if auth.User != "" && !dryRun {
+			signerUsage.record(auth.User, auth.Signer, recorder.status, currentConf().UsageWindow)
+			record := auditRecord{
+				Time:        time.Now().UTC(),
+				RequestID:   getRequestID(r),
+				User:        auth.User,
+				Signer:      auth.Signer,
+				InputSHA256: inputSha256,
+				Status:      recorder.status,
+				Metadata:    metadata,
+			}
+			if sw != nil && sw.started {
+				record.OutputSHA256 = fmt.Sprintf("%x", sw.hash.Sum(nil))
+			}
+			auditor.record(record)
+		}
+
+		span.SetAttributes(
+			attribute.String("signer", auth.Signer),
+			attribute.Int("http.status_code", recorder.status),
+		)
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+		span.End()
+	}()
+
+	var clientAddr string
+	if ip, err := clientIP(r); err == nil {
+		clientAddr = ip.String()
+	}
+	logger.WithFields(log.Fields{
+		"client_ip":          clientAddr,
 		"remoteAddressChain": "[" + r.Header.Get("X-Forwarded-For") + "]",
 		"method":             r.Method,
 		"proto":              r.Proto,
 		"url":                r.URL.String(),
 		"ua":                 r.UserAgent(),
-		"rid":                rid,
 	}).Info("request")
 
 	// some sanity checking on the request
+	signer, ok := pathSigner(r)
+	if !ok {
+		notFoundHandler(w, r)
+		return
+	}
+	if !signingEnabled {
+		logger.Error(errSigningDisabled)
+		writeSigningError(w, r, errSigningDisabled)
+		return
+	}
+	if c := currentConf(); c.MaintenanceMode {
+		logger.Error(errMaintenance)
+		writeMaintenanceError(w, r, c.MaintenanceMessage)
+		return
+	}
+	if memory.overloaded(currentConf().MemorySoftLimit) {
+		logger.Error(errOverloaded)
+		writeSigningError(w, r, errOverloaded)
+		return
+	}
 	if r.Method != http.MethodPost {
-		log.WithFields(log.Fields{"rid": rid}).Error("invalid method")
-		httpError(w, r, http.StatusMethodNotAllowed, "invalid method")
+		logger.Error("invalid method")
+		w.Header().Set("Allow", http.MethodPost)
+		writeSigningError(w, r, errInvalidMethod)
 		return
 	}
-	if len(r.Header.Get("Authorization")) < 60 {
-		log.WithFields(log.Fields{"rid": rid}).Error("missing authorization header")
-		httpError(w, r, http.StatusUnauthorized, "missing authorization header")
+	token, err := clientToken(r)
+	if err != nil {
+		logger.Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	if token == "" {
+		logger.Error(errMissingToken)
+		writeSigningError(w, r, errMissingToken)
 		return
 	}
 	// verify auth token
-	auth, err := authorize(r.Header.Get("Authorization"))
+	_, authSpan := tracer().Start(r.Context(), "authorize")
+	auth, err = authorize(token)
+	authSpan.SetAttributes(attribute.String("signer", auth.Signer))
+	endSpan(authSpan, err)
+	if errors.Is(err, errSignerDisabled) || errors.Is(err, errTokenExpired) {
+		logger.WithFields(log.Fields{"user": auth.User, "signer": auth.Signer}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
 	if err != nil {
-		log.WithFields(log.Fields{"rid": rid}).Error(err)
-		httpError(w, r, http.StatusUnauthorized, "not authorized")
+		logger.Error(err)
+		writeSigningError(w, r, errInvalidToken)
 		return
 	}
+	if signer != "" {
+		signer = currentConf().resolveSigner(signer)
+		if !auth.allowsSigner(signer) {
+			logger.WithFields(log.Fields{"user": auth.User, "signer": signer}).Error(errSignerNotAllowed)
+			writeSigningError(w, r, errSignerNotAllowed)
+			return
+		}
+		auth.Signer = signer
+	}
+	if !currentConf().allowsUpstreamSigner(auth.Signer) {
+		logger.WithFields(log.Fields{"user": auth.User, "signer": auth.Signer}).Errorf("MISCONFIGURED TOKEN: refusing to forward to autograph signer %q, which is not an allowed upstream signer", auth.Signer)
+		writeSigningError(w, r, errUpstreamSignerNotAllowed)
+		return
+	}
+	if auth.UpstreamTimeout > 0 {
+		ctx, cancelOverride := context.WithDeadline(spanCtx, start.Add(auth.UpstreamTimeout))
+		defer cancelOverride()
+		r = r.WithContext(ctx)
+	}
+	if err = checkTimestamp(r, auth, time.Now(), currentConf().MaxClockSkew); err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	requiredHeaders, err = auth.requiredHeaderValues(r)
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	metadata, err = auditMetadata(r, currentConf().AuditMetadataHeaders, currentConf().MaxAuditMetadataBytes)
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	nonce, hasNonce, err := requestNonce(r, auth, token)
+	if err == nil && hasNonce {
+		err = seenNonces.use(nonce, currentConf().Nonces.Window, currentConf().Nonces.MaxEntries)
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	if len(auth.AllowedCIDRs) > 0 {
+		ip, err := clientIP(r)
+		if err != nil || !auth.allowsIP(ip) {
+			logger.WithFields(log.Fields{"user": auth.User, "client_ip": ip}).Error(errIPNotAllowed)
+			writeSigningError(w, r, errIPNotAllowed)
+			return
+		}
+	}
+	if auth.RateLimit > 0 {
+		ok, retryAfter := limiter.allow(token, auth.RateLimit)
+		if !ok {
+			logger.WithFields(log.Fields{"user": auth.User}).Error("rate limit exceeded")
+			writeRateLimitResponse(w, r, retryAfterSeconds(retryAfter))
+			return
+		}
+	}
+	if auth.MaxConcurrent > 0 {
+		if !tokenSlots.acquire(token, auth.MaxConcurrent) {
+			logger.WithFields(log.Fields{"user": auth.User, "max_concurrent": auth.MaxConcurrent}).Error(errConcurrencyLimited)
+			writeSigningError(w, r, errConcurrencyLimited)
+			return
+		}
+		defer tokenSlots.release(token)
+	}
 
-	fd, fdHeader, err := r.FormFile("input")
+	maxUploadBytes := currentConf().maxUploadBytes(auth)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if isGzipEncoded(r.Header.Get("Content-Encoding")) {
+		gzBody, err := newGzipBody(r.Body)
+		if err != nil {
+			logger.Error(err)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				writeSigningError(w, r, errBodyReadTimeout)
+				return
+			}
+			writeSigningError(w, r, errInvalidGzip)
+			return
+		}
+		// limit the decompressed size too so a compression bomb
+		// cannot exhaust the memory
+		r.Body = http.MaxBytesReader(w, gzBody, maxUploadBytes)
+		r.Header.Del("Content-Encoding")
+	}
+	readCtx, readSpan := tracer().Start(r.Context(), "read_input")
+	inputHash := sha256.New()
+	var input []byte
+	releaseInput := func() {}
+	batch, err := isBatchRequest(r, currentConf())
+	if err == nil && !batch {
+		input, releaseInput, err = readInput(readCtx, r, auth, maxUploadBytes, inputHash)
+	}
+	defer releaseInput()
+	readSpan.SetAttributes(attribute.Int("input_size", len(input)))
+	endSpan(readSpan, err)
 	if err != nil {
-		log.WithFields(log.Fields{"rid": rid}).Error(err)
-		httpError(w, r, http.StatusBadRequest, "failed to read form data")
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	inputSize = int64(len(input))
+	inputSha256 = fmt.Sprintf("%x", inputHash.Sum(nil))
+	if expected := r.Header.Get(contentSHA256Header); !batch && expected != "" && !strings.EqualFold(strings.TrimSpace(expected), inputSha256) {
+		logger.WithFields(log.Fields{"input_sha256": inputSha256, "expected_sha256": expected}).Error(errChecksumMismatch)
+		writeSigningError(w, r, errChecksumMismatch)
+		return
+	}
+	if sigType := auth.signatureType(); sigType != signatureTypeData {
+		if detected := detectSignatureType(input); detected != "" && detected != sigType {
+			logger.WithFields(log.Fields{"user": auth.User, "signature_type": sigType, "detected_type": detected}).Error(errSignatureTypeMismatch)
+			writeSignatureTypeMismatch(w, r, detected, sigType)
+			return
+		}
+	}
+	if !batch {
+		if err = auth.allowsInput(declaredContentType(r), input); err != nil {
+			logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+			writeSigningError(w, r, err)
+			return
+		}
+	}
+
+	var params signingParams
+	params.COSEAlgorithms, err = allowedCOSEAlgorithms(auth, requestedCOSEAlgorithms(r))
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+
+	params.PKCS7Digest, err = allowedPKCS7Digest(auth, requestedPKCS7Digest(r))
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+
+	params.COSEIssuer, params.COSESubject, err = allowedCOSEOverride(auth, r)
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
 		return
 	}
-	defer fd.Close()
 
-	input := make([]byte, fdHeader.Size)
-	_, err = io.ReadFull(fd, input)
+	params.NotBefore, params.NotAfter, err = allowedValidityWindow(auth, r, time.Now())
 	if err != nil {
-		log.WithFields(log.Fields{"rid": rid}).Error(err)
-		httpError(w, r, http.StatusBadRequest, "failed to read input")
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
 		return
 	}
-	inputSha256 := fmt.Sprintf("%x", sha256.Sum256(input))
+
+	params.Output, err = allowedOutputOption(auth, r, currentConf().OutputOptions)
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+
+	params.KeyID, err = allowedKeyID(auth, requestedKeyID(r))
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+
+	params.AddonID, err = allowedAddonID(auth, requestedAddonID(r))
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+
+	params.MaxAttempts, err = requestedMaxAttempts(r, currentConf().UpstreamMaxAttempts)
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+
+	options, err := requestedOptions(r)
+	if err == nil {
+		params.Options, err = allowedOptions(auth, options)
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	if isRawRequest(r) {
+		if !auth.AllowRawResponse {
+			logger.WithFields(log.Fields{"user": auth.User}).Error(errRawResponseNotAllowed)
+			writeSigningError(w, r, errRawResponseNotAllowed)
+			return
+		}
+		params.Raw = true
+	}
+	if isDetachedRequest(r) {
+		if err = allowedDetached(auth, params); err != nil {
+			logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+			writeSigningError(w, r, err)
+			return
+		}
+		params.Detached = true
+	}
+	idempotencyKey, err := requestIdempotencyKey(r, token)
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+
+	r = withForwardedHeaders(r, currentConf().ForwardHeaders, currentConf().AuthHeader)
+	r = withEdgeClient(r)
 
 	// prepare an x-forwarded-for by reusing the values received and adding the client IP
-	clientip := strings.Split(r.RemoteAddr, ":")
-	xff := strings.Join([]string{
-		r.Header.Get("X-Forwarded-For"),
-		strings.Join(clientip[:len(clientip)-1], ":")},
-		",")
+	xff := forwardedFor(r)
+
+	if batch {
+		if dryRun {
+			writeSigningError(w, r, errBatchDryRun)
+			return
+		}
+		if params.Raw {
+			writeSigningError(w, r, errBatchRaw)
+			return
+		}
+		if params.Detached {
+			writeSigningError(w, r, errBatchDetached)
+			return
+		}
+		signBatch(w, r, auth, params, xff)
+		return
+	}
+	if params.Detached {
+		auth = detachedAuthorization(auth)
+	}
+
+	if dryRun {
+		writeDryRunResponse(w, r, auth, params, input, inputSha256)
+		return
+	}
+
+	sw = &signedFileWriter{w: w, hash: sha256.New(), contentType: "application/octet-stream"}
+	if params.Raw || auth.signatureType() == signatureTypeData {
+		sw.contentType = "application/json"
+	} else {
+		sw.contentDisposition = contentDisposition(signedFilename(auth, inputFilename(r)))
+	}
+	if !auth.DisableResponseGzip {
+		sw.allowGzip = true
+		sw.acceptsGzip = acceptsGzip(r.Header.Get("Accept-Encoding"))
+	}
+
+	c := currentConf()
+	if idempotencyKey != "" {
+		fingerprint, err := responseCacheKey(auth, params, input)
+		if err != nil {
+			logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+			writeSigningError(w, r, errInternal)
+			return
+		}
+		signed, replay, err := idempotentRequests.begin(idempotencyKey, fingerprint, c.Idempotency.Window)
+		if err != nil {
+			logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+			writeSigningError(w, r, err)
+			return
+		}
+		if replay {
+			w.Header().Set("Idempotent-Replayed", "true")
+			sw.Write(signed)
+			sw.close()
+			logger.WithFields(log.Fields{
+				"user":          auth.User,
+				"input_sha256":  inputSha256,
+				"output_sha256": fmt.Sprintf("%x", sw.hash.Sum(nil)),
+			}).Info("replaying signed data of idempotency key")
+			return
+		}
+		defer idempotentRequests.abandon(idempotencyKey)
+	}
+	var cacheKey string
+	if auth.AllowCache {
+		cacheKey, err = responseCacheKey(auth, params, input)
+		if err != nil {
+			logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+			writeSigningError(w, r, errInternal)
+			return
+		}
+		if signed, ok := signedResponses.get(cacheKey); ok {
+			responseCacheRequestsTotal.WithLabelValues("hit").Inc()
+			if sw.writeCached(r, signed, c.ResponseCache.MaxAge) {
+				logger.WithFields(log.Fields{"user": auth.User, "input_sha256": inputSha256}).Info("client holds the cached signed data")
+				return
+			}
+			logger.WithFields(log.Fields{
+				"user":          auth.User,
+				"input_sha256":  inputSha256,
+				"output_sha256": fmt.Sprintf("%x", sw.hash.Sum(nil)),
+			}).Info("returning cached signed data")
+			return
+		}
+		responseCacheRequestsTotal.WithLabelValues("miss").Inc()
+	}
+	// dedup is the autograph call this request leads for the identical
+	// requests of tokens with Deduplicate
+	var dedup *inflightCall
+	if auth.Deduplicate {
+		dedupKey, err := responseCacheKey(auth, params, input)
+		if err != nil {
+			logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+			writeSigningError(w, r, errInternal)
+			return
+		}
+		call, leader := inflightSigns.join(dedupKey)
+		if leader {
+			dedup = call
+			// in case the request ends without an autograph result
+			defer inflightSigns.finish(dedup, nil, errUpstreamFailed)
+		} else {
+			deduplicatedRequestsTotal.WithLabelValues(auth.Signer).Inc()
+			shared, err := call.wait(r.Context())
+			if err == nil {
+				sw.Write(shared)
+				sw.close()
+				logger.WithFields(log.Fields{
+					"user":          auth.User,
+					"input_sha256":  inputSha256,
+					"output_sha256": fmt.Sprintf("%x", sw.hash.Sum(nil)),
+				}).Info("returning signed data shared with a concurrent request")
+				return
+			}
+			// unless the client of the leading request went away, in
+			// which case this one is signed on its own
+			if !errors.Is(err, context.Canceled) || r.Context().Err() != nil {
+				logger.WithFields(log.Fields{"input_sha256": inputSha256}).Errorf("shared signing request failed: %v", err)
+				writeAutographError(w, r, err)
+				return
+			}
+		}
+	}
+
+	if c.CircuitBreakerThreshold > 0 && !breakers.allow(auth.Signer, c.CircuitBreakerCooldown) {
+		logger.WithFields(log.Fields{"signer": auth.Signer}).Error("circuit breaker is open")
+		inflightSigns.finish(dedup, nil, errCircuitOpen)
+		writeSigningError(w, r, errCircuitOpen)
+		return
+	}
+	release, err := upstreamSlots.acquire(r.Context(), c.MaxConcurrentUpstream, c.UpstreamQueue, upstreamQueueKeyOf(auth, requestPriority(r, auth)))
+	if err != nil {
+		logger.WithFields(log.Fields{"signer": auth.Signer}).Errorf("no upstream slot available: %v", err)
+		if c.CircuitBreakerThreshold > 0 {
+			breakers.record(auth.Signer, errUpstreamBusy, c.CircuitBreakerThreshold)
+		}
+		inflightSigns.finish(dedup, nil, errUpstreamBusy)
+		writeSigningError(w, r, errUpstreamBusy)
+		return
+	}
+	defer release()
 
 	// let's get this file signed!
-	output, err := callAutograph(auth, input, xff)
+	var out io.Writer = sw
+	var signed bytes.Buffer
+	// the ETag of a cacheable file is only known once it is signed
+	revalidate := cacheKey != "" && c.ResponseCache.MaxAge > 0
+	switch {
+	case revalidate:
+		out = &signed
+	case cacheKey != "" || idempotencyKey != "" || dedup != nil:
+		out = io.MultiWriter(sw, &signed)
+	}
+	upstreamCtx, upstreamSpan := tracer().Start(r.Context(), "autograph", trace.WithSpanKind(trace.SpanKindClient))
+	upstreamSpan.SetAttributes(attribute.String("signer", auth.Signer))
+	upstreamStart := time.Now()
+	var sent int64
+	err = signingWorkers.run(upstreamCtx, func(ctx context.Context) (err error) {
+		// the latency of the call leaves out the wait for a worker
+		upstreamStart = time.Now()
+		sent, err = streamAutograph(ctx, auth, params, input, xff, out, &sw.upstream)
+		return err
+	})
+	upstreamLatency = time.Since(upstreamStart)
+	endSpan(upstreamSpan, err)
+	if c.CircuitBreakerThreshold > 0 {
+		breakers.record(auth.Signer, err, c.CircuitBreakerThreshold)
+	}
+	inflightSigns.finish(dedup, signed.Bytes(), err)
 	if err != nil {
-		log.WithFields(log.Fields{"rid": rid, "input_sha256": inputSha256}).Error(err)
-		httpError(w, r, http.StatusBadGateway, "failed to call autograph for signature")
+		logger.WithFields(log.Fields{"input_sha256": inputSha256}).Error(err)
+		if sw.started {
+			// the status and part of the file were already sent, so
+			// the response must not look complete
+			endPartialResponse(w, r, sw, c.PartialResponse, sent, err)
+			return
+		}
+		writeAutographError(w, r, err)
+		return
+	}
+	notModified := false
+	if revalidate {
+		notModified = sw.writeCached(r, signed.Bytes(), c.ResponseCache.MaxAge)
+	} else {
+		// an empty signed file never wrote the status
+		sw.close()
+	}
+	lastSuccessfulSign.record(auth.Signer, time.Now())
+	if cacheKey != "" {
+		signedResponses.add(cacheKey, signed.Bytes(), c.ResponseCache.TTL, c.ResponseCache.MaxBytes)
+	}
+	if idempotencyKey != "" {
+		idempotentRequests.complete(idempotencyKey, signed.Bytes(), c.Idempotency.Window, c.Idempotency.MaxBytes)
+	}
+	if notModified {
+		logger.WithFields(log.Fields{"user": auth.User, "input_sha256": inputSha256}).Info("client holds the signed data")
 		return
 	}
-	outputSha256 := fmt.Sprintf("%x", sha256.Sum256(output))
 
-	log.WithFields(log.Fields{"rid": rid,
+	logger.WithFields(log.Fields{
 		"user":          auth.User,
 		"input_sha256":  inputSha256,
-		"output_sha256": outputSha256,
+		"output_sha256": fmt.Sprintf("%x", sw.hash.Sum(nil)),
 	}).Info("returning signed data")
+}
+
+// writeAutographError writes the error response of a signing request
+// that failed with err before any of the signed file was sent
+func writeAutographError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeSigningError(w, r, errUpstreamTimeout)
+		return
+	}
+	if errors.Is(err, errIncompleteXPISignature) || errors.Is(err, errInvalidSignedAPK) || errors.Is(err, errOutputTooLarge) ||
+		errors.Is(err, errCircuitOpen) || errors.Is(err, errUpstreamBusy) {
+		writeSigningError(w, r, err)
+		return
+	}
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		writeUpstreamStatusError(w, r, statusErr)
+		return
+	}
+	writeSigningError(w, r, errUpstreamFailed)
+}
+
+// readInput returns the file to sign, uploaded in the input form field
+// or, for tokens allowing it, fetched from the input_url form field.
+// The input is written to inputHash as it is read. Uploads are read
+// into a pooled buffer, handed back by calling release once the input
+// is no longer used.
+func readInput(ctx context.Context, r *http.Request, auth authorization, maxUploadBytes int64, inputHash hash.Hash) (input []byte, release func(), err error) {
+	release = func() {}
+	fd, fdHeader, err := r.FormFile("input")
+	if err != nil {
+		if isMissingInputFile(err) && r.FormValue(inputURLField) != "" {
+			input, err = fetchInputURL(ctx, auth, r.FormValue(inputURLField), maxUploadBytes)
+			inputHash.Write(input)
+			return input, release, err
+		}
+		return nil, release, formError(err)
+	}
+	defer fd.Close()
+
+	input, release = getBodyBuffer(fdHeader.Size, currentConf().BodyBufferSize)
+	_, err = io.ReadFull(io.TeeReader(fd, inputHash), input)
+	if err != nil {
+		release()
+		return nil, func() {}, errors.Wrap(errInvalidInput, err.Error())
+	}
+	return input, release, nil
+}
+
+// formError returns the error of a request whose form could not be read
+func formError(err error) error {
+	if errors.Is(err, errTooManyMultipartParts) || errors.Is(err, errMultipartTooLarge) || errors.Is(err, errInvalidPartHeaders) {
+		return err
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errPayloadTooLarge
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return errBodyReadTimeout
+	}
+	if errors.Is(err, errInvalidGzip) {
+		return errInvalidGzip
+	}
+	return errors.Wrap(errInvalidFormData, err.Error())
+}
+
+// isDryRun returns whether r asks to be validated without being signed
+func isDryRun(r *http.Request) bool {
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get("dryrun"))
+	return err == nil && dryRun
+}
+
+// isRawRequest returns whether r asks for the autograph response
+// instead of the signed file
+func isRawRequest(r *http.Request) bool {
+	raw, err := strconv.ParseBool(r.URL.Query().Get("raw"))
+	return err == nil && raw
+}
+
+// dryRunResponse summarizes what a dry-run request would send to autograph
+type dryRunResponse struct {
+	DryRun      bool        `json:"dry_run"`
+	User        string      `json:"user"`
+	Signer      string      `json:"signer"`
+	InputSize   int         `json:"input_size"`
+	InputSha256 string      `json:"input_sha256"`
+	Options     interface{} `json:"options,omitempty"`
+}
+
+// writeDryRunResponse returns the summary of the signing request that
+// would be sent to autograph, without sending it
+func writeDryRunResponse(w http.ResponseWriter, r *http.Request, auth authorization, params signingParams, input []byte, inputSha256 string) {
+	request, err := newSignatureRequest(auth, params, input)
+	if err != nil {
+		getLogger(r).Error(err)
+		writeSigningError(w, r, errInternal)
+		return
+	}
+	body, err := json.Marshal(dryRunResponse{
+		DryRun:      true,
+		User:        auth.User,
+		Signer:      request.KeyID,
+		InputSize:   len(input),
+		InputSha256: inputSha256,
+		Options:     request.Options,
+	})
+	if err != nil {
+		getLogger(r).Error(err)
+		writeSigningError(w, r, errInternal)
+		return
+	}
+	getLogger(r).WithFields(log.Fields{
+		"user":         auth.User,
+		"input_sha256": inputSha256,
+	}).Info("dry run, not calling autograph")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
 
-	w.Header().Add("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusCreated)
-	w.Write(output)
+// signedFileWriter streams a signed file to the client, sending the
+// success status with the first bytes of the file so that errors
+// happening before it can still be returned as an error response
+type signedFileWriter struct {
+	w           http.ResponseWriter
+	hash        hash.Hash
+	contentType string
+	// contentDisposition names the signed file when set
+	contentDisposition string
+	// allowGzip compresses the signed file for clients acceptsGzip
+	// is set for, which is still hashed uncompressed
+	allowGzip   bool
+	acceptsGzip bool
+	gz          *gzip.Writer
+	started     bool
+	// upstream sets the signer headers of the values of the autograph
+	// response known when the response starts
+	upstream upstreamMetadata
+}
+
+func (sw *signedFileWriter) start() {
+	if sw.started {
+		return
+	}
+	sw.started = true
+	sw.w.Header().Add("Content-Type", sw.contentType)
+	if sw.contentDisposition != "" {
+		sw.w.Header().Set("Content-Disposition", sw.contentDisposition)
+	}
+	sw.upstream.setHeaders(sw.w.Header())
+	if sw.allowGzip {
+		sw.w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if sw.allowGzip && sw.acceptsGzip {
+		sw.w.Header().Set("Content-Encoding", "gzip")
+		sw.gz = gzip.NewWriter(sw.w)
+	}
+	sw.w.WriteHeader(http.StatusCreated)
+}
+
+func (sw *signedFileWriter) Write(p []byte) (int, error) {
+	sw.start()
+	sw.hash.Write(p)
+	if sw.gz != nil {
+		return sw.gz.Write(p)
+	}
+	return sw.w.Write(p)
+}
+
+// close completes the response once the whole signed file is written,
+// sending the status of an empty file and the end of the gzip stream
+func (sw *signedFileWriter) close() error {
+	sw.start()
+	if sw.gz != nil {
+		return sw.gz.Close()
+	}
+	return nil
+}
+
+// contentSHA256Header optionally carries the hex SHA256 of the input,
+// which is checked before it is sent to autograph
+const contentSHA256Header = "X-Content-SHA256"
+
+// bearerPrefix is the Authorization scheme of standard bearer tokens
+const bearerPrefix = "Bearer "
+
+// clientToken returns the token presented in the auth header of r,
+// Authorization unless the live configuration names another, either as
+// the raw header value or with a Bearer scheme
+func clientToken(r *http.Request) (string, error) {
+	header := r.Header.Get(currentConf().AuthHeader)
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return header, nil
+	}
+	token := strings.TrimSpace(header[len(bearerPrefix):])
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", errMalformedBearerToken
+	}
+	return token, nil
+}
+
+// requestedCOSEAlgorithms returns the COSE algorithms requested in the
+// cose_algorithms form values, which can be repeated or comma separated
+func requestedCOSEAlgorithms(r *http.Request) (algs []string) {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	for _, value := range r.MultipartForm.Value["cose_algorithms"] {
+		for _, alg := range strings.Split(value, ",") {
+			alg = strings.TrimSpace(alg)
+			if alg != "" {
+				algs = append(algs, alg)
+			}
+		}
+	}
+	return algs
+}
+
+// allowedCOSEAlgorithms checks that the requested COSE algorithms are
+// allowed for an add-on token and returns them. Tokens that are not for
+// add-ons or don't list algorithms ignore the request and use their
+// default.
+func allowedCOSEAlgorithms(auth authorization, requested []string) ([]string, error) {
+	if auth.AddonID == "" || len(auth.AddonCOSEAlgorithms) == 0 || len(requested) == 0 {
+		return nil, nil
+	}
+	for _, alg := range requested {
+		if !stringInSlice(alg, auth.AddonCOSEAlgorithms) {
+			return nil, errors.Wrapf(errCOSEAlgorithmNotAllowed, "algorithm %q", alg)
+		}
+	}
+	return requested, nil
+}
+
+// stringInSlice returns whether s is one of the strings in list
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfterSeconds rounds a retry delay up to a whole number of seconds
+func retryAfterSeconds(retryAfter time.Duration) int {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
 }
 
 func notFoundHandler(w http.ResponseWriter, r *http.Request) {
@@ -94,17 +871,49 @@ func notFoundHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func versionHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := versionResponse()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to build version: %v", err)
+		return
+	}
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write(jsonVersion)
+	w.Write(body)
+}
+
+// versionResponse returns the fields of version.json with the hash of
+// the live configuration file added as config_sha256
+func versionResponse() ([]byte, error) {
+	version := make(map[string]interface{})
+	err := json.Unmarshal(jsonVersion, &version)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse version.json")
+	}
+	version["config_sha256"] = currentConf().fileSHA256
+	return json.Marshal(version)
+}
+
+// lbHeartbeatHandler tells the load balancer the process is alive
+// without checking the upstream autograph
+func lbHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if outOfRotation() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 type heartbeat struct {
-	Status bool `json:"status"`
-	Checks struct {
-		CheckAutographHeartbeat bool `json:"check_autograph_heartbeat"`
-	} `json:"checks"`
-	Details string `json:"details"`
+	Status  bool            `json:"status"`
+	Checks  map[string]bool `json:"checks"`
+	Details string          `json:"details"`
+
+	// CircuitBreakers is the circuit breaker state of each signer
+	CircuitBreakers map[string]string `json:"circuit_breakers,omitempty"`
+
+	// Age is how many seconds ago the status was checked, set when it
+	// is served from the background poller
+	Age *float64 `json:"age,omitempty"`
 }
 
 func writeHeartbeatResponse(w http.ResponseWriter, st heartbeat) {
@@ -122,33 +931,82 @@ func writeHeartbeatResponse(w http.ResponseWriter, st heartbeat) {
 	w.Write(jsonSt)
 }
 
-// send a GET request to the autograph heartbeat endpoint and
-// evaluate its status code before responding
-func heartbeatHandler(baseURL string, client heartbeatRequester) http.HandlerFunc {
-	var (
-		st           heartbeat
-		heartbeatURL string = baseURL + "__heartbeat__"
-	)
+// send a GET request to the heartbeat endpoint of each autograph backend
+// and evaluate their status codes before responding. The edge is healthy
+// as long as one of the backends is, since requests fail over between them.
+// The backends are read from the live configuration on each request.
+func heartbeatHandler(client heartbeatRequester) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// assume the best, change if we encounter errors
-		st.Status = true
-		st.Checks.CheckAutographHeartbeat = true
-		resp, err := client.Get(heartbeatURL)
-		if err != nil {
-			st.Checks.CheckAutographHeartbeat = false
-			st.Status = false
-			st.Details = fmt.Sprintf("failed to request autograph heartbeat from %s: %v", heartbeatURL, err)
-			writeHeartbeatResponse(w, st)
+		if outOfRotation() {
+			details := "autograph-edge is shutting down"
+			if !shuttingDown.Load() {
+				details = "autograph-edge is draining"
+			}
+			writeHeartbeatResponse(w, heartbeat{
+				Checks:  make(map[string]bool),
+				Details: details,
+			})
 			return
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			st.Checks.CheckAutographHeartbeat = false
-			st.Status = false
-			st.Details = fmt.Sprintf("upstream autograph returned heartbeat code %d %s", resp.StatusCode, resp.Status)
-			writeHeartbeatResponse(w, st)
-			return
+		writeHeartbeatResponse(w, checkHeartbeats(client))
+	}
+}
+
+// checkHeartbeats requests the heartbeat of each autograph backend of the
+// live configuration and returns the status of the edge
+func checkHeartbeats(client heartbeatRequester) heartbeat {
+	st := heartbeat{Checks: make(map[string]bool)}
+	conf := currentConf()
+	var details, reachable []string
+	for _, baseURL := range conf.BaseURLs {
+		ok, detail := checkAutographHeartbeat(baseURL, client)
+		st.Checks[heartbeatCheckName(baseURL)] = ok
+		if ok {
+			st.Status = true
+			reachable = append(reachable, baseURL)
+		} else {
+			details = append(details, detail)
+		}
+	}
+	// rejected credentials only fail the requests of their tokens, so
+	// they are reported without failing the heartbeat
+	if conf.HeartbeatCheckCredentials && len(reachable) > 0 {
+		checks, failures := checkCredentials(conf, reachable, autographClient)
+		for name, ok := range checks {
+			st.Checks[name] = ok
 		}
-		writeHeartbeatResponse(w, st)
+		details = append(details, failures...)
+	}
+	st.Details = strings.Join(details, "; ")
+	if conf.CircuitBreakerThreshold > 0 {
+		st.CircuitBreakers = breakers.states()
+	}
+	return st
+}
+
+// heartbeatCheckName returns the name of the heartbeat check of
+// an autograph backend
+func heartbeatCheckName(baseURL string) string {
+	return "autograph_heartbeat:" + baseURL
+}
+
+// checkAutographHeartbeat requests the heartbeat of the autograph
+// backend at baseURL and returns whether it is healthy, with details
+// of the failure when it is not
+func checkAutographHeartbeat(baseURL string, client heartbeatRequester) (ok bool, details string) {
+	heartbeatURL := baseURL + "__heartbeat__"
+	start := time.Now()
+	resp, err := client.Get(heartbeatURL)
+	metrics.UpstreamDuration("heartbeat", time.Since(start))
+	if err != nil {
+		heartbeatChecksTotal.WithLabelValues("error").Inc()
+		return false, fmt.Sprintf("failed to request autograph heartbeat from %s: %v", heartbeatURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		heartbeatChecksTotal.WithLabelValues("unhealthy").Inc()
+		return false, fmt.Sprintf("upstream autograph returned heartbeat code %d %s", resp.StatusCode, resp.Status)
 	}
+	heartbeatChecksTotal.WithLabelValues("healthy").Inc()
+	return true, ""
 }
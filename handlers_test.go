@@ -2,21 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
 	"github.com/mozilla-services/autograph-edge/mock_main"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 func Test_heartbeatHandler(t *testing.T) {
 	type args struct {
-		baseURL string
-		r       *http.Request
+		baseURLs []string
+		r        *http.Request
 	}
 	type expectedResponse struct {
 		status      int
@@ -33,8 +47,8 @@ func Test_heartbeatHandler(t *testing.T) {
 		{
 			name: "edge heartbeat OK when autograph app returns 200",
 			args: args{
-				baseURL: conf.BaseURL,
-				r:       httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil),
+				baseURLs: conf.BaseURLs,
+				r:        httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil),
 			},
 			upstreamResponse: &http.Response{
 				Status:     http.StatusText(http.StatusOK),
@@ -45,14 +59,14 @@ func Test_heartbeatHandler(t *testing.T) {
 			expectedResponse: expectedResponse{
 				status:      http.StatusOK,
 				contentType: "application/json",
-				body:        []byte("{\"status\":true,\"checks\":{\"check_autograph_heartbeat\":true},\"details\":\"\"}"),
+				body:        []byte("{\"status\":true,\"checks\":{\"autograph_heartbeat:http://localhost:8000/\":true},\"details\":\"\"}"),
 			},
 		},
 		{
 			name: "edge heartbeat 503 when autograph app returns 502",
 			args: args{
-				baseURL: conf.BaseURL,
-				r:       httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil),
+				baseURLs: conf.BaseURLs,
+				r:        httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil),
 			},
 			upstreamResponse: &http.Response{
 				Status:     http.StatusText(http.StatusBadGateway),
@@ -63,21 +77,21 @@ func Test_heartbeatHandler(t *testing.T) {
 			expectedResponse: expectedResponse{
 				status:      http.StatusServiceUnavailable,
 				contentType: "application/json",
-				body:        []byte("{\"status\":false,\"checks\":{\"check_autograph_heartbeat\":false},\"details\":\"upstream autograph returned heartbeat code 502 Bad Gateway\"}"),
+				body:        []byte("{\"status\":false,\"checks\":{\"autograph_heartbeat:http://localhost:8000/\":false},\"details\":\"upstream autograph returned heartbeat code 502 Bad Gateway\"}"),
 			},
 		},
 		{
 			name: "edge heartbeat 503 when autograph app is down",
 			args: args{
-				baseURL: conf.BaseURL,
-				r:       httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil),
+				baseURLs: conf.BaseURLs,
+				r:        httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil),
 			},
 			upstreamResponse: &http.Response{},
 			upstreamErr:      fmt.Errorf("Get \"http://localhost:8000/__heartbeat__\": dial tcp 127.0.0.1:8000: connect: connection refused <nil>"),
 			expectedResponse: expectedResponse{
 				status:      http.StatusServiceUnavailable,
 				contentType: "application/json",
-				body:        []byte("{\"status\":false,\"checks\":{\"check_autograph_heartbeat\":false},\"details\":\"failed to request autograph heartbeat from http://localhost:8000/__heartbeat__: Get \\\"http://localhost:8000/__heartbeat__\\\": dial tcp 127.0.0.1:8000: connect: connection refused \\u003cnil\\u003e\"}"),
+				body:        []byte("{\"status\":false,\"checks\":{\"autograph_heartbeat:http://localhost:8000/\":false},\"details\":\"failed to request autograph heartbeat from http://localhost:8000/__heartbeat__: Get \\\"http://localhost:8000/__heartbeat__\\\": dial tcp 127.0.0.1:8000: connect: connection refused \\u003cnil\\u003e\"}"),
 			},
 		},
 	}
@@ -89,15 +103,16 @@ func Test_heartbeatHandler(t *testing.T) {
 				defer ctrl.Finish()
 
 				clientMock := mock_main.NewMockheartbeatRequester(ctrl)
-				clientMock.EXPECT().Get(tt.args.baseURL+"__heartbeat__").Return(tt.upstreamResponse, tt.upstreamErr)
+				clientMock.EXPECT().Get(tt.args.baseURLs[0]+"__heartbeat__").Return(tt.upstreamResponse, tt.upstreamErr)
 				client = clientMock
 			} else {
 				client = &heartbeatClient{&http.Client{}}
 			}
 
+			useTestBaseURLs(t, tt.args.baseURLs...)
 			w := httptest.NewRecorder()
 
-			heartbeatHandler(tt.args.baseURL, client)(w, tt.args.r)
+			heartbeatHandler(client)(w, tt.args.r)
 
 			resp := w.Result()
 			body, _ := ioutil.ReadAll(resp.Body)
@@ -127,12 +142,39 @@ func TestVersion(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("returned unexpected status %v expected %v", resp.StatusCode, http.StatusOK)
 	}
-	if !bytes.Equal(body, jsonVersion) {
-		t.Fatalf("failed to return version.json contents got %s and expected %s", body, jsonVersion)
-	}
 	if resp.Header.Get("Content-Type") != "application/json" {
 		t.Fatalf("version returned unexpected content type: %s", resp.Header.Get("Content-Type"))
 	}
+	var version, expected map[string]interface{}
+	err := json.Unmarshal(body, &version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(jsonVersion, &expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, value := range expected {
+		if version[field] != value {
+			t.Fatalf("version %s is %v expected %v from version.json", field, version[field], value)
+		}
+	}
+
+	confData, err := ioutil.ReadFile("./autograph-edge.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHash := fmt.Sprintf("%x", sha256.Sum256(confData))
+	if version["config_sha256"] != expectedHash {
+		t.Fatalf("version config_sha256 is %v expected %s", version["config_sha256"], expectedHash)
+	}
+
+	// the hash is that of the file, not of the request
+	w = httptest.NewRecorder()
+	versionHandler(w, req)
+	if !bytes.Equal(w.Body.Bytes(), body) {
+		t.Fatalf("second version response %s differs from %s", w.Body.Bytes(), body)
+	}
 }
 
 func TestNotFoundHandler(t *testing.T) {
@@ -153,3 +195,1055 @@ func TestNotFoundHandler(t *testing.T) {
 		t.Fatalf("notFoundHandler returned unexpected content type: %q", resp.Header.Get("Content-Type"))
 	}
 }
+
+// newMultipartSignRequest returns a signing request uploading input
+// as the multipart input file and authorized with token
+func newMultipartSignRequest(t *testing.T, token string, input []byte) *http.Request {
+	return newMultipartSignRequestWithFields(t, token, input, nil)
+}
+
+// newMultipartSignRequestWithFields returns a signing request uploading
+// input as the multipart input file along with form fields
+func newMultipartSignRequestWithFields(t *testing.T, token string, input []byte, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		err := mw.WriteField(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("input", "input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(input)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", token)
+	return req
+}
+
+func TestSigHandlerMaxUploadBytes(t *testing.T) {
+	testConf := currentConf()
+	testConf.MaxUploadBytes = 1024
+	testConf.Authorizations = []authorization{
+		{
+			ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			User:        "alice",
+			Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+			Signer:      "extensions-ecdsa",
+		},
+		{
+			ClientToken:    "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+			User:           "alice",
+			Key:            "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+			Signer:         "testapp-android",
+			MaxUploadBytes: 8192,
+		},
+	}
+	useTestConf(t, testConf)
+
+	tests := []struct {
+		name           string
+		token          string
+		inputSize      int
+		expectedStatus int
+	}{
+		{
+			name:           "upload under the global limit is signed",
+			token:          "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			inputSize:      512,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "upload over the global limit is rejected",
+			token:          "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			inputSize:      2048,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "upload over the global limit but under the signer override is signed",
+			token:          "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+			inputSize:      4096,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "upload over the signer override is rejected",
+			token:          "dd095f88adbf7bdfa18b06e23e83896107d7e0f969f7415830028fa2c1ccf9fd",
+			inputSize:      16384,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+			}
+
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequest(t, tt.token, bytes.Repeat([]byte("a"), tt.inputSize)))
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+func Test_heartbeatHandlerMultipleBackends(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	tests := []struct {
+		name           string
+		baseURLs       []string
+		expectedStatus int
+		expectedChecks map[string]bool
+	}{
+		{
+			name:           "healthy when one backend is up",
+			baseURLs:       []string{broken.URL + "/", up.URL + "/"},
+			expectedStatus: http.StatusOK,
+			expectedChecks: map[string]bool{
+				heartbeatCheckName(broken.URL + "/"): false,
+				heartbeatCheckName(up.URL + "/"):     true,
+			},
+		},
+		{
+			name:           "unhealthy when all backends are down",
+			baseURLs:       []string{broken.URL + "/", broken.URL + "/other/"},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedChecks: map[string]bool{
+				heartbeatCheckName(broken.URL + "/"):       false,
+				heartbeatCheckName(broken.URL + "/other/"): false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestBaseURLs(t, tt.baseURLs...)
+			w := httptest.NewRecorder()
+			heartbeatHandler(&heartbeatClient{&http.Client{}})(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("heartbeatHandler() returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+			var st heartbeat
+			err := json.Unmarshal(w.Body.Bytes(), &st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(st.Checks, tt.expectedChecks) {
+				t.Fatalf("heartbeatHandler() returned checks %v expected %v", st.Checks, tt.expectedChecks)
+			}
+		})
+	}
+}
+
+func TestLBHeartbeat(t *testing.T) {
+	// the mock fails the test if the upstream autograph is called
+	useMockAutographClient(t)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/__lbheartbeat__", nil)
+	w := httptest.NewRecorder()
+	lbHeartbeatHandler(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("returned unexpected status %v expected %v", resp.StatusCode, http.StatusOK)
+	}
+	if len(body) != 0 {
+		t.Fatalf("returned unexpected body %q expected it to be empty", body)
+	}
+}
+
+func TestSigHandlerCOSEAlgorithms(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          string
+		requested      string
+		expectedStatus int
+		expectedAlgs   []string
+	}{
+		{
+			name:           "allowed algorithm is forwarded",
+			token:          "b8c8c00f310c9e160dda75790df6be106e29607fde3c1092287d026c014be880",
+			requested:      "ES256",
+			expectedStatus: http.StatusCreated,
+			expectedAlgs:   []string{"ES256"},
+		},
+		{
+			name:           "algorithm missing from the token list is forbidden",
+			token:          "b8c8c00f310c9e160dda75790df6be106e29607fde3c1092287d026c014be880",
+			requested:      "ES256,PS256",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "token defaults apply when no algorithm is requested",
+			token:          "b8c8c00f310c9e160dda75790df6be106e29607fde3c1092287d026c014be880",
+			expectedStatus: http.StatusCreated,
+			expectedAlgs:   []string{"ES256"},
+		},
+		{
+			name:           "requested algorithms are ignored for tokens without a list",
+			token:          "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+			requested:      "PS256",
+			expectedStatus: http.StatusCreated,
+			expectedAlgs:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []struct {
+				Options xpiOptions
+			}
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					err := json.NewDecoder(req.Body).Decode(&upstreamRequests)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return newSignedFileResponse(newSignedXPI(t, xpiPKCS7SignaturePath, xpiCOSESignaturePath)), nil
+				})
+			}
+
+			fields := map[string]string{}
+			if tt.requested != "" {
+				fields["cose_algorithms"] = tt.requested
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequestWithFields(t, tt.token, []byte("unsigned"), fields))
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus != http.StatusCreated {
+				return
+			}
+			if len(upstreamRequests) != 1 {
+				t.Fatalf("upstream received %d signing requests expected 1", len(upstreamRequests))
+			}
+			if !reflect.DeepEqual(upstreamRequests[0].Options.COSEAlgorithms, tt.expectedAlgs) {
+				t.Fatalf("upstream received COSE algorithms %v expected %v", upstreamRequests[0].Options.COSEAlgorithms, tt.expectedAlgs)
+			}
+		})
+	}
+}
+
+func TestSigHandlerRequestTimeout(t *testing.T) {
+	testConf := currentConf()
+	testConf.RequestTimeout = 50 * time.Millisecond
+	useTestConf(t, testConf)
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		// hang until the request deadline fires, like an unresponsive autograph
+		select {
+		case <-req.Context().Done():
+			return nil, &url.Error{Op: "Post", URL: req.URL.String(), Err: req.Context().Err()}
+		case <-time.After(5 * time.Second):
+			t.Error("upstream request context was not cancelled at the deadline")
+			return newSignedFileResponse([]byte("signed")), nil
+		}
+	})
+
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547", []byte("unsigned")))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusGatewayTimeout)
+	}
+	var resp errorResponse
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != "timeout" {
+		t.Fatalf("returned unexpected code %q expected timeout", resp.Code)
+	}
+}
+
+func TestSigHandlerUpstreamTimeout(t *testing.T) {
+	testConf := currentConf()
+	testConf.RequestTimeout = 50 * time.Millisecond
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].UpstreamTimeout = 5 * time.Second
+	useTestConf(t, testConf)
+
+	// a slow autograph answering after the global request timeout
+	slowUpstream := func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-req.Context().Done():
+			return nil, &url.Error{Op: "Post", URL: req.URL.String(), Err: req.Context().Err()}
+		case <-time.After(200 * time.Millisecond):
+			return newSignedFileResponse([]byte("signed")), nil
+		}
+	}
+
+	t.Run("the upstream timeout of the token applies", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(slowUpstream)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, http.StatusCreated, w.Body.String())
+		}
+	})
+
+	t.Run("the request timeout applies to other tokens", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(slowUpstream)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[0].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusGatewayTimeout {
+			t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, http.StatusGatewayTimeout, w.Body.String())
+		}
+	})
+}
+
+func Test_heartbeatHandlerTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+
+	useTestBaseURLs(t, slow.URL+"/")
+	w := httptest.NewRecorder()
+	client := &heartbeatClient{&http.Client{Timeout: 20 * time.Millisecond}}
+	heartbeatHandler(client)(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("heartbeatHandler() returned unexpected status %v expected %v", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// useTestBaseURLs points the live configuration at the autograph
+// backends at baseURLs for the duration of the test
+func useTestBaseURLs(t *testing.T, baseURLs ...string) {
+	c := currentConf()
+	c.BaseURLs = baseURLs
+	useTestConf(t, c)
+}
+
+func Test_heartbeatHandlerReload(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	// the handler is built once, like in prepareServer, and must
+	// follow the backends and timeout of the reloaded configurations
+	handler := heartbeatHandler(&heartbeatClient{&http.Client{}})
+	useTestBaseURLs(t, up.URL+"/")
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("heartbeatHandler() returned unexpected status %v expected %v", w.Code, http.StatusOK)
+	}
+
+	c := currentConf()
+	c.BaseURLs = upstreamURLs{slow.URL + "/"}
+	c.HeartbeatTimeout = 20 * time.Millisecond
+	useTestConf(t, c)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("heartbeatHandler() returned unexpected status %v expected %v", w.Code, http.StatusServiceUnavailable)
+	}
+	var st heartbeat
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Checks[heartbeatCheckName(slow.URL+"/")]; !ok || len(st.Checks) != 1 {
+		t.Fatalf("heartbeatHandler() returned checks %v expected only the reloaded backend", st.Checks)
+	}
+}
+
+func TestSigHandlerIncompleteXPISignature(t *testing.T) {
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(newSignedXPI(t, xpiPKCS7SignaturePath)), nil)
+
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, currentConf().Authorizations[1].ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusBadGateway)
+	}
+	var body errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "incomplete_signature" {
+		t.Fatalf("unexpected code %q expected incomplete_signature", body.Code)
+	}
+}
+
+func TestSigHandlerRawResponse(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[0].AllowRawResponse = true
+	testConf.Authorizations[1].AllowRawResponse = true
+	useTestConf(t, testConf)
+
+	signedXPI := newSignedXPI(t, xpiPKCS7SignaturePath, xpiCOSESignaturePath)
+	rawResponse := fmt.Sprintf(`[{"ref":"1","type":"xpi","signer_id":"extensions-ecdsa","x5u":"https://example.com/chain.pem","signed_file":"%s"}]`,
+		base64.StdEncoding.EncodeToString(signedXPI))
+	tests := []struct {
+		name           string
+		auth           authorization
+		upstream       *http.Response
+		expectedStatus int
+		expectedBody   string
+		expectedCode   string
+	}{
+		{"passthrough", testConf.Authorizations[0], newAutographResponse(http.StatusCreated, rawResponse), http.StatusCreated, rawResponse, ""},
+		{"passthrough of a verified COSE signature", testConf.Authorizations[1], newAutographResponse(http.StatusCreated, rawResponse), http.StatusCreated, rawResponse, ""},
+		{"upstream errors use the envelope", testConf.Authorizations[0], newAutographResponse(http.StatusBadRequest, "invalid input"), http.StatusUnprocessableEntity, "", "upstream_rejected"},
+		{"token without the flag", testConf.Authorizations[2], nil, http.StatusForbidden, "", "raw_response_not_allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			if tt.upstream != nil {
+				clientMock.EXPECT().Do(gomock.Any()).Return(tt.upstream, nil)
+			}
+			req := newMultipartSignRequest(t, tt.auth.ClientToken, []byte("unsigned"))
+			req.URL.RawQuery = "raw=true"
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if w.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("returned unexpected content type %q", w.Header().Get("Content-Type"))
+			}
+			if tt.expectedCode == "" {
+				if w.Body.String() != tt.expectedBody {
+					t.Fatalf("returned body %s expected the autograph response %s", w.Body.String(), tt.expectedBody)
+				}
+				if w.Header().Get("Content-Disposition") != "" {
+					t.Fatal("raw response has a Content-Disposition")
+				}
+				return
+			}
+			var body errorResponse
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.expectedCode {
+				t.Fatalf("unexpected code %q expected %q", body.Code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func Test_clientToken(t *testing.T) {
+	const token = "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547"
+	testcases := []struct {
+		header   string
+		expected string
+		wantErr  bool
+	}{
+		{token, token, false},
+		{"Bearer " + token, token, false},
+		{"bearer " + token, token, false},
+		{"Bearer  " + token + " ", token, false},
+		{"Bearer ", "", true},
+		{"Bearer " + token + " extra", "", true},
+		{"", "", false},
+	}
+	for i, testcase := range testcases {
+		req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+		req.Header.Set("Authorization", testcase.header)
+		got, err := clientToken(req)
+		if (err != nil) != testcase.wantErr {
+			t.Fatalf("testcase %d: clientToken() returned error %v wantErr %t", i, err, testcase.wantErr)
+		}
+		if got != testcase.expected {
+			t.Fatalf("testcase %d: clientToken() returned %q expected %q", i, got, testcase.expected)
+		}
+	}
+}
+
+func TestSigHandlerBearerToken(t *testing.T) {
+	token := currentConf().Authorizations[0].ClientToken
+	testcases := []struct {
+		name           string
+		header         string
+		expectedStatus int
+	}{
+		{"raw token", token, http.StatusCreated},
+		{"bearer token", "Bearer " + token, http.StatusCreated},
+		{"malformed bearer token", "Bearer " + token + " " + token, http.StatusUnauthorized},
+		{"short bearer token", "Bearer deadbeef", http.StatusUnauthorized},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+			}
+			req := newMultipartSignRequest(t, "", []byte("unsigned"))
+			req.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestSigHandlerCustomAuthHeader(t *testing.T) {
+	testConf := currentConf()
+	testConf.AuthHeader = "X-Autograph-Token"
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[0].ClientToken
+	testcases := []struct {
+		name           string
+		header         string
+		value          string
+		expectedStatus int
+	}{
+		{"raw token", "X-Autograph-Token", token, http.StatusCreated},
+		{"bearer token", "X-Autograph-Token", "Bearer " + token, http.StatusCreated},
+		{"token in Authorization", "Authorization", token, http.StatusUnauthorized},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+			}
+			req := newMultipartSignRequest(t, "", []byte("unsigned"))
+			req.Header.Set(tt.header, tt.value)
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestSigHandlerDryRun(t *testing.T) {
+	c := currentConf()
+	c.MaxUploadBytes = 1024
+	useTestConf(t, c)
+	// no upstream call is expected, the mock fails the test if one is made
+	useMockAutographClient(t)
+
+	tests := []struct {
+		name           string
+		token          string
+		inputSize      int
+		expectedStatus int
+	}{
+		{"valid request", c.Authorizations[1].ClientToken, 16, http.StatusOK},
+		{"invalid token", "3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4", 16, http.StatusUnauthorized},
+		{"oversized file", c.Authorizations[1].ClientToken, 2048, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := "extensions-ecdsa"
+			if tt.expectedStatus == http.StatusUnauthorized {
+				signer = "unknown"
+			}
+			status := strconv.Itoa(tt.expectedStatus)
+			dryRunsBefore := testutil.ToFloat64(dryRunRequestsTotal.WithLabelValues(signer, status))
+			signingBefore := testutil.ToFloat64(signingRequestsTotal.WithLabelValues(signer, status))
+
+			req := newMultipartSignRequest(t, tt.token, bytes.Repeat([]byte("a"), tt.inputSize))
+			req.URL.RawQuery = "dryrun=true"
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+			if got := testutil.ToFloat64(dryRunRequestsTotal.WithLabelValues(signer, status)); got != dryRunsBefore+1 {
+				t.Fatalf("dry-run requests counter got %v expected %v", got, dryRunsBefore+1)
+			}
+			if got := testutil.ToFloat64(signingRequestsTotal.WithLabelValues(signer, status)); got != signingBefore {
+				t.Fatalf("signing requests counter got %v expected %v for a dry run", got, signingBefore)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			var summary struct {
+				DryRun    bool   `json:"dry_run"`
+				Signer    string `json:"signer"`
+				InputSize int    `json:"input_size"`
+				Options   xpiOptions
+			}
+			if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+				t.Fatal(err)
+			}
+			if !summary.DryRun || summary.Signer != signer || summary.InputSize != tt.inputSize {
+				t.Fatalf("unexpected dry-run summary %+v", summary)
+			}
+			if summary.Options.ID != c.Authorizations[1].AddonID || summary.Options.PKCS7Digest != "SHA256" ||
+				len(summary.Options.COSEAlgorithms) != 1 {
+				t.Fatalf("unexpected dry-run options %+v", summary.Options)
+			}
+		})
+	}
+}
+
+func TestSigHandlerUpstreamRateLimited(t *testing.T) {
+	c := currentConf()
+	c.UpstreamMaxAttempts = 3
+	c.UpstreamRetryDelay = time.Millisecond
+	useTestConf(t, c)
+	useTestBaseURLs(t, "http://localhost:8000/", "http://localhost:8001/")
+
+	// the 429 is neither retried nor failed over
+	clientMock := useMockAutographClient(t)
+	upstream := newAutographResponse(http.StatusTooManyRequests, "too many requests")
+	upstream.Header = http.Header{"Retry-After": []string{"30"}}
+	clientMock.EXPECT().Do(gomock.Any()).Return(upstream, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, c.Authorizations[2].ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Fatalf("returned Retry-After %q expected 30", got)
+	}
+	var body errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "upstream_rate_limited" || body.RetryAfter != 30 || body.UpstreamStatus != http.StatusTooManyRequests {
+		t.Fatalf("returned unexpected error %+v", body)
+	}
+}
+
+func TestSigHandlerUpstreamErrors(t *testing.T) {
+	c := currentConf()
+	c.UpstreamMaxAttempts = 1
+	useTestConf(t, c)
+
+	tests := []struct {
+		name           string
+		upstream       *http.Response
+		expectedStatus int
+		expected       errorResponse
+	}{
+		{
+			name:           "autograph rejects the file",
+			upstream:       newAutographResponse(http.StatusBadRequest, "failed to parse XPI: zip: not a valid zip file\n"),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expected: errorResponse{
+				Error:          "autograph rejected the request: failed to parse XPI: zip: not a valid zip file",
+				Code:           "upstream_rejected",
+				UpstreamStatus: http.StatusBadRequest,
+			},
+		},
+		{
+			name:           "autograph rejects the file with a JSON error",
+			upstream:       newAutographResponse(http.StatusBadRequest, `{"error":"invalid input"}`),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expected: errorResponse{
+				Error:          "autograph rejected the request: invalid input",
+				Code:           "upstream_rejected",
+				UpstreamStatus: http.StatusBadRequest,
+			},
+		},
+		{
+			name:           "autograph rejects the hawk credentials",
+			upstream:       newAutographResponse(http.StatusUnauthorized, "authorization header is invalid"),
+			expectedStatus: http.StatusBadGateway,
+			expected: errorResponse{
+				Error:          "failed to call autograph for signature",
+				Code:           "upstream_error",
+				UpstreamStatus: http.StatusUnauthorized,
+			},
+		},
+		{
+			name:           "autograph fails",
+			upstream:       newAutographResponse(http.StatusInternalServerError, "database is on fire"),
+			expectedStatus: http.StatusBadGateway,
+			expected: errorResponse{
+				Error:          "failed to call autograph for signature",
+				Code:           "upstream_error",
+				UpstreamStatus: http.StatusInternalServerError,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			clientMock.EXPECT().Do(gomock.Any()).Return(tt.upstream, nil)
+
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequest(t, c.Authorizations[0].ClientToken, []byte("unsigned")))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+			var body errorResponse
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			body.RequestID = ""
+			if body != tt.expected {
+				t.Fatalf("returned error %+v expected %+v", body, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSigHandlerDisabledSigner(t *testing.T) {
+	c := currentConf()
+	c.Authorizations = append([]authorization(nil), c.Authorizations...)
+	c.Authorizations[0].Disabled = true
+	useTestConf(t, c)
+	// disabled tokens never reach autograph
+	useMockAutographClient(t)
+
+	auth, err := authorize(c.Authorizations[0].ClientToken)
+	if err != errSignerDisabled {
+		t.Fatalf("authorize() of a disabled token returned error %v expected %v", err, errSignerDisabled)
+	}
+	if auth.Signer != c.Authorizations[0].Signer {
+		t.Fatalf("authorize() of a disabled token returned signer %q expected %q", auth.Signer, c.Authorizations[0].Signer)
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"disabled token", c.Authorizations[0].ClientToken, http.StatusServiceUnavailable, "signer_disabled"},
+		{"unknown token", "3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4", http.StatusUnauthorized, "invalid_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequest(t, tt.token, []byte("unsigned")))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+			var body errorResponse
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.expectedCode {
+				t.Fatalf("unexpected code %q expected %q", body.Code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestSigHandlerContentSHA256(t *testing.T) {
+	input := []byte("unsigned")
+	digest := fmt.Sprintf("%x", sha256.Sum256(input))
+	tests := []struct {
+		name           string
+		header         string
+		expectedStatus int
+	}{
+		{"no checksum", "", http.StatusCreated},
+		{"matching checksum", digest, http.StatusCreated},
+		{"matching uppercase checksum", strings.ToUpper(digest), http.StatusCreated},
+		{"mismatching checksum", fmt.Sprintf("%x", sha256.Sum256([]byte("tampered"))), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+			}
+			req := newMultipartSignRequest(t, currentConf().Authorizations[0].ClientToken, input)
+			if tt.header != "" {
+				req.Header.Set("X-Content-SHA256", tt.header)
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus == http.StatusBadRequest && !strings.Contains(w.Body.String(), `"code":"checksum_mismatch"`) {
+				t.Fatalf("unexpected error response %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSigHandlerSignatureTypeMismatch(t *testing.T) {
+	xpi := readFixture(t, "integration_test/test.xpi")
+	apk := readFixture(t, "integration_test/test.apk")
+	tests := []struct {
+		name           string
+		auth           int
+		input          []byte
+		expectedStatus int
+	}{
+		{"xpi to an xpi token", 0, xpi, http.StatusCreated},
+		{"apk to an apk token", 2, apk, http.StatusCreated},
+		{"apk to an xpi token", 0, apk, http.StatusBadRequest},
+		{"xpi to an apk token", 2, xpi, http.StatusBadRequest},
+		{"unknown input to an apk token", 2, []byte("unsigned"), http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+			}
+			req := newMultipartSignRequest(t, currentConf().Authorizations[tt.auth].ClientToken, tt.input)
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusBadRequest && !strings.Contains(w.Body.String(), `"code":"signature_type_mismatch"`) {
+				t.Fatalf("unexpected error response %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSigHandlerUnauthorized(t *testing.T) {
+	tests := []struct {
+		name              string
+		authHeader        string
+		expectedCode      string
+		expectedChallenge string
+	}{
+		{"missing token", "", "missing_token", `Bearer realm="autograph-edge"`},
+		{"short token", "fkdjkso", "invalid_token", `Bearer realm="autograph-edge", error="invalid_token"`},
+		{"malformed bearer token", "Bearer a b", "invalid_token", `Bearer realm="autograph-edge", error="invalid_token"`},
+		{"unknown token", "3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4", "invalid_token", `Bearer realm="autograph-edge", error="invalid_token"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newMultipartSignRequest(t, tt.authHeader, []byte("unsigned"))
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusUnauthorized)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.expectedChallenge {
+				t.Fatalf("returned WWW-Authenticate %q expected %q", got, tt.expectedChallenge)
+			}
+			var resp errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tt.expectedCode {
+				t.Fatalf("returned code %q expected %q", resp.Code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestSigHandlerBodyReadTimeout(t *testing.T) {
+	testConf := currentConf()
+	testConf.BodyReadTimeout = 100 * time.Millisecond
+	useTestConf(t, testConf)
+	useMockAutographClient(t)
+	server := httptest.NewServer(http.HandlerFunc(sigHandler))
+	defer server.Close()
+
+	// the body starts an input file then stops sending, like a client
+	// trickling its upload
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, err := mw.CreateFormFile("input", "input")
+		if err != nil {
+			return
+		}
+		fw.Write([]byte("unsigned"))
+	}()
+	req, err := http.NewRequest("POST", server.URL, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", testConf.Authorizations[0].ClientToken)
+
+	client := server.Client()
+	client.Timeout = 5 * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("returned unexpected status %v expected %v", resp.StatusCode, http.StatusRequestTimeout)
+	}
+	var errResp errorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+		t.Fatal(err)
+	}
+	if errResp.Code != "body_read_timeout" {
+		t.Fatalf("returned code %q expected body_read_timeout", errResp.Code)
+	}
+}
+
+func TestSigHandlerBodyReadTimeoutExtendsReadTimeout(t *testing.T) {
+	testConf := currentConf()
+	testConf.BodyReadTimeout = 5 * time.Second
+	useTestConf(t, testConf)
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(sigHandler))
+	server.Config.ReadTimeout = 50 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// the upload takes longer than the server read timeout, but fits
+	// in the body read timeout of signing requests
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, err := mw.CreateFormFile("input", "input")
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		fw.Write([]byte("unsigned"))
+		time.Sleep(300 * time.Millisecond)
+		fw.Write([]byte(" input"))
+		pw.CloseWithError(mw.Close())
+	}()
+	req, err := http.NewRequest("POST", server.URL, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", testConf.Authorizations[0].ClientToken)
+
+	client := server.Client()
+	client.Timeout = 5 * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v expected %v", resp.StatusCode, http.StatusCreated)
+	}
+}
+
+func TestSigHandlerClientDisconnect(t *testing.T) {
+	origBreakers := breakers
+	breakers = newCircuitBreakers()
+	defer func() { breakers = origBreakers }()
+	c := currentConf()
+	c.CircuitBreakerThreshold = 1
+	c.CircuitBreakerCooldown = time.Hour
+	useTestConf(t, c)
+
+	upstreamStarted := make(chan struct{})
+	upstreamCancelled := make(chan struct{})
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		close(upstreamStarted)
+		select {
+		case <-req.Context().Done():
+			close(upstreamCancelled)
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			return newSignedFileResponse([]byte("signed")), nil
+		}
+	})
+
+	// the request context is cancelled like the server does when the
+	// client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	req := newMultipartSignRequest(t, c.Authorizations[0].ClientToken, []byte("unsigned")).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sigHandler(httptest.NewRecorder(), req)
+	}()
+	<-upstreamStarted
+	cancel()
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled when the client disconnected")
+	}
+	<-done
+
+	// and a disconnecting client isn't a failure of the signer
+	if !breakers.allow(c.Authorizations[0].Signer, c.CircuitBreakerCooldown) {
+		t.Fatal("client disconnect opened the circuit breaker")
+	}
+}
+
+func TestSigHandlerSlowRequestWarning(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		threshold time.Duration
+		warned    bool
+	}{
+		{"past the threshold", 10 * time.Millisecond, true},
+		{"below the threshold", time.Hour, false},
+		{"disabled", 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testConf := currentConf()
+			testConf.SlowRequestThreshold = tt.threshold
+			useTestConf(t, testConf)
+			origHooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+			t.Cleanup(func() { log.StandardLogger().ReplaceHooks(origHooks) })
+			hook := logtest.NewLocal(log.StandardLogger())
+
+			clientMock := useMockAutographClient(t)
+			clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+				time.Sleep(20 * time.Millisecond)
+				return newSignedFileResponse([]byte("signed")), nil
+			})
+			req := newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned"))
+			req = req.WithContext(context.WithValue(req.Context(), contextKeyRequestID, "slow-request"))
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+			}
+			var warning *log.Entry
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == log.WarnLevel && entry.Message == "slow upstream request" {
+					warning = entry
+				}
+			}
+			if (warning != nil) != tt.warned {
+				t.Fatalf("logged slow request warning %v expected %t", warning, tt.warned)
+			}
+			if warning == nil {
+				return
+			}
+			if warning.Data["signer"] != testConf.Authorizations[2].Signer || warning.Data["request_id"] != "slow-request" {
+				t.Fatalf("slow request warning has fields %v", warning.Data)
+			}
+			if latency, _ := warning.Data["upstream_latency_ms"].(int64); latency < 20 {
+				t.Fatalf("slow request warning has latency %v expected at least 20ms", warning.Data["upstream_latency_ms"])
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// heartbeatPoller checks the autograph heartbeats in the background so
+// that /__heartbeat__ can return the latest status without calling
+// autograph on each request
+type heartbeatPoller struct {
+	client   heartbeatRequester
+	interval time.Duration
+
+	mu        sync.Mutex
+	status    heartbeat
+	checkedAt time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newHeartbeatPoller(client heartbeatRequester, interval time.Duration) *heartbeatPoller {
+	return &heartbeatPoller{
+		client:   client,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start polls the heartbeats right away, then every interval until
+// shutdown is called
+func (p *heartbeatPoller) start() {
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			p.poll()
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p *heartbeatPoller) poll() {
+	st := checkHeartbeats(p.client)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = st
+	p.checkedAt = time.Now()
+}
+
+// latest returns the last polled status and when it was checked, which
+// is zero before the first poll completes
+func (p *heartbeatPoller) latest() (heartbeat, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status, p.checkedAt
+}
+
+// shutdown stops a started poller and waits for a poll in progress to
+// return
+func (p *heartbeatPoller) shutdown() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+}
+
+// handler serves the latest polled status with its age. Requests with
+// ?live=true, requests while draining or shutting down and requests
+// before the first poll completes are served by live instead.
+func (p *heartbeatPoller) handler(live http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, checkedAt := p.latest()
+		if isLiveHeartbeat(r) || outOfRotation() || checkedAt.IsZero() {
+			live(w, r)
+			return
+		}
+		age := time.Since(checkedAt).Seconds()
+		st.Age = &age
+		writeHeartbeatResponse(w, st)
+	}
+}
+
+// isLiveHeartbeat returns whether r asks for the heartbeats to be
+// checked instead of served from the poller
+func isLiveHeartbeat(r *http.Request) bool {
+	live, err := strconv.ParseBool(r.URL.Query().Get("live"))
+	return err == nil && live
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHeartbeatClient answers every heartbeat with status and
+// counts the calls
+type countingHeartbeatClient struct {
+	status int
+	calls  atomic.Int32
+}
+
+func (c *countingHeartbeatClient) Get(string) (*http.Response, error) {
+	c.calls.Add(1)
+	return &http.Response{
+		Status:     http.StatusText(c.status),
+		StatusCode: c.status,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("{}"))),
+	}, nil
+}
+
+func Test_heartbeatPollerHandler(t *testing.T) {
+	useTestBaseURLs(t, "http://localhost:8000/")
+	client := &countingHeartbeatClient{status: http.StatusOK}
+	p := newHeartbeatPoller(client, time.Hour)
+	handler := p.handler(heartbeatHandler(client))
+	get := func(t *testing.T, target string) heartbeat {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("returned unexpected status %v: %s", w.Code, w.Body.String())
+		}
+		var st heartbeat
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	t.Run("checks live before the first poll", func(t *testing.T) {
+		if st := get(t, "/__heartbeat__"); st.Age != nil || client.calls.Load() != 1 {
+			t.Fatalf("returned age %v after %d calls expected a live check", st.Age, client.calls.Load())
+		}
+	})
+
+	p.poll()
+	calls := client.calls.Load()
+	t.Run("serves the cached status", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			st := get(t, "/__heartbeat__")
+			if !st.Status || st.Age == nil || !st.Checks["autograph_heartbeat:http://localhost:8000/"] {
+				t.Fatalf("returned %+v expected the cached healthy status with its age", st)
+			}
+		}
+		if got := client.calls.Load(); got != calls {
+			t.Fatalf("made %d heartbeat calls expected none", got-calls)
+		}
+	})
+
+	t.Run("checks live with ?live=true", func(t *testing.T) {
+		if st := get(t, "/__heartbeat__?live=true"); st.Age != nil {
+			t.Fatalf("returned age %v expected a live check", *st.Age)
+		}
+		if got := client.calls.Load(); got != calls+1 {
+			t.Fatalf("made %d heartbeat calls expected 1", got-calls)
+		}
+	})
+}
+
+func Test_heartbeatPollerShutdown(t *testing.T) {
+	useTestBaseURLs(t, "http://localhost:8000/")
+	client := &countingHeartbeatClient{status: http.StatusOK}
+	p := newHeartbeatPoller(client, time.Millisecond)
+	p.start()
+	for client.calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	p.shutdown()
+	calls := client.calls.Load()
+	time.Sleep(10 * time.Millisecond)
+	if got := client.calls.Load(); got != calls {
+		t.Fatalf("made %d heartbeat calls after shutdown", got-calls)
+	}
+	// shutting down again doesn't block or panic
+	p.shutdown()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// idempotencyConfig bounds the signed files kept to replay the signing
+// requests retried with the same Idempotency-Key header
+type idempotencyConfig struct {
+	// Window is how long a key replays the file signed for its first
+	// request. Defaults to 10m.
+	Window time.Duration `yaml:"window"`
+
+	// MaxBytes is the maximum total size of the kept signed files,
+	// over which the least recently used are evicted. Defaults to 64MiB.
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+const (
+	defaultIdempotencyWindow   = 10 * time.Minute
+	defaultIdempotencyMaxBytes = 64 << 20
+)
+
+// idempotencyKeyHeader optionally names a signing request so that its
+// retries return the file signed for it instead of signing it again
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+var (
+	errInvalidIdempotencyKey    = errors.New("invalid Idempotency-Key header")
+	errIdempotencyKeyReused     = errors.New("idempotency key was already used for a different request")
+	errIdempotencyKeyInProgress = errors.New("a request with this idempotency key is in progress")
+)
+
+// requestIdempotencyKey returns the key of the Idempotency-Key header
+// of r scoped to the client token, so that clients can't replay each
+// other's signed files. It is empty when the header is not set.
+func requestIdempotencyKey(r *http.Request, token string) (string, error) {
+	key := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+	if key == "" {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return "", errors.Wrapf(errInvalidIdempotencyKey, "key is longer than %d bytes", maxIdempotencyKeyLength)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token+"\x00"+key))), nil
+}
+
+// idempotencyStore is an in-memory LRU of the signing requests named by
+// an idempotency key, holding their signed file once they succeed
+type idempotencyStore struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+type idempotentRequest struct {
+	key string
+	// fingerprint is the responseCacheKey of the request, which its
+	// retries must match
+	fingerprint string
+	done        bool
+	body        []byte
+	expires     time.Time
+}
+
+var idempotentRequests = newIdempotencyStore()
+
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// begin returns the file signed for the earlier request of key, which
+// must have the same fingerprint. Otherwise it reserves key for the
+// caller, which must then complete or abandon it, until the window
+// expires. Concurrent requests of the same key get
+// errIdempotencyKeyInProgress.
+func (s *idempotencyStore) begin(key, fingerprint string, window time.Duration) (body []byte, replay bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*idempotentRequest)
+		switch {
+		case time.Now().After(entry.expires):
+			s.remove(elem)
+		case entry.fingerprint != fingerprint:
+			return nil, false, errIdempotencyKeyReused
+		case !entry.done:
+			return nil, false, errIdempotencyKeyInProgress
+		default:
+			s.lru.MoveToFront(elem)
+			return entry.body, true, nil
+		}
+	}
+	s.entries[key] = s.lru.PushFront(&idempotentRequest{
+		key:         key,
+		fingerprint: fingerprint,
+		expires:     time.Now().Add(window),
+	})
+	return nil, false, nil
+}
+
+// complete keeps body to replay the request of key for window,
+// evicting the least recently used files until the store fits in
+// maxBytes. Files larger than maxBytes are not kept and their key is
+// released.
+func (s *idempotencyStore) complete(key string, body []byte, window time.Duration, maxBytes int64) {
+	s.Lock()
+	defer s.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	if int64(len(body)) > maxBytes {
+		s.remove(elem)
+		return
+	}
+	entry := elem.Value.(*idempotentRequest)
+	entry.done = true
+	entry.body = body
+	entry.expires = time.Now().Add(window)
+	s.size += int64(len(body))
+	s.lru.MoveToFront(elem)
+	for s.size > maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+// abandon releases the key of a request that did not complete, so that
+// it can be retried. Completed requests are left as is.
+func (s *idempotencyStore) abandon(key string) {
+	s.Lock()
+	defer s.Unlock()
+	if elem, ok := s.entries[key]; ok && !elem.Value.(*idempotentRequest).done {
+		s.remove(elem)
+	}
+}
+
+func (s *idempotencyStore) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*idempotentRequest)
+	delete(s.entries, entry.key)
+	s.size -= int64(len(entry.body))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func useTestIdempotencyStore(t *testing.T) *idempotencyStore {
+	origStore := idempotentRequests
+	idempotentRequests = newIdempotencyStore()
+	t.Cleanup(func() { idempotentRequests = origStore })
+	return idempotentRequests
+}
+
+func Test_idempotencyStore(t *testing.T) {
+	s := newIdempotencyStore()
+	if _, replay, err := s.begin("a", "input a", time.Hour); replay || err != nil {
+		t.Fatalf("begin() of a new key = %v, %v expected a reservation", replay, err)
+	}
+	if _, _, err := s.begin("a", "input a", time.Hour); err != errIdempotencyKeyInProgress {
+		t.Fatalf("begin() of a pending key returned %v expected %v", err, errIdempotencyKeyInProgress)
+	}
+	s.complete("a", []byte("signed a"), time.Hour, 16)
+	if body, replay, err := s.begin("a", "input a", time.Hour); !replay || err != nil || string(body) != "signed a" {
+		t.Fatalf("begin() of a completed key = %q, %v, %v expected a replay", body, replay, err)
+	}
+	if _, _, err := s.begin("a", "input b", time.Hour); err != errIdempotencyKeyReused {
+		t.Fatalf("begin() with another fingerprint returned %v expected %v", err, errIdempotencyKeyReused)
+	}
+
+	s.begin("abandoned", "input", time.Hour)
+	s.abandon("abandoned")
+	if _, replay, err := s.begin("abandoned", "other input", time.Hour); replay || err != nil {
+		t.Fatalf("begin() of an abandoned key = %v, %v expected a reservation", replay, err)
+	}
+	s.abandon("a")
+	if _, ok := s.entries["a"]; !ok {
+		t.Fatal("abandon() removed a completed key")
+	}
+
+	s.begin("large", "input", time.Hour)
+	s.complete("large", []byte(strings.Repeat("a", 17)), time.Hour, 16)
+	if _, ok := s.entries["large"]; ok {
+		t.Fatal("file larger than the store was kept")
+	}
+
+	// b doesn't fit with a, which is evicted as the least recently used
+	s.begin("b", "input b", time.Hour)
+	s.complete("b", []byte("signed b"), time.Hour, 16)
+	s.begin("c", "input c", time.Hour)
+	s.complete("c", []byte("signed c"), time.Hour, 16)
+	if _, ok := s.entries["a"]; ok {
+		t.Fatal("least recently used key was not evicted")
+	}
+
+	s.begin("expired", "input", -time.Second)
+	if _, replay, err := s.begin("expired", "other input", time.Hour); replay || err != nil {
+		t.Fatalf("begin() of an expired key = %v, %v expected a reservation", replay, err)
+	}
+}
+
+func TestSigHandlerIdempotencyKey(t *testing.T) {
+	useTestIdempotencyStore(t)
+	testConf := currentConf()
+	token := testConf.Authorizations[2].ClientToken
+
+	sign := func(t *testing.T, token, key string, input []byte) *httptest.ResponseRecorder {
+		req := newMultipartSignRequest(t, token, input)
+		req.Header.Set(idempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		return w
+	}
+
+	t.Run("replays the signed file", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil).Times(1)
+		first := sign(t, token, "replay", []byte("unsigned"))
+		second := sign(t, token, "replay", []byte("unsigned"))
+		if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+			t.Fatalf("returned statuses %d and %d expected 201", first.Code, second.Code)
+		}
+		if second.Body.String() != "signed" {
+			t.Fatalf("replayed %q expected the signed file", second.Body.String())
+		}
+		if second.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatal("replayed response is missing its Idempotent-Replayed header")
+		}
+		if first.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatal("first response is marked as replayed")
+		}
+	})
+
+	t.Run("rejects another body with 409", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil).Times(1)
+		sign(t, token, "distinct", []byte("unsigned"))
+		w := sign(t, token, "distinct", []byte("other"))
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "idempotency_key_reused") {
+			t.Fatalf("returned %d %s expected a 409 idempotency_key_reused", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("keys are scoped to the token", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+			return newSignedFileResponse([]byte("signed")), nil
+		}).Times(2)
+		sign(t, token, "scoped", []byte("unsigned"))
+		w := sign(t, testConf.Authorizations[0].ClientToken, "scoped", []byte("other"))
+		if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("returned %d replayed %q for another token expected a new signature", w.Code, w.Header().Get("Idempotent-Replayed"))
+		}
+	})
+
+	t.Run("expired keys sign again", func(t *testing.T) {
+		expiringConf := currentConf()
+		expiringConf.Idempotency.Window = time.Millisecond
+		useTestConf(t, expiringConf)
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+			return newSignedFileResponse([]byte("signed")), nil
+		}).Times(2)
+		sign(t, token, "expiry", []byte("unsigned"))
+		time.Sleep(5 * time.Millisecond)
+		w := sign(t, token, "expiry", []byte("other"))
+		if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("returned %d replayed %q after the window expected a new signature", w.Code, w.Header().Get("Idempotent-Replayed"))
+		}
+	})
+
+	t.Run("failed signatures can be retried", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		gomock.InOrder(
+			clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadRequest, "bad input"), nil),
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed retry")), nil),
+		)
+		if w := sign(t, token, "retry", []byte("unsigned")); w.Code == http.StatusCreated {
+			t.Fatal("rejected signature returned a 201")
+		}
+		if w := sign(t, token, "retry", []byte("unsigned")); w.Body.String() != "signed retry" {
+			t.Fatalf("returned %q expected the newly signed file", w.Body.String())
+		}
+	})
+
+	t.Run("rejects long keys", func(t *testing.T) {
+		w := sign(t, token, strings.Repeat("k", maxIdempotencyKeyLength+1), []byte("unsigned"))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_idempotency_key") {
+			t.Fatalf("returned %d %s expected a 400 invalid_idempotency_key", w.Code, w.Body.String())
+		}
+	})
+}
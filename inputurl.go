@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// inputURLField is the form field holding the URL of the file
+// to sign, for tokens allowed to send one instead of the file
+const inputURLField = "input_url"
+
+// maxInputURLRedirects is the maximum number of redirects followed
+// when fetching an input URL
+const maxInputURLRedirects = 5
+
+// cgnatNet is the shared address space of carrier-grade NATs, which
+// net.IP.IsPrivate does not cover
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP returns whether ip is a globally routable unicast address
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || cgnatNet.Contains(ip))
+}
+
+// inputIPAllowed returns whether the edge can connect to ip to fetch
+// an input URL, and can be replaced in tests
+var inputIPAllowed = isPublicIP
+
+// inputDialControl refuses connections to non-public addresses. It
+// runs after the hostname is resolved, so a public host that resolves
+// to a private address is refused too.
+func inputDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !inputIPAllowed(ip) {
+		return errors.Wrapf(errInputURLNotAllowed, "address %s is not public", host)
+	}
+	return nil
+}
+
+// inputTransport fetches input URLs. It doesn't use the environment
+// proxy, which would hide the address being connected to.
+var inputTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   inputDialControl,
+	}).DialContext,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// allowsInputURL returns an error unless the token can fetch its
+// input from u
+func (auth authorization) allowsInputURL(u *url.URL) error {
+	if !auth.AllowURLInput {
+		return errInputURLNotAllowed
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.Wrapf(errInputURLNotAllowed, "unsupported scheme %q", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.Wrap(errInputURLNotAllowed, "url has credentials")
+	}
+	for _, host := range auth.AllowedInputHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return errors.Wrapf(errInputURLNotAllowed, "host %q is not allowed", u.Hostname())
+}
+
+// fetchInputURL downloads the file to sign from rawURL, following
+// redirects only to allowed hosts, and returns at most maxBytes of it
+func fetchInputURL(ctx context.Context, auth authorization, rawURL string, maxBytes int64) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(errInputURLNotAllowed, err.Error())
+	}
+	err = auth.allowsInputURL(u)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: inputTransport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxInputURLRedirects {
+				return errors.Wrapf(errInputURLFailed, "stopped after %d redirects", len(via))
+			}
+			return auth.allowsInputURL(req.URL)
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(errInputURLFailed, err.Error())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, errInputURLNotAllowed) {
+			return nil, err
+		}
+		return nil, errors.Wrap(errInputURLFailed, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Wrapf(errInputURLFailed, "unexpected status %s", resp.Status)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, errPayloadTooLarge
+	}
+	input, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, errors.Wrap(errInputURLFailed, err.Error())
+	}
+	if int64(len(input)) > maxBytes {
+		return nil, errPayloadTooLarge
+	}
+	return input, nil
+}
+
+// isMissingInputFile returns whether err from reading the input form
+// file means the request has no file, rather than a broken one
+func isMissingInputFile(err error) bool {
+	return errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var errInvalidJSONRequest = errors.New("invalid JSON signing request")
+
+// jsonSignPath is the signing endpoint of the clients sending a JSON
+// body instead of a multipart upload
+const jsonSignPath = "/__sign__"
+
+// maxJSONSignOverhead bounds the JSON of a signing request other than
+// its base64 input, like its signer and options
+const maxJSONSignOverhead = 64 << 10
+
+// jsonSignRequest is the body of the requests to /__sign__
+type jsonSignRequest struct {
+	// Input is the base64 file to sign
+	Input string `json:"input"`
+	// Signer picks one of the allowed signers of the token like the
+	// path of /sign/<signer> when set
+	Signer string `json:"signer,omitempty"`
+	// Options are the signing options of the options form field
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// jsonSignResponse is returned by /__sign__ in place of the signed file
+type jsonSignResponse struct {
+	SignedFile string `json:"signed_file"`
+	SignerID   string `json:"signer_id,omitempty"`
+	X5U        string `json:"x5u,omitempty"`
+}
+
+// jsonSignHandler signs the input of a JSON body. The body is turned
+// into the multipart upload of the same input and options, which
+// sigHandler authorizes, validates and signs like any other, so that
+// both endpoints share the same checks. The signed file is returned
+// base64 encoded in JSON, and the responses that already are JSON, like
+// errors, data signatures and raw responses, are unchanged. Unlike the
+// multipart endpoint, the signed file is buffered to be encoded.
+func jsonSignHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sigHandler(w, r)
+		return
+	}
+	c := currentConf()
+	limit := int64(base64.StdEncoding.EncodedLen(int(c.largestUploadBytes()))) + maxJSONSignOverhead
+	var req jsonSignRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeSigningError(w, r, errPayloadTooLarge)
+			return
+		}
+		getLogger(r).Error(err)
+		writeSigningError(w, r, errors.Wrap(errInvalidJSONRequest, err.Error()))
+		return
+	}
+	signReq, err := req.multipartRequest(r)
+	if err != nil {
+		getLogger(r).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	bw := &bufferedResponseWriter{ResponseWriter: w, header: make(http.Header), status: http.StatusOK}
+	sigHandler(bw, signReq)
+	bw.writeJSONTo(w, r)
+}
+
+// multipartRequest returns a copy of r uploading the input and options
+// of req as a multipart form to the signing path of its signer
+func (req jsonSignRequest) multipartRequest(r *http.Request) (*http.Request, error) {
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		return nil, errors.Wrap(errInvalidJSONRequest, "input is not valid base64")
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if len(req.Options) > 0 && string(req.Options) != "null" {
+		if err = mw.WriteField("options", string(req.Options)); err != nil {
+			return nil, err
+		}
+	}
+	fw, err := mw.CreateFormFile("input", "input")
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(input)
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+
+	signReq := r.Clone(r.Context())
+	signReq.URL.Path, signReq.URL.RawPath = "/sign", ""
+	if req.Signer != "" {
+		signReq.URL.Path = signPathPrefix + req.Signer
+		signReq.URL.RawPath = signPathPrefix + url.PathEscape(req.Signer)
+	}
+	signReq.Body = io.NopCloser(bytes.NewReader(body.Bytes()))
+	signReq.ContentLength = int64(body.Len())
+	signReq.Header.Set("Content-Type", mw.FormDataContentType())
+	signReq.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	// the signed file is encoded in JSON, not compressed
+	signReq.Header.Del("Content-Encoding")
+	signReq.Header.Del("Accept-Encoding")
+	return signReq, nil
+}
+
+// bufferedResponseWriter holds the response of sigHandler to return it
+// in JSON. It unwraps to the client connection so that response
+// controllers still set its deadlines.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (bw *bufferedResponseWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferedResponseWriter) WriteHeader(status int) {
+	if bw.wrote {
+		return
+	}
+	bw.wrote = true
+	bw.status = status
+}
+
+func (bw *bufferedResponseWriter) Write(p []byte) (int, error) {
+	bw.WriteHeader(http.StatusOK)
+	return bw.body.Write(p)
+}
+
+func (bw *bufferedResponseWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// writeJSONTo writes the buffered response to w, with a signed file
+// base64 encoded in a jsonSignResponse
+func (bw *bufferedResponseWriter) writeJSONTo(w http.ResponseWriter, r *http.Request) {
+	if _, incomplete := bw.header[http.TrailerPrefix+incompleteTrailer]; incomplete {
+		// a truncated signed file can't be returned in JSON
+		writeSigningError(w, r, errUpstreamFailed)
+		return
+	}
+	body := bw.body.Bytes()
+	if bw.status == http.StatusCreated && bw.header.Get("Content-Type") == "application/octet-stream" {
+		var err error
+		body, err = json.Marshal(jsonSignResponse{
+			SignedFile: base64.StdEncoding.EncodeToString(body),
+			SignerID:   bw.header.Get(signerHeader),
+			X5U:        bw.header.Get(x5uHeader),
+		})
+		if err != nil {
+			getLogger(r).Errorf("failed to marshal JSON signing response: %v", err)
+			writeSigningError(w, r, errInternal)
+			return
+		}
+		bw.header.Set("Content-Type", "application/json")
+		bw.header.Del("Content-Disposition")
+	}
+	for name, values := range bw.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(bw.status)
+	w.Write(body)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+// newJSONSignRequest returns a request to /__sign__ of body for token
+func newJSONSignRequest(token, body string) *http.Request {
+	req := httptest.NewRequest("POST", "http://localhost:8080"+jsonSignPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return req
+}
+
+func TestJSONSignHandler(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[0].AllowRequestOptions = true
+	useTestConf(t, testConf)
+	auth := testConf.Authorizations[0]
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent []signaturerequest
+		if err := json.Unmarshal(body, &sent); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent) != 1 || sent[0].Input != base64.StdEncoding.EncodeToString([]byte("unsigned")) {
+			t.Errorf("sent %s to autograph expected the decoded input", body)
+		}
+		if options, _ := sent[0].Options.(map[string]interface{}); options["pkcs7_digest"] != "SHA256" {
+			t.Errorf("sent options %v to autograph expected the requested pkcs7_digest", sent[0].Options)
+		}
+		return newSignedFileResponse([]byte("signed")), nil
+	})
+	w := httptest.NewRecorder()
+	jsonSignHandler(w, newJSONSignRequest(auth.ClientToken, `{"input":"`+base64.StdEncoding.EncodeToString([]byte("unsigned"))+`","options":{"pkcs7_digest":"SHA256"}}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "application/json" || w.Header().Get("Content-Disposition") != "" {
+		t.Fatalf("returned content type %q and disposition %q expected JSON", w.Header().Get("Content-Type"), w.Header().Get("Content-Disposition"))
+	}
+	var resp jsonSignResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.SignedFile != base64.StdEncoding.EncodeToString([]byte("signed")) {
+		t.Fatalf("returned signed file %q expected the base64 signed file", resp.SignedFile)
+	}
+}
+
+func TestJSONSignHandlerErrors(t *testing.T) {
+	testConf := currentConf()
+	testConf.MaxUploadBytes = 1024
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+	input := base64.StdEncoding.EncodeToString([]byte("unsigned"))
+
+	for _, tt := range []struct {
+		name           string
+		token          string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"missing token", "", `{"input":"` + input + `"}`, http.StatusUnauthorized, "missing_token"},
+		{"invalid base64", token, `{"input":"not base64!"}`, http.StatusBadRequest, "invalid_request"},
+		{"unknown field", token, `{"input":"` + input + `","keyid":"other"}`, http.StatusBadRequest, "invalid_request"},
+		{"not JSON", token, `input=` + input, http.StatusBadRequest, "invalid_request"},
+		{"signer not allowed", token, `{"input":"` + input + `","signer":"other-signer"}`, http.StatusForbidden, "signer_not_allowed"},
+		{"decoded input too large", token, `{"input":"` + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 2048))) + `"}`, http.StatusRequestEntityTooLarge, "payload_too_large"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useMockAutographClient(t)
+			w := httptest.NewRecorder()
+			jsonSignHandler(w, newJSONSignRequest(tt.token, tt.body))
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("returned %q: %v", w.Body.String(), err)
+			}
+			if w.Code != tt.expectedStatus || body.Code != tt.expectedCode {
+				t.Fatalf("returned %d %q expected %d %q", w.Code, body.Code, tt.expectedStatus, tt.expectedCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errKeyIDNotAllowed = errors.New("requested key id is not allowed for this token")
+
+// requestedKeyID returns the autograph key id requested in the keyid
+// form value or, when it is absent, in the keyid query parameter
+func requestedKeyID(r *http.Request) string {
+	if r.MultipartForm != nil && len(r.MultipartForm.Value["keyid"]) > 0 {
+		return strings.TrimSpace(r.MultipartForm.Value["keyid"][0])
+	}
+	return strings.TrimSpace(r.URL.Query().Get("keyid"))
+}
+
+// allowedKeyID checks that the requested key id is one of the allowed
+// key ids of auth and returns it. Tokens without AllowedKeyIDs ignore
+// the request and sign with their signer.
+func allowedKeyID(auth authorization, requested string) (string, error) {
+	if len(auth.AllowedKeyIDs) == 0 || requested == "" {
+		return "", nil
+	}
+	if !stringInSlice(requested, auth.AllowedKeyIDs) {
+		return "", errors.Wrapf(errKeyIDNotAllowed, "key id %q", requested)
+	}
+	return requested, nil
+}
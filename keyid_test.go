@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerKeyID(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].AllowedKeyIDs = []string{"testapp-android-2024", "testapp-android-2025"}
+	useTestConf(t, testConf)
+
+	testcases := []struct {
+		name           string
+		token          string
+		fields         map[string]string
+		query          string
+		expectedStatus int
+		expectedKeyID  string
+	}{
+		{"allowed key id", testConf.Authorizations[2].ClientToken, map[string]string{"keyid": "testapp-android-2025"}, "", http.StatusCreated, "testapp-android-2025"},
+		{"allowed key id in the query", testConf.Authorizations[2].ClientToken, nil, "keyid=testapp-android-2024", http.StatusCreated, "testapp-android-2024"},
+		{"no key id", testConf.Authorizations[2].ClientToken, nil, "", http.StatusCreated, "testapp-android"},
+		{"denied key id", testConf.Authorizations[2].ClientToken, map[string]string{"keyid": "other-signer"}, "", http.StatusForbidden, ""},
+		{"tokens without allowed key ids ignore it", testConf.Authorizations[0].ClientToken, map[string]string{"keyid": "other-signer"}, "", http.StatusCreated, "extensions-ecdsa"},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []signaturerequest
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					if err := json.NewDecoder(req.Body).Decode(&upstreamRequests); err != nil {
+						t.Fatal(err)
+					}
+					return newSignedFileResponse([]byte("signed")), nil
+				})
+			}
+			req := newMultipartSignRequestWithFields(t, tt.token, []byte("unsigned"), tt.fields)
+			req.URL.RawQuery = tt.query
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusCreated {
+				return
+			}
+			if len(upstreamRequests) != 1 || upstreamRequests[0].KeyID != tt.expectedKeyID {
+				t.Fatalf("upstream received %+v expected key id %q", upstreamRequests, tt.expectedKeyID)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// lintConfig looks for mistakes in the authorizations and forwarded
+// headers of c that are valid but probably not what was meant, and returns a warning for
+// each. They are empty when nothing looks wrong.
+//
+// Authorizations of the same user and signer are only reported when
+// they also sign the same add-on, since add-on tokens of a user
+// commonly share a signer.
+func lintConfig(c configuration) (warnings []string) {
+	// index of the first authorization of each user, signer and add-on
+	seenUserSigners := map[[3]string]int{}
+	for i, auth := range c.tokenStore().Authorizations() {
+		key := [3]string{auth.User, auth.Signer, auth.AddonID}
+		if first, ok := seenUserSigners[key]; ok {
+			warnings = append(warnings, fmt.Sprintf("authorizations %d and %d both give user %q signer %q", first, i, auth.User, auth.Signer))
+		} else {
+			seenUserSigners[key] = i
+		}
+		if len(auth.pkcs7Digests()) > 0 && len(auth.AddonCOSEAlgorithms) == 0 {
+			warnings = append(warnings, fmt.Sprintf("authorization %d sets a PKCS7 digest without any COSE algorithms", i))
+		}
+		if auth.signatureType() != signatureTypeXPI && (len(auth.pkcs7Digests()) > 0 || len(auth.AddonCOSEAlgorithms) > 0) {
+			warnings = append(warnings, fmt.Sprintf("authorization %d sets add-on options but does not sign add-ons", i))
+		}
+		if !auth.AllowURLInput && len(auth.AllowedInputHosts) > 0 {
+			warnings = append(warnings, fmt.Sprintf("authorization %d sets allowed input hosts without allowing url input", i))
+		}
+		warnings = append(warnings, lintCIDRs(i, auth.AllowedCIDRs)...)
+		for _, signer := range append([]string{auth.Signer}, auth.AllowedSigners...) {
+			if signer = c.resolveSigner(signer); !c.allowsUpstreamSigner(signer) {
+				warnings = append(warnings, fmt.Sprintf("authorization %d signer %q is not an allowed upstream signer", i, signer))
+			}
+		}
+	}
+	for _, name := range c.ForwardHeaders {
+		if stringInSlice(http.CanonicalHeaderKey(name), hopByHopHeaders) {
+			warnings = append(warnings, fmt.Sprintf("forward header %q is a hop-by-hop header, which is never forwarded", name))
+		}
+	}
+	return warnings
+}
+
+// lintCIDRs returns a warning for each allowed CIDR of authorization
+// index that is already covered by another of its CIDRs
+func lintCIDRs(index int, cidrs []string) (warnings []string) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			// rejected by validateAuth
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	for i, inner := range nets {
+		for j, outer := range nets {
+			if i == j || !covers(outer, inner) {
+				continue
+			}
+			// report identical CIDRs once
+			if covers(inner, outer) && i < j {
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("authorization %d allowed CIDR %s is covered by %s", index, inner, outer))
+			break
+		}
+	}
+	return warnings
+}
+
+// covers returns whether every address of inner is in outer
+func covers(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
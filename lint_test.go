@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_lintConfig(t *testing.T) {
+	base := authorization{
+		ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+		User:        "alice",
+		Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+		Signer:      "testapp-android",
+	}
+	with := func(modify func(*authorization)) authorization {
+		auth := base
+		modify(&auth)
+		return auth
+	}
+	testcases := []struct {
+		name     string
+		auths    []authorization
+		expected []string
+	}{
+		{"no warnings", []authorization{base}, nil},
+		{
+			"duplicate user and signer",
+			[]authorization{base, with(func(a *authorization) { a.ClientToken = strings.Repeat("a", 64) })},
+			[]string{`authorizations 0 and 1 both give user "alice" signer "testapp-android"`},
+		},
+		{
+			"same user and signer for different add-ons",
+			[]authorization{
+				with(func(a *authorization) { a.AddonID = "one@allizom.org" }),
+				with(func(a *authorization) { a.AddonID = "two@allizom.org" }),
+			},
+			nil,
+		},
+		{
+			"PKCS7 digest without COSE algorithms",
+			[]authorization{with(func(a *authorization) { a.AddonID = "one@allizom.org"; a.AddonPKCS7Digest = "SHA256" })},
+			[]string{"authorization 0 sets a PKCS7 digest without any COSE algorithms"},
+		},
+		{
+			"add-on options on an apk token",
+			[]authorization{with(func(a *authorization) { a.AddonCOSEAlgorithms = []string{"ES256"} })},
+			[]string{"authorization 0 sets add-on options but does not sign add-ons"},
+		},
+		{
+			"allowed input hosts without url input",
+			[]authorization{with(func(a *authorization) { a.AllowedInputHosts = []string{"example.com"} })},
+			[]string{"authorization 0 sets allowed input hosts without allowing url input"},
+		},
+		{
+			"overlapping CIDRs",
+			[]authorization{with(func(a *authorization) {
+				a.AllowedCIDRs = []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/24", "192.168.0.0/24", "2001:db8::/32"}
+			})},
+			[]string{
+				"authorization 0 allowed CIDR 10.1.0.0/16 is covered by 10.0.0.0/8",
+				"authorization 0 allowed CIDR 192.168.0.0/24 is covered by 192.168.0.0/24",
+			},
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			warnings := lintConfig(configuration{Authorizations: testcase.auths})
+			if strings.Join(warnings, "\n") != strings.Join(testcase.expected, "\n") {
+				t.Fatalf("lintConfig() returned warnings %q expected %q", warnings, testcase.expected)
+			}
+		})
+	}
+
+	warnings := lintConfig(configuration{Authorizations: []authorization{base}, ForwardHeaders: []string{"X-Autograph-Route", "transfer-encoding"}})
+	if expected := `forward header "transfer-encoding" is a hop-by-hop header, which is never forwarded`; len(warnings) != 1 || warnings[0] != expected {
+		t.Fatalf("lintConfig() returned warnings %q expected %q", warnings, expected)
+	}
+}
+
+func Test_loadAndValidateConfStrictLint(t *testing.T) {
+	const conf = `autograph_base_url: http://localhost:8000/
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: testapp-android
+      allowed_input_hosts:
+      - example.com
+`
+	path := t.TempDir() + "/autograph-edge.yaml"
+	for _, strict := range []bool{false, true} {
+		data := conf
+		if strict {
+			data = "strict_lint: true\n" + conf
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadAndValidateConf(path, "")
+		if strict && (err == nil || !strings.Contains(err.Error(), "config lint found 1 problems")) {
+			t.Fatalf("loadAndValidateConf() with strict_lint returned error %v", err)
+		}
+		if !strict && err != nil {
+			t.Fatalf("loadAndValidateConf() without strict_lint returned error %v", err)
+		}
+	}
+
+	// the sample configurations have nothing to warn about
+	for _, path := range []string{"./autograph-edge.yaml", "./autograph-edge.json"} {
+		c, err := loadAndValidateConf(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warnings := lintConfig(c); len(warnings) > 0 {
+			t.Fatalf("lintConfig() of %s returned warnings %q", path, warnings)
+		}
+	}
+}
@@ -1,38 +1,447 @@
 package main
 
 import (
-	"crypto/subtle"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
 	_ "embed"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/mozlogrus"
 	"go.mozilla.org/sops"
 	"go.mozilla.org/sops/decrypt"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v2"
 )
 
 var (
 	errInvalidToken              = errors.New("invalid authorization token")
 	errInvalidMethod             = errors.New("only POST requests are supported")
+	errGetOnly                   = errors.New("only GET requests are supported")
 	errMissingBody               = errors.New("missing request body")
 	errAutographBadStatusCode    = errors.New("failed to retrieve signature from autograph")
 	errAutographBadResponseCount = errors.New("received an invalid number of responses from autograph")
 	errAutographEmptyResponse    = errors.New("autograph returned an invalid empty response")
 
-	conf configuration
+	// conf is the live configuration along with the indexes derived
+	// from it. It is never modified once set, so that a reload swaps
+	// the pointer to a fully built new one.
+	conf = &configuration{}
+	// confLock guards conf so it can be swapped when the
+	// configuration is reloaded while requests are being served
+	confLock sync.RWMutex
+	// reloadLock serializes reloads so that a slower reload cannot
+	// swap in an older file over a newer one
+	reloadLock sync.Mutex
+
+	// cfgFile and autographBaseURL hold the command line arguments
+	// so the configuration can be reloaded with the same settings
+	cfgFile          string
+	autographBaseURL string
+
+	// shuttingDown is set when the server is draining in-flight
+	// requests before exiting
+	shuttingDown atomic.Bool
+
+	// shutdownTracing flushes the spans not exported yet
+	shutdownTracing = func(context.Context) error { return nil }
 )
 
 type configuration struct {
-	BaseURL        string `yaml:"autograph_base_url"`
+	// BaseURLs are the base URLs of the upstream autograph backends,
+	// which are tried in order until one of them succeeds
+	BaseURLs       upstreamURLs `yaml:"autograph_base_url"`
 	Authorizations []authorization
+
+	// BaseURLWeights spreads the signing requests between the BaseURLs
+	// with weighted round-robin, failing over to the others in order,
+	// instead of always trying them in order. It has a weight for each
+	// of them, or none.
+	BaseURLWeights []int `yaml:"autograph_base_url_weights"`
+
+	// TokenStore loads the authorizations from an HTTP endpoint
+	// instead of the configuration file when its URL is set
+	TokenStore tokenStoreConfig `yaml:"token_store"`
+
+	// tokens is the token store loaded from TokenStore
+	tokens tokenStore
+
+	// fileTokens indexes the Authorizations, built by setConf
+	fileTokens *fileTokenStore
+
+	// fileSHA256 is the hex SHA256 of the raw configuration file, or
+	// of its fragments in order when loaded from a directory, reported by /__version__ to compare the config of the nodes
+	fileSHA256 string
+
+	// UpstreamMaxAttempts is the maximum number of times a signing
+	// request is sent to autograph when it fails with a connection
+	// error or a 5xx. Defaults to 3.
+	UpstreamMaxAttempts int `yaml:"upstream_max_attempts"`
+
+	// UpstreamRetryDelay is the delay before the first retry, which
+	// doubles after each attempt. Defaults to 200ms.
+	UpstreamRetryDelay time.Duration `yaml:"upstream_retry_delay"`
+
+	// MaxUploadBytes is the maximum size of a signing request body.
+	// Defaults to 200MiB and can be overridden per authorization.
+	MaxUploadBytes int64 `yaml:"max_upload_bytes"`
+
+	// MaxConnections is the maximum number of client connections open
+	// at once, over which new ones wait to be accepted. Defaults to
+	// 1024. It is read at startup and not changed by reloads.
+	MaxConnections int `yaml:"max_connections"`
+
+	// BodyBufferSize is the size of the pooled buffers uploads are
+	// read into. Larger uploads get their own buffer. Defaults to 1MiB.
+	BodyBufferSize int64 `yaml:"body_buffer_size"`
+
+	// MaxHeaderBytes is the maximum size of the request headers.
+	// Defaults to 16KiB. It is read at startup and not changed by reloads.
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+
+	// RequestTimeout is the maximum duration of a signing request,
+	// including the calls to autograph. Defaults to 60s.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+
+	// BodyReadTimeout is the maximum duration of reading the body of a
+	// signing request, after which it is aborted with a 408. Defaults
+	// to the RequestTimeout.
+	BodyReadTimeout time.Duration `yaml:"body_read_timeout"`
+
+	// MaxClockSkew is how far the X-Autograph-Timestamp or Date header
+	// of a signing request can be from the server time. Defaults to 5m.
+	MaxClockSkew time.Duration `yaml:"max_clock_skew"`
+
+	// ReadHeaderTimeout is the maximum duration of reading the headers
+	// of a request. Defaults to 10s. It is read at startup and not
+	// changed by reloads.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+
+	// ReadTimeout is the maximum duration of reading a whole request.
+	// Signing requests replace it with BodyReadTimeout, counted from
+	// the start of the handler, so it can be shorter or longer than
+	// large uploads need. Defaults to 5m. It is read at startup and not
+	// changed by reloads.
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+
+	// WriteTimeout is the maximum duration from the end of the headers
+	// of a request to the end of its response. It can't be shorter than
+	// the RequestTimeout. Defaults to 5m. It is read at startup and not
+	// changed by reloads.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// HeartbeatTimeout is the maximum duration of a call to the
+	// autograph heartbeat. Defaults to 5s.
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`
+
+	// HeartbeatCheckCredentials authenticates the autograph credentials
+	// of the authorizations in each /__heartbeat__, which costs a call
+	// to autograph per distinct credential, and reports them in its
+	// checks
+	HeartbeatCheckCredentials bool `yaml:"heartbeat_check_credentials"`
+
+	// HeartbeatPollInterval checks the autograph heartbeat in the
+	// background at this interval, and makes /__heartbeat__ return the
+	// latest result instead of calling autograph. It is disabled when
+	// zero. It is read at startup and not changed by reloads.
+	HeartbeatPollInterval time.Duration `yaml:"heartbeat_poll_interval"`
+
+	// UpstreamLatencyBuckets are the upper bounds in seconds of the
+	// buckets of the autograph_edge_upstream_duration_seconds histogram.
+	// Defaults to the prometheus default buckets. It is read at startup
+	// and not changed by reloads.
+	UpstreamLatencyBuckets []float64 `yaml:"upstream_latency_buckets"`
+
+	// SlowRequestThreshold logs a warning for the signing requests
+	// whose autograph call took longer, on top of their usual log
+	// line. It is disabled when zero.
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold"`
+
+	// CircuitBreakerThreshold is the number of consecutive upstream
+	// failures of a signer after which its requests are rejected
+	// without calling autograph. Zero, the default, disables it.
+	CircuitBreakerThreshold int `yaml:"circuit_breaker_threshold"`
+
+	// CircuitBreakerCooldown is how long an open circuit breaker
+	// waits before letting a probe request through. Defaults to 30s.
+	CircuitBreakerCooldown time.Duration `yaml:"circuit_breaker_cooldown"`
+
+	// MaxConcurrentUpstream is the maximum number of signing requests
+	// in flight to autograph at once. Requests over the limit wait for
+	// a slot until their request timeout. Zero, the default, is unlimited.
+	MaxConcurrentUpstream int `yaml:"max_concurrent_upstream"`
+
+	// UpstreamQueue bounds the requests waiting for one of the max
+	// concurrent upstream slots, which are shared round-robin between
+	// the tokens with waiting requests
+	UpstreamQueue upstreamQueueConfig `yaml:"upstream_queue"`
+
+	// SigningWorkers calls autograph for the signing requests from a
+	// fixed pool of workers pulling them from a bounded queue
+	SigningWorkers workerPoolConfig `yaml:"signing_workers"`
+
+	// StartupCheck checks at startup that autograph is reachable and
+	// knows the configured signers. With warn, problems are logged; with
+	// strict, they stop the edge from starting. It is off when empty.
+	StartupCheck string `yaml:"startup_check"`
+
+	// WarmUp opens a connection to each distinct autograph backend with
+	// a heartbeat call at startup, so that the first signing requests
+	// don't wait for the connection and TLS handshake. Backends that
+	// are down are skipped.
+	WarmUp bool `yaml:"warm_up"`
+
+	// StrictLint makes the warnings of lintConfig fail the load or
+	// reload of the configuration instead of only being logged
+	StrictLint bool `yaml:"strict_lint"`
+
+	// ServiceCredential is the hawk credential used for all the calls
+	// to autograph instead of the user and key of each authorization
+	// when it is enabled
+	ServiceCredential serviceCredentialConfig `yaml:"service_credential"`
+
+	// ServerTLS makes the edge serve HTTPS with its cert and key. It
+	// is enabled at startup, and reloads only swap the certificate.
+	ServerTLS serverTLSConfig `yaml:"server_tls"`
+
+	// UpstreamTLS configures mutual TLS for the calls to autograph.
+	// It is read at startup and not changed by reloads.
+	UpstreamTLS upstreamTLSConfig `yaml:"upstream_tls"`
+
+	// UpstreamConnections tunes the pool of connections to autograph.
+	// It is read at startup and not changed by reloads.
+	UpstreamConnections upstreamConnConfig `yaml:"upstream_connections"`
+
+	// MaxBatchParts is the maximum number of files signed in a single
+	// batch request. Defaults to 10.
+	MaxBatchParts int `yaml:"max_batch_parts"`
+
+	// MaxMultipartParts is the maximum number of parts, files and
+	// fields, of a multipart signing request. Defaults to 64.
+	MaxMultipartParts int `yaml:"max_multipart_parts"`
+
+	// MaxMultipartBytes is the maximum size of a multipart signing
+	// request uploading more than one file. Single file uploads are
+	// only limited by the max upload bytes. Defaults to 50MiB.
+	MaxMultipartBytes int64 `yaml:"max_multipart_bytes"`
+
+	// MaxMultipartFieldName is the maximum length of the field name
+	// of a part of a multipart signing request. Defaults to 256.
+	MaxMultipartFieldName int `yaml:"max_multipart_field_name"`
+
+	// MaxMultipartPartHeaders is the maximum number of headers of a
+	// part of a multipart signing request. Defaults to 16.
+	MaxMultipartPartHeaders int `yaml:"max_multipart_part_headers"`
+
+	// ResponseCache bounds the cache of the signed files of the
+	// authorizations with AllowCache
+	ResponseCache responseCacheConfig `yaml:"response_cache"`
+
+	// Idempotency bounds the signed files kept to replay the signing
+	// requests retried with the same Idempotency-Key header
+	Idempotency idempotencyConfig `yaml:"idempotency"`
+
+	// Nonces bounds the X-Nonce values remembered to reject replayed
+	// requests of the tokens with RequireNonce
+	Nonces nonceConfig `yaml:"nonces"`
+
+	// Metrics selects the backend of the signing request metrics.
+	// It is read at startup and not changed by reloads.
+	Metrics metricsConfig `yaml:"metrics"`
+
+	// Tracing exports OpenTelemetry traces of the signing requests.
+	// It is read at startup and not changed by reloads.
+	Tracing tracingConfig `yaml:"tracing"`
+
+	// Audit writes a record of each signing request to a file or an
+	// HTTP endpoint. It is read at startup and not changed by reloads.
+	Audit auditConfig `yaml:"audit"`
+
+	// CORS lets browsers on other origins call the signing endpoint
+	CORS corsConfig `yaml:"cors"`
+
+	// ProxyProtocol expects every connection to start with a PROXY
+	// protocol v1 or v2 header, as sent by TCP load balancers, whose
+	// source address is used as the address of the client. It must only
+	// be set behind such a load balancer, and is read at startup and not
+	// changed by reloads.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+
+	// TrustedProxies is the number of proxies in front of the edge
+	// that append to X-Forwarded-For, used to find the client IP
+	TrustedProxies int `yaml:"trusted_proxies"`
+
+	// AllowedUpstreamSigners are the only autograph signer ids
+	// requests are forwarded to when set, whatever the authorizations
+	// say, to contain a bad token entry
+	AllowedUpstreamSigners []string `yaml:"allowed_upstream_signers"`
+
+	// UpstreamHeaders sets the User-Agent and client header of the
+	// signing requests, attributing them to the edge instance and the
+	// original client in the autograph logs
+	UpstreamHeaders upstreamHeadersConfig `yaml:"upstream_headers"`
+
+	// OutputOptions are the output conversions autograph offers, like
+	// a re-zipalign of APKs, that the clients of tokens with
+	// AllowOutputOptions can ask for in the output form field
+	OutputOptions []string `yaml:"output_options"`
+
+	// SignerAliases maps old signer names, used by authorizations
+	// or in signing paths, to the autograph signer id they are sent
+	// to autograph as, for example while migrating to a new signer
+	SignerAliases map[string]string `yaml:"signer_aliases"`
+
+	// ServerHeader is the Server header of the responses. It is
+	// omitted when empty, so it doesn't reveal the implementation.
+	ServerHeader string `yaml:"server_header"`
+
+	// RootStatus serves the service name, version and uptime at the
+	// root path instead of a 404, without calling autograph
+	RootStatus bool `yaml:"root_status"`
+
+	// AuthHeader is the request header carrying the client tokens and
+	// the admin token, with or without a Bearer scheme. Defaults to
+	// Authorization.
+	AuthHeader string `yaml:"auth_header"`
+
+	// ForwardHeaders are the request headers, like a routing header,
+	// copied verbatim onto the signing requests to autograph. No other
+	// client header is forwarded, and hop-by-hop headers never are.
+	ForwardHeaders []string `yaml:"forward_headers"`
+
+	// AuditMetadataHeaders are the X-Meta-* request headers, like a
+	// ticket ID, added to the audit records and the request logs of
+	// the signing requests. They are never forwarded to autograph.
+	AuditMetadataHeaders []string `yaml:"audit_metadata_headers"`
+
+	// MaxAuditMetadataBytes is the maximum length of the value of an
+	// audit metadata header, over which the request fails. Defaults
+	// to 256.
+	MaxAuditMetadataBytes int `yaml:"max_audit_metadata_bytes"`
+
+	// SigningEnabled makes the signing requests fail with a 503 and the
+	// signing_disabled code when false, while the heartbeats and version
+	// keep working. It defaults to true unless the build says otherwise,
+	// and is read at startup and not changed by reloads.
+	SigningEnabled *bool `yaml:"signing_enabled"`
+
+	// MaintenanceMode makes the signing requests fail with a 503 and
+	// the maintenance code without calling autograph, while the
+	// heartbeats and version keep working. It can be toggled by a
+	// reload.
+	MaintenanceMode bool `yaml:"maintenance_mode"`
+
+	// MaintenanceMessage replaces the error message of the signing
+	// requests rejected in maintenance mode
+	MaintenanceMessage string `yaml:"maintenance_message"`
+
+	// MemorySoftLimit makes the signing requests fail with a 503 and
+	// the overloaded code while the heap in use is over this many
+	// bytes, until it is back under 90% of it. It is disabled when
+	// zero.
+	MemorySoftLimit int64 `yaml:"memory_soft_limit"`
+
+	// VerifyCertificates maps signer IDs to a PEM file of the certificates
+	// autograph signs with, or their CA, which the XPIs checked by
+	// /verify must chain to. The tokens of other signers cannot verify.
+	VerifyCertificates map[string]string `yaml:"verify_certificates"`
+
+	// verifyRoots are the certificates loaded from VerifyCertificates
+	verifyRoots map[string]*x509.CertPool
+
+	// PartialResponse is what happens to a signing response the
+	// upstream fails in the middle of, once part of the signed file was
+	// sent: abort drops the connection and trailer ends the response
+	// with an X-Autograph-Edge-Incomplete: true trailer. Both log the
+	// truncation. Defaults to abort.
+	PartialResponse string `yaml:"partial_response"`
+
+	// AdminToken grants access to the /__config__ debug endpoint and
+	// the /__usage__ report, which are disabled when it is empty
+	AdminToken string `yaml:"admin_token"`
+
+	// UsageWindow is the rolling window of the signing requests
+	// reported by /__usage__. Zero reports them since the process
+	// started.
+	UsageWindow time.Duration `yaml:"usage_window"`
+
+	// ShutdownGracePeriod is how long in-flight requests have to
+	// complete when the process is asked to stop. Defaults to 30s.
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+
+	// DebugErrorEndpoint serves /__error__?code=<code>, returning the
+	// error envelope and status of any error code to test the alerting.
+	// It can only be set in builds with the debug tag, never in
+	// production ones. It is read at startup and not changed by reloads.
+	DebugErrorEndpoint bool `yaml:"debug_error_endpoint"`
+
+	// PprofAddress is the address of a separate listener serving the
+	// net/http/pprof handlers, like localhost:6060. They are disabled
+	// when it is empty. It is read at startup and not changed by reloads.
+	PprofAddress string `yaml:"pprof_address"`
+}
+
+// upstreamURLs is a list of autograph base URLs that can be
+// configured either as a single string or as a list of strings
+type upstreamURLs []string
+
+// UnmarshalYAML accepts a single URL for backward compatibility
+// with configurations that only have one upstream autograph
+func (u *upstreamURLs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*u = upstreamURLs{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*u = list
+	return nil
+}
+
+// supportedCOSEAlgorithms are the COSE algorithms autograph
+// can sign add-ons with
+var supportedCOSEAlgorithms = []string{"ES256", "ES384", "ES512", "PS256"}
+
+const (
+	defaultUpstreamMaxAttempts = 3
+	defaultUpstreamRetryDelay  = 200 * time.Millisecond
+	defaultMaxUploadBytes      = 200 << 20
+	defaultMaxHeaderBytes      = 16 << 10
+	defaultRequestTimeout      = 60 * time.Second
+	defaultHeartbeatTimeout    = 5 * time.Second
+	defaultReadHeaderTimeout   = 10 * time.Second
+	defaultReadTimeout         = 5 * time.Minute
+	defaultWriteTimeout        = 5 * time.Minute
+	defaultShutdownGracePeriod = 30 * time.Second
+	defaultAuthHeader          = "Authorization"
+
+	defaultCircuitBreakerCooldown = 30 * time.Second
+)
+
+// corsConfig lists the origins of browser clients allowed to sign
+type corsConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
 }
 
 type authorization struct {
@@ -43,6 +452,170 @@ type authorization struct {
 	AddonID             string
 	AddonPKCS7Digest    string
 	AddonCOSEAlgorithms []string
+
+	// AddonPKCS7Digests are the PKCS7 digests clients can pick from in
+	// the pkcs7_digest form field, the first being the default. It
+	// replaces AddonPKCS7Digest, which can't be set with it.
+	AddonPKCS7Digests []string
+
+	// ClientTokenHash is a bcrypt hash of the client token that can
+	// be configured instead of the plaintext ClientToken
+	ClientTokenHash string `yaml:"client_token_hash"`
+
+	// RateLimit is the maximum number of signing requests per
+	// minute allowed for the token. Zero means unlimited.
+	RateLimit int `yaml:"rate_limit"`
+
+	// MaxConcurrent is the maximum number of signing requests of the
+	// token in flight at once. Zero means unlimited.
+	MaxConcurrent int `yaml:"max_concurrent"`
+
+	// MaxUploadBytes overrides the maximum size of the request
+	// body for the token when set
+	MaxUploadBytes int64 `yaml:"max_upload_bytes"`
+
+	// MaxOutputBytes is the maximum size of the signed file relayed to
+	// the client of the token. Larger files fail with a 502, or abort
+	// the response once part of it was sent. Zero means unlimited.
+	MaxOutputBytes int64 `yaml:"max_output_bytes"`
+
+	// AllowedCIDRs restricts the client IPs the token can be used
+	// from when set
+	AllowedCIDRs []string `yaml:"allowed_cidrs"`
+
+	// AllowRequestOptions lets clients of the token set the
+	// forwardable autograph signing options in their requests
+	AllowRequestOptions bool `yaml:"allow_request_options"`
+
+	// UpstreamPath overrides the path of the autograph signing
+	// endpoint, relative to the base URLs, when set
+	UpstreamPath string `yaml:"upstream_path"`
+
+	// Disabled rejects the requests of the token with a 503 while
+	// keeping it in the configuration, for example during an incident
+	Disabled bool `yaml:"disabled"`
+
+	// SignatureType is what the token signs, one of xpi, apk or data.
+	// Defaults to xpi for add-on tokens and apk otherwise.
+	SignatureType string `yaml:"signature_type"`
+
+	// AllowURLInput lets clients of the token send the URL of the
+	// file to sign instead of uploading it. The URL must be on one of
+	// the AllowedInputHosts.
+	AllowURLInput     bool     `yaml:"allow_url_input"`
+	AllowedInputHosts []string `yaml:"allowed_input_hosts"`
+
+	// AllowCache returns the signed file of an input already signed
+	// with the same options from the response cache instead of calling
+	// autograph. It must not be set for signers that add timestamps.
+	AllowCache bool `yaml:"allow_cache"`
+
+	// AllowedContentTypes restricts the content types of the inputs of
+	// the token when set. Both the type declared with an upload and
+	// the type sniffed from the input must be allowed.
+	AllowedContentTypes []string `yaml:"allowed_content_types"`
+
+	// AllowDetached lets clients of the token ask with ?detached=true
+	// for the signature of their add-on or data alone, base64 encoded
+	// in JSON, instead of the signed file
+	AllowDetached bool `yaml:"allow_detached"`
+
+	// AllowRawResponse lets clients of the token ask with ?raw=true
+	// for the autograph JSON response instead of the signed file
+	AllowRawResponse bool `yaml:"allow_raw_response"`
+
+	// AllowedSigners are the signers other than Signer that requests
+	// to /sign/<signer> can pick. They are called with the same hawk
+	// credentials and options as Signer.
+	AllowedSigners []string `yaml:"allowed_signers"`
+
+	// RequireTimestamp rejects the requests of the token that don't
+	// send an X-Autograph-Timestamp or Date header
+	RequireTimestamp bool `yaml:"require_timestamp"`
+
+	// VerifyAPK checks that the APKs signed for the token are valid
+	// ZIPs with a signature block before returning them
+	VerifyAPK bool `yaml:"verify_apk"`
+
+	// RequiredHeaders are the headers, like a change reference, that
+	// every request of the token must send. Their values are logged
+	// with the completed request.
+	RequiredHeaders []string `yaml:"required_headers"`
+
+	// AllowedKeyIDs are the autograph key ids of Signer that requests
+	// can pick with the keyid parameter instead of the default one
+	AllowedKeyIDs []string `yaml:"allowed_keyids"`
+
+	// DisableResponseGzip returns the signed files of the token
+	// uncompressed even to clients accepting gzip, for formats like
+	// APKs that are already compressed
+	DisableResponseGzip bool `yaml:"disable_response_gzip"`
+
+	// AllowedAddonIDs are glob patterns, like "*@team.example.com", of
+	// the add-on ids that requests of an xpi token can sign with the
+	// addon_id parameter instead of AddonID
+	AllowedAddonIDs []string `yaml:"allowed_addon_ids"`
+
+	// AllowCOSEOverride lets clients of an add-on token with COSE
+	// algorithms send the cose_issuer and cose_subject hints of the
+	// COSE signatures to autograph
+	AllowCOSEOverride bool `yaml:"allow_cose_override"`
+
+	// AllowValidityWindow lets clients send the not_before and not_after
+	// validity window of the certificate generated by signers that
+	// accept one
+	AllowValidityWindow bool `yaml:"allow_validity_window"`
+
+	// Deduplicate shares the autograph call of a signing request with
+	// the identical requests of the token arriving while it is in
+	// flight. Don't set it for signers that add timestamps to their
+	// signatures.
+	Deduplicate bool `yaml:"deduplicate"`
+
+	// AllowOutputOptions lets clients send an output conversion of
+	// the signed file, one of the configured output options
+	AllowOutputOptions bool `yaml:"allow_output_options"`
+
+	// UpstreamTimeout overrides the RequestTimeout for the requests of
+	// the token when set, for signers like APKs that take much longer
+	// than others. It can't be longer than the WriteTimeout.
+	UpstreamTimeout time.Duration `yaml:"upstream_timeout"`
+
+	// RequireNonce rejects the requests of the token without a unique
+	// X-Nonce header, or repeating one seen within the nonce window,
+	// so that a captured request can't be replayed
+	RequireNonce bool `yaml:"require_nonce"`
+
+	// MaxPriority is the highest priority, high, normal or low, the
+	// requests of the token can ask for in the X-Priority header when
+	// waiting for an upstream slot. Defaults to normal.
+	MaxPriority string `yaml:"max_priority"`
+
+	// ValidFrom and ValidUntil are the RFC3339 times between which
+	// the token is accepted, so that rotated tokens expire on their
+	// own. Either can be left unset.
+	ValidFrom  time.Time `yaml:"valid_from"`
+	ValidUntil time.Time `yaml:"valid_until"`
+}
+
+const (
+	signatureTypeXPI  = "xpi"
+	signatureTypeAPK  = "apk"
+	signatureTypeData = "data"
+)
+
+var supportedSignatureTypes = []string{signatureTypeXPI, signatureTypeAPK, signatureTypeData}
+
+// signatureType returns the signature type of auth, inferring it from
+// the add-on ID when it is not set
+func (auth authorization) signatureType() string {
+	if auth.SignatureType != "" {
+		return auth.SignatureType
+	}
+	if auth.AddonID != "" {
+		return signatureTypeXPI
+	}
+	return signatureTypeAPK
 }
 
 //go:generate ./version.sh version.json
@@ -57,121 +630,1002 @@ func init() {
 func main() {
 	parseArgsAndLoadConf()
 	server := prepareServer()
+	handleReloadSignal()
+	shutdownDone := handleShutdownSignal(server)
+	c := currentConf()
+	if c.PprofAddress != "" {
+		go servePprof(c.PprofAddress)
+	}
 
-	log.Infof("starting autograph-edge on port 8080 with upstream autograph base URL %s", conf.BaseURL)
-	err := server.ListenAndServe()
+	ln, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if c.ProxyProtocol {
+		ln = newProxyProtocolListener(ln, c.ReadHeaderTimeout)
+	}
+	ln = newLimitListener(ln, c.MaxConnections)
+	if server.TLSConfig != nil {
+		log.Infof("starting autograph-edge with TLS on port 8080 with upstream autograph base URLs %s", strings.Join(c.BaseURLs, ", "))
+		// the certificate comes from the GetCertificate of TLSConfig
+		err = server.ServeTLS(ln, "", "")
+	} else {
+		log.Infof("starting autograph-edge on port 8080 with upstream autograph base URLs %s", strings.Join(c.BaseURLs, ", "))
+		err = server.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
 
 func parseArgsAndLoadConf() {
-	var (
-		cfgFile          string
-		autographBaseURL string
-	)
 	flag.StringVar(&cfgFile, "c", "autograph-edge.yaml", "Path to configuration file")
 	flag.StringVar(&autographBaseURL, "u", "", "Upstream Autograph Base URL with a trailing slash e.g. http://localhost:8000/")
+	checkConfigOnly := flag.Bool("checkconfig", false, "Validate the configuration, print it with the secrets redacted and exit")
 	flag.Parse()
 
-	err := conf.loadFromFile(cfgFile)
+	if *checkConfigOnly {
+		// keep stdout for the summary
+		log.SetOutput(os.Stderr)
+		if err := checkConfig(cfgFile, autographBaseURL, os.Stdout); err != nil {
+			fmt.Fprint(os.Stderr, formatConfigError(cfgFile, err))
+			os.Exit(exitInvalidConfig)
+		}
+		os.Exit(0)
+	}
+
+	newConf, err := loadAndValidateConf(cfgFile, autographBaseURL)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprint(os.Stderr, formatConfigError(cfgFile, err))
+		os.Exit(exitInvalidConfig)
+	}
+	setConf(newConf)
+	signingEnabled = newConf.isSigningEnabled()
+	if !signingEnabled {
+		log.Warn("signing is disabled by the configuration, signing requests will fail with a 503")
+	}
+
+	if len(newConf.UpstreamLatencyBuckets) > 0 {
+		setUpstreamLatencyBuckets(newConf.UpstreamLatencyBuckets)
 	}
-	for i, auth := range conf.Authorizations {
-		err = validateAuth(auth)
+
+	if newConf.ServerTLS.enabled() {
+		serverCert, err = newServerCertificate(newConf.ServerTLS)
 		if err != nil {
-			log.Fatalf("error validating auth %d %q", i, err)
+			log.Fatal(err)
 		}
 	}
-	err = findDuplicateClientToken(conf.Authorizations)
+
+	upstreamTransport, err = newUpstreamTransport(newConf.UpstreamTLS, newConf.UpstreamConnections)
 	if err != nil {
 		log.Fatal(err)
 	}
+	autographClient = &http.Client{Transport: upstreamTransport}
 
-	if autographBaseURL != "" {
-		log.Infof("using commandline autograph URL %s instead of conf %s", autographBaseURL, conf.BaseURL)
-		conf.BaseURL = autographBaseURL
+	metrics, err = newMetrics(newConf.Metrics)
+	if err != nil {
+		log.Fatal(err)
 	}
-	err = validateBaseURL(conf.BaseURL)
+
+	shutdownTracing, err = initTracing(newConf.Tracing)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if newConf.Audit.enabled() {
+		sink, err := newAuditSink(newConf.Audit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auditor = newAuditLogger(sink)
+	}
+
+	if newConf.StartupCheck != "" {
+		hbClient := &heartbeatClient{&http.Client{Transport: upstreamTransport, Timeout: newConf.HeartbeatTimeout}}
+		problems := checkSigners(newConf, hbClient, autographClient)
+		for _, problem := range problems {
+			log.Warnf("startup check: %s", problem)
+		}
+		if len(problems) > 0 && newConf.StartupCheck == startupCheckStrict {
+			log.Fatalf("startup check found %d problems with the configured signers", len(problems))
+		}
+	}
+
+	if newConf.WarmUp {
+		warmUpBackends(newConf.BaseURLs, &heartbeatClient{&http.Client{Transport: upstreamTransport, Timeout: newConf.HeartbeatTimeout}})
+	}
+}
+
+// loadAndValidateConf reads the configuration file at path, applies the
+// optional base URL override and returns it only if it passes validation
+func loadAndValidateConf(path, baseURLOverride string) (c configuration, err error) {
+	err = c.loadFromFile(path)
+	if err != nil {
+		return
+	}
+	var authErr error
+	if c.TokenStore.URL != "" {
+		if len(c.Authorizations) > 0 {
+			err = fmt.Errorf("authorizations cannot be set in the configuration file when a token store URL is set")
+			return
+		}
+		c.tokens, err = newHTTPTokenStore(c.TokenStore, &http.Client{Timeout: c.TokenStore.Timeout})
+	} else {
+		authErr = validateAuthorizations(c.Authorizations)
+	}
+	if err != nil {
+		return
+	}
+	// the rest of the configuration is still validated when some
+	// authorizations are invalid so that both are reported at once
+	defer func() {
+		if authErr != nil {
+			err = newConfigErrors(authErr, err)
+		}
+	}()
+	err = c.ServiceCredential.validate()
+	if err != nil {
+		return
+	}
+	err = c.ServerTLS.validate()
+	if err != nil {
+		return
+	}
+	if c.UpstreamTLS.enabled() {
+		_, err = c.UpstreamTLS.newTLSConfig()
+		if err != nil {
+			return
+		}
+	}
+	c.verifyRoots, err = loadVerifyCertificates(c.VerifyCertificates)
+	if err != nil {
+		return
+	}
+	err = c.Metrics.validate()
+	if err != nil {
+		return
+	}
+	if c.Tracing.enabled() {
+		err = c.Tracing.validate()
+		if err != nil {
+			return
+		}
+	}
+	if c.Audit.enabled() {
+		err = c.Audit.validate()
+		if err != nil {
+			return
+		}
+	}
+
+	if c.UpstreamMaxAttempts < 1 {
+		err = fmt.Errorf("upstream max attempts %d must be at least 1", c.UpstreamMaxAttempts)
+		return
+	}
+	if c.UpstreamRetryDelay < 0 {
+		err = fmt.Errorf("upstream retry delay %s is negative", c.UpstreamRetryDelay)
+		return
+	}
+	if c.TrustedProxies < 0 {
+		err = fmt.Errorf("trusted proxies %d is negative", c.TrustedProxies)
+		return
+	}
+	if c.MaxUploadBytes < 0 {
+		err = fmt.Errorf("max upload bytes %d is negative", c.MaxUploadBytes)
+		return
+	}
+	if c.MaxConnections < 0 {
+		err = fmt.Errorf("max connections %d is negative", c.MaxConnections)
+		return
+	}
+	if c.BodyBufferSize < 0 {
+		err = fmt.Errorf("body buffer size %d is negative", c.BodyBufferSize)
+		return
+	}
+	if c.MaxHeaderBytes < 0 {
+		err = fmt.Errorf("max header bytes %d is negative", c.MaxHeaderBytes)
+		return
+	}
+	if c.RequestTimeout < 0 {
+		err = fmt.Errorf("request timeout %s is negative", c.RequestTimeout)
+		return
+	}
+	if c.HeartbeatTimeout < 0 {
+		err = fmt.Errorf("heartbeat timeout %s is negative", c.HeartbeatTimeout)
+		return
+	}
+	if c.BodyReadTimeout < 0 || c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 {
+		err = fmt.Errorf("read timeouts cannot be negative")
+		return
+	}
+	if c.WriteTimeout < c.RequestTimeout {
+		err = fmt.Errorf("write timeout %s is shorter than the request timeout %s", c.WriteTimeout, c.RequestTimeout)
+		return
+	}
+	for i, auth := range c.Authorizations {
+		if c.WriteTimeout < auth.UpstreamTimeout {
+			err = fmt.Errorf("write timeout %s is shorter than the upstream timeout %s of authorization %d", c.WriteTimeout, auth.UpstreamTimeout, i)
+			return
+		}
+	}
+	if c.AuthHeader != "" && !isHeaderName(c.AuthHeader) {
+		err = fmt.Errorf("auth header %q is not a valid header name", c.AuthHeader)
+		return
+	}
+	err = c.UpstreamHeaders.validate()
+	if err != nil {
+		return
+	}
+	err = validateOutputOptions(c.OutputOptions)
+	if err != nil {
+		return
+	}
+	for _, name := range c.ForwardHeaders {
+		switch {
+		case !isHeaderName(name):
+			err = fmt.Errorf("forward header %q is not a valid header name", name)
+		case stringInSlice(http.CanonicalHeaderKey(name), upstreamRequestHeaders):
+			err = fmt.Errorf("forward header %q is set by the edge on upstream requests", name)
+		case c.AuthHeader != "" && strings.EqualFold(name, c.AuthHeader):
+			err = fmt.Errorf("forward header %q would forward the client tokens", name)
+		case isMetadataHeader(name):
+			err = fmt.Errorf("forward header %q is an audit metadata header", name)
+		}
+		if err != nil {
+			return
+		}
+	}
+	for _, name := range c.AuditMetadataHeaders {
+		if !isHeaderName(name) || !isMetadataHeader(name) {
+			err = fmt.Errorf("audit metadata header %q is not a valid %s* header name", name, metadataHeaderPrefix)
+			return
+		}
+	}
+	if c.MaxAuditMetadataBytes < 0 {
+		err = fmt.Errorf("max audit metadata bytes %d is negative", c.MaxAuditMetadataBytes)
+		return
+	}
+	if strings.IndexFunc(c.ServerHeader, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		err = fmt.Errorf("server header %q contains control characters", c.ServerHeader)
+		return
+	}
+	err = validateHistogramBuckets(c.UpstreamLatencyBuckets)
+	if err != nil {
+		err = fmt.Errorf("invalid upstream latency buckets: %v", err)
+		return
+	}
+	if c.MemorySoftLimit < 0 {
+		err = fmt.Errorf("memory soft limit %d is negative", c.MemorySoftLimit)
+		return
+	}
+	if c.SlowRequestThreshold < 0 {
+		err = fmt.Errorf("slow request threshold %s is negative", c.SlowRequestThreshold)
+		return
+	}
+	if c.HeartbeatPollInterval < 0 {
+		err = fmt.Errorf("heartbeat poll interval %s is negative", c.HeartbeatPollInterval)
+		return
+	}
+	if c.MaxClockSkew < 0 {
+		err = fmt.Errorf("max clock skew %s is negative", c.MaxClockSkew)
+		return
+	}
+	err = validateSignerAliases(c.SignerAliases)
+	if err != nil {
+		return
+	}
+	err = validateAllowedUpstreamSigners(c.AllowedUpstreamSigners)
+	if err != nil {
+		return
+	}
+	if c.ShutdownGracePeriod < 0 {
+		err = fmt.Errorf("shutdown grace period %s is negative", c.ShutdownGracePeriod)
+		return
+	}
+	if c.UsageWindow < 0 {
+		err = fmt.Errorf("usage window %s is negative", c.UsageWindow)
+		return
+	}
+	if c.PprofAddress != "" {
+		if _, _, err = net.SplitHostPort(c.PprofAddress); err != nil {
+			err = fmt.Errorf("invalid pprof address %q: %v", c.PprofAddress, err)
+			return
+		}
+	}
+	if c.DebugErrorEndpoint && !debugBuild {
+		err = fmt.Errorf("debug error endpoint can only be enabled in builds with the debug tag")
+		return
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < 60 {
+		err = fmt.Errorf("admin token is too short (%d chars) want at least 60", len(c.AdminToken))
+		return
+	}
+	for i, auth := range c.tokenStore().Authorizations() {
+		if c.AdminToken == "" {
+			break
+		}
+		if auth.ClientToken == c.AdminToken ||
+			(auth.ClientTokenHash != "" && bcrypt.CompareHashAndPassword([]byte(auth.ClientTokenHash), []byte(c.AdminToken)) == nil) {
+			err = fmt.Errorf("admin token is also the client token at position %d", i)
+			return
+		}
+	}
+	if c.CircuitBreakerThreshold < 0 {
+		err = fmt.Errorf("circuit breaker threshold %d is negative", c.CircuitBreakerThreshold)
+		return
+	}
+	if c.CircuitBreakerCooldown < 0 {
+		err = fmt.Errorf("circuit breaker cooldown %s is negative", c.CircuitBreakerCooldown)
+		return
+	}
+	if c.StartupCheck != "" && !stringInSlice(c.StartupCheck, supportedStartupChecks) {
+		err = fmt.Errorf("unknown startup check %q, supported checks are %s", c.StartupCheck, strings.Join(supportedStartupChecks, ", "))
+		return
+	}
+	if c.UpstreamConnections.MaxIdleConns < 0 || c.UpstreamConnections.MaxIdleConnsPerHost < 0 || c.UpstreamConnections.IdleConnTimeout < 0 {
+		err = fmt.Errorf("upstream connection settings %+v cannot be negative", c.UpstreamConnections)
+		return
+	}
+	if c.MaxConcurrentUpstream < 0 {
+		err = fmt.Errorf("max concurrent upstream %d is negative", c.MaxConcurrentUpstream)
+		return
+	}
+	err = c.UpstreamQueue.validate()
+	if err != nil {
+		return
+	}
+	err = c.SigningWorkers.validate()
+	if err != nil {
+		return
+	}
+	err = validatePartialResponse(c.PartialResponse)
+	if err != nil {
+		return
+	}
+	if c.MaxBatchParts < 0 {
+		err = fmt.Errorf("max batch parts %d is negative", c.MaxBatchParts)
+		return
+	}
+	if c.MaxMultipartParts < c.MaxBatchParts {
+		err = fmt.Errorf("max multipart parts %d is lower than the max batch parts %d", c.MaxMultipartParts, c.MaxBatchParts)
+		return
+	}
+	if c.MaxMultipartBytes < 0 {
+		err = fmt.Errorf("max multipart bytes %d is negative", c.MaxMultipartBytes)
+		return
+	}
+	if c.MaxMultipartFieldName < 0 {
+		err = fmt.Errorf("max multipart field name %d is negative", c.MaxMultipartFieldName)
+		return
+	}
+	if c.MaxMultipartPartHeaders < 0 {
+		err = fmt.Errorf("max multipart part headers %d is negative", c.MaxMultipartPartHeaders)
+		return
+	}
+	if c.ResponseCache.TTL < 0 || c.ResponseCache.MaxBytes < 0 || c.ResponseCache.MaxAge < 0 {
+		err = fmt.Errorf("response cache settings %+v cannot be negative", c.ResponseCache)
+		return
+	}
+	if c.Idempotency.Window < 0 || c.Idempotency.MaxBytes < 0 {
+		err = fmt.Errorf("idempotency settings %+v cannot be negative", c.Idempotency)
+		return
+	}
+	if c.Nonces.Window < 0 || c.Nonces.MaxEntries < 0 {
+		err = fmt.Errorf("nonce settings %+v cannot be negative", c.Nonces)
+		return
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		err = validateCORSOrigin(origin)
+		if err != nil {
+			return
+		}
+	}
+
+	if baseURLOverride != "" {
+		log.Infof("using commandline autograph URL %s instead of conf %s", baseURLOverride, strings.Join(c.BaseURLs, ", "))
+		c.BaseURLs = upstreamURLs{baseURLOverride}
+		c.BaseURLWeights = nil
+	}
+	if len(c.BaseURLs) == 0 {
+		err = fmt.Errorf("no upstream autograph base URL configured")
+		return
+	}
+	err = validateBackendWeights(c.BaseURLs, c.BaseURLWeights)
+	if err != nil {
+		return
+	}
+	for _, baseURL := range c.BaseURLs {
+		err = validateBaseURL(baseURL)
+		if err != nil {
+			return
+		}
+		for i, auth := range c.tokenStore().Authorizations() {
+			if authErr != nil {
+				break
+			}
+			err = validateUpstreamPath(baseURL, auth)
+			if err != nil {
+				err = errors.Wrapf(err, "error validating auth %d", i)
+				return
+			}
+		}
+	}
+	if authErr != nil {
+		return
+	}
+	c.logSignerAliases()
+	warnings := lintConfig(c)
+	for _, warning := range warnings {
+		log.Warnf("config lint: %s", warning)
+	}
+	if c.StrictLint && len(warnings) > 0 {
+		err = fmt.Errorf("config lint found %d problems with strict_lint set", len(warnings))
+	}
+	return
+}
+
+// setConf replaces the live configuration. The token index of c is
+// built before taking the lock, so that requests see either all of the
+// old configuration or all of the new one.
+func setConf(c configuration) {
+	c.fileTokens = newFileTokenStore(c.Authorizations)
+	// the upstream pools are only made by the next request at the new
+	// limit, so their size is reported as the configuration changes
+	upstreamSlotsLimit.Set(float64(c.MaxConcurrentUpstream))
+	signingWorkers.configure(c.SigningWorkers)
+	confLock.Lock()
+	defer confLock.Unlock()
+	conf = &c
+}
+
+// currentConf returns a snapshot of the live configuration that
+// remains consistent even if a reload happens while it is used
+func currentConf() configuration {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return *conf
+}
+
+// reloadConf loads the configuration file again and swaps it in. If the
+// new configuration is invalid, an error is returned and the current
+// configuration stays live. It is safe to call concurrently.
+func reloadConf() (configuration, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	newConf, err := loadAndValidateConf(cfgFile, autographBaseURL)
+	if err != nil {
+		return configuration{}, err
+	}
+	setConf(newConf)
+	// the listener is started with or without TLS, so reloads only
+	// swap its certificate
+	switch {
+	case serverCert != nil && newConf.ServerTLS.enabled():
+		if err = serverCert.load(newConf.ServerTLS); err != nil {
+			log.Errorf("failed to reload the server TLS certificate, keeping the current one: %v", err)
+		}
+	case serverCert != nil:
+		log.Warn("server TLS cannot be disabled by a reload, keeping the current certificate")
+	case newConf.ServerTLS.enabled():
+		log.Warn("server TLS cannot be enabled by a reload, restart to serve HTTPS")
+	}
+	return newConf, nil
+}
+
+// handleReloadSignal reloads the configuration every time the process
+// receives a SIGHUP
+func handleReloadSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			log.Infof("received SIGHUP, reloading configuration from %s", cfgFile)
+			_, err := reloadConf()
+			if err != nil {
+				log.Errorf("failed to reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			log.Infof("configuration reloaded from %s", cfgFile)
+		}
+	}()
+}
+
+// handleShutdownSignal gracefully shuts down server when the process
+// receives a SIGTERM or SIGINT. The returned channel is closed once
+// the in-flight requests have completed.
+func handleShutdownSignal(server *http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Infof("received %s, shutting down", sig)
+		err := shutdownServer(server, currentConf().ShutdownGracePeriod)
+		if err != nil {
+			log.Errorf("failed to gracefully shut down: %v", err)
+		}
+		auditor.close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = shutdownTracing(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("failed to flush traces: %v", err)
+		}
+		close(done)
+	}()
+	return done
+}
+
+// shutdownServer makes the heartbeats fail so load balancers stop
+// sending traffic, then stops accepting new connections and waits up
+// to gracePeriod for the in-flight requests to complete
+func shutdownServer(server *http.Server, gracePeriod time.Duration) error {
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	return server.Shutdown(ctx)
 }
 
 func prepareServer() *http.Server {
-	http.Handle("/sign",
+	mux := http.NewServeMux()
+	signHandler := handleWithMiddleware(
+		http.HandlerFunc(sigHandler),
+		setRequestID(),
+		setResponseHeaders(),
+		handleCORS(),
+	)
+	mux.Handle("/sign", signHandler)
+	mux.Handle(signPathPrefix, signHandler)
+	mux.Handle(jsonSignPath,
 		handleWithMiddleware(
-			http.HandlerFunc(sigHandler),
+			http.HandlerFunc(jsonSignHandler),
 			setRequestID(),
 			setResponseHeaders(),
+			handleCORS(),
 		),
 	)
-	http.Handle("/__version__",
+	mux.Handle("/signers",
 		handleWithMiddleware(
-			http.HandlerFunc(versionHandler),
+			http.HandlerFunc(signersHandler),
+			setRequestID(),
 			setResponseHeaders(),
 		),
 	)
-	http.Handle("/__heartbeat__",
+	mux.Handle("/verify",
 		handleWithMiddleware(
-			http.HandlerFunc(
-				heartbeatHandler(conf.BaseURL, &heartbeatClient{&http.Client{}}),
-			),
+			http.HandlerFunc(verifyHandler),
+			setRequestID(),
 			setResponseHeaders(),
 		),
 	)
-	http.Handle("/__lbheartbeat__",
+	mux.Handle("/__version__",
 		handleWithMiddleware(
 			http.HandlerFunc(versionHandler),
 			setResponseHeaders(),
+			allowGET(),
+		),
+	)
+	hbClient := &heartbeatClient{&http.Client{Transport: upstreamTransport}}
+	hbHandler := heartbeatHandler(hbClient)
+	var poller *heartbeatPoller
+	if interval := currentConf().HeartbeatPollInterval; interval > 0 {
+		poller = newHeartbeatPoller(hbClient, interval)
+		hbHandler = poller.handler(hbHandler)
+	}
+	mux.Handle("/__heartbeat__",
+		handleWithMiddleware(
+			hbHandler,
+			setResponseHeaders(),
+			allowGET(),
+		),
+	)
+	mux.Handle("/__lbheartbeat__",
+		handleWithMiddleware(
+			http.HandlerFunc(lbHeartbeatHandler),
+			setResponseHeaders(),
+			allowGET(),
+		),
+	)
+	mux.Handle("/__config__",
+		handleWithMiddleware(
+			http.HandlerFunc(configHandler),
+			setResponseHeaders(),
+		),
+	)
+	mux.Handle("/__usage__",
+		handleWithMiddleware(
+			http.HandlerFunc(usageHandler),
+			setResponseHeaders(),
+		),
+	)
+	mux.Handle("/__drain__",
+		handleWithMiddleware(
+			http.HandlerFunc(drainHandler),
+			setResponseHeaders(),
+		),
+	)
+	mux.Handle("/__reload__",
+		handleWithMiddleware(
+			http.HandlerFunc(reloadHandler),
+			setRequestID(),
+			setResponseHeaders(),
+		),
+	)
+	if debugBuild && currentConf().DebugErrorEndpoint {
+		mux.Handle("/__error__",
+			handleWithMiddleware(
+				http.HandlerFunc(debugErrorHandler),
+				setRequestID(),
+				setResponseHeaders(),
+			),
+		)
+	}
+	mux.Handle("/__metrics__",
+		handleWithMiddleware(
+			promhttp.Handler(),
+			setResponseHeaders(),
 		),
 	)
-	http.Handle("/",
+	mux.Handle("/",
 		handleWithMiddleware(
-			http.HandlerFunc(notFoundHandler),
+			http.HandlerFunc(rootHandler),
 			setResponseHeaders(),
 		),
 	)
-	return &http.Server{
-		Addr: ":8080",
+	server := &http.Server{
+		Addr:              ":8080",
+		Handler:           handleWithMiddleware(mux, setServerHeader()),
+		MaxHeaderBytes:    currentConf().MaxHeaderBytes,
+		ReadHeaderTimeout: currentConf().ReadHeaderTimeout,
+		ReadTimeout:       currentConf().ReadTimeout,
+		WriteTimeout:      currentConf().WriteTimeout,
 	}
+	if serverCert != nil {
+		server.TLSConfig = serverCert.newTLSConfig(currentConf().ServerTLS)
+	}
+	if poller != nil {
+		poller.start()
+		server.RegisterOnShutdown(poller.shutdown)
+	}
+	return server
 }
 
 // loadFromFile reads a configuration from a local file
 func (c *configuration) loadFromFile(path string) error {
-	var confData []byte
-	data, err := ioutil.ReadFile(path)
+	info, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
+	paths := []string{path}
+	if info.IsDir() {
+		// Glob sorts the fragments, so they merge in a stable order
+		paths, err = filepath.Glob(filepath.Join(path, "*.yaml"))
+		if err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			return errors.Errorf("configuration directory %q has no .yaml files", path)
+		}
+	}
+	h := sha256.New()
+	for _, fragment := range paths {
+		data, confData, err := readConfigFile(fragment)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load configuration file %q", fragment)
+		}
+		h.Write(data)
+		// the authorizations of each fragment are appended to the
+		// previous ones, while later fragments override the other
+		// settings they set. Unknown fields are rejected, so that a
+		// typo fails the load rather than silently drop a setting.
+		auths := c.Authorizations
+		c.Authorizations = nil
+		err = yaml.UnmarshalStrict(confData, &c)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load configuration file %q", fragment)
+		}
+		c.Authorizations = append(auths, c.Authorizations...)
+	}
+	c.fileSHA256 = fmt.Sprintf("%x", h.Sum(nil))
+	err = c.expandConfigEnv()
+	if err != nil {
+		return err
+	}
+	c.applyDefaults()
+	return nil
+}
+
+// readConfigFile returns the raw content of the configuration file at
+// path and its content decrypted with sops when it is encrypted
+func readConfigFile(path string) (data, confData []byte, err error) {
+	format, err := configFormat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
 	// Try to decrypt the conf using sops or load it as plaintext.
 	// If the configuration is not encrypted with sops, the error
 	// sops.MetadataNotFound will be returned, in which case we
 	// ignore it and continue loading the conf.
-	confData, err = decrypt.Data(data, "yaml")
+	confData, err = decrypt.Data(data, format)
 	if err != nil {
 		if err == sops.MetadataNotFound {
 			// not an encrypted file
 			confData = data
 		} else {
-			return errors.Wrap(err, "failed to load sops encrypted configuration")
+			return nil, nil, errors.Wrap(err, "failed to load sops encrypted configuration")
 		}
 	}
-	err = yaml.Unmarshal(confData, &c)
-	if err != nil {
-		return err
+	if format == "json" && !json.Valid(confData) {
+		return nil, nil, errors.Errorf("configuration file %q is not valid json", path)
 	}
-	return nil
+	// JSON is a subset of YAML, so both formats go through the yaml
+	// decoder and share the same field names and duration parsing
+	return data, confData, nil
 }
 
-func authorize(authHeader string) (auth authorization, err error) {
-	for _, auth := range conf.Authorizations {
-		if subtle.ConstantTimeCompare([]byte(authHeader), []byte(auth.ClientToken)) == 1 {
-			return auth, nil
+// configFormat returns the format of the configuration file at path,
+// "yaml" or "json", from its extension
+func configFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".json":
+		return "json", nil
+	default:
+		return "", errors.Errorf("unsupported configuration file extension %q, expected .yaml, .yml or .json", filepath.Ext(path))
+	}
+}
+
+// applyDefaults sets the default value of optional settings
+// that are missing from the configuration
+func (c *configuration) applyDefaults() {
+	if c.ServerTLS.MinVersion == "" {
+		c.ServerTLS.MinVersion = defaultServerTLSMinVersion
+	}
+	if c.UpstreamMaxAttempts == 0 {
+		c.UpstreamMaxAttempts = defaultUpstreamMaxAttempts
+	}
+	if c.UpstreamRetryDelay == 0 {
+		c.UpstreamRetryDelay = defaultUpstreamRetryDelay
+	}
+	if c.MaxUploadBytes == 0 {
+		c.MaxUploadBytes = defaultMaxUploadBytes
+	}
+	if c.MaxConnections == 0 {
+		c.MaxConnections = defaultMaxConnections
+	}
+	if c.BodyBufferSize == 0 {
+		c.BodyBufferSize = defaultBodyBufferSize
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if c.UpstreamConnections.MaxIdleConns == 0 {
+		c.UpstreamConnections.MaxIdleConns = defaultUpstreamMaxIdleConns
+	}
+	if c.UpstreamConnections.MaxIdleConnsPerHost == 0 {
+		c.UpstreamConnections.MaxIdleConnsPerHost = defaultUpstreamMaxIdleConnsPerHost
+	}
+	if c.UpstreamConnections.IdleConnTimeout == 0 {
+		c.UpstreamConnections.IdleConnTimeout = defaultUpstreamIdleConnTimeout
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = defaultRequestTimeout
+	}
+	if c.HeartbeatTimeout == 0 {
+		c.HeartbeatTimeout = defaultHeartbeatTimeout
+	}
+	if c.BodyReadTimeout == 0 {
+		c.BodyReadTimeout = c.RequestTimeout
+	}
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.Audit.MaxBytes == 0 {
+		c.Audit.MaxBytes = defaultAuditMaxBytes
+	}
+	if c.Audit.MaxBackups == 0 {
+		c.Audit.MaxBackups = defaultAuditMaxBackups
+	}
+	if c.Audit.Timeout == 0 {
+		c.Audit.Timeout = defaultAuditTimeout
+	}
+	if c.UpstreamQueue.PriorityAging == 0 {
+		c.UpstreamQueue.PriorityAging = defaultPriorityAging
+	}
+	if c.SigningWorkers.QueueCapacity == 0 {
+		c.SigningWorkers.QueueCapacity = c.SigningWorkers.Size
+	}
+	if c.UpstreamHeaders.UserAgent == "" {
+		c.UpstreamHeaders.UserAgent = defaultUpstreamUserAgent
+	}
+	if c.UpstreamHeaders.Instance == "" {
+		c.UpstreamHeaders.Instance = defaultInstance()
+	}
+	if c.UpstreamHeaders.ClientHeader == "" {
+		c.UpstreamHeaders.ClientHeader = defaultUpstreamClientHeader
+	}
+	if c.PartialResponse == "" {
+		c.PartialResponse = partialResponseAbort
+	}
+	if c.Metrics.Backend == "" {
+		c.Metrics.Backend = metricsBackendPrometheus
+	}
+	if c.Metrics.StatsD.Host == "" {
+		c.Metrics.StatsD.Host = defaultStatsDHost
+	}
+	if c.Metrics.StatsD.Port == 0 {
+		c.Metrics.StatsD.Port = defaultStatsDPort
+	}
+	if c.Metrics.StatsD.Prefix == "" {
+		c.Metrics.StatsD.Prefix = defaultStatsDPrefix
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = defaultServiceName
+	}
+	if c.AuthHeader == "" {
+		c.AuthHeader = defaultAuthHeader
+	}
+	if c.MaxClockSkew == 0 {
+		c.MaxClockSkew = defaultMaxClockSkew
+	}
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+	if c.CircuitBreakerCooldown == 0 {
+		c.CircuitBreakerCooldown = defaultCircuitBreakerCooldown
+	}
+	if c.TokenStore.Timeout == 0 {
+		c.TokenStore.Timeout = defaultTokenStoreTimeout
+	}
+	if c.MaxBatchParts == 0 {
+		c.MaxBatchParts = defaultMaxBatchParts
+	}
+	if c.MaxMultipartParts == 0 {
+		c.MaxMultipartParts = defaultMaxMultipartParts
+	}
+	if c.MaxMultipartBytes == 0 {
+		c.MaxMultipartBytes = defaultMaxMultipartBytes
+	}
+	if c.MaxMultipartFieldName == 0 {
+		c.MaxMultipartFieldName = defaultMaxMultipartFieldName
+	}
+	if c.MaxAuditMetadataBytes == 0 {
+		c.MaxAuditMetadataBytes = defaultMaxAuditMetadataBytes
+	}
+	if c.MaxMultipartPartHeaders == 0 {
+		c.MaxMultipartPartHeaders = defaultMaxMultipartPartHeaders
+	}
+	if c.ResponseCache.TTL == 0 {
+		c.ResponseCache.TTL = defaultResponseCacheTTL
+	}
+	if c.ResponseCache.MaxBytes == 0 {
+		c.ResponseCache.MaxBytes = defaultResponseCacheMaxBytes
+	}
+	if c.Idempotency.Window == 0 {
+		c.Idempotency.Window = defaultIdempotencyWindow
+	}
+	if c.Idempotency.MaxBytes == 0 {
+		c.Idempotency.MaxBytes = defaultIdempotencyMaxBytes
+	}
+	if c.Nonces.Window == 0 {
+		c.Nonces.Window = defaultNonceWindow
+	}
+	if c.Nonces.MaxEntries == 0 {
+		c.Nonces.MaxEntries = defaultNonceMaxEntries
+	}
+}
+
+// maxUploadBytes returns the maximum request body size for auth
+func (c configuration) maxUploadBytes(auth authorization) int64 {
+	if auth.MaxUploadBytes > 0 {
+		return auth.MaxUploadBytes
+	}
+	return c.MaxUploadBytes
+}
+
+// largestUploadBytes returns the largest max upload bytes of the
+// authorizations, which bounds requests before their token is known
+func (c configuration) largestUploadBytes() (largest int64) {
+	largest = c.MaxUploadBytes
+	for _, auth := range c.tokenStore().Authorizations() {
+		if n := c.maxUploadBytes(auth); n > largest {
+			largest = n
+		}
+	}
+	return
+}
+
+// maxHashedClientTokenLength is the longest input bcrypt hashes, so
+// no longer token can match a ClientTokenHash
+const maxHashedClientTokenLength = 72
+
+// longestClientToken returns the length of the longest token that can
+// match one of auths
+func longestClientToken(auths []authorization) (longest int) {
+	for _, auth := range auths {
+		length := len(auth.ClientToken)
+		if auth.ClientTokenHash != "" {
+			length = maxHashedClientTokenLength
+		}
+		if length > longest {
+			longest = length
+		}
+	}
+	return longest
+}
+
+// minClientTokenLength is the shortest client token, configured or
+// sent by a client
+const minClientTokenLength = 60
+
+// parseClientToken returns the client token of raw, or errInvalidToken
+// when it is shorter than minClientTokenLength or has other bytes than
+// printable ASCII without spaces. It doesn't require the 64 lowercase
+// hex of generated tokens, since longer configured tokens are in use,
+// but configured tokens are checked with it so that clients can send
+// all of them.
+func parseClientToken(raw string) (string, error) {
+	if len(raw) < minClientTokenLength {
+		return "", errInvalidToken
+	}
+	for i := 0; i < len(raw); i++ {
+		if raw[i] <= ' ' || raw[i] > '~' {
+			return "", errInvalidToken
 		}
 	}
-	return authorization{}, errInvalidToken
+	return raw, nil
+}
+
+// authorize returns the authorization of the token in authHeader
+// from the token store of the live configuration. Disabled tokens
+// return their authorization with errSignerDisabled.
+func authorize(authHeader string) (auth authorization, err error) {
+	c := currentConf()
+	store := c.tokenStore()
+	// no configured token is longer, so don't bother comparing
+	if len(authHeader) > store.LongestToken() {
+		return authorization{}, errInvalidToken
+	}
+	token, err := parseClientToken(authHeader)
+	if err != nil {
+		return authorization{}, err
+	}
+	auth, err = store.Lookup(token)
+	if err != nil {
+		return
+	}
+	auth = c.resolveSigners(auth)
+	if err = auth.checkValidity(time.Now()); err != nil {
+		return
+	}
+	if auth.Disabled {
+		return auth, errSignerDisabled
+	}
+	return
+}
+
+// tokenStore returns the store of the authorizations of c, which
+// are those of the configuration file unless a token store is set
+func (c configuration) tokenStore() tokenStore {
+	if c.tokens != nil {
+		return c.tokens
+	}
+	if c.fileTokens != nil {
+		return c.fileTokens
+	}
+	return newFileTokenStore(c.Authorizations)
 }
 
 func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessage string, args ...interface{}) {
@@ -192,37 +1646,229 @@ func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessa
 }
 
 // findDuplicateClientToken returns an error if it finds a duplicate
-// token in a slice of authorizations
+// token in a slice of authorizations, including plaintext tokens
+// matching the bcrypt hash of another authorization
 func findDuplicateClientToken(auths []authorization) error {
-	// a map of token to index in the auths slice
+	// maps of token and token hash to index in the auths slice
 	seenTokenIndexes := map[string]int{}
+	seenHashIndexes := map[string]int{}
 
 	for i, auth := range auths {
+		if auth.ClientTokenHash != "" {
+			seenHashIndex, exists := seenHashIndexes[auth.ClientTokenHash]
+			if exists {
+				return fmt.Errorf("found duplicate client token hash at positions %d and %d", seenHashIndex, i)
+			}
+			seenHashIndexes[auth.ClientTokenHash] = i
+			continue
+		}
 		seenTokenIndex, exists := seenTokenIndexes[auth.ClientToken]
 		if exists {
 			return fmt.Errorf("found duplicate client token at positions %d and %d", seenTokenIndex, i)
 		}
 		seenTokenIndexes[auth.ClientToken] = i
 	}
+	for token, tokenIndex := range seenTokenIndexes {
+		for hash, hashIndex := range seenHashIndexes {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(token)) == nil {
+				return fmt.Errorf("found duplicate client token at positions %d and %d", tokenIndex, hashIndex)
+			}
+		}
+	}
 	return nil
 }
 
 // vaidateAuth returns an error for auths with:
 //
-// a short (<60 chars) ClientToken
+// a ClientToken that parseClientToken rejects, like a short (<60 chars) one
+// both or neither of a ClientToken and a ClientTokenHash
+// a ClientTokenHash that is not a bcrypt hash
 // missing or empty required field autograph user, signer, or key
+// an unrecognized COSE algorithm
+// an unrecognized PKCS7 digest, or both PKCS7 digest fields
+// an allowed CIDR that does not parse
+// an unknown SignatureType, or add-on fields on a data signing token
+// URL input enabled without allowed input hosts, or an invalid host
+// an allowed content type that is not a media type
+// an empty allowed signer, or one with a slash
+// APK verification on a token that doesn't sign APKs
+// a required header that is not a valid header name
+// an empty or duplicate allowed key id, or one with whitespace
+//
+// The error is an *authFieldError naming the field, user and signer.
 func validateAuth(auth authorization) error {
-	if len(auth.ClientToken) < 60 {
-		return fmt.Errorf("client token is too short (%d chars) want at least 60", len(auth.ClientToken))
+	field, err := checkAuthFields(auth)
+	if err != nil {
+		return &authFieldError{Field: field, User: auth.User, Signer: auth.Signer, Err: err}
+	}
+	return nil
+}
+
+// authFieldError names the invalid field of an authorization, with its
+// user and signer to find it in a large configuration
+type authFieldError struct {
+	Field  string
+	User   string
+	Signer string
+	Err    error
+}
+
+func (e *authFieldError) Error() string {
+	return fmt.Sprintf("invalid %s of the authorization of user %q for signer %q: %v", e.Field, e.User, e.Signer, e.Err)
+}
+
+func (e *authFieldError) Unwrap() error {
+	return e.Err
+}
+
+// checkAuthFields returns the yaml name of the first invalid field of
+// auth with its error
+func checkAuthFields(auth authorization) (field string, err error) {
+	if auth.ClientTokenHash != "" {
+		if auth.ClientToken != "" {
+			return "client_token_hash", fmt.Errorf("only one of client token and client token hash can be set")
+		}
+		_, err := bcrypt.Cost([]byte(auth.ClientTokenHash))
+		if err != nil {
+			return "client_token_hash", fmt.Errorf("client token hash is not a valid bcrypt hash: %v", err)
+		}
+	} else if len(auth.ClientToken) < minClientTokenLength {
+		return "client_token", fmt.Errorf("client token is too short (%d chars) want at least %d", len(auth.ClientToken), minClientTokenLength)
+	} else if _, err := parseClientToken(auth.ClientToken); err != nil {
+		return "client_token", fmt.Errorf("client token has other characters than printable ASCII without spaces")
 	}
 	if auth.Signer == "" {
-		return fmt.Errorf("upstream autograph signer ID is empty")
+		return "signer", fmt.Errorf("upstream autograph signer ID is empty")
 	}
 	if auth.User == "" {
-		return fmt.Errorf("upstream autograph user name is empty")
+		return "user", fmt.Errorf("upstream autograph user name is empty")
 	}
 	if auth.Key == "" {
-		return fmt.Errorf("upstream autograph user key is empty")
+		return "key", fmt.Errorf("upstream autograph user key is empty")
+	}
+	for _, alg := range auth.AddonCOSEAlgorithms {
+		if !stringInSlice(alg, supportedCOSEAlgorithms) {
+			return "addoncosealgorithms", fmt.Errorf("unrecognized COSE algorithm %q, supported algorithms are %s", alg, strings.Join(supportedCOSEAlgorithms, ", "))
+		}
+	}
+	if len(auth.AddonPKCS7Digests) > 0 && auth.AddonPKCS7Digest != "" {
+		return "addonpkcs7digests", fmt.Errorf("only one of addonpkcs7digest and addonpkcs7digests can be set")
+	}
+	for _, digest := range auth.AddonPKCS7Digests {
+		if !stringInSlice(digest, supportedPKCS7Digests) {
+			return "addonpkcs7digests", fmt.Errorf("unrecognized PKCS7 digest %q, supported digests are %s", digest, strings.Join(supportedPKCS7Digests, ", "))
+		}
+	}
+	if auth.RateLimit < 0 {
+		return "rate_limit", fmt.Errorf("rate limit %d is negative", auth.RateLimit)
+	}
+	if auth.MaxConcurrent < 0 {
+		return "max_concurrent", fmt.Errorf("max concurrent %d is negative", auth.MaxConcurrent)
+	}
+	if auth.MaxUploadBytes < 0 {
+		return "max_upload_bytes", fmt.Errorf("max upload bytes %d is negative", auth.MaxUploadBytes)
+	}
+	if auth.MaxOutputBytes < 0 {
+		return "max_output_bytes", fmt.Errorf("max output bytes %d is negative", auth.MaxOutputBytes)
+	}
+	for _, cidr := range auth.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return "allowed_cidrs", fmt.Errorf("invalid allowed CIDR %q: %v", cidr, err)
+		}
+	}
+	if auth.SignatureType != "" && !stringInSlice(auth.SignatureType, supportedSignatureTypes) {
+		return "signature_type", fmt.Errorf("unknown signature type %q, supported types are %s", auth.SignatureType, strings.Join(supportedSignatureTypes, ", "))
+	}
+	if auth.SignatureType == signatureTypeData && (auth.AddonID != "" || len(auth.pkcs7Digests()) > 0 || len(auth.AddonCOSEAlgorithms) > 0) {
+		return "signature_type", fmt.Errorf("add-on fields cannot be set on a data signing token")
+	}
+	if !auth.ValidFrom.IsZero() && !auth.ValidUntil.IsZero() && !auth.ValidUntil.After(auth.ValidFrom) {
+		return "valid_until", fmt.Errorf("valid until %s is not after valid from %s", auth.ValidUntil.Format(time.RFC3339), auth.ValidFrom.Format(time.RFC3339))
+	}
+	if auth.AllowDetached && auth.signatureType() == signatureTypeAPK {
+		return "allow_detached", fmt.Errorf("apk signatures cannot be detached from the signed file")
+	}
+	if auth.AllowURLInput && len(auth.AllowedInputHosts) == 0 {
+		return "allowed_input_hosts", fmt.Errorf("url input is allowed without any allowed input hosts")
+	}
+	for _, host := range auth.AllowedInputHosts {
+		if host == "" || strings.ContainsAny(host, "/:@?#") {
+			return "allowed_input_hosts", fmt.Errorf("invalid allowed input host %q, want a bare hostname", host)
+		}
+	}
+	for _, contentType := range auth.AllowedContentTypes {
+		if err := validateContentType(contentType); err != nil {
+			return "allowed_content_types", err
+		}
+	}
+	for _, signer := range auth.AllowedSigners {
+		if signer == "" || strings.Contains(signer, "/") {
+			return "allowed_signers", fmt.Errorf("invalid allowed signer %q", signer)
+		}
+	}
+	if auth.VerifyAPK && auth.signatureType() != signatureTypeAPK {
+		return "verify_apk", fmt.Errorf("apk verification is enabled on a %s signing token", auth.signatureType())
+	}
+	for _, name := range auth.RequiredHeaders {
+		if !isHeaderName(name) {
+			return "required_headers", fmt.Errorf("invalid required header %q", name)
+		}
+	}
+	for i, keyID := range auth.AllowedKeyIDs {
+		if keyID == "" || strings.ContainsAny(keyID, " \t\r\n") {
+			return "allowed_keyids", fmt.Errorf("invalid allowed key id %q", keyID)
+		}
+		if stringInSlice(keyID, auth.AllowedKeyIDs[:i]) {
+			return "allowed_keyids", fmt.Errorf("duplicate allowed key id %q", keyID)
+		}
+	}
+	if len(auth.AllowedAddonIDs) > 0 && auth.signatureType() != signatureTypeXPI {
+		return "allowed_addon_ids", fmt.Errorf("allowed add-on ids are set on a %s signing token", auth.signatureType())
+	}
+	for _, pattern := range auth.AllowedAddonIDs {
+		if err := validateAddonIDPattern(pattern); err != nil {
+			return "allowed_addon_ids", err
+		}
+	}
+	if auth.UpstreamTimeout < 0 {
+		return "upstream_timeout", fmt.Errorf("upstream timeout %s is negative", auth.UpstreamTimeout)
+	}
+	if auth.AllowCOSEOverride && (auth.AddonID == "" || len(auth.AddonCOSEAlgorithms) == 0) {
+		return "allow_cose_override", fmt.Errorf("cose override is allowed on a token without an add-on id and COSE algorithms")
+	}
+	if _, ok := parsePriority(auth.MaxPriority); auth.MaxPriority != "" && !ok {
+		return "max_priority", fmt.Errorf("unknown max priority %q, must be one of high, normal or low", auth.MaxPriority)
+	}
+	return "", nil
+}
+
+// validateCORSOrigin returns an error for allowed origins that are not
+// a scheme and host, as browsers send in the Origin header
+func validateCORSOrigin(origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("failed to parse CORS origin %q: %v", origin, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+		return fmt.Errorf("CORS origin %q must be a scheme and host like https://example.com", origin)
+	}
+	return nil
+}
+
+// validateUpstreamPath returns an error when the upstream path of auth
+// does not make a plain URL when joined to baseURL
+func validateUpstreamPath(baseURL string, auth authorization) error {
+	if auth.UpstreamPath == "" {
+		return nil
+	}
+	joined := upstreamURL(baseURL, auth)
+	u, err := url.Parse(joined)
+	if err != nil {
+		return fmt.Errorf("failed to parse upstream url %q: %v", joined, err)
+	}
+	base, _ := url.Parse(baseURL)
+	if u.Scheme != base.Scheme || u.Host != base.Host || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("upstream path %q must be a path without a query or fragment", auth.UpstreamPath)
 	}
 	return nil
 }
@@ -239,3 +1885,17 @@ func validateBaseURL(baseURL string) error {
 	}
 	return nil
 }
+
+// isHeaderName returns whether name is a valid HTTP header name, made
+// of the token characters of RFC 7230
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,23 +2,35 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
 )
 
 func TestMain(m *testing.M) {
-	err := conf.loadFromFile("./autograph-edge.yaml")
+	var c configuration
+	err := c.loadFromFile("./autograph-edge.yaml")
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("configuration: %+v\n", conf)
+	setConf(c)
+	log.Printf("configuration: %+v\n", c)
 	// run the tests and exit
 	r := m.Run()
 	os.Exit(r)
@@ -64,6 +76,12 @@ func Test_authorize(t *testing.T) {
 			expectedAuth: authorization{},
 			expectedErr:  errInvalidToken,
 		},
+		{
+			name:         "over-long auth header",
+			args:         args{authHeader: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547" + strings.Repeat("0", 4096)},
+			expectedAuth: authorization{},
+			expectedErr:  errInvalidToken,
+		},
 		{
 			name:         "invalid auth header",
 			args:         args{authHeader: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67c98712jh"},
@@ -93,6 +111,67 @@ func Test_authorize(t *testing.T) {
 	}
 }
 
+func Test_parseClientToken(t *testing.T) {
+	valid := "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547"
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{"hex token", valid, false},
+		{"long token", strings.Repeat("c4180d2963fffdcd", 5), false},
+		{"printable token", strings.Repeat("Ab-_.~+/=", 8), false},
+		{"empty", "", true},
+		{"short", "c4180d2963fffdcd1cd5a1a343225288b964d8934", true},
+		{"space", valid[:30] + " " + valid[31:], true},
+		{"control character", valid + "\x00", true},
+		{"non ascii", valid + "é", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := parseClientToken(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseClientToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && err != errInvalidToken {
+				t.Fatalf("parseClientToken() error = %v expected %v", err, errInvalidToken)
+			}
+			if err == nil && token != tt.raw {
+				t.Fatalf("parseClientToken() = %q expected %q", token, tt.raw)
+			}
+		})
+	}
+}
+
+var acceptedClientToken = regexp.MustCompile(`^[!-~]{60,}$`)
+
+func FuzzParseClientToken(f *testing.F) {
+	f.Add("c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547")
+	f.Add("c4180d2963fffdcd1cd5a1a343225288b964d8934")
+	f.Add("c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67c98712jh")
+	f.Add("")
+	f.Add(strings.Repeat("Ab-_.~+/=", 8))
+	f.Add(strings.Repeat("a", 59) + " ")
+	f.Fuzz(func(t *testing.T, raw string) {
+		token, err := parseClientToken(raw)
+		if acceptedClientToken.MatchString(raw) != (err == nil) {
+			t.Fatalf("parseClientToken(%q) returned error %v", raw, err)
+		}
+		if err != nil {
+			if err != errInvalidToken || token != "" {
+				t.Fatalf("parseClientToken(%q) = %q, %v expected errInvalidToken", raw, token, err)
+			}
+			return
+		}
+		// the accepted format is at least 60 printable ASCII characters
+		// without spaces, which the 64 lowercase hex characters of
+		// generated tokens are
+		if token != raw || !acceptedClientToken.MatchString(token) {
+			t.Fatalf("parseClientToken(%q) accepted %q", raw, token)
+		}
+	})
+}
+
 func Test_findDuplicateClientToken(t *testing.T) {
 	type args struct {
 		auths []authorization
@@ -210,6 +289,359 @@ func Test_validateAuth(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "valid auth client token longer than 64 chars",
+			args: args{
+				auth: authorization{
+					ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547ff",
+					Signer:      "testapp-android",
+					User:        "alice",
+					Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid auth client token with a space",
+			args: args{
+				auth: authorization{
+					ClientToken: "c4180d2963fffdcd1cd5a1a343225288 964d8934b809a7d76941ccf67cc8547",
+					Signer:      "testapp-android",
+					User:        "alice",
+					Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth client token with a non ascii character",
+			args: args{
+				auth: authorization{
+					ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc854é",
+					Signer:      "testapp-android",
+					User:        "alice",
+					Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth apk verification on an add-on token",
+			args: args{
+				auth: authorization{
+					ClientToken: "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:      "extensions-ecdsa",
+					User:        "alice",
+					Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AddonID:     "myaddon@allizom.org",
+					VerifyAPK:   true,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth required header name",
+			args: args{
+				auth: authorization{
+					ClientToken:     "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:          "testapp-android",
+					User:            "alice",
+					Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					RequiredHeaders: []string{"X-Change Reference"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth empty allowed key id",
+			args: args{
+				auth: authorization{
+					ClientToken:   "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:        "testapp-android",
+					User:          "alice",
+					Key:           "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedKeyIDs: []string{""},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth duplicate allowed key id",
+			args: args{
+				auth: authorization{
+					ClientToken:   "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:        "testapp-android",
+					User:          "alice",
+					Key:           "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedKeyIDs: []string{"testapp-android-2024", "testapp-android-2024"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth malformed allowed add-on id",
+			args: args{
+				auth: authorization{
+					ClientToken:     "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:          "extensions-ecdsa",
+					User:            "alice",
+					Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AddonID:         "myaddon@allizom.org",
+					AllowedAddonIDs: []string{"[*@allizom.org"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth negative upstream timeout",
+			args: args{
+				auth: authorization{
+					ClientToken:     "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:          "testapp-android",
+					User:            "alice",
+					Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					UpstreamTimeout: -time.Second,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth cose override without COSE algorithms",
+			args: args{
+				auth: authorization{
+					ClientToken:       "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:            "extensions-ecdsa",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AddonID:           "myaddon@allizom.org",
+					AllowCOSEOverride: true,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth allowed add-on ids on an apk token",
+			args: args{
+				auth: authorization{
+					ClientToken:     "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:          "testapp-android",
+					User:            "alice",
+					Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedAddonIDs: []string{"*@allizom.org"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth empty allowed signer",
+			args: args{
+				auth: authorization{
+					ClientToken:    "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:         "testapp-android",
+					User:           "alice",
+					Key:            "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedSigners: []string{""},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth unrecognized COSE algorithm",
+			args: args{
+				auth: authorization{
+					ClientToken:         "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:              "extensions-ecdsa",
+					User:                "alice",
+					Key:                 "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AddonID:             "mycoseaddon@allizom.org",
+					AddonCOSEAlgorithms: []string{"ES256", "ROT13"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid auth with allowed CIDRs",
+			args: args{
+				auth: authorization{
+					ClientToken:  "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:       "extensions-ecdsa",
+					User:         "alice",
+					Key:          "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid auth malformed allowed CIDR",
+			args: args{
+				auth: authorization{
+					ClientToken:  "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:       "extensions-ecdsa",
+					User:         "alice",
+					Key:          "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedCIDRs: []string{"10.0.0.1"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid auth for data signing",
+			args: args{
+				auth: authorization{
+					ClientToken:   "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:        "normandy",
+					User:          "alice",
+					Key:           "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					SignatureType: "data",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid auth unknown signature type",
+			args: args{
+				auth: authorization{
+					ClientToken:   "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:        "normandy",
+					User:          "alice",
+					Key:           "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					SignatureType: "gpg",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth data signing with an add-on ID",
+			args: args{
+				auth: authorization{
+					ClientToken:   "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:        "normandy",
+					User:          "alice",
+					Key:           "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AddonID:       "myaddon@allizom.org",
+					SignatureType: "data",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid auth with url input",
+			args: args{
+				auth: authorization{
+					ClientToken:       "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:            "testapp-android",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowURLInput:     true,
+					AllowedInputHosts: []string{"artifacts.example.com"},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid auth url input without allowed hosts",
+			args: args{
+				auth: authorization{
+					ClientToken:   "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:        "testapp-android",
+					User:          "alice",
+					Key:           "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowURLInput: true,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth allowed input host with a scheme",
+			args: args{
+				auth: authorization{
+					ClientToken:       "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:            "testapp-android",
+					User:              "alice",
+					Key:               "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowURLInput:     true,
+					AllowedInputHosts: []string{"https://artifacts.example.com"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid auth with allowed content types",
+			args: args{
+				auth: authorization{
+					ClientToken:         "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:              "extensions-ecdsa",
+					User:                "alice",
+					Key:                 "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedContentTypes: []string{"application/x-xpinstall", "application/*"},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid auth allowed content type without a subtype",
+			args: args{
+				auth: authorization{
+					ClientToken:         "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:              "extensions-ecdsa",
+					User:                "alice",
+					Key:                 "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedContentTypes: []string{"application"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth allowed content type with parameters",
+			args: args{
+				auth: authorization{
+					ClientToken:         "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					Signer:              "extensions-ecdsa",
+					User:                "alice",
+					Key:                 "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					AllowedContentTypes: []string{"text/plain; charset=utf-8"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid auth with a client token hash",
+			args: args{
+				auth: authorization{
+					ClientTokenHash: "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+					Signer:          "extensions-ecdsa",
+					User:            "alice",
+					Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid auth malformed client token hash",
+			args: args{
+				auth: authorization{
+					ClientTokenHash: "not-a-bcrypt-hash",
+					Signer:          "extensions-ecdsa",
+					User:            "alice",
+					Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid auth both client token and hash",
+			args: args{
+				auth: authorization{
+					ClientToken:     "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547",
+					ClientTokenHash: "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+					Signer:          "extensions-ecdsa",
+					User:            "alice",
+					Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+				},
+			},
+			wantErr: true,
+		},
 		{
 			name: "invalid auth empty client token",
 			args: args{
@@ -280,6 +712,33 @@ func Test_validateAuth(t *testing.T) {
 	}
 }
 
+func Test_validateAuthorizationsReportsAll(t *testing.T) {
+	valid := currentConf().Authorizations[0]
+	shortToken := valid
+	shortToken.ClientToken = "tooshort"
+	shortToken.User = "bob"
+	negativeRate := currentConf().Authorizations[2]
+	negativeRate.RateLimit = -1
+
+	err := validateAuthorizations([]authorization{shortToken, valid, negativeRate})
+	if err == nil {
+		t.Fatal("validateAuthorizations() of two invalid authorizations returned no error")
+	}
+	for _, want := range []string{
+		"2 invalid authorizations",
+		`error validating auth 0: invalid client_token of the authorization of user "bob" for signer "extensions-ecdsa"`,
+		`error validating auth 2: invalid rate_limit of the authorization of user "alice" for signer "testapp-android"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validateAuthorizations() error %q does not contain %q", err, want)
+		}
+	}
+	var fieldErr *authFieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "client_token" || fieldErr.User != "bob" {
+		t.Fatalf("validateAuthorizations() error %v does not unwrap to the first field error", err)
+	}
+}
+
 func Test_validateBaseURL(t *testing.T) {
 	t.Parallel()
 
@@ -329,16 +788,41 @@ func Test_validateBaseURL(t *testing.T) {
 	}
 }
 
+func Test_isHeaderName(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"Authorization":      true,
+		"X-Autograph-Token":  true,
+		"":                   false,
+		"X Autograph Token":  false,
+		"X-Autograph-Token:": false,
+		"X-Autogräph":        false,
+	} {
+		if got := isHeaderName(name); got != expected {
+			t.Errorf("isHeaderName(%q) = %v expected %v", name, got, expected)
+		}
+	}
+}
+
 func Test_preparedServer(t *testing.T) {
 	// For the purpose of testing - ensure we're using IPv4.
-	conf.BaseURL = "http://127.0.0.1:8000/"
+	conf.BaseURLs = upstreamURLs{"http://127.0.0.1:8000/"}
 
 	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "Hello, client")
 	}))
+	versionBody, err := versionResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
 	testServer.Config = prepareServer()
 	testServer.Start()
 	defer testServer.Close()
+	if testServer.Config.MaxHeaderBytes != defaultMaxHeaderBytes {
+		t.Fatalf("server max header bytes is %d expected %d", testServer.Config.MaxHeaderBytes, defaultMaxHeaderBytes)
+	}
+	if cfg := testServer.Config; cfg.ReadHeaderTimeout != defaultReadHeaderTimeout || cfg.ReadTimeout != defaultReadTimeout || cfg.WriteTimeout != defaultWriteTimeout {
+		t.Fatalf("server timeouts are %s, %s and %s expected the defaults", cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.WriteTimeout)
+	}
 
 	tests := []struct {
 		name              string
@@ -364,7 +848,7 @@ func Test_preparedServer(t *testing.T) {
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: string(jsonVersion),
+			expectedBody: string(versionBody),
 		},
 		{
 			name:           "test GET /__lbheartbeat__ path ok",
@@ -373,13 +857,12 @@ func Test_preparedServer(t *testing.T) {
 			body:           []byte(""),
 			expectedStatus: http.StatusOK,
 			expectedHeaders: http.Header{
-				"Content-Type":              []string{"application/json"},
 				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
 				"X-Frame-Options":           []string{"DENY"},
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: string(jsonVersion),
+			expectedBody: "",
 		},
 		{
 			name:           "test GET / path not found",
@@ -424,7 +907,7 @@ func Test_preparedServer(t *testing.T) {
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: `{"status":false,"checks":{"check_autograph_heartbeat":false},"details":"failed to request autograph heartbeat from http://127.0.0.1:8000/__heartbeat__: Get \"http://127.0.0.1:8000/__heartbeat__\": dial tcp 127.0.0.1:8000: connect: connection refused"}`,
+			expectedBody: `{"status":false,"checks":{"autograph_heartbeat:http://127.0.0.1:8000/":false},"details":"failed to request autograph heartbeat from http://127.0.0.1:8000/__heartbeat__: Get \"http://127.0.0.1:8000/__heartbeat__\": dial tcp 127.0.0.1:8000: connect: connection refused"}`,
 		},
 		{
 			name:           "test GET /sign path method not allowed",
@@ -433,13 +916,46 @@ func Test_preparedServer(t *testing.T) {
 			body:           []byte(""),
 			expectedStatus: http.StatusMethodNotAllowed,
 			expectedHeaders: http.Header{
-				"Content-Type":              []string{"text/plain; charset=utf-8"},
+				"Allow":                     []string{"POST"},
+				"Content-Type":              []string{"application/json"},
 				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
 				"X-Frame-Options":           []string{"DENY"},
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: "invalid method\n",
+			expectedBody: `{"error":"only POST requests are supported","code":"invalid_method","request_id":"<rid>"}`,
+		},
+		{
+			name:           "test POST /__version__ path method not allowed",
+			method:         "POST",
+			path:           "/__version__",
+			body:           []byte(""),
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedHeaders: http.Header{
+				"Allow":                     []string{"GET, HEAD"},
+				"Content-Type":              []string{"application/json"},
+				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
+				"X-Frame-Options":           []string{"DENY"},
+				"X-Content-Type-Options":    []string{"nosniff"},
+				"Strict-Transport-Security": []string{"max-age=31536000;"},
+			},
+			expectedBody: `{"error":"only GET requests are supported","code":"invalid_method","request_id":"-"}`,
+		},
+		{
+			name:           "test DELETE /__heartbeat__ path method not allowed",
+			method:         "DELETE",
+			path:           "/__heartbeat__",
+			body:           []byte(""),
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedHeaders: http.Header{
+				"Allow":                     []string{"GET, HEAD"},
+				"Content-Type":              []string{"application/json"},
+				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
+				"X-Frame-Options":           []string{"DENY"},
+				"X-Content-Type-Options":    []string{"nosniff"},
+				"Strict-Transport-Security": []string{"max-age=31536000;"},
+			},
+			expectedBody: `{"error":"only GET requests are supported","code":"invalid_method","request_id":"-"}`,
 		},
 		{
 			name:           "test POST /sign path no auth header unauthorized",
@@ -448,13 +964,14 @@ func Test_preparedServer(t *testing.T) {
 			body:           []byte(""),
 			expectedStatus: http.StatusUnauthorized,
 			expectedHeaders: http.Header{
-				"Content-Type":              []string{"text/plain; charset=utf-8"},
+				"Content-Type":              []string{"application/json"},
+				"Www-Authenticate":          []string{`Bearer realm="autograph-edge"`},
 				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
 				"X-Frame-Options":           []string{"DENY"},
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: "missing authorization header\n",
+			expectedBody: `{"error":"missing authorization header","code":"missing_token","request_id":"<rid>"}`,
 		},
 		{
 			name:           "test POST /sign path short auth header unauthorized",
@@ -464,13 +981,14 @@ func Test_preparedServer(t *testing.T) {
 			body:           []byte(""),
 			expectedStatus: http.StatusUnauthorized,
 			expectedHeaders: http.Header{
-				"Content-Type":              []string{"text/plain; charset=utf-8"},
+				"Content-Type":              []string{"application/json"},
+				"Www-Authenticate":          []string{`Bearer realm="autograph-edge", error="invalid_token"`},
 				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
 				"X-Frame-Options":           []string{"DENY"},
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: "missing authorization header\n",
+			expectedBody: `{"error":"invalid authorization token","code":"invalid_token","request_id":"<rid>"}`,
 		},
 		{
 			name:           "test POST /sign path invalid auth header unauthorized",
@@ -480,13 +998,14 @@ func Test_preparedServer(t *testing.T) {
 			body:           []byte(""),
 			expectedStatus: http.StatusUnauthorized,
 			expectedHeaders: http.Header{
-				"Content-Type":              []string{"text/plain; charset=utf-8"},
+				"Content-Type":              []string{"application/json"},
+				"Www-Authenticate":          []string{`Bearer realm="autograph-edge", error="invalid_token"`},
 				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
 				"X-Frame-Options":           []string{"DENY"},
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: "not authorized\n",
+			expectedBody: `{"error":"invalid authorization token","code":"invalid_token","request_id":"<rid>"}`,
 		},
 		{
 			name:           "test POST /sign path valid auth header no input form field bad request",
@@ -496,13 +1015,13 @@ func Test_preparedServer(t *testing.T) {
 			body:           []byte(""),
 			expectedStatus: http.StatusBadRequest,
 			expectedHeaders: http.Header{
-				"Content-Type":              []string{"text/plain; charset=utf-8"},
+				"Content-Type":              []string{"application/json"},
 				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
 				"X-Frame-Options":           []string{"DENY"},
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: "failed to read form data\n",
+			expectedBody: `{"error":"failed to read form data","code":"invalid_request","request_id":"<rid>"}`,
 		},
 		{
 			name:              "test POST /sign path valid auth header small input form field form encoded bad request",
@@ -513,13 +1032,13 @@ func Test_preparedServer(t *testing.T) {
 			body:              []byte("input=Foo"),
 			expectedStatus:    http.StatusBadRequest,
 			expectedHeaders: http.Header{
-				"Content-Type":              []string{"text/plain; charset=utf-8"},
+				"Content-Type":              []string{"application/json"},
 				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
 				"X-Frame-Options":           []string{"DENY"},
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: "failed to read form data\n",
+			expectedBody: `{"error":"failed to read form data","code":"invalid_request","request_id":"<rid>"}`,
 		},
 		{
 			name:              "test POST /sign path valid auth header small input form field form encoded bad request",
@@ -536,13 +1055,13 @@ Content-Type: application/octet-stream
 `),
 			expectedStatus: http.StatusBadGateway,
 			expectedHeaders: http.Header{
-				"Content-Type":              []string{"text/plain; charset=utf-8"},
+				"Content-Type":              []string{"application/json"},
 				"Content-Security-Policy":   []string{"default-src 'none'; object-src 'none';"},
 				"X-Frame-Options":           []string{"DENY"},
 				"X-Content-Type-Options":    []string{"nosniff"},
 				"Strict-Transport-Security": []string{"max-age=31536000;"},
 			},
-			expectedBody: "failed to call autograph for signature\n",
+			expectedBody: `{"error":"failed to call autograph for signature","code":"upstream_error","request_id":"<rid>"}`,
 		},
 	}
 
@@ -576,6 +1095,10 @@ Content-Type: application/octet-stream
 			if res.StatusCode != tt.expectedStatus {
 				t.Fatalf("returned unexpected status %v expected %v", res.StatusCode, tt.expectedStatus)
 			}
+			// the request ID varies so replace it with a placeholder
+			if rid := res.Header.Get("X-Request-ID"); rid != "" {
+				body = bytes.Replace(body, []byte(rid), []byte("<rid>"), 1)
+			}
 			if !bytes.Equal([]byte(body), []byte(tt.expectedBody)) {
 				t.Fatalf("returned unexpected body '%s' expected '%s'", string(body), tt.expectedBody)
 			}
@@ -583,6 +1106,7 @@ Content-Type: application/octet-stream
 			// ignore headers that vary
 			res.Header.Del("Date")
 			res.Header.Del("Content-Length")
+			res.Header.Del("X-Request-ID")
 
 			if !reflect.DeepEqual(res.Header, tt.expectedHeaders) {
 				t.Fatalf("returned unexpected headers %+v expected %+v", res.Header, tt.expectedHeaders)
@@ -591,3 +1115,512 @@ Content-Type: application/octet-stream
 		})
 	}
 }
+
+func Test_reloadConf(t *testing.T) {
+	origConf, origCfgFile := currentConf(), cfgFile
+	defer func() {
+		setConf(origConf)
+		cfgFile = origCfgFile
+	}()
+
+	validConf := []byte(`autograph_base_url: http://localhost:8000/
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`)
+	invalidConf := []byte(`autograph_base_url: http://localhost:8000/
+authorizations:
+    - client_token: tooshort
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`)
+	cfgFile = t.TempDir() + "/autograph-edge.yaml"
+
+	err := ioutil.WriteFile(cfgFile, validConf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reloadConf()
+	if err != nil {
+		t.Fatalf("reloadConf() of a valid config returned error: %v", err)
+	}
+	auth, err := authorize("3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4")
+	if err != nil {
+		t.Fatalf("authorize() of the reloaded token returned error: %v", err)
+	}
+	if auth.User != "bob" {
+		t.Fatalf("authorize() auth.User got %v expected bob", auth.User)
+	}
+
+	err = ioutil.WriteFile(cfgFile, invalidConf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reloadConf()
+	if err == nil {
+		t.Fatal("reloadConf() of an invalid config did not return an error")
+	}
+	_, err = authorize("3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4")
+	if err != nil {
+		t.Fatalf("previous config was not kept live after a failed reload: %v", err)
+	}
+}
+
+func Test_reloadConfConsistent(t *testing.T) {
+	origConf, origCfgFile := currentConf(), cfgFile
+	defer func() {
+		setConf(origConf)
+		cfgFile = origCfgFile
+	}()
+	cfgFile = t.TempDir() + "/autograph-edge.yaml"
+
+	// both generations have the same tokens for different users, so a
+	// lookup in the index of the other generation would return the
+	// wrong user
+	tokens := []string{
+		"3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4",
+		"4c2b7e1f8a6d5b4c3f2e1d0a9b8c7f6e5d4c3b2a1f0e9d8c7b6a5948372615f0",
+		"5d3c8f2a9b7e6c5d4a3f2e1b0c9d8a7f6e5d4c3b2a1f0e9d8c7b6a59483726a1",
+	}
+	confOf := func(user string) []byte {
+		yml := "autograph_base_url: http://localhost:8000/\nauthorizations:\n"
+		for _, token := range tokens {
+			yml += fmt.Sprintf("    - client_token: %s\n      user: %s\n      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu\n      signer: extensions-ecdsa\n", token, user)
+		}
+		return []byte(yml)
+	}
+	users := []string{"gen-a", "gen-b"}
+	if err := ioutil.WriteFile(cfgFile, confOf(users[0]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConf(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c := currentConf()
+				user := c.Authorizations[0].User
+				for _, token := range tokens {
+					auth, err := c.tokenStore().Lookup(token)
+					if err != nil || auth.User != user {
+						t.Errorf("looked up %+v, %v in a configuration of %s", auth, err, user)
+						return
+					}
+				}
+				if auth, err := authorize(tokens[1]); err != nil || !stringInSlice(auth.User, users) {
+					t.Errorf("authorize() returned %+v, %v during reloads", auth, err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 50; i++ {
+		if err := ioutil.WriteFile(cfgFile, confOf(users[i%2]), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reloadConf(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func Test_upstreamURLsUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected upstreamURLs
+	}{
+		{
+			name:     "single base url",
+			yaml:     "autograph_base_url: http://localhost:8000/",
+			expected: upstreamURLs{"http://localhost:8000/"},
+		},
+		{
+			name:     "list of base urls",
+			yaml:     "autograph_base_url:\n  - http://localhost:8000/\n  - http://localhost:8001/",
+			expected: upstreamURLs{"http://localhost:8000/", "http://localhost:8001/"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c configuration
+			err := yaml.Unmarshal([]byte(tt.yaml), &c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.BaseURLs, tt.expected) {
+				t.Fatalf("unmarshalled base URLs %v expected %v", c.BaseURLs, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_loadFromFileJSON(t *testing.T) {
+	yamlConf, err := loadAndValidateConf("./autograph-edge.yaml", "")
+	if err != nil {
+		t.Fatalf("loading the yaml config returned error: %v", err)
+	}
+	jsonConf, err := loadAndValidateConf("./autograph-edge.json", "")
+	if err != nil {
+		t.Fatalf("loading the json config returned error: %v", err)
+	}
+	// only the hashes of the files differ
+	jsonConf.fileSHA256 = yamlConf.fileSHA256
+	if !reflect.DeepEqual(yamlConf, jsonConf) {
+		t.Fatalf("json config %+v differs from yaml config %+v", jsonConf, yamlConf)
+	}
+}
+
+func Test_loadFromFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name        string
+		file        string
+		data        string
+		expectedErr bool
+	}{
+		{"yml extension", "conf.yml", "autograph_base_url: http://localhost:8000/", false},
+		{"uppercase json extension", "conf.JSON", `{"autograph_base_url": "http://localhost:8000/"}`, false},
+		{"invalid json", "conf.json", "autograph_base_url: http://localhost:8000/", true},
+		{"unsupported extension", "conf.toml", `autograph_base_url = "http://localhost:8000/"`, true},
+		{"no extension", "conf", "autograph_base_url: http://localhost:8000/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := dir + "/" + tt.file
+			err := ioutil.WriteFile(path, []byte(tt.data), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c configuration
+			err = c.loadFromFile(path)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("loadFromFile() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+			if err == nil && !reflect.DeepEqual(c.BaseURLs, upstreamURLs{"http://localhost:8000/"}) {
+				t.Fatalf("loadFromFile() base URLs got %v", c.BaseURLs)
+			}
+		})
+	}
+}
+
+func Test_loadFromFileUnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name  string
+		file  string
+		data  string
+		field string
+	}{
+		{"top level yaml field", "conf.yaml", "autograph_base_url: http://localhost:8000/\nmax_upload_byte: 10\n", "max_upload_byte"},
+		{"authorization yaml field", "conf.yaml", "authorizations:\n- user: alice\n  singer: extensions-ecdsa\n", "singer"},
+		{"json field", "conf.json", `{"authorizations": [{"user": "alice", "Singer": "extensions-ecdsa"}]}`, "Singer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := dir + "/" + tt.file
+			err := ioutil.WriteFile(path, []byte(tt.data), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c configuration
+			err = c.loadFromFile(path)
+			if err == nil || !strings.Contains(err.Error(), "field "+tt.field+" not found") {
+				t.Fatalf("loadFromFile() error = %v, expected the unknown field %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func Test_loadAndValidateConfDirectory(t *testing.T) {
+	const (
+		aliceToken = "3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4"
+		bobToken   = "9f8e7d6c5b4a3928170f6e5d43b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a1"
+	)
+	writeFragments := func(t *testing.T, fragments map[string]string) string {
+		dir := t.TempDir()
+		for name, data := range fragments {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+	fragment := func(user, token string) string {
+		return fmt.Sprintf(`authorizations:
+    - client_token: %s
+      user: %s
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`, token, user)
+	}
+
+	dir := writeFragments(t, map[string]string{
+		"00-settings.yaml": "autograph_base_url: http://localhost:8000/\n",
+		"10-alice.yaml":    fragment("alice", aliceToken),
+		"20-bob.yaml":      fragment("bob", bobToken),
+		"notes.txt":        "not a fragment",
+	})
+	c, err := loadAndValidateConf(dir, "")
+	if err != nil {
+		t.Fatalf("loadAndValidateConf() of a directory returned error: %v", err)
+	}
+	if len(c.Authorizations) != 2 || c.Authorizations[0].User != "alice" || c.Authorizations[1].User != "bob" {
+		t.Fatalf("loadAndValidateConf() merged authorizations %+v expected alice then bob", c.Authorizations)
+	}
+	if !reflect.DeepEqual(c.BaseURLs, upstreamURLs{"http://localhost:8000/"}) {
+		t.Fatalf("loadAndValidateConf() base URLs got %v", c.BaseURLs)
+	}
+
+	dir = writeFragments(t, map[string]string{
+		"00-settings.yaml": "autograph_base_url: http://localhost:8000/\n",
+		"10-alice.yaml":    fragment("alice", aliceToken),
+		"20-bob.yaml":      fragment("bob", aliceToken),
+	})
+	_, err = loadAndValidateConf(dir, "")
+	if err == nil || !strings.Contains(err.Error(), "duplicate client token") {
+		t.Fatalf("loadAndValidateConf() of fragments sharing a token returned error %v", err)
+	}
+
+	_, err = loadAndValidateConf(t.TempDir(), "")
+	if err == nil {
+		t.Fatal("loadAndValidateConf() of a directory without fragments returned no error")
+	}
+}
+
+func Test_longestClientToken(t *testing.T) {
+	testcases := []struct {
+		auths    []authorization
+		expected int
+	}{
+		{nil, 0},
+		{[]authorization{{ClientToken: strings.Repeat("a", 60)}, {ClientToken: strings.Repeat("b", 80)}}, 80},
+		{[]authorization{{ClientToken: strings.Repeat("a", 64)}, {ClientTokenHash: "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"}}, maxHashedClientTokenLength},
+	}
+	for i, testcase := range testcases {
+		if got := longestClientToken(testcase.auths); got != testcase.expected {
+			t.Errorf("testcase %d: longestClientToken() returned %d expected %d", i, got, testcase.expected)
+		}
+	}
+}
+
+func Test_authorizeLongToken(t *testing.T) {
+	longToken := strings.Repeat("c4180d2963fffdcd", 5)
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization{
+		{
+			ClientToken: longToken,
+			User:        "bob",
+			Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+			Signer:      "extensions-ecdsa",
+		},
+	}, testConf.Authorizations...)
+	useTestConf(t, testConf)
+
+	auth, err := authorize(longToken)
+	if err != nil {
+		t.Fatalf("authorize() of an %d chars token returned error: %v", len(longToken), err)
+	}
+	if auth.User != "bob" {
+		t.Fatalf("authorize() auth.User got %v expected bob", auth.User)
+	}
+	if _, err = authorize(longToken + "0"); err != errInvalidToken {
+		t.Fatalf("authorize() of a token longer than any configured one returned error %v expected %v", err, errInvalidToken)
+	}
+}
+
+func Test_authorizeHashedToken(t *testing.T) {
+	const hashedToken = "0e5f3dc1b2a4968778695a4b3c2d1e0f9a8b7c6d5e4f30211a2b3c4d5e6f7a8b"
+	hash, err := bcrypt.GenerateFromPassword([]byte(hashedToken), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization{
+		{
+			ClientTokenHash: string(hash),
+			User:            "bob",
+			Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+			Signer:          "extensions-ecdsa",
+		},
+	}, testConf.Authorizations...)
+	useTestConf(t, testConf)
+
+	for _, auth := range testConf.Authorizations {
+		if err := validateAuth(auth); err != nil {
+			t.Fatalf("validateAuth() returned error: %v", err)
+		}
+	}
+	if err := findDuplicateClientToken(testConf.Authorizations); err != nil {
+		t.Fatalf("findDuplicateClientToken() returned error: %v", err)
+	}
+
+	auth, err := authorize(hashedToken)
+	if err != nil {
+		t.Fatalf("authorize() of a hashed token returned error: %v", err)
+	}
+	if auth.User != "bob" {
+		t.Fatalf("authorize() auth.User got %v expected bob", auth.User)
+	}
+	auth, err = authorize("c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547")
+	if err != nil {
+		t.Fatalf("authorize() of a plaintext token returned error: %v", err)
+	}
+	if auth.User != "alice" {
+		t.Fatalf("authorize() auth.User got %v expected alice", auth.User)
+	}
+	_, err = authorize("1e5f3dc1b2a4968778695a4b3c2d1e0f9a8b7c6d5e4f30211a2b3c4d5e6f7a8b")
+	if err != errInvalidToken {
+		t.Fatalf("authorize() of an unknown token returned error %v expected %v", err, errInvalidToken)
+	}
+}
+
+func Test_findDuplicateClientTokenHashed(t *testing.T) {
+	const token = "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547"
+	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHash, err := bcrypt.GenerateFromPassword([]byte("b8c8c00f310c9e160dda75790df6be106e29607fde3c1092287d026c014be880"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		auths   []authorization
+		wantErr bool
+	}{
+		{
+			name: "distinct hashed tokens",
+			auths: []authorization{
+				{ClientTokenHash: string(hash)},
+				{ClientTokenHash: string(otherHash)},
+			},
+			wantErr: false,
+		},
+		{
+			name: "duplicate token hash",
+			auths: []authorization{
+				{ClientTokenHash: string(hash)},
+				{ClientTokenHash: string(hash)},
+			},
+			wantErr: true,
+		},
+		{
+			name: "plaintext token matching a hash",
+			auths: []authorization{
+				{ClientTokenHash: string(hash)},
+				{ClientToken: token},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := findDuplicateClientToken(tt.auths); (err != nil) != tt.wantErr {
+				t.Errorf("findDuplicateClientToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_shutdownServer(t *testing.T) {
+	defer shuttingDown.Store(false)
+
+	handlerStarted := make(chan struct{})
+	releaseHandler := make(chan struct{})
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(handlerStarted)
+			<-releaseHandler
+			w.WriteHeader(http.StatusCreated)
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	inFlightStatus := make(chan int)
+	go func() {
+		resp, err := http.Post("http://"+listener.Addr().String()+"/sign", "text/plain", nil)
+		if err != nil {
+			t.Error(err)
+			inFlightStatus <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlightStatus <- resp.StatusCode
+	}()
+	<-handlerStarted
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- shutdownServer(server, 5*time.Second)
+	}()
+	for !shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	lbHeartbeatHandler(w, httptest.NewRequest("GET", "http://localhost:8080/__lbheartbeat__", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("lbheartbeat returned unexpected status %v during shutdown expected %v", w.Code, http.StatusServiceUnavailable)
+	}
+	w = httptest.NewRecorder()
+	heartbeatHandler(&heartbeatClient{&http.Client{}})(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("heartbeat returned unexpected status %v during shutdown expected %v", w.Code, http.StatusServiceUnavailable)
+	}
+
+	close(releaseHandler)
+	if status := <-inFlightStatus; status != http.StatusCreated {
+		t.Fatalf("in-flight request returned unexpected status %v expected %v", status, http.StatusCreated)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("shutdownServer() returned error: %v", err)
+	}
+}
+
+func Test_loadAndValidateConfUpstreamTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		timeout string
+		errPart string
+	}{
+		{"-1s", "upstream timeout -1s is negative"},
+		{"10m", "shorter than the upstream timeout 10m0s of authorization 0"},
+	} {
+		path := t.TempDir() + "/autograph-edge.yaml"
+		err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: testapp-android
+      upstream_timeout: `+tt.timeout+`
+`), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAndValidateConf(path, ""); err == nil || !strings.Contains(err.Error(), tt.errPart) {
+			t.Fatalf("loadAndValidateConf() with an upstream timeout of %s returned error %v expected %q", tt.timeout, err, tt.errPart)
+		}
+	}
+}
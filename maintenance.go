@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var errMaintenance = errors.New("signing is unavailable during maintenance")
+
+// writeMaintenanceError returns the maintenance error to the client,
+// with the configured message instead of the default one when it is set
+func writeMaintenanceError(w http.ResponseWriter, r *http.Request, message string) {
+	ec := lookupErrorCode(errMaintenance)
+	if message == "" {
+		message = ec.err.Error()
+	}
+	writeErrorResponse(w, r, ec.status, errorResponse{
+		Error:     message,
+		Code:      ec.code,
+		RequestID: getRequestID(r),
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	const adminToken = "0a6bf3e5d0c44a1f8e9b7c2d6f5a4e3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f"
+	const clientToken = "3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4"
+	origCfgFile := cfgFile
+	t.Cleanup(func() { cfgFile = origCfgFile })
+	c := currentConf()
+	c.AdminToken = adminToken
+	useTestConf(t, c)
+	cfgFile = t.TempDir() + "/autograph-edge.yaml"
+	reloadWith := func(maintenance string) {
+		t.Helper()
+		err := ioutil.WriteFile(cfgFile, []byte(`autograph_base_url: http://localhost:8000/
+admin_token: `+adminToken+`
+`+maintenance+`
+authorizations:
+    - client_token: `+clientToken+`
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "http://localhost:8080/__reload__", nil)
+		req.Header.Set("Authorization", adminToken)
+		w := httptest.NewRecorder()
+		reloadHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("reload returned %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	reloadWith("maintenance_mode: true\nmaintenance_message: autograph is being upgraded until 14:00 UTC")
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, clientToken, []byte("unsigned")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("signing returned %d %s expected a 503", w.Code, w.Body.String())
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != "maintenance" || resp.Error != "autograph is being upgraded until 14:00 UTC" {
+		t.Fatalf("returned error %+v expected the maintenance code and message", resp)
+	}
+
+	w = httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest("GET", "http://localhost:8080/__version__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("version returned %d expected a 200 in maintenance mode", w.Code)
+	}
+
+	// leaving maintenance mode signs again, here failing on the payload
+	reloadWith("")
+	w = httptest.NewRecorder()
+	sigHandler(w, httptest.NewRequest("POST", "http://localhost:8080/sign", nil))
+	if w.Code == http.StatusServiceUnavailable {
+		t.Fatalf("signing returned %d %s after leaving maintenance mode", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	runtimemetrics "runtime/metrics"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var errOverloaded = errors.New("signing is paused while the edge is low on memory")
+
+// heapObjectsMetric is the memory of the live and not yet swept heap
+// objects, which the runtime reads without stopping the world unlike
+// runtime.ReadMemStats
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// memoryGuard sheds the signing requests while the memory in use is
+// above a soft limit, so that a burst of large uploads is refused
+// before the kernel kills the process. Once over the limit, it keeps
+// shedding until the memory is back under 90% of it so that it doesn't
+// flap at the limit.
+type memoryGuard struct {
+	sync.Mutex
+	shedding bool
+
+	// inUse returns the bytes of memory in use and can be replaced in
+	// tests
+	inUse func() uint64
+}
+
+var memory = &memoryGuard{inUse: heapInUse}
+
+func heapInUse() uint64 {
+	sample := []runtimemetrics.Sample{{Name: heapObjectsMetric}}
+	runtimemetrics.Read(sample)
+	if sample[0].Value.Kind() != runtimemetrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// overloaded returns whether signing requests are shed under limit. It
+// is always false when limit is zero.
+func (g *memoryGuard) overloaded(limit int64) bool {
+	if limit <= 0 {
+		return false
+	}
+	inUse := g.inUse()
+	g.Lock()
+	defer g.Unlock()
+	switch {
+	case !g.shedding && inUse > uint64(limit):
+		g.shedding = true
+		log.Errorf("memory in use %d bytes is over the soft limit of %d bytes, shedding signing requests", inUse, limit)
+	case g.shedding && inUse < uint64(limit-limit/10):
+		g.shedding = false
+		log.Infof("memory in use %d bytes recovered under the soft limit of %d bytes, accepting signing requests", inUse, limit)
+	}
+	return g.shedding
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerMemorySoftLimit(t *testing.T) {
+	testConf := currentConf()
+	testConf.MemorySoftLimit = 1000
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+
+	var inUse atomic.Uint64
+	origMemory := memory
+	memory = &memoryGuard{inUse: inUse.Load}
+	t.Cleanup(func() { memory = origMemory })
+	clientMock := useMockAutographClient(t)
+
+	sign := func() *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, token, []byte("unsigned")))
+		return w
+	}
+	expectOverloaded := func() {
+		t.Helper()
+		w := sign()
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("returned %q: %v", w.Body.String(), err)
+		}
+		if w.Code != http.StatusServiceUnavailable || resp.Code != "overloaded" {
+			t.Fatalf("returned %d %q expected a 503 overloaded", w.Code, resp.Code)
+		}
+	}
+
+	inUse.Store(900)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	if w := sign(); w.Code != http.StatusCreated {
+		t.Fatalf("returned %d %s under the soft limit expected a 201", w.Code, w.Body.String())
+	}
+
+	inUse.Store(1001)
+	expectOverloaded()
+	w := httptest.NewRecorder()
+	lbHeartbeatHandler(w, httptest.NewRequest("GET", "http://localhost:8080/__lbheartbeat__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("lbheartbeat returned %d while overloaded expected a 200", w.Code)
+	}
+
+	// signing resumes once under 90% of the limit, not at the limit
+	inUse.Store(950)
+	expectOverloaded()
+	inUse.Store(800)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	if w := sign(); w.Code != http.StatusCreated {
+		t.Fatalf("returned %d %s once memory recovered expected a 201", w.Code, w.Body.String())
+	}
+
+	// a zero limit disables the guard
+	testConf.MemorySoftLimit = 0
+	useTestConf(t, testConf)
+	inUse.Store(1 << 40)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	if w := sign(); w.Code != http.StatusCreated {
+		t.Fatalf("returned %d %s without a soft limit expected a 201", w.Code, w.Body.String())
+	}
+}
+
+func Test_heapInUse(t *testing.T) {
+	if heapInUse() == 0 {
+		t.Fatal("heapInUse() returned 0 expected the heap in use")
+	}
+}
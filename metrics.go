@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	signingRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "autograph_edge_signing_requests_total",
+			Help: "Total number of signing requests by signer and HTTP status.",
+		},
+		[]string{"signer", "status"},
+	)
+	dryRunRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "autograph_edge_dry_run_requests_total",
+			Help: "Total number of dry-run signing requests by signer and HTTP status.",
+		},
+		[]string{"signer", "status"},
+	)
+	upstreamDuration = newUpstreamDuration(prometheus.DefBuckets)
+	inFlightRequests = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "autograph_edge_in_flight_requests",
+			Help: "Number of signing requests currently being processed.",
+		},
+	)
+	openConnections = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "autograph_edge_open_connections",
+			Help: "Number of client connections currently open.",
+		},
+	)
+	upstreamQueueDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "autograph_edge_upstream_queue_depth",
+			Help: "Number of signing requests waiting for a slot to call autograph.",
+		},
+	)
+	upstreamSlotsInUse = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "autograph_edge_upstream_slots_in_use",
+			Help: "Number of signing requests holding a slot to call autograph.",
+		},
+	)
+	upstreamSlotsLimit = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "autograph_edge_upstream_slots",
+			Help: "Number of slots to call autograph of max_concurrent_upstream, 0 when unlimited.",
+		},
+	)
+	signingWorkersSize = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "autograph_edge_signing_workers",
+			Help: "Number of workers calling autograph of signing_workers, 0 when disabled.",
+		},
+	)
+	signingWorkersBusy = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "autograph_edge_signing_workers_busy",
+			Help: "Number of workers calling autograph for a signing request.",
+		},
+	)
+	signingWorkerQueueDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "autograph_edge_signing_worker_queue_depth",
+			Help: "Number of signing requests waiting for a worker to call autograph.",
+		},
+	)
+	responseCacheRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "autograph_edge_response_cache_requests_total",
+			Help: "Total number of signing requests looked up in the response cache by result.",
+		},
+		[]string{"result"},
+	)
+	heartbeatChecksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "autograph_edge_heartbeat_checks_total",
+			Help: "Total number of upstream heartbeat checks by result.",
+		},
+		[]string{"result"},
+	)
+	auditErrorsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "autograph_edge_audit_errors_total",
+			Help: "Total number of audit records that failed to be written or were dropped.",
+		},
+	)
+)
+
+// newUpstreamDuration registers the histogram of the round-trip times
+// of the calls to autograph, with buckets as the upper bounds in seconds
+func newUpstreamDuration(buckets []float64) *prometheus.HistogramVec {
+	return promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "autograph_edge_upstream_duration_seconds",
+			Help:    "Round-trip time of calls to the upstream autograph.",
+			Buckets: buckets,
+		},
+		[]string{"call"},
+	)
+}
+
+// setUpstreamLatencyBuckets replaces the upstream duration histogram
+// with one of buckets. It is called at startup, before autograph is
+// called.
+func setUpstreamLatencyBuckets(buckets []float64) {
+	prometheus.Unregister(upstreamDuration)
+	upstreamDuration = newUpstreamDuration(buckets)
+}
+
+// validateHistogramBuckets returns an error unless buckets are finite
+// and strictly increasing, as prometheus requires
+func validateHistogramBuckets(buckets []float64) error {
+	for i, bucket := range buckets {
+		if math.IsNaN(bucket) || math.IsInf(bucket, 0) {
+			return fmt.Errorf("histogram bucket %v is not a finite number", bucket)
+		}
+		if i > 0 && bucket <= buckets[i-1] {
+			return fmt.Errorf("histogram buckets must be strictly increasing, got %v after %v", bucket, buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// statusRecorder is an http.ResponseWriter that remembers the status
+// code and counts the body written to it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+
+	// written is the number of bytes of the response body
+	written int64
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(p)
+	sr.written += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Metrics records the metrics of the signing requests, so that the
+// handlers emit them the same way whichever backend is configured
+type Metrics interface {
+	// SigningRequest counts a signing request of signer that returned
+	// status to the client
+	SigningRequest(signer string, status int, dryRun bool)
+
+	// UpstreamDuration times a call to autograph
+	UpstreamDuration(call string, d time.Duration)
+
+	// InFlight adds delta to the signing requests being processed
+	InFlight(delta int)
+
+	// PayloadSize records the sizes of the request and response
+	// bodies of a signing request of signer as sent on the wire
+	PayloadSize(signer string, requestBytes, responseBytes int64)
+}
+
+// metrics is the backend of the configured metrics. It is set at
+// startup and not changed by reloads.
+var metrics Metrics = prometheusMetrics{}
+
+// prometheusMetrics records to the metrics exported at /__metrics__
+type prometheusMetrics struct{}
+
+func (prometheusMetrics) SigningRequest(signer string, status int, dryRun bool) {
+	if dryRun {
+		recordDryRunRequest(signer, status)
+	} else {
+		recordSigningRequest(signer, status)
+	}
+}
+
+func (prometheusMetrics) UpstreamDuration(call string, d time.Duration) {
+	upstreamDuration.WithLabelValues(call).Observe(d.Seconds())
+}
+
+func (prometheusMetrics) InFlight(delta int) {
+	inFlightRequests.Add(float64(delta))
+}
+
+func (prometheusMetrics) PayloadSize(signer string, request, response int64) {
+	if signer == "" {
+		signer = "unknown"
+	}
+	requestBytes.WithLabelValues(signer).Observe(float64(request))
+	responseBytes.WithLabelValues(signer).Observe(float64(response))
+}
+
+// noopMetrics drops the metrics
+type noopMetrics struct{}
+
+func (noopMetrics) SigningRequest(string, int, bool)       {}
+func (noopMetrics) UpstreamDuration(string, time.Duration) {}
+func (noopMetrics) InFlight(int)                           {}
+func (noopMetrics) PayloadSize(string, int64, int64)       {}
+
+// recordSigningRequest increments the signing request counter for
+// a signer and the status code returned to the client
+func recordSigningRequest(signer string, status int) {
+	if signer == "" {
+		signer = "unknown"
+	}
+	signingRequestsTotal.WithLabelValues(signer, strconv.Itoa(status)).Inc()
+}
+
+// recordDryRunRequest increments the dry-run request counter for
+// a signer and the status code returned to the client
+func recordDryRunRequest(signer string, status int) {
+	if signer == "" {
+		signer = "unknown"
+	}
+	dryRunRequestsTotal.WithLabelValues(signer, strconv.Itoa(status)).Inc()
+}
+
+// signerActivity remembers when each signer last returned a signature
+type signerActivity struct {
+	sync.Mutex
+	lastSuccess map[string]time.Time
+}
+
+var lastSuccessfulSign = &signerActivity{lastSuccess: make(map[string]time.Time)}
+
+// record sets the last successful signature of signer to t
+func (sa *signerActivity) record(signer string, t time.Time) {
+	sa.Lock()
+	defer sa.Unlock()
+	sa.lastSuccess[signer] = t
+}
+
+// timestamps returns the unix time of the last successful signature
+// of each signer, which is zero for signers that never signed
+func (sa *signerActivity) timestamps(signers []string) map[string]int64 {
+	sa.Lock()
+	defer sa.Unlock()
+	timestamps := make(map[string]int64, len(signers))
+	for _, signer := range signers {
+		timestamps[signer] = 0
+		if t, ok := sa.lastSuccess[signer]; ok {
+			timestamps[signer] = t.Unix()
+		}
+	}
+	return timestamps
+}
+
+var lastSuccessfulSignDesc = prometheus.NewDesc(
+	"autograph_edge_last_successful_sign_timestamp_seconds",
+	"Unix time of the last successful signature of each configured signer, zero if it never signed.",
+	[]string{"signer"}, nil,
+)
+
+// lastSuccessfulSignCollector exports the last successful signature of
+// the signers of the live configuration, so that signers which never
+// signed are reported and removed signers disappear on reload
+type lastSuccessfulSignCollector struct{}
+
+func (lastSuccessfulSignCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastSuccessfulSignDesc
+}
+
+func (lastSuccessfulSignCollector) Collect(ch chan<- prometheus.Metric) {
+	for signer, timestamp := range lastSuccessfulSign.timestamps(configuredSigners()) {
+		ch <- prometheus.MustNewConstMetric(lastSuccessfulSignDesc, prometheus.GaugeValue, float64(timestamp), signer)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(lastSuccessfulSignCollector{})
+}
+
+// configuredSigners returns the distinct signers of the live configuration
+func configuredSigners() (signers []string) {
+	for _, auth := range currentConf().tokenStore().Authorizations() {
+		if !stringInSlice(auth.Signer, signers) {
+			signers = append(signers, auth.Signer)
+		}
+	}
+	return signers
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSigningRequestMetrics(t *testing.T) {
+	before := testutil.ToFloat64(signingRequestsTotal.WithLabelValues("extensions-ecdsa", "400"))
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+	req.Header.Set("Authorization", "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547")
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusBadRequest)
+	}
+	after := testutil.ToFloat64(signingRequestsTotal.WithLabelValues("extensions-ecdsa", "400"))
+	if after != before+1 {
+		t.Fatalf("signing requests counter got %v expected %v", after, before+1)
+	}
+	if inFlight := testutil.ToFloat64(inFlightRequests); inFlight != 0 {
+		t.Fatalf("in-flight gauge got %v expected 0 after the request completed", inFlight)
+	}
+}
+
+func TestHeartbeatMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	before := testutil.ToFloat64(heartbeatChecksTotal.WithLabelValues("healthy"))
+	useTestBaseURLs(t, upstream.URL+"/")
+	w := httptest.NewRecorder()
+	heartbeatHandler(&heartbeatClient{&http.Client{}})(w, httptest.NewRequest("GET", "http://localhost:8080/__heartbeat__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusOK)
+	}
+	after := testutil.ToFloat64(heartbeatChecksTotal.WithLabelValues("healthy"))
+	if after != before+1 {
+		t.Fatalf("heartbeat checks counter got %v expected %v", after, before+1)
+	}
+
+	metricsRecorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(metricsRecorder, httptest.NewRequest("GET", "http://localhost:8080/__metrics__", nil))
+	body, _ := ioutil.ReadAll(metricsRecorder.Result().Body)
+	for _, name := range []string{
+		"autograph_edge_heartbeat_checks_total",
+		"autograph_edge_upstream_duration_seconds",
+		"autograph_edge_in_flight_requests",
+	} {
+		if !bytes.Contains(body, []byte(name)) {
+			t.Fatalf("metrics endpoint did not export %s:\n%s", name, strings.TrimSpace(string(body)))
+		}
+	}
+}
+
+func TestLastSuccessfulSignMetric(t *testing.T) {
+	c := currentConf()
+	c.Authorizations = append([]authorization(nil), c.Authorizations...)
+	c.Authorizations = append(c.Authorizations, authorization{Signer: "never-signed"})
+	useTestConf(t, c)
+
+	origActivity := lastSuccessfulSign
+	lastSuccessfulSign = &signerActivity{lastSuccess: make(map[string]time.Time)}
+	defer func() { lastSuccessfulSign = origActivity }()
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	before := time.Now().Unix()
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, c.Authorizations[2].ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusCreated)
+	}
+
+	timestamps := lastSuccessfulSign.timestamps(configuredSigners())
+	if timestamps["testapp-android"] < before {
+		t.Fatalf("last successful sign of testapp-android got %d expected at least %d", timestamps["testapp-android"], before)
+	}
+	if ts, ok := timestamps["never-signed"]; !ok || ts != 0 {
+		t.Fatalf("last successful sign of a signer that never signed got %d, %t expected 0, true", ts, ok)
+	}
+
+	metricsRecorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(metricsRecorder, httptest.NewRequest("GET", "http://localhost:8080/__metrics__", nil))
+	body := metricsRecorder.Body.String()
+	if !strings.Contains(body, `autograph_edge_last_successful_sign_timestamp_seconds{signer="never-signed"} 0`) {
+		t.Fatal("metrics do not report the signer that never signed")
+	}
+}
+
+func Test_validateHistogramBuckets(t *testing.T) {
+	for _, tt := range []struct {
+		buckets []float64
+		wantErr bool
+	}{
+		{nil, false},
+		{[]float64{0.1, 0.5, 1, 5, 30}, false},
+		{[]float64{0.5, 0.1}, true},
+		{[]float64{1, 1}, true},
+		{[]float64{1, math.Inf(1)}, true},
+		{[]float64{math.NaN()}, true},
+	} {
+		if err := validateHistogramBuckets(tt.buckets); (err != nil) != tt.wantErr {
+			t.Errorf("validateHistogramBuckets(%v) error = %v, wantErr %v", tt.buckets, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_loadAndValidateConfUpstreamLatencyBuckets(t *testing.T) {
+	path := t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+upstream_latency_buckets: [0.25, 1, 0.5]
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: testapp-android
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAndValidateConf(path, ""); err == nil || !strings.Contains(err.Error(), "invalid upstream latency buckets") {
+		t.Fatalf("loadAndValidateConf() with decreasing buckets returned error %v", err)
+	}
+}
+
+func Test_setUpstreamLatencyBuckets(t *testing.T) {
+	setUpstreamLatencyBuckets([]float64{0.5, 30})
+	t.Cleanup(func() { setUpstreamLatencyBuckets(prometheus.DefBuckets) })
+	upstreamDuration.WithLabelValues("sign").Observe(12)
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/__metrics__", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, `autograph_edge_upstream_duration_seconds_bucket{call="sign",le="30"} 1`) {
+		t.Fatalf("metrics are missing the configured bucket:\n%s", body)
+	}
+	if strings.Contains(body, `autograph_edge_upstream_duration_seconds_bucket{call="sign",le="10"}`) {
+		t.Fatal("metrics still have the default buckets")
+	}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"math/rand"
 	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Middleware wraps an http.Handler with additional functionality
@@ -29,13 +32,45 @@ func makeRequestID() string {
 	return string(rid)
 }
 
+// maxRequestIDLength bounds the incoming request IDs, which fits UUIDs
+// and the IDs of the usual gateways
+const maxRequestIDLength = 64
+
+// isValidRequestID returns whether rid can be trusted as a request ID:
+// a non-empty string of at most maxRequestIDLength ASCII letters,
+// digits and dashes
+func isValidRequestID(rid string) bool {
+	if rid == "" || len(rid) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range rid {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
 // setRequestID is a middleware the generates a random ID for each request processed
-// by the HTTP server. The request ID is added to the request context and used to
-// track various information and correlate logs.
+// by the HTTP server, unless the client sent a valid one in the X-Request-ID header.
+// The request ID is added to the request context and used to track various
+// information and correlate logs. It is also returned to the client in the
+// X-Request-ID response header, and a logger carrying the ID is added to the
+// request context.
 func setRequestID() Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			h.ServeHTTP(w, addToContext(r, contextKeyRequestID, makeRequestID()))
+			rid := r.Header.Get("X-Request-ID")
+			if !isValidRequestID(rid) {
+				if rid != "" {
+					log.Warnf("replacing a malformed X-Request-ID of %d bytes", len(rid))
+				}
+				rid = makeRequestID()
+			}
+			w.Header().Set("X-Request-ID", rid)
+			r = addToContext(r, contextKeyRequestID, rid)
+			r = addToContext(r, contextKeyLogger, log.WithField("rid", rid))
+			h.ServeHTTP(w, r)
 		})
 	}
 }
@@ -53,3 +88,106 @@ func setResponseHeaders() Middleware {
 		})
 	}
 }
+
+// allowGET is a middleware that rejects the requests of other methods
+// than GET and HEAD with a 405 and the JSON error of the signing
+// endpoint
+func allowGET() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				w.Header().Set("Allow", "GET, HEAD")
+				writeSigningError(w, r, errGetOnly)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setServerHeader is a middleware that strips the Server header from
+// the responses, so they don't fingerprint the edge or a proxied
+// backend, and sets the server_header of the live configuration
+// instead when there is one
+func setServerHeader() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(&serverHeaderWriter{ResponseWriter: w, server: currentConf().ServerHeader}, r)
+		})
+	}
+}
+
+// serverHeaderWriter replaces the Server header when the response
+// headers are written, after the handler had a chance to set it
+type serverHeaderWriter struct {
+	http.ResponseWriter
+	server      string
+	wroteHeader bool
+}
+
+func (sw *serverHeaderWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		if sw.server == "" {
+			sw.Header().Del("Server")
+		} else {
+			sw.Header().Set("Server", sw.server)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *serverHeaderWriter) Write(p []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (sw *serverHeaderWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// corsAllowedHeaders returns the request headers browsers can send to
+// the signing endpoint, including the authHeader carrying the token
+func corsAllowedHeaders(authHeader string) string {
+	return strings.Join([]string{
+		authHeader,
+		"Content-Type",
+		"Content-Encoding",
+		optionsHeader,
+		contentSHA256Header,
+		filenameHeader,
+		maxRetriesHeader,
+		priorityHeader,
+	}, ", ")
+}
+
+// handleCORS is a middleware that lets browsers on the configured
+// origins call a handler. It answers CORS preflight requests and adds
+// the CORS headers to the responses of allowed origins. Requests from
+// other origins get no CORS headers.
+func handleCORS() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conf := currentConf()
+			origin := r.Header.Get("Origin")
+			if origin == "" || !stringInSlice(origin, conf.CORS.AllowedOrigins) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Content-Disposition, X-Autograph-Signer, X-Autograph-X5U")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders(conf.AuthHeader))
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
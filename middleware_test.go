@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+func Test_setRequestID(t *testing.T) {
+	var (
+		ctxRequestID string
+		loggerRID    interface{}
+	)
+	handler := handleWithMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctxRequestID = getRequestID(r)
+			loggerRID = getLogger(r).Data["rid"]
+		}),
+		setRequestID(),
+	)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/sign", nil))
+
+	headerRequestID := w.Result().Header.Get("X-Request-ID")
+	if len(headerRequestID) != 16 {
+		t.Fatalf("unexpected X-Request-ID response header %q", headerRequestID)
+	}
+	if ctxRequestID != headerRequestID {
+		t.Fatalf("request ID in context %q does not match response header %q", ctxRequestID, headerRequestID)
+	}
+	if loggerRID != headerRequestID {
+		t.Fatalf("request ID of the context logger %q does not match response header %q", loggerRID, headerRequestID)
+	}
+}
+
+func Test_setRequestIDIncoming(t *testing.T) {
+	handler := handleWithMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		setRequestID(),
+	)
+	for _, tt := range []struct {
+		name     string
+		incoming string
+		kept     bool
+	}{
+		{"valid UUID", "6f1c9a52-3b7e-4d2a-9c41-0e8b5d7f2a19", true},
+		{"valid alphanumeric", "gatewayReq42", true},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"malformed", "req id\nforged log line", false},
+		{"absent", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost:8080/sign", nil)
+			if tt.incoming != "" {
+				req.Header.Set("X-Request-ID", tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			rid := w.Result().Header.Get("X-Request-ID")
+			if tt.kept && rid != tt.incoming {
+				t.Fatalf("returned X-Request-ID %q expected the incoming %q", rid, tt.incoming)
+			}
+			if !tt.kept && (rid == tt.incoming || len(rid) != 16) {
+				t.Fatalf("returned X-Request-ID %q expected a generated one", rid)
+			}
+		})
+	}
+}
+
+func TestRequestIDForwardedUpstream(t *testing.T) {
+	var upstreamRequestID string
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		upstreamRequestID = req.Header.Get("X-Request-ID")
+		return newSignedFileResponse([]byte("signed")), nil
+	})
+
+	req := newMultipartSignRequest(t, "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547", []byte("unsigned"))
+	req.Header.Set("X-Request-ID", "6f1c9a52-3b7e-4d2a-9c41-0e8b5d7f2a19")
+	w := httptest.NewRecorder()
+	handleWithMiddleware(http.HandlerFunc(sigHandler), setRequestID()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusCreated)
+	}
+	if upstreamRequestID != "6f1c9a52-3b7e-4d2a-9c41-0e8b5d7f2a19" || upstreamRequestID != w.Result().Header.Get("X-Request-ID") {
+		t.Fatalf("upstream X-Request-ID %q does not match response header %q", upstreamRequestID, w.Result().Header.Get("X-Request-ID"))
+	}
+}
+
+func Test_handleCORS(t *testing.T) {
+	c := currentConf()
+	c.CORS.AllowedOrigins = []string{"https://signer.example.com"}
+	useTestConf(t, c)
+
+	var called bool
+	handler := handleWithMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			w.WriteHeader(http.StatusCreated)
+		}),
+		handleCORS(),
+	)
+
+	t.Run("preflight from an allowed origin", func(t *testing.T) {
+		called = false
+		req := httptest.NewRequest("OPTIONS", "http://localhost:8080/sign", nil)
+		req.Header.Set("Origin", "https://signer.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "authorization")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if called {
+			t.Fatal("preflight request was passed to the handler")
+		}
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusNoContent)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://signer.example.com" {
+			t.Fatalf("unexpected Access-Control-Allow-Origin %q", got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "POST") {
+			t.Fatalf("unexpected Access-Control-Allow-Methods %q", got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Authorization") {
+			t.Fatalf("Access-Control-Allow-Headers %q does not allow the token header", got)
+		}
+	})
+
+	t.Run("request from an allowed origin", func(t *testing.T) {
+		called = false
+		req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+		req.Header.Set("Origin", "https://signer.example.com")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if !called {
+			t.Fatal("request was not passed to the handler")
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://signer.example.com" {
+			t.Fatalf("unexpected Access-Control-Allow-Origin %q", got)
+		}
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		for _, method := range []string{"OPTIONS", "POST"} {
+			called = false
+			req := httptest.NewRequest(method, "http://localhost:8080/sign", nil)
+			req.Header.Set("Origin", "https://evil.example.com")
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if !called {
+				t.Fatalf("%s request was not passed to the handler", method)
+			}
+			for name := range w.Header() {
+				if strings.HasPrefix(name, "Access-Control-") {
+					t.Fatalf("%s request from a disallowed origin got CORS header %s", method, name)
+				}
+			}
+		}
+	})
+}
+
+func Test_validateCORSOrigin(t *testing.T) {
+	for _, origin := range []string{"https://signer.example.com", "http://localhost:3000"} {
+		if err := validateCORSOrigin(origin); err != nil {
+			t.Errorf("validateCORSOrigin(%q) returned error: %v", origin, err)
+		}
+	}
+	for _, origin := range []string{"*", "signer.example.com", "https://signer.example.com/path", "ftp://signer.example.com"} {
+		if err := validateCORSOrigin(origin); err == nil {
+			t.Errorf("validateCORSOrigin(%q) returned no error", origin)
+		}
+	}
+}
+
+func Test_setServerHeader(t *testing.T) {
+	// the handlers themselves don't set it, so stand in for a proxy
+	// or library that does
+	leaky := handleWithMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Go-http-server/1.1")
+		w.Write([]byte("ok"))
+	}), setServerHeader())
+	w := httptest.NewRecorder()
+	leaky.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if _, ok := w.Result().Header["Server"]; ok {
+		t.Fatalf("returned Server header %q expected none", w.Result().Header.Get("Server"))
+	}
+
+	for _, serverHeader := range []string{"", "edge"} {
+		testConf := currentConf()
+		testConf.ServerHeader = serverHeader
+		useTestConf(t, testConf)
+		handler := prepareServer().Handler
+		for _, path := range []string{"/__version__", "/__lbheartbeat__", "/sign", "/blargh"} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if got := w.Result().Header.Values("Server"); serverHeader == "" && len(got) != 0 || serverHeader != "" && (len(got) != 1 || got[0] != serverHeader) {
+				t.Fatalf("%s returned Server header %q expected %q", path, got, serverHeader)
+			}
+			if got := w.Result().Header.Values("X-Content-Type-Options"); len(got) != 1 || got[0] != "nosniff" {
+				t.Fatalf("%s returned X-Content-Type-Options %q expected nosniff", path, got)
+			}
+		}
+	}
+}
@@ -11,6 +11,44 @@ import (
 	gomock "github.com/golang/mock/gomock"
 )
 
+// MockautographRequester is a mock of autographRequester interface.
+type MockautographRequester struct {
+	ctrl     *gomock.Controller
+	recorder *MockautographRequesterMockRecorder
+}
+
+// MockautographRequesterMockRecorder is the mock recorder for MockautographRequester.
+type MockautographRequesterMockRecorder struct {
+	mock *MockautographRequester
+}
+
+// NewMockautographRequester creates a new mock instance.
+func NewMockautographRequester(ctrl *gomock.Controller) *MockautographRequester {
+	mock := &MockautographRequester{ctrl: ctrl}
+	mock.recorder = &MockautographRequesterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockautographRequester) EXPECT() *MockautographRequesterMockRecorder {
+	return m.recorder
+}
+
+// Do mocks base method.
+func (m *MockautographRequester) Do(arg0 *http.Request) (*http.Response, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Do", arg0)
+	ret0, _ := ret[0].(*http.Response)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Do indicates an expected call of Do.
+func (mr *MockautographRequesterMockRecorder) Do(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Do", reflect.TypeOf((*MockautographRequester)(nil).Do), arg0)
+}
+
 // MockheartbeatRequester is a mock of heartbeatRequester interface.
 type MockheartbeatRequester struct {
 	ctrl     *gomock.Controller
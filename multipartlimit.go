@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultMaxMultipartParts leaves room for the form fields of a
+	// full batch of the default max batch parts
+	defaultMaxMultipartParts = 64
+
+	// defaultMaxMultipartBytes bounds the batches well under the
+	// default max upload bytes of a single file
+	defaultMaxMultipartBytes = 50 << 20
+
+	// defaultMaxMultipartFieldName is much longer than the field
+	// names of the edge, like input or output
+	defaultMaxMultipartFieldName = 256
+
+	// defaultMaxMultipartPartHeaders leaves room for the
+	// Content-Disposition, Content-Type and a few more headers of
+	// each part
+	defaultMaxMultipartPartHeaders = 16
+
+	// maxPartHeaderReadAhead is how much more than the headers of a
+	// part the multipart reader can buffer while reading them
+	maxPartHeaderReadAhead = 4096
+)
+
+var (
+	errTooManyMultipartParts = errors.New("too many parts in multipart request")
+	errMultipartTooLarge     = errors.New("multipart request uploading several files is too large")
+	errInvalidPartHeaders    = errors.New("invalid multipart part headers")
+)
+
+// multipartLimits are the limits of the multipart signing requests
+type multipartLimits struct {
+	// Parts is the maximum number of parts, files and fields
+	Parts int
+	// Bytes is the maximum size of a request uploading more than one
+	// file
+	Bytes int64
+	// FieldName is the maximum length of the name of a part
+	FieldName int
+	// PartHeaders is the maximum number of headers of a part
+	PartHeaders int
+}
+
+// multipartLimits returns the multipart limits of c
+func (c configuration) multipartLimits() multipartLimits {
+	return multipartLimits{
+		Parts:       c.MaxMultipartParts,
+		Bytes:       c.MaxMultipartBytes,
+		FieldName:   c.MaxMultipartFieldName,
+		PartHeaders: c.MaxMultipartPartHeaders,
+	}
+}
+
+// maxHeaderBytes bounds the bytes read for the headers of a part, so
+// that a part with endless headers is rejected before they are
+// buffered. The longest valid Content-Disposition fits in a line per
+// header.
+func (l multipartLimits) maxHeaderBytes() int64 {
+	return int64(l.PartHeaders) * int64(l.FieldName+1024)
+}
+
+// parseLimitedMultipartForm parses the multipart form of r like
+// ParseMultipartForm, stopping with errTooManyMultipartParts once the
+// body has more than limits.Parts parts, with errMultipartTooLarge once
+// it uploads more than one file and limits.Bytes have been read, and
+// with errInvalidPartHeaders once a part has too many or too long
+// headers, a field name longer than limits.FieldName or a nested
+// multipart content type. The parts are checked by a second multipart
+// reader fed the body as the form reads it, so that the limits are hit
+// before the rest of the body is buffered.
+func parseLimitedMultipartForm(r *http.Request, limits multipartLimits) error {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		// let ParseMultipartForm return its usual error
+		return r.ParseMultipartForm(maxFormMemory)
+	}
+	pr, pw := io.Pipe()
+	limitErr := make(chan error, 1)
+	go func() {
+		err := checkMultipartLimits(pr, params["boundary"], limits)
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			// drain the epilogue and the rest of a malformed body,
+			// which the form reports
+			io.Copy(io.Discard, pr)
+		}
+		limitErr <- err
+	}()
+	body := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, pw), body}
+	err = r.ParseMultipartForm(maxFormMemory)
+	r.Body = body
+	pw.Close()
+	if limit := <-limitErr; limit != nil {
+		if r.MultipartForm != nil {
+			r.MultipartForm.RemoveAll()
+			r.MultipartForm = nil
+		}
+		return limit
+	}
+	return err
+}
+
+// checkMultipartLimits reads the parts of a multipart body from body
+// and returns an error once they exceed the limits
+func checkMultipartLimits(body io.Reader, boundary string, limits multipartLimits) error {
+	counter := &countingReader{r: body}
+	mr := multipart.NewReader(counter, boundary)
+	var parts, files int
+	tooLarge := func() error {
+		if files > 1 && counter.n > limits.Bytes {
+			return errors.Wrapf(errMultipartTooLarge, "the maximum is %d bytes", limits.Bytes)
+		}
+		return nil
+	}
+	for {
+		counter.limit = counter.n + limits.maxHeaderBytes() + maxPartHeaderReadAhead
+		part, err := mr.NextPart()
+		counter.limit = 0
+		if errors.Is(err, errInvalidPartHeaders) {
+			return err
+		}
+		if err != nil {
+			// the end of the body or a malformed part, which the
+			// form reports
+			return tooLarge()
+		}
+		parts++
+		if parts > limits.Parts {
+			return errors.Wrapf(errTooManyMultipartParts, "the maximum is %d", limits.Parts)
+		}
+		if err = checkPartHeaders(part, limits); err != nil {
+			return err
+		}
+		if part.FileName() != "" {
+			files++
+		}
+		for err == nil {
+			if err = tooLarge(); err != nil {
+				return err
+			}
+			_, err = io.CopyN(io.Discard, part, 32<<10)
+		}
+	}
+}
+
+// checkPartHeaders returns an error when the headers of part exceed
+// the limits or it nests another multipart body, which the form would
+// not read as parts
+func checkPartHeaders(part *multipart.Part, limits multipartLimits) error {
+	var headers int
+	for _, values := range part.Header {
+		headers += len(values)
+	}
+	if headers > limits.PartHeaders {
+		return errors.Wrapf(errInvalidPartHeaders, "part has %d headers, the maximum is %d", headers, limits.PartHeaders)
+	}
+	if name := part.FormName(); len(name) > limits.FieldName {
+		return errors.Wrapf(errInvalidPartHeaders, "field name is %d bytes long, the maximum is %d", len(name), limits.FieldName)
+	}
+	if contentType := part.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+			return errors.Wrapf(errInvalidPartHeaders, "part of field %q has nested content type %s", part.FormName(), mediaType)
+		}
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r. Reads fail with
+// errInvalidPartHeaders once more than limit bytes were read, when it
+// is set.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	if cr.limit > 0 && cr.n >= cr.limit {
+		return 0, errors.Wrap(errInvalidPartHeaders, "part headers are too long")
+	}
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
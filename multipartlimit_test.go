@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerMultipartLimits(t *testing.T) {
+	testConf := currentConf()
+	testConf.MaxMultipartParts = 16
+	testConf.MaxMultipartBytes = 4096
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+
+	t.Run("rejects too many parts", func(t *testing.T) {
+		fields := make(map[string]string)
+		for i := 0; i < 20; i++ {
+			fields[fmt.Sprintf("field%d", i)] = "value"
+		}
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequestWithFields(t, token, []byte("unsigned"), fields))
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "too_many_multipart_parts") {
+			t.Fatalf("returned %d %s expected a 413 too_many_multipart_parts", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("rejects batches over the aggregate size", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		sigHandler(w, newBatchSignRequest(t, token, map[string][]byte{
+			"first":  bytes.Repeat([]byte("a"), 3000),
+			"second": bytes.Repeat([]byte("b"), 3000),
+		}))
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "multipart_too_large") {
+			t.Fatalf("returned %d %s expected a 413 multipart_too_large", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("single files over the aggregate size are signed", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, token, bytes.Repeat([]byte("a"), 10000)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+		}
+	})
+}
+
+// endlessParts is a multipart body of form fields that never ends,
+// counting the bytes read from it
+type endlessParts struct {
+	part []byte
+	off  int
+	read int
+}
+
+func (e *endlessParts) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		copied := copy(p[n:], e.part[e.off:])
+		n += copied
+		e.off = (e.off + copied) % len(e.part)
+	}
+	e.read += n
+	return n, nil
+}
+
+func Test_parseLimitedMultipartFormStopsEarly(t *testing.T) {
+	body := &endlessParts{part: []byte("--boundary\r\nContent-Disposition: form-data; name=\"field\"\r\n\r\n" + strings.Repeat("x", 1024) + "\r\n")}
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", body)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+	err := parseLimitedMultipartForm(req, multipartLimits{Parts: 16, Bytes: 4096, FieldName: 256, PartHeaders: 16})
+	if err == nil || !strings.Contains(err.Error(), errTooManyMultipartParts.Error()) {
+		t.Fatalf("parseLimitedMultipartForm() returned %v expected %v", err, errTooManyMultipartParts)
+	}
+	if body.read > 256<<10 {
+		t.Fatalf("read %d bytes of the body before rejecting it", body.read)
+	}
+}
+
+func Test_parseLimitedMultipartFormPartHeaders(t *testing.T) {
+	limits := multipartLimits{Parts: 16, Bytes: 4096, FieldName: 256, PartHeaders: 16}
+	manyHeaders := ""
+	for i := 0; i < 20; i++ {
+		manyHeaders += fmt.Sprintf("X-Header-%d: value\r\n", i)
+	}
+	for _, tt := range []struct {
+		name    string
+		headers string
+		wantErr bool
+	}{
+		{"valid", "Content-Disposition: form-data; name=\"input\"; filename=\"a.apk\"\r\nContent-Type: application/octet-stream\r\n", false},
+		{"long field name", "Content-Disposition: form-data; name=\"" + strings.Repeat("a", 257) + "\"\r\n", true},
+		{"many headers", "Content-Disposition: form-data; name=\"input\"\r\n" + manyHeaders, true},
+		{"enormous header", "Content-Disposition: form-data; name=\"input\"\r\nX-Padding: " + strings.Repeat("x", 1<<20) + "\r\n", true},
+		{"nested multipart", "Content-Disposition: form-data; name=\"input\"\r\nContent-Type: multipart/mixed; boundary=inner\r\n", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := "--boundary\r\n" + tt.headers + "\r\nunsigned\r\n--boundary--\r\n"
+			req := httptest.NewRequest("POST", "http://localhost:8080/sign", strings.NewReader(body))
+			req.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+			err := parseLimitedMultipartForm(req, limits)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidPartHeaders) {
+					t.Fatalf("parseLimitedMultipartForm() returned %v expected %v", err, errInvalidPartHeaders)
+				}
+				if req.MultipartForm != nil {
+					t.Fatal("parseLimitedMultipartForm() kept the form of a rejected request")
+				}
+			} else if err != nil {
+				t.Fatalf("parseLimitedMultipartForm() returned %v", err)
+			}
+		})
+	}
+}
+
+func Test_parseLimitedMultipartFormEndlessHeaders(t *testing.T) {
+	body := &endlessParts{part: []byte("X-Padding: " + strings.Repeat("x", 1024) + "\r\n")}
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", io.MultiReader(strings.NewReader("--boundary\r\n"), body))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+	err := parseLimitedMultipartForm(req, multipartLimits{Parts: 16, Bytes: 4096, FieldName: 256, PartHeaders: 16})
+	if !errors.Is(err, errInvalidPartHeaders) {
+		t.Fatalf("parseLimitedMultipartForm() returned %v expected %v", err, errInvalidPartHeaders)
+	}
+	if body.read > 256<<10 {
+		t.Fatalf("read %d bytes of the headers before rejecting them", body.read)
+	}
+}
+
+func TestSigHandlerRejectsInvalidPartHeaders(t *testing.T) {
+	token := currentConf().Authorizations[2].ClientToken
+	body := "--boundary\r\nContent-Disposition: form-data; name=\"" + strings.Repeat("a", 4096) + "\"; filename=\"a.apk\"\r\n\r\nunsigned\r\n--boundary--\r\n"
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", strings.NewReader(body))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+	req.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_part_headers") {
+		t.Fatalf("returned %d %s expected a 400 invalid_part_headers", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// nonceConfig bounds the nonces remembered to reject the replayed
+// requests of the tokens with RequireNonce
+type nonceConfig struct {
+	// Window is how long a nonce is remembered. Defaults to 10m.
+	Window time.Duration `yaml:"window"`
+
+	// MaxEntries is the maximum number of nonces remembered, over
+	// which the least recently used are forgotten. Defaults to 100000.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+const (
+	defaultNonceWindow     = 10 * time.Minute
+	defaultNonceMaxEntries = 100000
+)
+
+// nonceHeader carries the unique value of a signing request of a token
+// with RequireNonce
+const nonceHeader = "X-Nonce"
+
+// maxNonceLength bounds the X-Nonce header
+const maxNonceLength = 255
+
+var (
+	errMissingNonce = errors.New("missing X-Nonce header")
+	errInvalidNonce = errors.New("invalid X-Nonce header")
+	errNonceReused  = errors.New("nonce was already used")
+)
+
+// requestNonce returns the nonce of the X-Nonce header of r scoped to
+// the client token, so that tokens don't share nonces, or an error when
+// auth requires a nonce that is missing or too long. It is empty for
+// tokens without RequireNonce.
+func requestNonce(r *http.Request, auth authorization, token string) (key [sha256.Size]byte, ok bool, err error) {
+	if !auth.RequireNonce {
+		return key, false, nil
+	}
+	nonce := strings.TrimSpace(r.Header.Get(nonceHeader))
+	if nonce == "" {
+		return key, false, errMissingNonce
+	}
+	if len(nonce) > maxNonceLength {
+		return key, false, errors.Wrapf(errInvalidNonce, "nonce is longer than %d bytes", maxNonceLength)
+	}
+	return sha256.Sum256([]byte(token + "\x00" + nonce)), true, nil
+}
+
+// nonceStore is an in-memory LRU of the nonces seen within their window
+type nonceStore struct {
+	sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+}
+
+type seenNonce struct {
+	key     [sha256.Size]byte
+	expires time.Time
+}
+
+var seenNonces = newNonceStore()
+
+func newNonceStore() *nonceStore {
+	return &nonceStore{
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// use records key for window and returns errNonceReused when it was
+// already recorded and has not expired. The least recently used nonces
+// are forgotten to keep at most maxEntries.
+func (s *nonceStore) use(key [sha256.Size]byte, window time.Duration, maxEntries int) error {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if elem, ok := s.entries[key]; ok {
+		if now.Before(elem.Value.(*seenNonce).expires) {
+			s.lru.MoveToFront(elem)
+			return errNonceReused
+		}
+		s.remove(elem)
+	}
+	s.entries[key] = s.lru.PushFront(&seenNonce{key: key, expires: now.Add(window)})
+	for s.lru.Len() > maxEntries {
+		s.remove(s.lru.Back())
+	}
+	return nil
+}
+
+func (s *nonceStore) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*seenNonce)
+	delete(s.entries, entry.key)
+}
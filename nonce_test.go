@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func useTestNonceStore(t *testing.T) *nonceStore {
+	origStore := seenNonces
+	seenNonces = newNonceStore()
+	t.Cleanup(func() { seenNonces = origStore })
+	return seenNonces
+}
+
+func Test_nonceStore(t *testing.T) {
+	s := newNonceStore()
+	a, b := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+	if err := s.use(a, time.Hour, 2); err != nil {
+		t.Fatalf("use() of a fresh nonce returned %v", err)
+	}
+	if err := s.use(a, time.Hour, 2); err != errNonceReused {
+		t.Fatalf("use() of a replayed nonce returned %v expected %v", err, errNonceReused)
+	}
+
+	// nonces are forgotten once their window is over
+	s.use(b, 50*time.Millisecond, 2)
+	time.Sleep(100 * time.Millisecond)
+	if err := s.use(b, time.Hour, 2); err != nil {
+		t.Fatalf("use() of an expired nonce returned %v", err)
+	}
+
+	// c doesn't fit with a and b, so a is evicted as the least recently used
+	s.use(sha256.Sum256([]byte("c")), time.Hour, 2)
+	if _, ok := s.entries[a]; ok || s.lru.Len() != 2 {
+		t.Fatalf("kept %d nonces expected the least recently used to be evicted", s.lru.Len())
+	}
+
+	// concurrent requests of the same nonce are only accepted once
+	var wg sync.WaitGroup
+	accepted := make(chan struct{}, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.use(sha256.Sum256([]byte("d")), time.Hour, 2) == nil {
+				accepted <- struct{}{}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(accepted) != 1 {
+		t.Fatalf("accepted a concurrently replayed nonce %d times expected once", len(accepted))
+	}
+}
+
+func TestSigHandlerNonce(t *testing.T) {
+	useTestNonceStore(t)
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].RequireNonce = true
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+
+	sign := func(nonce string) *httptest.ResponseRecorder {
+		req := newMultipartSignRequest(t, token, []byte("unsigned"))
+		if nonce != "" {
+			req.Header.Set(nonceHeader, nonce)
+		}
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		return w
+	}
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	if w := sign("9f2b7c1e-1"); w.Code != http.StatusCreated {
+		t.Fatalf("fresh nonce returned %d %s expected a 201", w.Code, w.Body.String())
+	}
+	if w := sign("9f2b7c1e-1"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "nonce_reused") {
+		t.Fatalf("replayed nonce returned %d %s expected a 409 nonce_reused", w.Code, w.Body.String())
+	}
+	if w := sign(""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "missing_nonce") {
+		t.Fatalf("missing nonce returned %d %s expected a 400 missing_nonce", w.Code, w.Body.String())
+	}
+}
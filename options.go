@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errInvalidOptions = errors.New("invalid signing options")
+
+// optionsHeader can carry the signing options when they are not sent
+// as an options form value
+const optionsHeader = "X-Autograph-Options"
+
+// forwardableOptions are the autograph signing options clients can set.
+// Options that pin what a token may sign, like the add-on id, and the
+// COSE algorithms, which have their own allow-list, are not forwardable.
+var forwardableOptions = []string{
+	"pkcs7_digest",
+	"zip",
+}
+
+// requestedOptions returns the JSON signing options of the options
+// form value or, when it is absent, of the X-Autograph-Options header
+func requestedOptions(r *http.Request) (map[string]interface{}, error) {
+	raw := ""
+	if r.MultipartForm != nil && len(r.MultipartForm.Value["options"]) > 0 {
+		raw = r.MultipartForm.Value["options"][0]
+	} else {
+		raw = r.Header.Get(optionsHeader)
+	}
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var options map[string]interface{}
+	err := json.Unmarshal([]byte(raw), &options)
+	if err != nil {
+		return nil, errors.Wrap(errInvalidOptions, err.Error())
+	}
+	return options, nil
+}
+
+// allowedOptions checks that the requested signing options can be
+// forwarded and returns them. Tokens without AllowRequestOptions
+// ignore the request options.
+func allowedOptions(auth authorization, requested map[string]interface{}) (map[string]interface{}, error) {
+	if !auth.AllowRequestOptions || len(requested) == 0 {
+		return nil, nil
+	}
+	var unknown []string
+	for key := range requested {
+		if !stringInSlice(key, forwardableOptions) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.Wrapf(errInvalidOptions, "option %s cannot be set", strings.Join(unknown, ", "))
+	}
+	return requested, nil
+}
+
+// mergeOptions returns the signing options of base with the
+// request options set on top of them
+func mergeOptions(base interface{}, options map[string]interface{}) (interface{}, error) {
+	if len(options) == 0 {
+		return base, nil
+	}
+	merged := map[string]interface{}{}
+	if base != nil {
+		encoded, err := json.Marshal(base)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(encoded, &merged)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range options {
+		merged[key] = value
+	}
+	return merged, nil
+}
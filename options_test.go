@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+)
+
+func Test_allowedOptions(t *testing.T) {
+	trusted := authorization{AllowRequestOptions: true}
+
+	options, err := allowedOptions(authorization{}, map[string]interface{}{"pkcs7_digest": "SHA256"})
+	if err != nil || options != nil {
+		t.Fatalf("allowedOptions() without AllowRequestOptions returned %v, %v expected nil, nil", options, err)
+	}
+	options, err = allowedOptions(trusted, map[string]interface{}{"pkcs7_digest": "SHA256"})
+	if err != nil || options["pkcs7_digest"] != "SHA256" {
+		t.Fatalf("allowedOptions() returned %v, %v expected the forwardable option", options, err)
+	}
+	_, err = allowedOptions(trusted, map[string]interface{}{"pkcs7_digest": "SHA256", "id": "other@allizom.org"})
+	if !errors.Is(err, errInvalidOptions) {
+		t.Fatalf("allowedOptions() with an unknown key returned error %v expected %v", err, errInvalidOptions)
+	}
+}
+
+func Test_mergeOptions(t *testing.T) {
+	merged, err := mergeOptions(xpiOptions{ID: "myaddon@allizom.org", PKCS7Digest: "SHA1"}, map[string]interface{}{"pkcs7_digest": "SHA256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := merged.(map[string]interface{})
+	if m["id"] != "myaddon@allizom.org" || m["pkcs7_digest"] != "SHA256" {
+		t.Fatalf("mergeOptions() returned unexpected options %v", m)
+	}
+
+	merged, err = mergeOptions(nil, map[string]interface{}{"zip": "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.(map[string]interface{})["zip"] != "all" {
+		t.Fatalf("mergeOptions() returned unexpected options %v", merged)
+	}
+}
+
+func TestSigHandlerRequestOptions(t *testing.T) {
+	c := currentConf()
+	c.Authorizations = append([]authorization(nil), c.Authorizations...)
+	c.Authorizations[0].AllowRequestOptions = true
+	useTestConf(t, c)
+
+	testcases := []struct {
+		name           string
+		token          string
+		options        string
+		header         bool
+		expectedStatus int
+		expectedDigest string
+	}{
+		{"trusted token form options", c.Authorizations[0].ClientToken, `{"pkcs7_digest":"SHA256"}`, false, http.StatusCreated, "SHA256"},
+		{"trusted token header options", c.Authorizations[0].ClientToken, `{"pkcs7_digest":"SHA256"}`, true, http.StatusCreated, "SHA256"},
+		{"trusted token unknown option", c.Authorizations[0].ClientToken, `{"id":"other@allizom.org"}`, false, http.StatusBadRequest, ""},
+		{"trusted token malformed options", c.Authorizations[0].ClientToken, `{"pkcs7_digest":`, false, http.StatusBadRequest, ""},
+		{"untrusted token options are ignored", c.Authorizations[1].ClientToken, `{"pkcs7_digest":"SHA1","id":"other@allizom.org"}`, false, http.StatusCreated, "SHA256"},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []struct {
+				Options xpiOptions
+			}
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					err := json.NewDecoder(req.Body).Decode(&upstreamRequests)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return newSignedFileResponse(newSignedXPI(t, xpiPKCS7SignaturePath, xpiCOSESignaturePath)), nil
+				})
+			}
+
+			fields := map[string]string{}
+			if !tt.header {
+				fields["options"] = tt.options
+			}
+			req := newMultipartSignRequestWithFields(t, tt.token, []byte("unsigned"), fields)
+			if tt.header {
+				req.Header.Set(optionsHeader, tt.options)
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v", w.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus != http.StatusCreated {
+				return
+			}
+			if len(upstreamRequests) != 1 {
+				t.Fatalf("upstream received %d signing requests expected 1", len(upstreamRequests))
+			}
+			opts := upstreamRequests[0].Options
+			if opts.PKCS7Digest != tt.expectedDigest {
+				t.Fatalf("upstream received pkcs7_digest %q expected %q", opts.PKCS7Digest, tt.expectedDigest)
+			}
+			if opts.ID == "other@allizom.org" {
+				t.Fatal("request options overrode the add-on id")
+			}
+		})
+	}
+}
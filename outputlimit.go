@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var errOutputTooLarge = errors.New("signed file is larger than the maximum output size of the token")
+
+// maxResponseOverhead bounds the JSON of an autograph response around
+// its base64 signed file, like its ref, signer id and x5u
+const maxResponseOverhead = 64 << 10
+
+// maxBufferedResponseBytes returns how much of the autograph response
+// of a signed file of up to maxOutputBytes is buffered to be verified,
+// the response itself for raw responses and otherwise its base64
+// encoding with the rest of the JSON
+func maxBufferedResponseBytes(maxOutputBytes int64, raw bool) int64 {
+	if raw {
+		return maxOutputBytes
+	}
+	return int64(base64.StdEncoding.EncodedLen(int(maxOutputBytes))) + maxResponseOverhead
+}
+
+// readLimited reads all of r, failing with errOutputTooLarge instead of
+// reading more than limit bytes when limit is set
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errOutputTooLarge
+	}
+	return body, nil
+}
+
+// outputLimitWriter fails with errOutputTooLarge instead of writing
+// more than remaining bytes to w. The write crossing the limit is not
+// written at all.
+type outputLimitWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (lw *outputLimitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, errOutputTooLarge
+	}
+	n, err := lw.w.Write(p)
+	lw.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerMaxOutputBytes(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].MaxOutputBytes = 1024
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+
+	t.Run("relays signed files under the limit", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(bytes.Repeat([]byte("s"), 1024)), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, token, []byte("unsigned")))
+		if w.Code != http.StatusCreated || w.Body.Len() != 1024 {
+			t.Fatalf("returned %d with %d bytes expected a 201 with the signed file", w.Code, w.Body.Len())
+		}
+	})
+
+	t.Run("rejects an oversized signed file with a 502", func(t *testing.T) {
+		// the signed XPIs of COSE tokens are verified before any
+		// of them is sent
+		testConf.Authorizations[1].MaxOutputBytes = 64
+		useTestConf(t, testConf)
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(newSignedXPI(t, "manifest.json", xpiPKCS7SignaturePath, xpiCOSESignaturePath)), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[1].ClientToken, newSignedXPI(t, "manifest.json")))
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "output_too_large") {
+			t.Fatalf("returned %d %s expected a 502 output_too_large", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("aborts the response once the limit is crossed mid-stream", func(t *testing.T) {
+		testConf.Authorizations[2].MaxOutputBytes = 10000
+		useTestConf(t, testConf)
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse(bytes.Repeat([]byte("s"), 100000)), nil)
+		w := httptest.NewRecorder()
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Fatalf("recovered %v expected the response to be aborted", recovered)
+			}
+			if w.Body.Len() > 10000 {
+				t.Fatalf("relayed %d bytes over the limit", w.Body.Len())
+			}
+		}()
+		sigHandler(w, newMultipartSignRequest(t, token, []byte("unsigned")))
+		t.Fatalf("returned %d without aborting the response", w.Code)
+	})
+
+	t.Run("stops buffering an oversized response to verify", func(t *testing.T) {
+		testConf.Authorizations[2].MaxOutputBytes = 1024
+		testConf.Authorizations[2].VerifyAPK = true
+		useTestConf(t, testConf)
+		body := &countingReader{r: io.MultiReader(strings.NewReader(`[{"signed_file":"`), endlessReader('A'))}
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(&http.Response{StatusCode: http.StatusCreated, Body: io.NopCloser(body)}, nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, token, []byte("unsigned")))
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "output_too_large") {
+			t.Fatalf("returned %d %s expected a 502 output_too_large", w.Code, w.Body.String())
+		}
+		if limit := maxBufferedResponseBytes(1024, false) + 1; body.n > limit {
+			t.Fatalf("read %d bytes of the response expected at most %d", body.n, limit)
+		}
+	})
+}
+
+// endlessReader returns its byte forever
+type endlessReader byte
+
+func (e endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(e)
+	}
+	return len(p), nil
+}
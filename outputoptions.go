@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errOutputOptionNotAllowed  = errors.New("output option cannot be set for this token")
+	errUnsupportedOutputOption = errors.New("unsupported output option")
+)
+
+// outputField is the form field of the output conversion, like a
+// re-zipalign of APKs, forwarded to autograph in the option of the
+// same name
+const outputField = "output"
+
+// validateOutputOptions returns an error for empty, malformed or
+// duplicate output options
+func validateOutputOptions(options []string) error {
+	seen := make(map[string]bool, len(options))
+	for _, option := range options {
+		if option == "" || strings.IndexFunc(option, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+			return fmt.Errorf("invalid output option %q", option)
+		}
+		if seen[option] {
+			return fmt.Errorf("duplicate output option %q", option)
+		}
+		seen[option] = true
+	}
+	return nil
+}
+
+// allowedOutputOption returns the output conversion requested in the
+// output form value, or an empty string when it is not sent. Only
+// tokens with AllowOutputOptions can send it, and it must be one of
+// supported.
+func allowedOutputOption(auth authorization, r *http.Request, supported []string) (string, error) {
+	if r.MultipartForm == nil {
+		return "", nil
+	}
+	sent, ok := r.MultipartForm.Value[outputField]
+	if !ok {
+		return "", nil
+	}
+	if !auth.AllowOutputOptions {
+		return "", errOutputOptionNotAllowed
+	}
+	if len(sent) != 1 {
+		return "", errors.Wrap(errUnsupportedOutputOption, "output must be sent once")
+	}
+	output := strings.TrimSpace(sent[0])
+	if !stringInSlice(output, supported) {
+		return "", errors.Wrapf(errUnsupportedOutputOption, "output %q is not one of %s", output, strings.Join(supported, ", "))
+	}
+	return output, nil
+}
+
+// outputOptions returns the autograph options of the output conversion
+// of params, or nil when it has none
+func outputOptions(params signingParams) map[string]interface{} {
+	if params.Output == "" {
+		return nil
+	}
+	return map[string]interface{}{outputField: params.Output}
+}
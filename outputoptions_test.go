@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerOutputOptions(t *testing.T) {
+	testConf := currentConf()
+	testConf.OutputOptions = []string{"zipalign", "v2_only"}
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].AllowOutputOptions = true
+	useTestConf(t, testConf)
+
+	testcases := []struct {
+		name            string
+		token           string
+		fields          map[string]string
+		expectedStatus  int
+		expectedCode    string
+		expectedOptions map[string]interface{}
+	}{
+		{
+			name:            "permitted output",
+			token:           testConf.Authorizations[2].ClientToken,
+			fields:          map[string]string{"output": "zipalign"},
+			expectedStatus:  http.StatusCreated,
+			expectedOptions: map[string]interface{}{"output": "zipalign"},
+		},
+		{
+			name:           "permitted token without an output",
+			token:          testConf.Authorizations[2].ClientToken,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "unsupported output",
+			token:          testConf.Authorizations[2].ClientToken,
+			fields:         map[string]string{"output": "repack"},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "unsupported_output_option",
+		},
+		{
+			name:           "forbidden for tokens without allow_output_options",
+			token:          testConf.Authorizations[0].ClientToken,
+			fields:         map[string]string{"output": "zipalign"},
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   "output_option_not_allowed",
+		},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []struct {
+				Options map[string]interface{}
+			}
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					if err := json.NewDecoder(req.Body).Decode(&upstreamRequests); err != nil {
+						t.Fatal(err)
+					}
+					return newSignedFileResponse([]byte("signed")), nil
+				})
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequestWithFields(t, tt.token, []byte("unsigned"), tt.fields))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusCreated {
+				var body errorResponse
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code != tt.expectedCode {
+					t.Fatalf("returned %+v (%v) expected the %s code", body, err, tt.expectedCode)
+				}
+				return
+			}
+			if len(upstreamRequests) != 1 {
+				t.Fatalf("upstream received %d requests expected 1", len(upstreamRequests))
+			}
+			if !reflect.DeepEqual(upstreamRequests[0].Options, tt.expectedOptions) {
+				t.Fatalf("upstream received options %+v expected %+v", upstreamRequests[0].Options, tt.expectedOptions)
+			}
+		})
+	}
+}
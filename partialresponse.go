@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// partialResponseAbort drops the connection of a response truncated
+	// by an upstream failure, so that the client cannot take it for a
+	// complete one
+	partialResponseAbort = "abort"
+
+	// partialResponseTrailer ends a truncated response normally with
+	// the incompleteTrailer trailer, for clients that check it
+	partialResponseTrailer = "trailer"
+
+	// incompleteTrailer is set to true on the responses truncated by
+	// an upstream failure with the trailer partial response
+	incompleteTrailer = "X-Autograph-Edge-Incomplete"
+)
+
+func validatePartialResponse(mode string) error {
+	if mode != partialResponseAbort && mode != partialResponseTrailer {
+		return fmt.Errorf("unknown partial response %q, must be one of %s or %s",
+			mode, partialResponseAbort, partialResponseTrailer)
+	}
+	return nil
+}
+
+// endPartialResponse ends the response of sw once the upstream failed
+// with err after sent bytes of the signed file were written, which
+// cannot be turned into an error response anymore
+func endPartialResponse(w http.ResponseWriter, r *http.Request, sw *signedFileWriter, mode string, sent int64, err error) {
+	getLogger(r).WithFields(log.Fields{
+		"bytes_sent":       sent,
+		"partial_response": mode,
+	}).Errorf("TRUNCATED RESPONSE: upstream failed after part of the signed file was sent: %v", err)
+	if mode != partialResponseTrailer {
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set(http.TrailerPrefix+incompleteTrailer, "true")
+	if sw.gz != nil {
+		// flush the compressed bytes of what was received
+		sw.gz.Close()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	gomock "github.com/golang/mock/gomock"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// newInterruptedAutographResponse returns a successful upstream
+// response whose body fails after prefix
+func newInterruptedAutographResponse(prefix string) *http.Response {
+	return &http.Response{
+		Status:     http.StatusText(http.StatusCreated),
+		StatusCode: http.StatusCreated,
+		Body: ioutil.NopCloser(io.MultiReader(strings.NewReader(prefix),
+			iotest.ErrReader(errors.New("connection reset by peer")))),
+	}
+}
+
+func TestSigHandlerPartialResponse(t *testing.T) {
+	signed := bytes.Repeat([]byte("signed"), 4096)
+	encoded := base64.StdEncoding.EncodeToString(signed)
+
+	t.Run("nothing sent returns a 502", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newInterruptedAutographResponse(`[{"signed_file":"`), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, currentConf().Authorizations[0].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "upstream_error") {
+			t.Fatalf("returned %d %s expected a 502 upstream_error", w.Code, w.Body.String())
+		}
+		if got := w.Result().Trailer.Get(incompleteTrailer); got != "" {
+			t.Fatalf("error response has the %s trailer %q", incompleteTrailer, got)
+		}
+	})
+
+	t.Run("trailer marks a truncated response", func(t *testing.T) {
+		c := currentConf()
+		c.PartialResponse = partialResponseTrailer
+		useTestConf(t, c)
+		origHooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+		t.Cleanup(func() { log.StandardLogger().ReplaceHooks(origHooks) })
+		hook := logtest.NewLocal(log.StandardLogger())
+
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newInterruptedAutographResponse(`[{"signed_file":"`+encoded[:len(encoded)/2]), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, c.Authorizations[0].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned %d expected the %d already sent", w.Code, http.StatusCreated)
+		}
+		if w.Body.Len() == 0 || w.Body.Len() >= len(signed) || !bytes.HasPrefix(signed, w.Body.Bytes()) {
+			t.Fatalf("sent %d bytes expected the start of the %d bytes signed file", w.Body.Len(), len(signed))
+		}
+		if got := w.Result().Trailer.Get(incompleteTrailer); got != "true" {
+			t.Fatalf("returned %s trailer %q expected true", incompleteTrailer, got)
+		}
+
+		var truncated *log.Entry
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, "TRUNCATED RESPONSE") {
+				truncated = entry
+			}
+		}
+		if truncated == nil || truncated.Level != log.ErrorLevel {
+			t.Fatal("did not log the truncated response as an error")
+		}
+		if got := truncated.Data["bytes_sent"]; got != int64(w.Body.Len()) {
+			t.Fatalf("logged bytes_sent %v expected %d", got, w.Body.Len())
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	payloadObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+	requestBytes = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "autograph_edge_request_bytes",
+			Help:       "Size of the bodies of the signing requests as received by signer.",
+			Objectives: payloadObjectives,
+		},
+		[]string{"signer"},
+	)
+	responseBytes = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "autograph_edge_response_bytes",
+			Help:       "Size of the bodies of the signing responses as sent by signer.",
+			Objectives: payloadObjectives,
+		},
+		[]string{"signer"},
+	)
+)
+
+// countingReadCloser counts the bytes read from a request body as it
+// streams, without buffering it
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// payloadSizeMetrics remembers the last payload sizes recorded
+type payloadSizeMetrics struct {
+	noopMetrics
+	signer            string
+	request, response int64
+}
+
+func (m *payloadSizeMetrics) PayloadSize(signer string, request, response int64) {
+	m.signer, m.request, m.response = signer, request, response
+}
+
+func Test_countingReadCloser(t *testing.T) {
+	body := &countingReadCloser{ReadCloser: ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 100000)))}
+	// read in small chunks so that the count adds up several reads
+	buf := make([]byte, 4096)
+	for {
+		_, err := body.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if body.n != 100000 {
+		t.Fatalf("counted %d bytes expected 100000", body.n)
+	}
+}
+
+func Test_statusRecorderCountsWrites(t *testing.T) {
+	sr := &statusRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	for i := 0; i < 10; i++ {
+		sr.Write(bytes.Repeat([]byte("a"), 1000))
+	}
+	if sr.written != 10000 {
+		t.Fatalf("counted %d bytes expected 10000", sr.written)
+	}
+}
+
+func TestSigHandlerPayloadSize(t *testing.T) {
+	origHooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(origHooks) })
+	hook := logtest.NewLocal(log.StandardLogger())
+	recorded := &payloadSizeMetrics{}
+	origMetrics := metrics
+	metrics = recorded
+	t.Cleanup(func() { metrics = origMetrics })
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	req := newMultipartSignRequest(t, currentConf().Authorizations[2].ClientToken, bytes.Repeat([]byte("a"), 10000))
+	requestSize := req.ContentLength
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+	}
+
+	var completed *log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "request completed" {
+			completed = entry
+		}
+	}
+	if completed == nil {
+		t.Fatal("did not log the completed request")
+	}
+	if got := completed.Data["request_bytes"]; got != requestSize {
+		t.Fatalf("logged request_bytes %v expected %d", got, requestSize)
+	}
+	if got := completed.Data["response_bytes"]; got != int64(w.Body.Len()) {
+		t.Fatalf("logged response_bytes %v expected %d", got, w.Body.Len())
+	}
+	if recorded.signer != "testapp-android" || recorded.request != requestSize || recorded.response != int64(w.Body.Len()) {
+		t.Fatalf("recorded payload sizes %+v expected %d and %d for testapp-android", *recorded, requestSize, w.Body.Len())
+	}
+}
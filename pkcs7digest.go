@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errPKCS7DigestNotAllowed = errors.New("requested PKCS7 digest is not allowed for this token")
+	errInvalidPKCS7Digest    = errors.New("unknown PKCS7 digest")
+)
+
+// defaultPKCS7Digest is the PKCS7 digest of the add-on tokens that
+// don't set one
+const defaultPKCS7Digest = "SHA1"
+
+// supportedPKCS7Digests are the PKCS7 digests autograph can sign
+// add-ons with
+var supportedPKCS7Digests = []string{"SHA1", "SHA256"}
+
+// pkcs7Digests returns the PKCS7 digests of auth, the first being the
+// default, from AddonPKCS7Digests or the single AddonPKCS7Digest
+func (auth authorization) pkcs7Digests() []string {
+	if len(auth.AddonPKCS7Digests) > 0 {
+		return auth.AddonPKCS7Digests
+	}
+	if auth.AddonPKCS7Digest != "" {
+		return []string{auth.AddonPKCS7Digest}
+	}
+	return nil
+}
+
+// requestedPKCS7Digest returns the PKCS7 digest requested in the
+// pkcs7_digest form value
+func requestedPKCS7Digest(r *http.Request) string {
+	if r.MultipartForm == nil || len(r.MultipartForm.Value["pkcs7_digest"]) == 0 {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSpace(r.MultipartForm.Value["pkcs7_digest"][0]))
+}
+
+// allowedPKCS7Digest checks that the requested PKCS7 digest is one of
+// the digests of an add-on token and returns it. Tokens that are not
+// for add-ons ignore the request, and an empty request gets the default
+// digest of the token.
+func allowedPKCS7Digest(auth authorization, requested string) (string, error) {
+	if auth.AddonID == "" || requested == "" {
+		return "", nil
+	}
+	if !stringInSlice(requested, supportedPKCS7Digests) {
+		return "", errors.Wrapf(errInvalidPKCS7Digest, "digest %q, supported digests are %s", requested, strings.Join(supportedPKCS7Digests, ", "))
+	}
+	allowed := auth.pkcs7Digests()
+	if len(allowed) == 0 {
+		allowed = []string{defaultPKCS7Digest}
+	}
+	if !stringInSlice(requested, allowed) {
+		return "", errors.Wrapf(errPKCS7DigestNotAllowed, "digest %q", requested)
+	}
+	return requested, nil
+}
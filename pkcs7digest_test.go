@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerPKCS7Digest(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[0].AddonPKCS7Digests = []string{"SHA1", "SHA256"}
+	useTestConf(t, testConf)
+	listToken := testConf.Authorizations[0].ClientToken
+	// the COSE token sets the single addonpkcs7digest: SHA256
+	singleToken := testConf.Authorizations[1].ClientToken
+
+	for _, tt := range []struct {
+		name           string
+		token          string
+		digest         string
+		expectedStatus int
+		expectedCode   string
+		expectedDigest string
+	}{
+		{"defaults to the first digest", listToken, "", http.StatusCreated, "", "SHA1"},
+		{"selects an allowed digest", listToken, "SHA256", http.StatusCreated, "", "SHA256"},
+		{"selects regardless of case", listToken, "sha256", http.StatusCreated, "", "SHA256"},
+		{"single digest by default", singleToken, "", http.StatusCreated, "", "SHA256"},
+		{"single digest requested", singleToken, "SHA256", http.StatusCreated, "", "SHA256"},
+		{"digest not allowed", singleToken, "SHA1", http.StatusForbidden, "pkcs7_digest_not_allowed", ""},
+		{"unknown digest", listToken, "MD5", http.StatusBadRequest, "invalid_pkcs7_digest", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []struct {
+				Options xpiOptions
+			}
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					if err := json.NewDecoder(req.Body).Decode(&upstreamRequests); err != nil {
+						t.Fatal(err)
+					}
+					return newSignedFileResponse(newSignedXPI(t, "manifest.json", xpiPKCS7SignaturePath, xpiCOSESignaturePath)), nil
+				})
+			}
+			var fields map[string]string
+			if tt.digest != "" {
+				fields = map[string]string{"pkcs7_digest": tt.digest}
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequestWithFields(t, tt.token, newSignedXPI(t, "manifest.json"), fields))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusCreated {
+				var body errorResponse
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code != tt.expectedCode {
+					t.Fatalf("returned %+v (%v) expected the %s code", body, err, tt.expectedCode)
+				}
+				return
+			}
+			if len(upstreamRequests) != 1 || upstreamRequests[0].Options.PKCS7Digest != tt.expectedDigest {
+				t.Fatalf("upstream received %+v expected the %s digest", upstreamRequests, tt.expectedDigest)
+			}
+		})
+	}
+}
+
+func Test_validateAuthPKCS7Digests(t *testing.T) {
+	for _, digests := range [][]string{{"SHA1", "MD5"}, {"sha256"}} {
+		auth := currentConf().Authorizations[0]
+		auth.AddonPKCS7Digests = digests
+		var fieldErr *authFieldError
+		if err := validateAuth(auth); !errors.As(err, &fieldErr) || fieldErr.Field != "addonpkcs7digests" {
+			t.Errorf("validateAuth() with digests %v returned %v expected an invalid addonpkcs7digests", digests, err)
+		}
+	}
+	auth := currentConf().Authorizations[1]
+	auth.AddonPKCS7Digests = []string{"SHA256"}
+	if err := validateAuth(auth); err == nil {
+		t.Error("validateAuth() with both addonpkcs7digest and addonpkcs7digests returned no error")
+	}
+	auth.AddonPKCS7Digest = ""
+	if err := validateAuth(auth); err != nil {
+		t.Errorf("validateAuth() with addonpkcs7digests returned %v", err)
+	}
+}
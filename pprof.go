@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pprofMux returns the mux of the net/http/pprof handlers. They are
+// registered on their own mux and listener so the profiles are never
+// served on the signing port.
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// servePprof serves the pprof handlers on addr until the process exits
+func servePprof(addr string) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           pprofMux(),
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+	}
+	log.Infof("serving pprof on %s", addr)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("pprof listener failed: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_pprofMux(t *testing.T) {
+	w := httptest.NewRecorder()
+	pprofMux().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:6060/debug/pprof/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Fatalf("pprof index returned unexpected status %v: %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_prepareServerDoesNotServePprof(t *testing.T) {
+	w := httptest.NewRecorder()
+	prepareServer().Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/debug/pprof/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("signing server returned unexpected status %v for pprof expected %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func Test_loadAndValidateConfPprofAddress(t *testing.T) {
+	path := t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+pprof_address: localhost
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAndValidateConf(path, ""); err == nil || !strings.Contains(err.Error(), "invalid pprof address") {
+		t.Fatalf("loadAndValidateConf() with a pprof address without a port returned error %v", err)
+	}
+}
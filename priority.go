@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// priorityHeader optionally carries the priority of a signing
+// request, high, normal or low, which orders it among the requests
+// waiting for an upstream slot
+const priorityHeader = "X-Priority"
+
+// defaultPriorityAging promotes the waiting requests quickly enough
+// that the low priority ones still get a slot under a steady load of
+// higher priority ones
+const defaultPriorityAging = 5 * time.Second
+
+// upstreamPriority orders the requests waiting for an upstream slot,
+// the higher ones first
+type upstreamPriority int
+
+const (
+	priorityLow upstreamPriority = iota
+	priorityNormal
+	priorityHigh
+
+	// upstreamPriorities is the number of priorities
+	upstreamPriorities
+)
+
+var priorityNames = map[string]upstreamPriority{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+}
+
+func (p upstreamPriority) String() string {
+	for name, priority := range priorityNames {
+		if priority == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// parsePriority returns the priority of name, ignoring its case
+func parsePriority(name string) (upstreamPriority, bool) {
+	priority, ok := priorityNames[strings.ToLower(strings.TrimSpace(name))]
+	return priority, ok
+}
+
+// maxPriority returns the highest priority the requests of auth can
+// ask for, normal unless MaxPriority says otherwise
+func (auth authorization) maxPriority() upstreamPriority {
+	if priority, ok := parsePriority(auth.MaxPriority); ok {
+		return priority
+	}
+	return priorityNormal
+}
+
+// requestPriority returns the priority requested in the X-Priority
+// header of r, normal when it is missing. Unknown priorities and those
+// over the max priority of auth are clamped to its max priority.
+func requestPriority(r *http.Request, auth authorization) upstreamPriority {
+	max := auth.maxPriority()
+	priority := priorityNormal
+	if header := r.Header.Get(priorityHeader); header != "" {
+		var ok bool
+		priority, ok = parsePriority(header)
+		if !ok {
+			return max
+		}
+	}
+	if priority > max {
+		return max
+	}
+	return priority
+}
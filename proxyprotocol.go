@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var errMissingProxyHeader = errors.New("connection did not start with a PROXY protocol header")
+
+const (
+	// proxyV1MaxLength is the longest PROXY protocol v1 header line,
+	// including its CRLF
+	proxyV1MaxLength = 107
+
+	// defaultProxyHeaderTimeout bounds reading the PROXY protocol
+	// header when the read header timeout is not set
+	defaultProxyHeaderTimeout = 10 * time.Second
+)
+
+// proxyV2Signature starts the PROXY protocol v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections from a load balancer that
+// starts each of them with a PROXY protocol v1 or v2 header, whose
+// source address replaces the address of the load balancer as the
+// RemoteAddr of the connection. Connections without a valid header fail
+// on their first read, since anything sent before it can't be trusted.
+type proxyProtocolListener struct {
+	net.Listener
+	headerTimeout time.Duration
+}
+
+func newProxyProtocolListener(l net.Listener, headerTimeout time.Duration) *proxyProtocolListener {
+	if headerTimeout <= 0 {
+		headerTimeout = defaultProxyHeaderTimeout
+	}
+	return &proxyProtocolListener{Listener: l, headerTimeout: headerTimeout}
+}
+
+// Accept returns the next connection without waiting for its header,
+// which is read by the first call to its RemoteAddr or Read, so that a
+// slow client doesn't hold up the others
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, r: bufio.NewReader(conn), headerTimeout: l.headerTimeout}, nil
+}
+
+// proxyProtocolConn is a connection starting with a PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	r             *bufio.Reader
+	headerTimeout time.Duration
+
+	once sync.Once
+	// remote is the source address of the header, or nil when it
+	// doesn't have one, like the health checks of the load balancer
+	remote net.Addr
+	err    error
+}
+
+// readHeader reads the PROXY protocol header once. The http server
+// calls RemoteAddr before setting the deadlines of the connection, so
+// clearing the deadline of the header doesn't clear those.
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Errorf("rejecting connection from %s: invalid PROXY protocol header: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the source address of the PROXY protocol header,
+// or the address of the load balancer when it has none
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r and
+// returns its source address, or nil for the LOCAL and UNKNOWN headers
+// of connections that were not proxied
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil && !bytes.HasPrefix(start, []byte("PROXY ")) {
+		if err == io.EOF {
+			return nil, errMissingProxyHeader
+		}
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2Header(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1Header(r)
+	}
+	return nil, errMissingProxyHeader
+}
+
+// readProxyV1Header reads a header line like
+// PROXY TCP4 203.0.113.7 192.0.2.1 56324 443
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header is longer than %d bytes or not terminated by CRLF", proxyV1MaxLength)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads a binary header of the signature, version and
+// command, address family, address length and addresses
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0x0:
+		// LOCAL, like a health check of the load balancer itself
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 header command %d", versionCommand&0x0f)
+	}
+	switch family >> 4 {
+	case 0x1:
+		if len(addrs) < 12 {
+			return nil, fmt.Errorf("v2 IPv4 addresses are %d bytes long", len(addrs))
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:]))}, nil
+	case 0x2:
+		if len(addrs) < 36 {
+			return nil, fmt.Errorf("v2 IPv6 addresses are %d bytes long", len(addrs))
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:]))}, nil
+	}
+	// unspecified or unix socket addresses can't be a client IP
+	return nil, nil
+}
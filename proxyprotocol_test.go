@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolListenerClientIP(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := clientIP(r)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(ip.String()))
+	})}
+	go server.Serve(newProxyProtocolListener(inner, time.Second))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\nGET / HTTP/1.1\r\nHost: edge\r\nConnection: close\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "203.0.113.7" {
+		t.Fatalf("handler recovered client IP %q expected 203.0.113.7", body)
+	}
+}
+
+// newProxyV2Header returns a v2 PROXY header of command and family
+// carrying addrs
+func newProxyV2Header(command, family byte, addrs []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func Test_readProxyHeader(t *testing.T) {
+	v4Addrs := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6Addrs := make([]byte, 36)
+	copy(v6Addrs, net.ParseIP("2001:db8::7"))
+	binary.BigEndian.PutUint16(v6Addrs[32:], 56324)
+
+	for _, tt := range []struct {
+		name     string
+		header   []byte
+		expected string
+		wantErr  bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n"), "203.0.113.7:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n"), "[2001:db8::7]:56324", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 mismatched family", []byte("PROXY TCP6 203.0.113.7 192.0.2.1 56324 443\r\n"), "", true},
+		{"v1 without CRLF", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n"), "", true},
+		{"v2 tcp4", newProxyV2Header(0x1, 0x11, v4Addrs), "203.0.113.7:56324", false},
+		{"v2 tcp6", newProxyV2Header(0x1, 0x21, v6Addrs), "[2001:db8::7]:56324", false},
+		{"v2 local", newProxyV2Header(0x0, 0x00, nil), "", false},
+		{"v2 short addresses", newProxyV2Header(0x1, 0x11, v4Addrs[:8]), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\nHost: edge\r\n\r\n"), "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const payload = "GET / HTTP/1.1\r\n"
+			r := bufio.NewReader(bytes.NewReader(append(tt.header, payload...)))
+			addr, err := readProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got string
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.expected {
+				t.Fatalf("readProxyHeader() returned address %q expected %q", got, tt.expected)
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != payload {
+				t.Fatalf("read %q after the header expected %q", rest, payload)
+			}
+		})
+	}
+}
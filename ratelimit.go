@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the number of requests a client token can still
+// make, and when that number was last refilled
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// rateLimiter enforces a per-minute request rate for each key
+// using a token bucket algorithm
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+
+	// now returns the current time and can be replaced in tests
+	now func() time.Time
+}
+
+var limiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow consumes a request from the bucket of key refilling it at
+// perMinute requests per minute. When the bucket is empty, it returns
+// false and how long to wait before the next request is allowed.
+func (rl *rateLimiter) allow(key string, perMinute int) (ok bool, retryAfter time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := rl.now()
+	capacity := float64(perMinute)
+	bucket, exists := rl.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: capacity, lastRefill: now}
+		rl.buckets[key] = bucket
+	}
+	ratePerSecond := capacity / 60
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*ratePerSecond)
+	bucket.lastRefill = now
+
+	if bucket.tokens < 1 {
+		missing := 1 - bucket.tokens
+		return false, time.Duration(missing / ratePerSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// tokenConcurrency counts the signing requests in flight for each key
+type tokenConcurrency struct {
+	sync.Mutex
+	inFlight map[string]int
+}
+
+var tokenSlots = newTokenConcurrency()
+
+func newTokenConcurrency() *tokenConcurrency {
+	return &tokenConcurrency{inFlight: make(map[string]int)}
+}
+
+// acquire counts a new request in flight for key unless max of them
+// already are. Requests for which it returns true must be released.
+func (tc *tokenConcurrency) acquire(key string, max int) bool {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if tc.inFlight[key] >= max {
+		return false
+	}
+	tc.inFlight[key]++
+	return true
+}
+
+// release marks a request of key as completed
+func (tc *tokenConcurrency) release(key string) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	tc.inFlight[key]--
+	if tc.inFlight[key] <= 0 {
+		delete(tc.inFlight, key)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_rateLimiterAllow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := newRateLimiter()
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("spam", 3); !ok {
+			t.Fatalf("allow() rejected request %d under the limit", i)
+		}
+	}
+	ok, retryAfter := rl.allow("spam", 3)
+	if ok {
+		t.Fatal("allow() accepted a request over the limit")
+	}
+	if retryAfter != 20*time.Second {
+		t.Fatalf("allow() returned retry after %s expected 20s", retryAfter)
+	}
+	if ok, _ := rl.allow("eggs", 3); !ok {
+		t.Fatal("allow() rejected a request for a different key")
+	}
+
+	now = now.Add(20 * time.Second)
+	if ok, _ := rl.allow("spam", 3); !ok {
+		t.Fatal("allow() rejected a request after the bucket refilled")
+	}
+}
+
+func Test_sigHandlerRateLimit(t *testing.T) {
+	origConf, origLimiter := currentConf(), limiter
+	defer func() {
+		setConf(origConf)
+		limiter = origLimiter
+	}()
+	limiter = newRateLimiter()
+
+	const token = "c4180d2963fffdcd1cd5a1a343225288b964d8934b809a7d76941ccf67cc8547"
+	testConf := origConf
+	testConf.Authorizations = []authorization{
+		{
+			ClientToken: token,
+			User:        "alice",
+			Key:         "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+			Signer:      "extensions-ecdsa",
+			RateLimit:   2,
+		},
+	}
+	setConf(testConf)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		resp := w.Result()
+
+		if i < 2 {
+			// under the limit the request proceeds and fails on the missing input
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("request %d returned unexpected status %v expected %v", i, resp.StatusCode, http.StatusBadRequest)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("request %d returned unexpected status %v expected %v", i, resp.StatusCode, http.StatusTooManyRequests)
+		}
+		if resp.Header.Get("Retry-After") != "30" {
+			t.Fatalf("unexpected Retry-After header %q expected 30", resp.Header.Get("Retry-After"))
+		}
+		var body errorResponse
+		err := json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.RetryAfter != 30 {
+			t.Fatalf("unexpected retry_after %d expected 30", body.RetryAfter)
+		}
+		if body.Code != "rate_limited" {
+			t.Fatalf("unexpected code %q expected rate_limited", body.Code)
+		}
+	}
+}
+
+func Test_sigHandlerRateLimitHashedTokens(t *testing.T) {
+	origLimiter := limiter
+	defer func() { limiter = origLimiter }()
+	limiter = newRateLimiter()
+
+	tokens := []string{
+		"0e5f3dc1b2a4968778695a4b3c2d1e0f9a8b7c6d5e4f30211a2b3c4d5e6f7a8b",
+		"1e5f3dc1b2a4968778695a4b3c2d1e0f9a8b7c6d5e4f30211a2b3c4d5e6f7a8b",
+	}
+	testConf := currentConf()
+	testConf.Authorizations = nil
+	for _, token := range tokens {
+		hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testConf.Authorizations = append(testConf.Authorizations, authorization{
+			ClientTokenHash: string(hash),
+			User:            "alice",
+			Key:             "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+			Signer:          "extensions-ecdsa",
+			RateLimit:       1,
+		})
+	}
+	useTestConf(t, testConf)
+
+	// each hashed token has its own bucket, so the first request of
+	// both proceeds and fails on the missing input
+	for _, token := range tokens {
+		req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("first request of token %s returned unexpected status %v expected %v", token[:8], w.Code, http.StatusBadRequest)
+		}
+	}
+	req := httptest.NewRequest("POST", "http://localhost:8080/sign", nil)
+	req.Header.Set("Authorization", tokens[0])
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request returned unexpected status %v expected %v", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func Test_tokenConcurrency(t *testing.T) {
+	tc := newTokenConcurrency()
+	if !tc.acquire("spam", 2) || !tc.acquire("spam", 2) {
+		t.Fatal("acquire() rejected a request under the limit")
+	}
+	if tc.acquire("spam", 2) {
+		t.Fatal("acquire() accepted a request over the limit")
+	}
+	if !tc.acquire("eggs", 2) {
+		t.Fatal("acquire() rejected a request for a different key")
+	}
+	tc.release("spam")
+	if !tc.acquire("spam", 2) {
+		t.Fatal("acquire() rejected a request after one was released")
+	}
+	tc.release("spam")
+	tc.release("spam")
+	tc.release("eggs")
+	if len(tc.inFlight) != 0 {
+		t.Fatalf("released keys are still counted: %v", tc.inFlight)
+	}
+}
+
+func TestSigHandlerMaxConcurrent(t *testing.T) {
+	origSlots := tokenSlots
+	tokenSlots = newTokenConcurrency()
+	defer func() { tokenSlots = origSlots }()
+
+	c := currentConf()
+	c.Authorizations = append([]authorization(nil), c.Authorizations...)
+	c.Authorizations[0].MaxConcurrent = 1
+	useTestConf(t, c)
+	noisy, other := c.Authorizations[0], c.Authorizations[2]
+
+	// hold the only slot of the noisy token until the other requests are done
+	started, unblock := make(chan struct{}), make(chan struct{})
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if strings.Contains(string(body), noisy.Signer) {
+			close(started)
+			<-unblock
+			return newSignedFileResponse([]byte("signed")), nil
+		}
+		return newSignedFileResponse([]byte("signed")), nil
+	}).Times(2)
+
+	noisyDone := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, noisy.ClientToken, []byte("unsigned")))
+		noisyDone <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, noisy.ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request of the noisy token returned status %v expected %v", w.Code, http.StatusTooManyRequests)
+	}
+	var resp errorResponse
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != "concurrency_limited" {
+		t.Fatalf("returned unexpected code %q expected concurrency_limited", resp.Code)
+	}
+
+	w = httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, other.ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("request of another token returned status %v expected %v", w.Code, http.StatusCreated)
+	}
+
+	close(unblock)
+	if status := <-noisyDone; status != http.StatusCreated {
+		t.Fatalf("first request of the noisy token returned status %v expected %v", status, http.StatusCreated)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errMissingRequiredHeader = errors.New("request is missing a header required for this token")
+
+// requiredHeaderValues returns the values of the required headers of
+// auth sent with r, keyed by their canonical name, or an error naming
+// the first one that is missing or empty
+func (auth authorization) requiredHeaderValues(r *http.Request) (map[string]string, error) {
+	if len(auth.RequiredHeaders) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]string, len(auth.RequiredHeaders))
+	for _, name := range auth.RequiredHeaders {
+		value := strings.TrimSpace(r.Header.Get(name))
+		if value == "" {
+			return nil, errors.Wrapf(errMissingRequiredHeader, "header %s", http.CanonicalHeaderKey(name))
+		}
+		values[http.CanonicalHeaderKey(name)] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSigHandlerRequiredHeaders(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].RequiredHeaders = []string{"X-Change-Reference", "x-ticket"}
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+
+	t.Run("signs and logs the required headers", func(t *testing.T) {
+		origHooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+		t.Cleanup(func() { log.StandardLogger().ReplaceHooks(origHooks) })
+		hook := logtest.NewLocal(log.StandardLogger())
+
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+		req := newMultipartSignRequest(t, token, []byte("unsigned"))
+		req.Header.Set("X-Change-Reference", "CHG-1234")
+		req.Header.Set("X-Ticket", "BUG-42")
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+		}
+
+		var completed *log.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "request completed" {
+				completed = entry
+			}
+		}
+		if completed == nil {
+			t.Fatal("did not log the completed request")
+		}
+		headers, _ := completed.Data["required_headers"].(map[string]string)
+		if headers["X-Change-Reference"] != "CHG-1234" || headers["X-Ticket"] != "BUG-42" {
+			t.Fatalf("logged required headers %v expected both values", completed.Data["required_headers"])
+		}
+	})
+
+	t.Run("rejects requests missing a required header", func(t *testing.T) {
+		req := newMultipartSignRequest(t, token, []byte("unsigned"))
+		req.Header.Set("X-Change-Reference", "CHG-1234")
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "missing_required_header") {
+			t.Fatalf("returned %d %s expected a 400 missing_required_header", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("tokens without required headers sign as before", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[0].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+		}
+	})
+}
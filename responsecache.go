@@ -0,0 +1,169 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseCacheConfig bounds the cache of the signed files returned to
+// the tokens allowing it
+type responseCacheConfig struct {
+	// TTL is how long a signed file is returned from the cache.
+	// Defaults to 1h.
+	TTL time.Duration `yaml:"ttl"`
+
+	// MaxBytes is the maximum total size of the cached signed files,
+	// over which the least recently used are evicted. Defaults to 64MiB.
+	MaxBytes int64 `yaml:"max_bytes"`
+
+	// MaxAge makes the signed files of the tokens allowing the cache
+	// carry an ETag of their SHA256 and a Cache-Control max-age, and
+	// return a 304 to the requests whose If-None-Match holds it. It
+	// is disabled when zero.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+const (
+	defaultResponseCacheTTL      = time.Hour
+	defaultResponseCacheMaxBytes = 64 << 20
+)
+
+// responseCache is an in-memory LRU cache of signed files keyed by
+// responseCacheKey
+type responseCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+type cachedResponse struct {
+	key     string
+	body    []byte
+	expires time.Time
+}
+
+var signedResponses = newResponseCache()
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the signed file cached for key unless it has expired
+func (rc *responseCache) get(key string) ([]byte, bool) {
+	rc.Lock()
+	defer rc.Unlock()
+	elem, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		rc.remove(elem)
+		return nil, false
+	}
+	rc.lru.MoveToFront(elem)
+	return entry.body, true
+}
+
+// add caches body for key for ttl, evicting the least recently used
+// files until the cache fits in maxBytes. Files larger than maxBytes
+// are not cached. The limits are those of the live configuration, so
+// a reload lowering them applies on the next add.
+func (rc *responseCache) add(key string, body []byte, ttl time.Duration, maxBytes int64) {
+	if int64(len(body)) > maxBytes {
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	if elem, ok := rc.entries[key]; ok {
+		rc.remove(elem)
+	}
+	rc.entries[key] = rc.lru.PushFront(&cachedResponse{
+		key:     key,
+		body:    body,
+		expires: time.Now().Add(ttl),
+	})
+	rc.size += int64(len(body))
+	for rc.size > maxBytes {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+func (rc *responseCache) remove(elem *list.Element) {
+	entry := rc.lru.Remove(elem).(*cachedResponse)
+	delete(rc.entries, entry.key)
+	rc.size -= int64(len(entry.body))
+}
+
+// responseCacheKey returns the hex SHA256 of the input, the hawk user,
+// the signer, the options of the autograph signing request of auth and
+// params and whether the response is raw, so that only requests
+// autograph would sign the same way for the same user share a key
+func responseCacheKey(auth authorization, params signingParams, input []byte) (string, error) {
+	request, err := newSignatureRequest(auth, params, nil)
+	if err != nil {
+		return "", err
+	}
+	options, err := json.Marshal(request.Options)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(input)
+	fmt.Fprintf(h, "\x00%s\x00%s\x00%s\x00%s\x00%t\x00", auth.User, auth.signatureType(), upstreamURL("", auth), request.KeyID, params.Raw)
+	h.Write(options)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// signedFileETag returns the ETag of the signed file, weak when it is
+// sent gzip compressed since it is the hash of the uncompressed file
+func (sw *signedFileWriter) signedFileETag(signed []byte) string {
+	etag := fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256(signed)))
+	if sw.allowGzip && sw.acceptsGzip {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// etagMatches returns whether the If-None-Match header of r holds etag,
+// comparing them weakly
+func etagMatches(r *http.Request, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, value := range r.Header.Values("If-None-Match") {
+		for _, candidate := range strings.Split(value, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeCached writes the whole signed file of a token allowing the
+// cache. With a max age, its ETag and Cache-Control are set and a 304
+// without a body is returned instead when the client already holds it.
+func (sw *signedFileWriter) writeCached(r *http.Request, signed []byte, maxAge time.Duration) (notModified bool) {
+	if maxAge > 0 {
+		etag := sw.signedFileETag(signed)
+		sw.w.Header().Set("ETag", etag)
+		sw.w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(maxAge.Seconds())))
+		if etagMatches(r, etag) {
+			sw.w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	sw.Write(signed)
+	sw.close()
+	return false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func useTestResponseCache(t *testing.T) *responseCache {
+	origCache := signedResponses
+	signedResponses = newResponseCache()
+	t.Cleanup(func() { signedResponses = origCache })
+	return signedResponses
+}
+
+func Test_responseCache(t *testing.T) {
+	rc := newResponseCache()
+	if _, ok := rc.get("a"); ok {
+		t.Fatal("empty cache returned a hit")
+	}
+	rc.add("a", []byte("signed a"), time.Hour, 16)
+	if body, ok := rc.get("a"); !ok || string(body) != "signed a" {
+		t.Fatalf("get() = %q, %v expected a hit", body, ok)
+	}
+
+	// b doesn't fit with a, which is evicted as the least recently used
+	rc.add("b", []byte("signed b"), time.Hour, 16)
+	rc.get("b")
+	rc.add("c", []byte("signed c"), time.Hour, 16)
+	if _, ok := rc.get("a"); ok {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	if _, ok := rc.get("b"); !ok {
+		t.Fatal("recently used entry was evicted")
+	}
+	if rc.size != 16 {
+		t.Fatalf("cache size %d expected 16", rc.size)
+	}
+
+	rc.add("large", bytes.Repeat([]byte("a"), 17), time.Hour, 16)
+	if _, ok := rc.get("large"); ok {
+		t.Fatal("entry larger than the cache was cached")
+	}
+
+	rc.add("expired", []byte("signed"), -time.Second, 16)
+	if _, ok := rc.get("expired"); ok {
+		t.Fatal("expired entry returned a hit")
+	}
+	if _, ok := rc.entries["expired"]; ok {
+		t.Fatal("expired entry was not removed")
+	}
+}
+
+func Test_responseCacheKey(t *testing.T) {
+	auths := currentConf().Authorizations
+	key := func(auth authorization, params signingParams, input string) string {
+		k, err := responseCacheKey(auth, params, []byte(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	otherUser := auths[0]
+	otherUser.User = "bob"
+	base := key(auths[0], signingParams{}, "unsigned")
+	if base != key(auths[0], signingParams{}, "unsigned") {
+		t.Fatal("same request returned different keys")
+	}
+	for name, other := range map[string]string{
+		"input":   key(auths[0], signingParams{}, "other"),
+		"signer":  key(auths[2], signingParams{}, "unsigned"),
+		"user":    key(otherUser, signingParams{}, "unsigned"),
+		"options": key(auths[0], signingParams{Options: map[string]interface{}{"zip": "all"}}, "unsigned"),
+		"cose":    key(auths[0], signingParams{COSEAlgorithms: []string{"ES256"}}, "unsigned"),
+	} {
+		if other == base {
+			t.Errorf("requests with a different %s share a key", name)
+		}
+	}
+}
+
+func TestSigHandlerResponseCache(t *testing.T) {
+	useTestResponseCache(t)
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].AllowCache = true
+	bob := testConf.Authorizations[2]
+	bob.ClientToken = "3b7e8a1f5c2d9e4b6a0f1c3d5e7f9a2b4c6d8e0f1a3b5c7d9e1f2a4b6c8d0e1f"
+	bob.User = "bob"
+	testConf.Authorizations = append(testConf.Authorizations, bob)
+	useTestConf(t, testConf)
+
+	sign := func(t *testing.T, token string, input []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, token, input))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned unexpected status %v: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+	hitsBefore := testutil.ToFloat64(responseCacheRequestsTotal.WithLabelValues("hit"))
+	missesBefore := testutil.ToFloat64(responseCacheRequestsTotal.WithLabelValues("miss"))
+
+	t.Run("miss then hit", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil).Times(1)
+		token := testConf.Authorizations[2].ClientToken
+		first := sign(t, token, []byte("unsigned"))
+		second := sign(t, token, []byte("unsigned"))
+		if second.Body.String() != "signed" || first.Body.String() != second.Body.String() {
+			t.Fatalf("cached response %q does not match %q", second.Body.String(), first.Body.String())
+		}
+		if second.Header().Get("Content-Disposition") == "" {
+			t.Fatal("cached response is missing its Content-Disposition")
+		}
+		if got := testutil.ToFloat64(responseCacheRequestsTotal.WithLabelValues("miss")) - missesBefore; got != 1 {
+			t.Fatalf("recorded %v cache misses expected 1", got)
+		}
+		if got := testutil.ToFloat64(responseCacheRequestsTotal.WithLabelValues("hit")) - hitsBefore; got != 1 {
+			t.Fatalf("recorded %v cache hits expected 1", got)
+		}
+	})
+
+	t.Run("other input misses", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed other")), nil).Times(1)
+		w := sign(t, testConf.Authorizations[2].ClientToken, []byte("other"))
+		if w.Body.String() != "signed other" {
+			t.Fatalf("returned %q expected the newly signed file", w.Body.String())
+		}
+	})
+
+	t.Run("other user misses", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed for bob")), nil).Times(1)
+		w := sign(t, bob.ClientToken, []byte("unsigned"))
+		if w.Body.String() != "signed for bob" {
+			t.Fatalf("returned %q expected the file signed for bob", w.Body.String())
+		}
+	})
+
+	t.Run("tokens without allow_cache always call autograph", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+			return newSignedFileResponse([]byte("signed")), nil
+		}).Times(2)
+		sign(t, testConf.Authorizations[0].ClientToken, []byte("unsigned"))
+		sign(t, testConf.Authorizations[0].ClientToken, []byte("unsigned"))
+	})
+
+	t.Run("failed signatures are not cached", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		gomock.InOrder(
+			clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadRequest, "bad input"), nil),
+			clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed retry")), nil),
+		)
+		token := testConf.Authorizations[2].ClientToken
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, token, []byte("retry")))
+		if w.Code == http.StatusCreated {
+			t.Fatal("rejected signature returned a 201")
+		}
+		if w := sign(t, token, []byte("retry")); w.Body.String() != "signed retry" {
+			t.Fatalf("returned %q expected the newly signed file", w.Body.String())
+		}
+	})
+}
+
+func TestSigHandlerResponseCacheETag(t *testing.T) {
+	useTestResponseCache(t)
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].AllowCache = true
+	testConf.ResponseCache.MaxAge = 10 * time.Minute
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte("signed")))
+
+	sign := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := newMultipartSignRequest(t, token, []byte("unsigned"))
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		return w
+	}
+	expectNotModified := func(w *httptest.ResponseRecorder) {
+		t.Helper()
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Fatalf("returned %d %q expected a 304 without a body", w.Code, w.Body.String())
+		}
+		if w.Header().Get("ETag") != etag || w.Header().Get("Content-Type") != "" {
+			t.Fatalf("returned ETag %q and content type %q on a 304", w.Header().Get("ETag"), w.Header().Get("Content-Type"))
+		}
+	}
+
+	// a signed file matching If-None-Match isn't sent even on a miss
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	expectNotModified(sign(etag))
+
+	// the cached file is sent with its ETag unless the client holds it
+	for _, ifNoneMatch := range []string{"", `"other"`} {
+		w := sign(ifNoneMatch)
+		if w.Code != http.StatusCreated || w.Body.String() != "signed" {
+			t.Fatalf("returned %d %q expected the cached signed file", w.Code, w.Body.String())
+		}
+		if w.Header().Get("ETag") != etag || w.Header().Get("Cache-Control") != "private, max-age=600" {
+			t.Fatalf("returned ETag %q and Cache-Control %q", w.Header().Get("ETag"), w.Header().Get("Cache-Control"))
+		}
+	}
+	expectNotModified(sign(`"other", W/` + etag))
+
+	// tokens without allow_cache have no ETag
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+	w := httptest.NewRecorder()
+	req := newMultipartSignRequest(t, testConf.Authorizations[0].ClientToken, []byte("unsigned"))
+	req.Header.Set("If-None-Match", etag)
+	sigHandler(w, req)
+	if w.Code != http.StatusCreated || w.Header().Get("ETag") != "" {
+		t.Fatalf("returned %d with ETag %q for a token without allow_cache", w.Code, w.Header().Get("ETag"))
+	}
+}
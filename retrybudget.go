@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxRetriesHeader lets clients lower the number of times the edge
+// retries a failed upstream request on their behalf
+const maxRetriesHeader = "X-Max-Retries"
+
+var errInvalidMaxRetries = errors.New("X-Max-Retries must be a non-negative integer")
+
+// requestedMaxAttempts returns the upstream attempts of r from its
+// X-Max-Retries header, clamped to the maxAttempts of the server. It
+// returns 0, for the server default, when the header is not sent.
+func requestedMaxAttempts(r *http.Request, maxAttempts int) (int, error) {
+	value := strings.TrimSpace(r.Header.Get(maxRetriesHeader))
+	if value == "" {
+		return 0, nil
+	}
+	retries, err := strconv.Atoi(value)
+	if err != nil || retries < 0 {
+		return 0, errors.Wrapf(errInvalidMaxRetries, "got %q", value)
+	}
+	if retries >= maxAttempts {
+		return maxAttempts, nil
+	}
+	return retries + 1, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerMaxRetries(t *testing.T) {
+	testConf := currentConf()
+	testConf.UpstreamMaxAttempts = 3
+	testConf.UpstreamRetryDelay = time.Millisecond
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+
+	for _, tt := range []struct {
+		name          string
+		maxRetries    string
+		expectedCalls int
+	}{
+		{"no header uses the upstream max attempts", "", 3},
+		{"zero disables retries", "0", 1},
+		{"one retry", "1", 2},
+		{"values over the max are clamped", "10", 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientMock := useMockAutographClient(t)
+			clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+				return newAutographResponse(http.StatusBadGateway, "bad gateway"), nil
+			}).Times(tt.expectedCalls)
+			req := newMultipartSignRequest(t, token, []byte("unsigned"))
+			if tt.maxRetries != "" {
+				req.Header.Set(maxRetriesHeader, tt.maxRetries)
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("returned %d %s expected a 502", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	for _, value := range []string{"-1", "two"} {
+		req := newMultipartSignRequest(t, token, []byte("unsigned"))
+		req.Header.Set(maxRetriesHeader, value)
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_max_retries") {
+			t.Fatalf("X-Max-Retries %q returned %d %s expected a 400 invalid_max_retries", value, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// processStart is when the process started, which the uptime of the
+// root status is counted from
+var processStart = time.Now()
+
+// rootStatus is the response of the root path when root_status is
+// enabled
+type rootStatus struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+	// Uptime is the number of seconds since the process started
+	Uptime int64 `json:"uptime"`
+}
+
+// rootHandler serves the root status at / when the live configuration
+// enables it, and a 404 for the other paths no handler matched
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || !currentConf().RootStatus {
+		notFoundHandler(w, r)
+		return
+	}
+	allowGET()(http.HandlerFunc(rootStatusHandler)).ServeHTTP(w, r)
+}
+
+func rootStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var version struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(jsonVersion, &version); err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to parse version.json: %v", err)
+		return
+	}
+	body, err := json.Marshal(rootStatus{
+		Service: "autograph-edge",
+		Version: version.Version,
+		Uptime:  int64(time.Since(processStart).Seconds()),
+	})
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to build root status: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_rootHandler(t *testing.T) {
+	handler := prepareServer().Handler
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("root returned unexpected status %v expected %v without root_status", w.Code, http.StatusNotFound)
+	}
+
+	testConf := currentConf()
+	testConf.RootStatus = true
+	useTestConf(t, testConf)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("root returned unexpected status %v and content type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	var status rootStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Service != "autograph-edge" || status.Version == "" || status.Uptime < 0 {
+		t.Fatalf("root returned unexpected status %+v", status)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown path returned unexpected status %v expected %v", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serverTLSVersions are the accepted min_version of the server TLS
+var serverTLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+const defaultServerTLSMinVersion = "1.2"
+
+// serverTLSConfig makes the edge serve HTTPS itself instead of plain
+// HTTP behind a TLS terminating proxy. The cert and key are set
+// together, and TLS is enabled or not at startup.
+type serverTLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// MinVersion is the lowest TLS version accepted, "1.2" or "1.3".
+	// Defaults to 1.2.
+	MinVersion string `yaml:"min_version"`
+
+	// AllowedSNI rejects the handshakes of clients whose SNI is not
+	// one of these hostnames, compared case insensitively, when set.
+	// Clients sending no SNI are rejected too.
+	AllowedSNI []string `yaml:"allowed_sni"`
+}
+
+func (c serverTLSConfig) enabled() bool {
+	return c.Cert != "" || c.Key != ""
+}
+
+// validate checks that the cert and key are set together and load,
+// so that a reload with a bad certificate is rejected before it is
+// swapped in
+func (c serverTLSConfig) validate() error {
+	if (c.Cert == "") != (c.Key == "") {
+		return fmt.Errorf("server TLS cert and key must be set together")
+	}
+	if _, ok := serverTLSVersions[c.MinVersion]; !ok {
+		return fmt.Errorf("server TLS min version %q must be 1.2 or 1.3", c.MinVersion)
+	}
+	for _, name := range c.AllowedSNI {
+		if name == "" || strings.ContainsAny(name, " /:*") {
+			return fmt.Errorf("invalid server TLS allowed SNI %q, want a hostname", name)
+		}
+	}
+	if !c.enabled() {
+		return nil
+	}
+	_, err := c.loadCertificate()
+	return err
+}
+
+func (c serverTLSConfig) loadCertificate() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server TLS cert %q and key %q: %v", c.Cert, c.Key, err)
+	}
+	return &cert, nil
+}
+
+// serverCertificate holds the certificate served to clients, which is
+// loaded again on reloads without restarting the listener
+type serverCertificate struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// serverCert is set at startup when the server TLS is enabled
+var serverCert *serverCertificate
+
+func newServerCertificate(c serverTLSConfig) (*serverCertificate, error) {
+	sc := &serverCertificate{}
+	return sc, sc.load(c)
+}
+
+// load swaps in the certificate of c, keeping the current one when it
+// fails to load
+func (sc *serverCertificate) load(c serverTLSConfig) error {
+	cert, err := c.loadCertificate()
+	if err != nil {
+		return err
+	}
+	sc.cert.Store(cert)
+	return nil
+}
+
+func (sc *serverCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return sc.cert.Load(), nil
+}
+
+// newTLSConfig returns the server TLS configuration serving sc
+func (sc *serverCertificate) newTLSConfig(c serverTLSConfig) *tls.Config {
+	return &tls.Config{
+		MinVersion:         serverTLSVersions[c.MinVersion],
+		GetCertificate:     sc.getCertificate,
+		GetConfigForClient: checkClientSNI,
+	}
+}
+
+// checkClientSNI fails the handshake of clients whose SNI is not one of
+// the allowed SNI of the live configuration, so that a reload changes
+// them for the new connections. It keeps the server TLS configuration
+// otherwise.
+func checkClientSNI(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	allowed := currentConf().ServerTLS.AllowedSNI
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+	for _, name := range allowed {
+		if strings.EqualFold(hello.ServerName, name) {
+			return nil, nil
+		}
+	}
+	log.Warnf("rejecting TLS handshake from %s with SNI %q that is not allowed", hello.Conn.RemoteAddr(), hello.ServerName)
+	return nil, fmt.Errorf("server name %q is not allowed", hello.ServerName)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, cert := writeTestCert(t, dir, "server", x509.ExtKeyUsageServerAuth, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+	testConf := currentConf()
+	testConf.BaseURLs = upstreamURLs{up.URL + "/"}
+	testConf.ServerTLS = serverTLSConfig{Cert: certPath, Key: keyPath, MinVersion: "1.2"}
+	useTestConf(t, testConf)
+
+	var err error
+	serverCert, err = newServerCertificate(testConf.ServerTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serverCert = nil })
+	server := prepareServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	for _, path := range []string{"/__version__", "/__heartbeat__"} {
+		resp, err := client.Get("https://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("GET %s over TLS returned error: %v", path, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if resp.StatusCode != w.Code || string(body) != w.Body.String() {
+			t.Fatalf("GET %s over TLS returned %d %s expected %d %s", path, resp.StatusCode, body, w.Code, w.Body.String())
+		}
+	}
+
+	// a reload swaps the certificate of the new connections
+	certPath, keyPath, cert = writeTestCert(t, dir, "server", x509.ExtKeyUsageServerAuth, 2)
+	if err := serverCert.load(serverTLSConfig{Cert: certPath, Key: keyPath}); err != nil {
+		t.Fatal(err)
+	}
+	roots.AddCert(cert)
+	client.CloseIdleConnections()
+	resp, err := client.Get("https://" + ln.Addr().String() + "/__lbheartbeat__")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Fatalf("served certificate %d after the reload expected 2", serial)
+	}
+}
+
+func Test_serverTLSConfigValidate(t *testing.T) {
+	certPath, keyPath, _ := writeTestCert(t, t.TempDir(), "server", x509.ExtKeyUsageServerAuth, 1)
+	for _, tt := range []struct {
+		name    string
+		config  serverTLSConfig
+		wantErr bool
+	}{
+		{"disabled", serverTLSConfig{MinVersion: "1.2"}, false},
+		{"cert and key", serverTLSConfig{Cert: certPath, Key: keyPath, MinVersion: "1.3"}, false},
+		{"cert without key", serverTLSConfig{Cert: certPath, MinVersion: "1.2"}, true},
+		{"key without cert", serverTLSConfig{Key: keyPath, MinVersion: "1.2"}, true},
+		{"missing files", serverTLSConfig{Cert: certPath + ".missing", Key: keyPath, MinVersion: "1.2"}, true},
+		{"unsupported min version", serverTLSConfig{Cert: certPath, Key: keyPath, MinVersion: "1.0"}, true},
+		{"allowed SNI", serverTLSConfig{Cert: certPath, Key: keyPath, MinVersion: "1.2", AllowedSNI: []string{"autograph-edge.example.com"}}, false},
+		{"invalid allowed SNI", serverTLSConfig{Cert: certPath, Key: keyPath, MinVersion: "1.2", AllowedSNI: []string{"https://autograph-edge.example.com"}}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerTLSAllowedSNI(t *testing.T) {
+	certPath, keyPath, cert := writeTestCert(t, t.TempDir(), "server", x509.ExtKeyUsageServerAuth, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+	testConf := currentConf()
+	testConf.BaseURLs = upstreamURLs{up.URL + "/"}
+	testConf.ServerTLS = serverTLSConfig{Cert: certPath, Key: keyPath, MinVersion: "1.2", AllowedSNI: []string{"LOCALHOST"}}
+	useTestConf(t, testConf)
+
+	var err error
+	serverCert, err = newServerCertificate(testConf.ServerTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serverCert = nil })
+	server := prepareServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"}}}
+	for _, path := range []string{"/__version__", "/__heartbeat__"} {
+		resp, err := client.Get("https://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("GET %s with an allowed SNI returned error: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s with an allowed SNI returned %d", path, resp.StatusCode)
+		}
+	}
+
+	for _, serverName := range []string{"autograph-edge.example.com", ""} {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+			t.Fatalf("handshake with SNI %q succeeded", serverName)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+
+// serviceCredentialConfig is a single hawk credential the edge calls
+// autograph with, when enabled, instead of the user and key of the
+// authorization of each request. The authorizations then only decide
+// what clients can do at the edge.
+type serviceCredentialConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	User    string `yaml:"user"`
+	Key     string `yaml:"key"`
+}
+
+// validate returns an error unless c is enabled with both a user and a
+// key, or disabled and empty
+func (c serviceCredentialConfig) validate() error {
+	if c.Enabled && (c.User == "" || c.Key == "") {
+		return fmt.Errorf("service credential is enabled without a user and a key")
+	}
+	if !c.Enabled && (c.User != "" || c.Key != "") {
+		return fmt.Errorf("service credential user or key is set but the service credential is not enabled")
+	}
+	return nil
+}
+
+// hawkCredentials returns the autograph user and key the calls for auth
+// are made with, which are those of the service credential of the live
+// configuration when it is enabled
+func hawkCredentials(auth authorization) (user, key string) {
+	if sc := currentConf().ServiceCredential; sc.Enabled {
+		return sc.User, sc.Key
+	}
+	return auth.User, auth.Key
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func Test_serviceCredentialConfigValidate(t *testing.T) {
+	testcases := []struct {
+		conf    serviceCredentialConfig
+		wantErr bool
+	}{
+		{serviceCredentialConfig{}, false},
+		{serviceCredentialConfig{Enabled: true, User: "edge", Key: "secret"}, false},
+		{serviceCredentialConfig{Enabled: true, User: "edge"}, true},
+		{serviceCredentialConfig{Enabled: true, Key: "secret"}, true},
+		{serviceCredentialConfig{User: "edge", Key: "secret"}, true},
+	}
+	for i, testcase := range testcases {
+		if err := testcase.conf.validate(); (err != nil) != testcase.wantErr {
+			t.Errorf("testcase %d: validate() returned error %v, wantErr %t", i, err, testcase.wantErr)
+		}
+	}
+}
+
+func TestSigHandlerServiceCredential(t *testing.T) {
+	const serviceKey = "9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e0f9a8b"
+	for _, enabled := range []bool{false, true} {
+		testConf := currentConf()
+		expectedUser := testConf.Authorizations[0].User
+		if enabled {
+			testConf.ServiceCredential = serviceCredentialConfig{Enabled: true, User: "edge-service", Key: serviceKey}
+			expectedUser = "edge-service"
+		}
+		useTestConf(t, testConf)
+
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+			header := req.Header.Get("Authorization")
+			if !strings.Contains(header, `id="`+expectedUser+`"`) {
+				t.Fatalf("upstream request with service credential %t sent hawk header %q expected user %q", enabled, header, expectedUser)
+			}
+			return newSignedFileResponse([]byte("signed")), nil
+		})
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[0].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned unexpected status %v: %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+func Test_hawkCredentials(t *testing.T) {
+	auth := authorization{User: "alice", Key: "alice-key"}
+	if user, key := hawkCredentials(auth); user != "alice" || key != "alice-key" {
+		t.Fatalf("hawkCredentials() without a service credential returned %q, %q", user, key)
+	}
+	testConf := currentConf()
+	testConf.ServiceCredential = serviceCredentialConfig{Enabled: true, User: "edge-service", Key: "service-key"}
+	useTestConf(t, testConf)
+	if user, key := hawkCredentials(auth); user != "edge-service" || key != "service-key" {
+		t.Fatalf("hawkCredentials() with a service credential returned %q, %q", user, key)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var errAutographInvalidResponse = errors.New("autograph returned an invalid response")
+
+// maxResponseKeyLength bounds the object keys read from an autograph
+// response, which are short field names
+const maxResponseKeyLength = 1024
+
+// copySignedFile decodes the base64 signed_file of the single
+// signature response in the autograph JSON response r to w. It reads r
+// as the file is decoded so the signed file is never fully buffered.
+// The signer_id and x5u fields are recorded in meta when it is set,
+// only those preceding signed_file being known by the first write.
+func copySignedFile(w io.Writer, r io.Reader, meta *upstreamMetadata) (n int64, err error) {
+	s := &responseScanner{r: bufio.NewReader(r)}
+	if err = s.expect('['); err != nil {
+		return
+	}
+	c, err := s.next()
+	if err != nil {
+		return
+	}
+	if c == ']' {
+		return 0, errAutographBadResponseCount
+	}
+	if c != '{' {
+		return 0, s.syntaxError(c)
+	}
+	found := false
+	for {
+		var key string
+		key, err = s.readKey()
+		if err != nil {
+			return
+		}
+		if err = s.expect(':'); err != nil {
+			return
+		}
+		if key == "signed_file" && !found {
+			found = true
+			if err = s.expect('"'); err != nil {
+				return
+			}
+			n, err = io.Copy(w, base64.NewDecoder(base64.StdEncoding, &jsonStringReader{s: s}))
+			if err != nil {
+				return
+			}
+		} else if meta != nil && (key == "signer_id" || key == "x5u") {
+			var value string
+			value, err = s.readStringValue()
+			if err != nil {
+				return
+			}
+			meta.set(key, value)
+		} else if err = s.skipValue(); err != nil {
+			return
+		}
+		c, err = s.next()
+		if err != nil {
+			return
+		}
+		if c == '}' {
+			break
+		}
+		if c != ',' {
+			return n, s.syntaxError(c)
+		}
+	}
+	c, err = s.next()
+	if err != nil {
+		return
+	}
+	if c == ',' {
+		return n, errAutographBadResponseCount
+	}
+	if c != ']' {
+		return n, s.syntaxError(c)
+	}
+	if !found {
+		return n, errAutographEmptyResponse
+	}
+	return n, nil
+}
+
+// responseScanner reads the tokens of an autograph JSON response
+type responseScanner struct {
+	r *bufio.Reader
+}
+
+func (s *responseScanner) readByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err == io.EOF {
+		err = errors.Wrap(errAutographInvalidResponse, "unexpected end of response")
+	}
+	return c, err
+}
+
+// next returns the next byte that isn't whitespace
+func (s *responseScanner) next() (byte, error) {
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if !isJSONSpace(c) {
+			return c, nil
+		}
+	}
+}
+
+func (s *responseScanner) expect(want byte) error {
+	c, err := s.next()
+	if err != nil {
+		return err
+	}
+	if c != want {
+		return s.syntaxError(c)
+	}
+	return nil
+}
+
+func (s *responseScanner) syntaxError(c byte) error {
+	return errors.Wrap(errAutographInvalidResponse, fmt.Sprintf("unexpected character %q", c))
+}
+
+// readKey reads an object key
+func (s *responseScanner) readKey() (string, error) {
+	if err := s.expect('"'); err != nil {
+		return "", err
+	}
+	key, err := io.ReadAll(io.LimitReader(&jsonStringReader{s: s}, maxResponseKeyLength+1))
+	if err != nil {
+		return "", err
+	}
+	if len(key) > maxResponseKeyLength {
+		return "", errors.Wrap(errAutographInvalidResponse, "object key too long")
+	}
+	return string(key), nil
+}
+
+// readStringValue reads the next value, returning it when it is a
+// string of up to maxSignerHeaderLength bytes and an empty string for
+// other values
+func (s *responseScanner) readStringValue() (string, error) {
+	c, err := s.next()
+	if err != nil {
+		return "", err
+	}
+	if c != '"' {
+		if err = s.r.UnreadByte(); err != nil {
+			return "", err
+		}
+		return "", s.skipValue()
+	}
+	jr := &jsonStringReader{s: s}
+	value, err := io.ReadAll(io.LimitReader(jr, maxSignerHeaderLength+1))
+	if err != nil {
+		return "", err
+	}
+	// discard the rest of a longer string
+	if _, err = io.Copy(io.Discard, jr); err != nil {
+		return "", err
+	}
+	if len(value) > maxSignerHeaderLength {
+		return "", nil
+	}
+	return string(value), nil
+}
+
+// skipValue reads and discards the next value
+func (s *responseScanner) skipValue() error {
+	c, err := s.next()
+	if err != nil {
+		return err
+	}
+	switch c {
+	case '"':
+		_, err = io.Copy(io.Discard, &jsonStringReader{s: s})
+		return err
+	case '{', '[':
+		for depth := 1; depth > 0; {
+			c, err = s.readByte()
+			if err != nil {
+				return err
+			}
+			switch c {
+			case '"':
+				_, err = io.Copy(io.Discard, &jsonStringReader{s: s})
+				if err != nil {
+					return err
+				}
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+		return nil
+	}
+	// numbers and literals end at the next delimiter
+	for {
+		c, err = s.readByte()
+		if err != nil {
+			return err
+		}
+		if c == ',' || c == '}' || c == ']' || isJSONSpace(c) {
+			return s.r.UnreadByte()
+		}
+	}
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// jsonStringReader reads the unescaped contents of a JSON string
+// whose opening quote was already read, returning io.EOF at its
+// closing quote
+type jsonStringReader struct {
+	s    *responseScanner
+	done bool
+	// pending holds the remaining bytes of a decoded escape sequence
+	pending []byte
+}
+
+func (jr *jsonStringReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(jr.pending) > 0 {
+			c := copy(p[n:], jr.pending)
+			jr.pending = jr.pending[c:]
+			n += c
+			continue
+		}
+		if jr.done {
+			break
+		}
+		// avoid blocking on the upstream once some bytes are available
+		if n > 0 && jr.s.r.Buffered() == 0 {
+			return n, nil
+		}
+		var c byte
+		c, err = jr.s.readByte()
+		if err != nil {
+			return n, err
+		}
+		switch c {
+		case '"':
+			jr.done = true
+		case '\\':
+			jr.pending, err = jr.readEscape()
+			if err != nil {
+				return n, err
+			}
+		default:
+			p[n] = c
+			n++
+		}
+	}
+	if n == 0 && jr.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (jr *jsonStringReader) readEscape() ([]byte, error) {
+	c, err := jr.s.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case '"', '\\', '/':
+		return []byte{c}, nil
+	case 'b':
+		return []byte{'\b'}, nil
+	case 'f':
+		return []byte{'\f'}, nil
+	case 'n':
+		return []byte{'\n'}, nil
+	case 'r':
+		return []byte{'\r'}, nil
+	case 't':
+		return []byte{'\t'}, nil
+	case 'u':
+		var r rune
+		for i := 0; i < 4; i++ {
+			c, err = jr.s.readByte()
+			if err != nil {
+				return nil, err
+			}
+			var v byte
+			switch {
+			case c >= '0' && c <= '9':
+				v = c - '0'
+			case c >= 'a' && c <= 'f':
+				v = c - 'a' + 10
+			case c >= 'A' && c <= 'F':
+				v = c - 'A' + 10
+			default:
+				return nil, jr.s.syntaxError(c)
+			}
+			r = r<<4 | rune(v)
+		}
+		buf := make([]byte, utf8.UTFMax)
+		return buf[:utf8.EncodeRune(buf, r)], nil
+	}
+	return nil, jr.s.syntaxError(c)
+}
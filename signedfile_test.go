@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+)
+
+func Test_copySignedFile(t *testing.T) {
+	signed := base64.StdEncoding.EncodeToString([]byte("signed file contents"))
+	testcases := []struct {
+		name     string
+		response string
+		expected string
+		err      error
+	}{
+		{"signed file", `[{"ref":"1","signed_file":"` + signed + `"}]`, "signed file contents", nil},
+		{"whitespace and trailing fields", "[ {\n \"signed_file\" : \"" + signed + "\", \"x5u\": \"https://example.com/\" } ]", "signed file contents", nil},
+		{"escaped slashes", `[{"signed_file":"` + strings.ReplaceAll(base64.StdEncoding.EncodeToString([]byte{0xff, 0xff, 0xff}), "/", `\/`) + `"}]`, "\xff\xff\xff", nil},
+		{"non string fields", `[{"ref":1,"meta":{"a":["}",null]},"ok":true,"signed_file":"` + signed + `"}]`, "signed file contents", nil},
+		{"no responses", `[]`, "", errAutographBadResponseCount},
+		{"two responses", `[{"signed_file":"` + signed + `"},{"signed_file":"` + signed + `"}]`, "signed file contents", errAutographBadResponseCount},
+		{"missing signed file", `[{"ref":"1"}]`, "", errAutographEmptyResponse},
+		{"not an array", `{"signed_file":"` + signed + `"}`, "", errAutographInvalidResponse},
+		{"truncated", `[{"signed_file":"` + signed[:8], "", errAutographInvalidResponse},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			n, err := copySignedFile(&out, strings.NewReader(tt.response), nil)
+			if tt.err == nil && err != nil {
+				t.Fatalf("copySignedFile() returned error: %v", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("copySignedFile() returned error %v expected %v", err, tt.err)
+			}
+			if tt.err == nil && out.String() != tt.expected {
+				t.Fatalf("copySignedFile() wrote %q expected %q", out.String(), tt.expected)
+			}
+			if n != int64(out.Len()) {
+				t.Fatalf("copySignedFile() returned %d bytes written expected %d", n, out.Len())
+			}
+		})
+	}
+
+	t.Run("invalid base64", func(t *testing.T) {
+		_, err := copySignedFile(io.Discard, strings.NewReader(`[{"signed_file":"!!!!"}]`), nil)
+		if err == nil {
+			t.Fatal("copySignedFile() of invalid base64 returned no error")
+		}
+	})
+}
+
+// notifyingRecorder signals on first when the first bytes of the
+// response body are written
+type notifyingRecorder struct {
+	*httptest.ResponseRecorder
+	first chan struct{}
+	wrote bool
+}
+
+func (nr *notifyingRecorder) Write(p []byte) (int, error) {
+	if !nr.wrote {
+		nr.wrote = true
+		close(nr.first)
+	}
+	return nr.ResponseRecorder.Write(p)
+}
+
+func TestSigHandlerStreamsSignedFile(t *testing.T) {
+	chunk := bytes.Repeat([]byte("signed"), 256<<10)
+	pr, pw := io.Pipe()
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(&http.Response{
+		StatusCode: http.StatusCreated,
+		Body:       pr,
+	}, nil)
+
+	w := &notifyingRecorder{ResponseRecorder: httptest.NewRecorder(), first: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sigHandler(w, newMultipartSignRequest(t, currentConf().Authorizations[0].ClientToken, []byte("unsigned")))
+	}()
+
+	// send the first half of the signed file and hold the rest of the
+	// response until the client received bytes, which only happens if
+	// the handler streams the file
+	encoded := base64.StdEncoding.EncodeToString(append(chunk, chunk...))
+	fmt.Fprintf(pw, `[{"ref":"1","signed_file":"%s`, encoded[:len(encoded)/2])
+	select {
+	case <-w.first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no bytes were sent to the client before the upstream response completed")
+	}
+	fmt.Fprintf(pw, `%s"}]`, encoded[len(encoded)/2:])
+	pw.Close()
+	<-done
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusCreated)
+	}
+	if !bytes.Equal(w.Body.Bytes(), append(chunk, chunk...)) {
+		t.Fatal("client received a different signed file")
+	}
+}
+
+func TestSigHandlerStreamErrorAborts(t *testing.T) {
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusCreated,
+		`[{"signed_file":"`+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("signed"), 4096))), nil)
+
+	defer func() {
+		if recover() != http.ErrAbortHandler {
+			t.Fatal("sigHandler() did not abort the truncated response")
+		}
+	}()
+	sigHandler(httptest.NewRecorder(), newMultipartSignRequest(t, currentConf().Authorizations[0].ClientToken, []byte("unsigned")))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resolveSigner returns the autograph signer id of signer, following
+// the signer aliases of c until it is not an alias. The aliases are
+// checked for cycles when the configuration is loaded.
+func (c configuration) resolveSigner(signer string) string {
+	for i := 0; i < len(c.SignerAliases); i++ {
+		target, ok := c.SignerAliases[signer]
+		if !ok {
+			break
+		}
+		signer = target
+	}
+	return signer
+}
+
+// resolveSigners returns auth with its signer and allowed signers
+// resolved to their autograph signer ids
+func (c configuration) resolveSigners(auth authorization) authorization {
+	if len(c.SignerAliases) == 0 {
+		return auth
+	}
+	auth.Signer = c.resolveSigner(auth.Signer)
+	if len(auth.AllowedSigners) > 0 {
+		allowed := make([]string, len(auth.AllowedSigners))
+		for i, signer := range auth.AllowedSigners {
+			allowed[i] = c.resolveSigner(signer)
+		}
+		auth.AllowedSigners = allowed
+	}
+	return auth
+}
+
+// validateSignerAliases checks that aliases map signer names to other
+// names and that following them never comes back to an alias
+func validateSignerAliases(aliases map[string]string) error {
+	for alias, target := range aliases {
+		if alias == "" || target == "" {
+			return fmt.Errorf("signer alias %q of %q cannot be empty", alias, target)
+		}
+		seen := map[string]bool{alias: true}
+		for next, ok := target, true; ok; next, ok = aliases[next] {
+			if seen[next] {
+				return fmt.Errorf("signer alias %q is part of a cycle through %q", alias, next)
+			}
+			seen[next] = true
+		}
+	}
+	return nil
+}
+
+// logSignerAliases logs the signer id each alias resolves to
+func (c configuration) logSignerAliases() {
+	for alias := range c.SignerAliases {
+		log.Infof("signer alias %q resolves to autograph signer %q", alias, c.resolveSigner(alias))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerSignerAlias(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].AllowedSigners = []string{"testapp-android-legacy"}
+	testConf.SignerAliases = map[string]string{
+		"testapp-android":        "testapp-android-v2",
+		"testapp-android-legacy": "testapp-android",
+	}
+	useTestConf(t, testConf)
+
+	for _, tt := range []struct {
+		name          string
+		path          string
+		expectedKeyID string
+	}{
+		{"signer of the token", "/sign", "testapp-android-v2"},
+		{"aliased signer in the path", "/sign/testapp-android-legacy", "testapp-android-v2"},
+		{"real signer id in the path", "/sign/testapp-android-v2", "testapp-android-v2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []signaturerequest
+			clientMock := useMockAutographClient(t)
+			clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+				if err := json.NewDecoder(req.Body).Decode(&upstreamRequests); err != nil {
+					t.Fatal(err)
+				}
+				return newSignedFileResponse([]byte("signed")), nil
+			})
+			req := newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned"))
+			req.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("returned unexpected status %v: %s", w.Code, w.Body.String())
+			}
+			if len(upstreamRequests) != 1 || upstreamRequests[0].KeyID != tt.expectedKeyID {
+				t.Fatalf("upstream received %+v expected key id %q", upstreamRequests, tt.expectedKeyID)
+			}
+		})
+	}
+
+	t.Run("unknown tokens are not resolved", func(t *testing.T) {
+		auth, err := authorize("0e5f3dc1b2a4968778695a4b3c2d1e0f9a8b7c6d5e4f30211a2b3c4d5e6f7a8b")
+		if err != errInvalidToken || !reflect.DeepEqual(auth, authorization{}) {
+			t.Fatalf("authorize() of an unknown token returned %+v, %v expected an empty authorization", auth, err)
+		}
+	})
+}
+
+func Test_validateSignerAliases(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		aliases map[string]string
+		wantErr bool
+	}{
+		{"no aliases", nil, false},
+		{"chained aliases", map[string]string{"a": "b", "b": "c"}, false},
+		{"alias of itself", map[string]string{"a": "a"}, true},
+		{"cycle", map[string]string{"a": "b", "b": "c", "c": "a"}, true},
+		{"empty target", map[string]string{"a": ""}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSignerAliases(tt.aliases); (err != nil) != tt.wantErr {
+				t.Fatalf("validateSignerAliases() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
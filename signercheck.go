@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// startup checks of the configured signers, which are disabled when
+// the check is not set
+const (
+	startupCheckWarn   = "warn"
+	startupCheckStrict = "strict"
+)
+
+var supportedStartupChecks = []string{startupCheckWarn, startupCheckStrict}
+
+// maxSignerListLength bounds the list of signer IDs read from autograph
+const maxSignerListLength = 1 << 16
+
+// checkSigners verifies that the autograph backends are reachable and
+// that autograph lets the user of each authorization use its signer.
+// It returns the problems found, which are empty when all is well.
+func checkSigners(c configuration, hbClient heartbeatRequester, client autographRequester) (problems []string) {
+	var reachable []string
+	for _, baseURL := range c.BaseURLs {
+		ok, details := checkAutographHeartbeat(baseURL, hbClient)
+		if !ok {
+			problems = append(problems, details)
+			continue
+		}
+		reachable = append(reachable, baseURL)
+	}
+	if len(reachable) == 0 {
+		return problems
+	}
+
+	// list the signers available to each user once
+	signersOfUser := make(map[string][]string)
+	for i, auth := range c.tokenStore().Authorizations() {
+		user, _ := hawkCredentials(auth)
+		signers, ok := signersOfUser[user]
+		if !ok {
+			var err error
+			signers, err = listUserSigners(reachable, auth, client, c.HeartbeatTimeout)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("failed to list the signers of autograph user %q: %v", user, err))
+			}
+			signersOfUser[user] = signers
+		}
+		// signers is nil when they could not be listed, which is
+		// reported once for the user
+		if signer := c.resolveSigner(auth.Signer); signers != nil && !stringInSlice(signer, signers) {
+			problems = append(problems, fmt.Sprintf("signer %q of authorization %d is unknown to autograph or not available to user %q", signer, i, user))
+		}
+	}
+	return problems
+}
+
+// listUserSigners returns the IDs of the signers autograph lets the
+// user of auth use, from the first of baseURLs that answers
+func listUserSigners(baseURLs []string, auth authorization, client autographRequester, timeout time.Duration) (signers []string, err error) {
+	for _, baseURL := range baseURLs {
+		signers, err = requestUserSigners(baseURL, auth, client, timeout)
+		if err == nil {
+			return signers, nil
+		}
+	}
+	return nil, err
+}
+
+func requestUserSigners(baseURL string, auth authorization, client autographRequester, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	user, _ := hawkCredentials(auth)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"auths/"+url.PathEscape(user)+"/keyids", nil)
+	if err != nil {
+		return nil, err
+	}
+	setHawkAuthorization(req, auth, "", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSignerListLength))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamStatusError(resp.StatusCode, body)
+	}
+	var signers []string
+	err = json.Unmarshal(body, &signers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the signer IDs from %s: %v", baseURL, err)
+	}
+	return signers, nil
+}
+
+// credentialCheckName returns the name of the heartbeat check of the
+// credentials of an autograph user
+func credentialCheckName(user string) string {
+	return "autograph_credential:" + user
+}
+
+// checkCredentials authenticates each distinct autograph credential of
+// the authorizations of c by listing the signers of its user from the
+// first of baseURLs that answers. It returns whether the credentials of
+// each user were accepted, keyed by the name of their check, and the
+// details of the failures. A user configured with several keys fails
+// when any of them is rejected.
+func checkCredentials(c configuration, baseURLs []string, client autographRequester) (checks map[string]bool, details []string) {
+	checks = make(map[string]bool)
+	checked := make(map[[2]string]bool)
+	for i, auth := range c.tokenStore().Authorizations() {
+		user, key := hawkCredentials(auth)
+		if checked[[2]string{user, key}] {
+			continue
+		}
+		checked[[2]string{user, key}] = true
+		_, err := listUserSigners(baseURLs, auth, client, c.HeartbeatTimeout)
+		if err != nil {
+			details = append(details, fmt.Sprintf("failed to authenticate autograph user %q of authorization %d: %v", user, i, err))
+		}
+		if ok, seen := checks[credentialCheckName(user)]; !seen || ok {
+			checks[credentialCheckName(user)] = err == nil
+		}
+	}
+	return checks, details
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mozilla-services/autograph-edge/mock_main"
+)
+
+func Test_checkSigners(t *testing.T) {
+	c := currentConf()
+	c.BaseURLs = upstreamURLs{"http://127.0.0.1:8000/"}
+
+	testcases := []struct {
+		name             string
+		heartbeatErr     error
+		keyIDsStatus     int
+		keyIDsBody       string
+		expectedProblems []string
+	}{
+		{
+			name:         "all signers known",
+			keyIDsStatus: http.StatusOK,
+			keyIDsBody:   `["extensions-ecdsa", "testapp-android", "normandy"]`,
+		},
+		{
+			name:             "unknown signer",
+			keyIDsStatus:     http.StatusOK,
+			keyIDsBody:       `["extensions-ecdsa"]`,
+			expectedProblems: []string{`signer "testapp-android" of authorization 2`},
+		},
+		{
+			name:             "rejected credentials",
+			keyIDsStatus:     http.StatusUnauthorized,
+			keyIDsBody:       "authorization verification failed",
+			expectedProblems: []string{`failed to list the signers of autograph user "alice"`},
+		},
+		{
+			name:             "unreachable autograph",
+			heartbeatErr:     fmt.Errorf("connection refused"),
+			expectedProblems: []string{"failed to request autograph heartbeat from http://127.0.0.1:8000/__heartbeat__"},
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			heartbeatMock := mock_main.NewMockheartbeatRequester(ctrl)
+			if testcase.heartbeatErr != nil {
+				heartbeatMock.EXPECT().Get("http://127.0.0.1:8000/__heartbeat__").Return(nil, testcase.heartbeatErr)
+			} else {
+				heartbeatMock.EXPECT().Get("http://127.0.0.1:8000/__heartbeat__").Return(newAutographResponse(http.StatusOK, "{}"), nil)
+			}
+			clientMock := mock_main.NewMockautographRequester(ctrl)
+			if testcase.keyIDsStatus != 0 {
+				// the three test authorizations share a user, listed once
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					if req.URL.String() != "http://127.0.0.1:8000/auths/alice/keyids" {
+						t.Errorf("unexpected signers request to %s", req.URL)
+					}
+					if !strings.HasPrefix(req.Header.Get("Authorization"), "Hawk ") {
+						t.Errorf("signers request is not hawk authenticated")
+					}
+					return newAutographResponse(testcase.keyIDsStatus, testcase.keyIDsBody), nil
+				})
+			}
+
+			problems := checkSigners(c, heartbeatMock, clientMock)
+			if len(problems) != len(testcase.expectedProblems) {
+				t.Fatalf("checkSigners() returned problems %q expected %q", problems, testcase.expectedProblems)
+			}
+			for i, expected := range testcase.expectedProblems {
+				if !strings.Contains(problems[i], expected) {
+					t.Errorf("problem %q does not contain %q", problems[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func Test_checkHeartbeatsCredentials(t *testing.T) {
+	testConf := currentConf()
+	testConf.BaseURLs = upstreamURLs{"http://127.0.0.1:8000/"}
+	testConf.HeartbeatCheckCredentials = true
+	testConf.Authorizations = append(append([]authorization(nil), testConf.Authorizations...), authorization{
+		ClientToken: strings.Repeat("b", 64),
+		User:        "bob",
+		Key:         "malformed",
+		Signer:      "testapp-android",
+	})
+	useTestConf(t, testConf)
+
+	ctrl := gomock.NewController(t)
+	heartbeatMock := mock_main.NewMockheartbeatRequester(ctrl)
+	heartbeatMock.EXPECT().Get("http://127.0.0.1:8000/__heartbeat__").Return(newAutographResponse(http.StatusOK, "{}"), nil)
+	clientMock := useMockAutographClient(t)
+	// the three authorizations of alice share their credentials, checked once
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/auths/bob/keyids" {
+			return newAutographResponse(http.StatusUnauthorized, "authorization verification failed"), nil
+		}
+		return newAutographResponse(http.StatusOK, `["extensions-ecdsa", "testapp-android"]`), nil
+	}).Times(2)
+
+	st := checkHeartbeats(heartbeatMock)
+	expectedChecks := map[string]bool{
+		"autograph_heartbeat:http://127.0.0.1:8000/": true,
+		"autograph_credential:alice":                 true,
+		"autograph_credential:bob":                   false,
+	}
+	if !reflect.DeepEqual(st.Checks, expectedChecks) {
+		t.Fatalf("checkHeartbeats() returned checks %v expected %v", st.Checks, expectedChecks)
+	}
+	if !st.Status || !strings.Contains(st.Details, `failed to authenticate autograph user "bob" of authorization 3`) {
+		t.Fatalf("checkHeartbeats() returned status %v and details %q expected a healthy status detailing bob", st.Status, st.Details)
+	}
+}
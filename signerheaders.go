@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+const (
+	signerHeader = "X-Autograph-Signer"
+	x5uHeader    = "X-Autograph-X5U"
+
+	// maxSignerHeaderLength bounds the autograph values returned in
+	// the signer headers
+	maxSignerHeaderLength = 2048
+)
+
+// upstreamMetadata holds the signer ID and x5u of the autograph
+// response returned to the client in the signer headers. Only these
+// two public values are read, so neither the hawk credentials nor the
+// client token can end up in them.
+type upstreamMetadata struct {
+	SignerID string
+	X5U      string
+}
+
+// set records the value of key of the autograph signature response
+// when it is one of the returned fields and safe to put in a header.
+// It does nothing when m is nil.
+func (m *upstreamMetadata) set(key, value string) {
+	if m == nil {
+		return
+	}
+	switch key {
+	case "signer_id":
+		if isSafeHeaderValue(value) {
+			m.SignerID = value
+		}
+	case "x5u":
+		if isSafeX5U(value) {
+			m.X5U = value
+		}
+	}
+}
+
+// setHeaders sets the signer headers of the recorded values on h
+func (m *upstreamMetadata) setHeaders(h http.Header) {
+	if m.SignerID != "" {
+		h.Set(signerHeader, m.SignerID)
+	}
+	if m.X5U != "" {
+		h.Set(x5uHeader, m.X5U)
+	}
+}
+
+// isSafeHeaderValue returns whether value is non-empty, bounded and
+// only has printable ASCII characters
+func isSafeHeaderValue(value string) bool {
+	if value == "" || len(value) > maxSignerHeaderLength {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// isSafeX5U returns whether x5u is an http or https URL without
+// userinfo, which could carry credentials
+func isSafeX5U(x5u string) bool {
+	if !isSafeHeaderValue(x5u) {
+		return false
+	}
+	u, err := url.Parse(x5u)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.User == nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errSignerNotAllowed = errors.New("signer is not allowed for this token")
+
+// signPathPrefix is followed by the signer to sign with in the path of
+// signing requests that pick one of the allowed signers of their token
+const signPathPrefix = "/sign/"
+
+// pathSigner returns the signer named in the path of r, or an empty
+// string when the path doesn't start with /sign/. ok is false for paths
+// that are not a single signer name after /sign/.
+func pathSigner(r *http.Request) (signer string, ok bool) {
+	if !strings.HasPrefix(r.URL.Path, signPathPrefix) {
+		return "", true
+	}
+	signer = strings.TrimPrefix(r.URL.Path, signPathPrefix)
+	if strings.Contains(signer, "/") {
+		return "", false
+	}
+	return signer, true
+}
+
+// allowsSigner returns whether auth can sign with signer, its default
+// signer or one of its allowed signers
+func (auth authorization) allowsSigner(signer string) bool {
+	return signer == auth.Signer || stringInSlice(signer, auth.AllowedSigners)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func Test_pathSigner(t *testing.T) {
+	testcases := []struct {
+		path     string
+		expected string
+		ok       bool
+	}{
+		{"/sign", "", true},
+		{"/sign/", "", true},
+		{"/sign/extensions-ecdsa", "extensions-ecdsa", true},
+		{"/sign/extensions-ecdsa/", "", false},
+		{"/sign/a/b", "", false},
+	}
+	for _, testcase := range testcases {
+		signer, ok := pathSigner(httptest.NewRequest("POST", "http://localhost:8080"+testcase.path, nil))
+		if signer != testcase.expected || ok != testcase.ok {
+			t.Errorf("pathSigner(%q) = %q, %t expected %q, %t", testcase.path, signer, ok, testcase.expected, testcase.ok)
+		}
+	}
+}
+
+func TestSigHandlerPathSigner(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].AllowedSigners = []string{"testapp-android-legacy"}
+	useTestConf(t, testConf)
+	auth := testConf.Authorizations[2]
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedKeyID  string
+	}{
+		{"allowed path signer", "/sign/testapp-android-legacy", http.StatusCreated, "testapp-android-legacy"},
+		{"default signer in the path", "/sign/" + auth.Signer, http.StatusCreated, auth.Signer},
+		{"fallback to the default signer", "/sign", http.StatusCreated, auth.Signer},
+		{"disallowed path signer", "/sign/extensions-ecdsa", http.StatusForbidden, ""},
+		{"nested path", "/sign/testapp-android-legacy/other", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keyID string
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					var requests []map[string]interface{}
+					if err := json.NewDecoder(req.Body).Decode(&requests); err != nil {
+						t.Fatal(err)
+					}
+					keyID, _ = requests[0]["keyid"].(string)
+					return newSignedFileResponse([]byte("signed")), nil
+				})
+			}
+			req := newMultipartSignRequest(t, auth.ClientToken, []byte("unsigned"))
+			req.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if keyID != tt.expectedKeyID {
+				t.Fatalf("autograph was called with keyid %q expected %q", keyID, tt.expectedKeyID)
+			}
+			if tt.expectedStatus == http.StatusForbidden && !strings.Contains(w.Body.String(), `"code":"signer_not_allowed"`) {
+				t.Fatalf("unexpected error response %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenSigner describes a signer a token can sign with
+type tokenSigner struct {
+	ID             string   `json:"id"`
+	SignatureType  string   `json:"signature_type"`
+	PKCS7Digest    string   `json:"pkcs7_digest,omitempty"`
+	COSEAlgorithms []string `json:"cose_algorithms,omitempty"`
+}
+
+// signersResponse is the body returned by /signers
+type signersResponse struct {
+	Signers []tokenSigner `json:"signers"`
+}
+
+// tokenSigners returns the signer of auth followed by its allowed
+// signers, with the signature type and algorithms they sign with
+func tokenSigners(auth authorization) ([]tokenSigner, error) {
+	signers := make([]tokenSigner, 0, 1+len(auth.AllowedSigners))
+	for _, id := range append([]string{auth.Signer}, auth.AllowedSigners...) {
+		auth.Signer = id
+		request, err := newSignatureRequest(auth, signingParams{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		signer := tokenSigner{ID: id, SignatureType: auth.signatureType()}
+		if opt, ok := request.Options.(xpiOptions); ok {
+			signer.PKCS7Digest = opt.PKCS7Digest
+			signer.COSEAlgorithms = opt.COSEAlgorithms
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// signersHandler returns the signers the token of the request can sign
+// with, and nothing about the other tokens
+func signersHandler(w http.ResponseWriter, r *http.Request) {
+	logger := getLogger(r)
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeSigningError(w, r, errGetOnly)
+		return
+	}
+	token, err := clientToken(r)
+	if err == nil && token == "" {
+		err = errMissingToken
+	}
+	if err != nil {
+		logger.Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	auth, err := authorize(token)
+	if errors.Is(err, errSignerDisabled) || errors.Is(err, errTokenExpired) {
+		logger.WithFields(log.Fields{"user": auth.User, "signer": auth.Signer}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	if err != nil {
+		logger.Error(err)
+		writeSigningError(w, r, errInvalidToken)
+		return
+	}
+	if len(auth.AllowedCIDRs) > 0 {
+		ip, err := clientIP(r)
+		if err != nil || !auth.allowsIP(ip) {
+			logger.WithFields(log.Fields{"user": auth.User, "client_ip": ip}).Error(errIPNotAllowed)
+			writeSigningError(w, r, errIPNotAllowed)
+			return
+		}
+	}
+	signers, err := tokenSigners(auth)
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Errorf("failed to list signers: %v", err)
+		writeSigningError(w, r, errInternal)
+		return
+	}
+	body, err := json.Marshal(signersResponse{Signers: signers})
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Errorf("failed to marshal signers: %v", err)
+		writeSigningError(w, r, errInternal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
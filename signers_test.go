@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSignersHandler(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[1].AllowedSigners = []string{"extensions-ecdsa-expired", "extensions-rsa"}
+	useTestConf(t, testConf)
+
+	tests := []struct {
+		name            string
+		token           string
+		expectedStatus  int
+		expectedSigners []tokenSigner
+	}{
+		{
+			name:           "token with a single signer",
+			token:          testConf.Authorizations[2].ClientToken,
+			expectedStatus: http.StatusOK,
+			expectedSigners: []tokenSigner{
+				{ID: "testapp-android", SignatureType: signatureTypeAPK},
+			},
+		},
+		{
+			name:           "token with allowed signers",
+			token:          testConf.Authorizations[1].ClientToken,
+			expectedStatus: http.StatusOK,
+			expectedSigners: []tokenSigner{
+				{ID: "extensions-ecdsa", SignatureType: signatureTypeXPI, PKCS7Digest: "SHA256", COSEAlgorithms: []string{"ES256"}},
+				{ID: "extensions-ecdsa-expired", SignatureType: signatureTypeXPI, PKCS7Digest: "SHA256", COSEAlgorithms: []string{"ES256"}},
+				{ID: "extensions-rsa", SignatureType: signatureTypeXPI, PKCS7Digest: "SHA256", COSEAlgorithms: []string{"ES256"}},
+			},
+		},
+		{
+			name:           "unknown token",
+			token:          "0000000000000000000000000000000000000000000000000000000000000000",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "missing token",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost:8080/signers", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+			w := httptest.NewRecorder()
+			signersHandler(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned %d %s expected %d", w.Code, w.Body.String(), tt.expectedStatus)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			var body signersResponse
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body.Signers, tt.expectedSigners) {
+				t.Fatalf("returned signers %+v expected %+v", body.Signers, tt.expectedSigners)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var errSigningDisabled = errors.New("signing is disabled on this instance")
+
+// defaultSigningEnabled is the signing policy of the configurations
+// that don't set signing_enabled. Locked-down builds set it to false
+// with -ldflags "-X main.defaultSigningEnabled=false" so that they only
+// sign when their configuration opts in.
+var defaultSigningEnabled = "true"
+
+// signingEnabled is the signing policy of the configuration loaded at
+// startup. It is a deploy-time policy that reloads don't change.
+var signingEnabled = true
+
+// isSigningEnabled returns whether c lets the signing requests through,
+// which is the build default when it doesn't say. An invalid build
+// default disables signing.
+func (c configuration) isSigningEnabled() bool {
+	if c.SigningEnabled != nil {
+		return *c.SigningEnabled
+	}
+	enabled, err := strconv.ParseBool(defaultSigningEnabled)
+	return err == nil && enabled
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSigHandlerSigningDisabled(t *testing.T) {
+	signingEnabled = false
+	t.Cleanup(func() { signingEnabled = true })
+
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, currentConf().Authorizations[2].ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"code":"signing_disabled"`) {
+		t.Fatalf("signing returned %d %s expected a 503 signing_disabled", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest("GET", "http://localhost:8080/__version__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("version returned %d expected a 200 with signing disabled", w.Code)
+	}
+	w = httptest.NewRecorder()
+	lbHeartbeatHandler(w, httptest.NewRequest("GET", "http://localhost:8080/__lbheartbeat__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("lbheartbeat returned %d expected a 200 with signing disabled", w.Code)
+	}
+}
+
+func Test_isSigningEnabled(t *testing.T) {
+	enabled, disabled := true, false
+	for _, tt := range []struct {
+		buildDefault string
+		configured   *bool
+		want         bool
+	}{
+		{"true", nil, true},
+		{"true", &disabled, false},
+		{"false", nil, false},
+		{"false", &enabled, true},
+		{"not a bool", nil, false},
+	} {
+		defaultSigningEnabled = tt.buildDefault
+		if got := (configuration{SigningEnabled: tt.configured}).isSigningEnabled(); got != tt.want {
+			t.Errorf("isSigningEnabled() with build default %q and %v = %v, want %v", tt.buildDefault, tt.configured, got, tt.want)
+		}
+	}
+	defaultSigningEnabled = "true"
+}
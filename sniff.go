@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// sniffPrefixLength bounds how much of the input is inspected to
+// detect its type
+const sniffPrefixLength = 64 << 10
+
+// zipLocalHeaderSignature starts the local header of each file of a
+// ZIP archive, which is followed by the name of the file
+var zipLocalHeaderSignature = []byte("PK\x03\x04")
+
+// zipLocalHeaderLength is the length of a local header before the name
+const zipLocalHeaderLength = 30
+
+// signatureTypeMarkers are the files that identify XPIs and APKs,
+// which are both ZIP archives
+var signatureTypeMarkers = map[string]string{
+	"manifest.json":       signatureTypeXPI,
+	"install.rdf":         signatureTypeXPI,
+	"AndroidManifest.xml": signatureTypeAPK,
+	"classes.dex":         signatureTypeAPK,
+	"resources.arsc":      signatureTypeAPK,
+}
+
+// detectSignatureType returns whether input looks like an XPI or an
+// APK from the names of the ZIP entries in its first bytes. It returns
+// an empty string when the type is unknown or ambiguous.
+//
+// APKs are written with data descriptors, so the local headers can't
+// be skipped by size and are found by their signature instead.
+func detectSignatureType(input []byte) string {
+	if !bytes.HasPrefix(input, zipLocalHeaderSignature) {
+		return ""
+	}
+	if len(input) > sniffPrefixLength {
+		input = input[:sniffPrefixLength]
+	}
+	var detected string
+	for offset := 0; ; {
+		i := bytes.Index(input[offset:], zipLocalHeaderSignature)
+		if i < 0 {
+			break
+		}
+		header := input[offset+i:]
+		offset += i + len(zipLocalHeaderSignature)
+		if len(header) < zipLocalHeaderLength {
+			break
+		}
+		nameLength := int(binary.LittleEndian.Uint16(header[26:28]))
+		if len(header) < zipLocalHeaderLength+nameLength {
+			break
+		}
+		sigType, ok := signatureTypeMarkers[string(header[zipLocalHeaderLength:zipLocalHeaderLength+nameLength])]
+		if !ok {
+			continue
+		}
+		if detected != "" && detected != sigType {
+			return ""
+		}
+		detected = sigType
+	}
+	return detected
+}
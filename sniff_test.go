@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// newZipWithLargeFirstEntry returns a ZIP archive whose entry name is
+// stored after an uncompressed entry larger than the sniffed prefix
+func newZipWithLargeFirstEntry(t *testing.T, name string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "padding", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(bytes.Repeat([]byte("a"), sniffPrefixLength))
+	_, err = zw.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readFixture(t *testing.T, path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func Test_detectSignatureType(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+	}{
+		{"xpi fixture", readFixture(t, "integration_test/test.xpi"), signatureTypeXPI},
+		{"apk fixture", readFixture(t, "integration_test/test.apk"), signatureTypeAPK},
+		{"xpi", newSignedXPI(t, "manifest.json"), signatureTypeXPI},
+		{"legacy xpi", newSignedXPI(t, "chrome/", "install.rdf"), signatureTypeXPI},
+		{"apk", newSignedXPI(t, "AndroidManifest.xml", "classes.dex"), signatureTypeAPK},
+		{"zip without markers", newSignedXPI(t, "readme.txt"), ""},
+		{"zip with both markers", newSignedXPI(t, "manifest.json", "AndroidManifest.xml"), ""},
+		{"marker in a subdirectory", newSignedXPI(t, "assets/manifest.json"), ""},
+		{"not a zip", []byte("unsigned"), ""},
+		{"empty", nil, ""},
+		{"truncated header", []byte("PK\x03\x04\x14\x00"), ""},
+		{"truncated name", append([]byte("PK\x03\x04"), make([]byte, 26)...)[:29], ""},
+		{"marker past the prefix", newZipWithLargeFirstEntry(t, "manifest.json"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectSignatureType(tt.input); got != tt.expected {
+				t.Fatalf("detectSignatureType() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsBackendNone       = "none"
+	metricsBackendPrometheus = "prometheus"
+	metricsBackendStatsD     = "statsd"
+
+	defaultStatsDHost   = "127.0.0.1"
+	defaultStatsDPort   = 8125
+	defaultStatsDPrefix = "autograph_edge"
+)
+
+// metricsConfig selects where the metrics of the signing requests are
+// emitted. It is read at startup and not changed by reloads.
+type metricsConfig struct {
+	// Backend is none, prometheus or statsd. Defaults to prometheus.
+	Backend string `yaml:"backend"`
+
+	// StatsD is the daemon receiving the metrics of the statsd backend
+	StatsD statsdConfig `yaml:"statsd"`
+}
+
+type statsdConfig struct {
+	// Host defaults to 127.0.0.1
+	Host string `yaml:"host"`
+
+	// Port defaults to 8125
+	Port int `yaml:"port"`
+
+	// Prefix is prepended with a dot to the metric names. Defaults
+	// to autograph_edge.
+	Prefix string `yaml:"prefix"`
+}
+
+func (mc metricsConfig) validate() error {
+	switch mc.Backend {
+	case metricsBackendNone, metricsBackendPrometheus:
+	case metricsBackendStatsD:
+		if mc.StatsD.Host == "" {
+			return fmt.Errorf("statsd host cannot be empty")
+		}
+		if mc.StatsD.Port < 1 || mc.StatsD.Port > 65535 {
+			return fmt.Errorf("statsd port %d is not between 1 and 65535", mc.StatsD.Port)
+		}
+	default:
+		return fmt.Errorf("unknown metrics backend %q, must be one of %s, %s or %s",
+			mc.Backend, metricsBackendNone, metricsBackendPrometheus, metricsBackendStatsD)
+	}
+	return nil
+}
+
+// newMetrics returns the configured metrics backend
+func newMetrics(mc metricsConfig) (Metrics, error) {
+	switch mc.Backend {
+	case metricsBackendNone:
+		return noopMetrics{}, nil
+	case metricsBackendStatsD:
+		return newStatsDMetrics(mc.StatsD)
+	}
+	return prometheusMetrics{}, nil
+}
+
+// statsDMetrics sends the metrics over UDP to a statsd daemon, with
+// the labels of the prometheus metrics as DogStatsD tags. Metrics that
+// cannot be sent are dropped.
+type statsDMetrics struct {
+	conn     net.Conn
+	prefix   string
+	inFlight int64
+}
+
+func newStatsDMetrics(sc statsdConfig) (*statsDMetrics, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(sc.Host, strconv.Itoa(sc.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd: %v", err)
+	}
+	prefix := sc.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &statsDMetrics{conn: conn, prefix: prefix}, nil
+}
+
+func (s *statsDMetrics) SigningRequest(signer string, status int, dryRun bool) {
+	if signer == "" {
+		signer = "unknown"
+	}
+	name := "signing_requests"
+	if dryRun {
+		name = "dry_run_requests"
+	}
+	s.send(name, "1", "c", "signer:"+signer, "status:"+strconv.Itoa(status))
+}
+
+func (s *statsDMetrics) UpstreamDuration(call string, d time.Duration) {
+	ms := strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	s.send("upstream_duration", ms, "ms", "call:"+call)
+}
+
+// InFlight sends the absolute number of requests in flight, since
+// statsd reads a gauge value starting with a minus as a decrement
+func (s *statsDMetrics) InFlight(delta int) {
+	inFlight := atomic.AddInt64(&s.inFlight, int64(delta))
+	s.send("in_flight_requests", strconv.FormatInt(inFlight, 10), "g")
+}
+
+func (s *statsDMetrics) PayloadSize(signer string, request, response int64) {
+	if signer == "" {
+		signer = "unknown"
+	}
+	s.send("request_bytes", strconv.FormatInt(request, 10), "h", "signer:"+signer)
+	s.send("response_bytes", strconv.FormatInt(response, 10), "h", "signer:"+signer)
+}
+
+func (s *statsDMetrics) send(name, value, kind string, tags ...string) {
+	line := s.prefix + name + ":" + value + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	s.conn.Write([]byte(line))
+}
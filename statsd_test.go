@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+// listenFakeStatsD returns a UDP socket receiving the metrics of a
+// statsd backend installed for the duration of the test
+func listenFakeStatsD(t *testing.T) net.PacketConn {
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	backend, err := newMetrics(metricsConfig{
+		Backend: metricsBackendStatsD,
+		StatsD: statsdConfig{
+			Host:   "127.0.0.1",
+			Port:   sink.LocalAddr().(*net.UDPAddr).Port,
+			Prefix: "edge",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origMetrics := metrics
+	metrics = backend
+	t.Cleanup(func() { metrics = origMetrics })
+	return sink
+}
+
+// readStatsD returns the next n metrics received by sink
+func readStatsD(t *testing.T, sink net.PacketConn, n int) (lines []string) {
+	buf := make([]byte, 1500)
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(lines) < n {
+		size, _, err := sink.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("received %q then %v, expected %d metrics", lines, err, n)
+		}
+		lines = append(lines, string(buf[:size]))
+	}
+	return lines
+}
+
+func TestSigHandlerStatsDMetrics(t *testing.T) {
+	sink := listenFakeStatsD(t)
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, currentConf().Authorizations[2].ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+	}
+
+	lines := readStatsD(t, sink, 4)
+	if lines[0] != "edge.in_flight_requests:1|g" {
+		t.Fatalf("first sent %q expected the in-flight gauge to go up", lines[0])
+	}
+	timing := strings.TrimPrefix(lines[1], "edge.upstream_duration:")
+	if !strings.HasSuffix(timing, "|ms|#call:sign") {
+		t.Fatalf("sent %q expected the timing of the call to autograph", lines[1])
+	}
+	if _, err := strconv.ParseFloat(strings.TrimSuffix(timing, "|ms|#call:sign"), 64); err != nil {
+		t.Fatalf("sent upstream duration %q that is not a number: %v", lines[1], err)
+	}
+	if lines[2] != "edge.in_flight_requests:0|g" {
+		t.Fatalf("sent %q expected the in-flight gauge back to 0", lines[2])
+	}
+	if lines[3] != "edge.signing_requests:1|c|#signer:testapp-android,status:201" {
+		t.Fatalf("sent %q expected the signing request counter", lines[3])
+	}
+}
+
+func Test_statsDMetricsDryRun(t *testing.T) {
+	sink := listenFakeStatsD(t)
+	metrics.SigningRequest("", http.StatusBadRequest, true)
+	if line := readStatsD(t, sink, 1)[0]; line != "edge.dry_run_requests:1|c|#signer:unknown,status:400" {
+		t.Fatalf("sent %q expected the dry-run counter of an unknown signer", line)
+	}
+}
+
+func Test_metricsConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		config  metricsConfig
+		wantErr bool
+	}{
+		{metricsConfig{Backend: metricsBackendNone}, false},
+		{metricsConfig{Backend: metricsBackendPrometheus}, false},
+		{metricsConfig{Backend: metricsBackendStatsD, StatsD: statsdConfig{Host: "localhost", Port: 8125}}, false},
+		{metricsConfig{Backend: metricsBackendStatsD, StatsD: statsdConfig{Host: "localhost", Port: 70000}}, true},
+		{metricsConfig{Backend: metricsBackendStatsD, StatsD: statsdConfig{Port: 8125}}, true},
+		{metricsConfig{Backend: "graphite"}, true},
+	} {
+		if err := tt.config.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() of %+v error = %v, wantErr %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// timestampHeader optionally carries the time a request was sent as
+// unix seconds. It takes precedence over the Date header.
+const timestampHeader = "X-Autograph-Timestamp"
+
+const defaultMaxClockSkew = 5 * time.Minute
+
+var (
+	errMissingTimestamp = errors.New("request timestamp is required for this token")
+	errInvalidTimestamp = errors.New("invalid request timestamp")
+	errStaleTimestamp   = errors.New("request timestamp is too far from the server time")
+)
+
+// requestTimestamp returns the time r was sent according to its
+// X-Autograph-Timestamp or Date header, and whether either was set
+func requestTimestamp(r *http.Request) (time.Time, bool, error) {
+	if header := strings.TrimSpace(r.Header.Get(timestampHeader)); header != "" {
+		seconds, err := strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			return time.Time{}, true, errors.Wrapf(errInvalidTimestamp, "%s %q", timestampHeader, header)
+		}
+		return time.Unix(seconds, 0), true, nil
+	}
+	if header := r.Header.Get("Date"); header != "" {
+		date, err := http.ParseTime(header)
+		if err != nil {
+			return time.Time{}, true, errors.Wrapf(errInvalidTimestamp, "Date %q", header)
+		}
+		return date, true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// checkTimestamp returns an error when the timestamp of r is more than
+// maxSkew away from now, or when it is missing and auth requires one
+func checkTimestamp(r *http.Request, auth authorization, now time.Time, maxSkew time.Duration) error {
+	sent, ok, err := requestTimestamp(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if auth.RequireTimestamp {
+			return errMissingTimestamp
+		}
+		return nil
+	}
+	skew := now.Sub(sent)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		return errors.Wrapf(errStaleTimestamp, "skew of %s exceeds %s", skew.Round(time.Second), maxSkew)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+)
+
+func Test_checkTimestamp(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	unix := func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		require     bool
+		expectedErr error
+	}{
+		{"no timestamp", nil, false, nil},
+		{"missing but required", nil, true, errMissingTimestamp},
+		{"timestamp in window", map[string]string{timestampHeader: unix(now.Add(-4 * time.Minute))}, true, nil},
+		{"future timestamp in window", map[string]string{timestampHeader: unix(now.Add(4 * time.Minute))}, false, nil},
+		{"timestamp out of window", map[string]string{timestampHeader: unix(now.Add(-6 * time.Minute))}, false, errStaleTimestamp},
+		{"future timestamp out of window", map[string]string{timestampHeader: unix(now.Add(6 * time.Minute))}, false, errStaleTimestamp},
+		{"date in window", map[string]string{"Date": now.Add(-time.Minute).Format(http.TimeFormat)}, true, nil},
+		{"date out of window", map[string]string{"Date": now.Add(-time.Hour).Format(http.TimeFormat)}, false, errStaleTimestamp},
+		{"timestamp takes precedence over date", map[string]string{
+			timestampHeader: unix(now),
+			"Date":          now.Add(-time.Hour).Format(http.TimeFormat),
+		}, false, nil},
+		{"invalid timestamp", map[string]string{timestampHeader: "yesterday"}, false, errInvalidTimestamp},
+		{"invalid date", map[string]string{"Date": "yesterday"}, false, errInvalidTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/sign", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			err := checkTimestamp(r, authorization{RequireTimestamp: tt.require}, now, 5*time.Minute)
+			if !errors.Is(err, tt.expectedErr) || (err != nil && tt.expectedErr == nil) {
+				t.Fatalf("checkTimestamp() = %v expected %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestSigHandlerTimestamp(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].RequireTimestamp = true
+	useTestConf(t, testConf)
+	token := testConf.Authorizations[2].ClientToken
+
+	t.Run("signs in-window requests", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+		req := newMultipartSignRequest(t, token, []byte("unsigned"))
+		req.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		w := httptest.NewRecorder()
+		sigHandler(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+		}
+	})
+
+	for name, header := range map[string]string{
+		"stale_timestamp":   time.Now().Add(-time.Hour).Format(http.TimeFormat),
+		"missing_timestamp": "",
+	} {
+		t.Run("rejects "+name, func(t *testing.T) {
+			req := newMultipartSignRequest(t, token, []byte("unsigned"))
+			if header != "" {
+				req.Header.Set("Date", header)
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, req)
+			if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), name) {
+				t.Fatalf("returned %d %s expected a 401 %s", w.Code, w.Body.String(), name)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, `error="invalid_request"`) {
+				t.Fatalf("returned WWW-Authenticate %q expected an invalid_request error", got)
+			}
+		})
+	}
+}
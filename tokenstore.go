@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// tokenStore looks up the authorizations of client tokens
+type tokenStore interface {
+	// Lookup returns the authorization of token
+	Lookup(token string) (authorization, error)
+
+	// Authorizations returns every authorization of the store
+	Authorizations() []authorization
+
+	// LongestToken returns the length of the longest token that can
+	// match an authorization of the store
+	LongestToken() int
+}
+
+// tokenStoreConfig configures where the authorizations are loaded from.
+// They are read from the authorizations of the configuration file
+// unless a URL is set.
+type tokenStoreConfig struct {
+	// URL returns the list of authorizations as YAML or JSON. It is
+	// fetched at startup and on every reload.
+	URL string `yaml:"url"`
+
+	// Timeout of the requests to URL. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const defaultTokenStoreTimeout = 10 * time.Second
+
+// fileTokenStore looks up the authorizations of the configuration file
+type fileTokenStore struct {
+	auths []authorization
+
+	// byToken indexes the authorizations with a plaintext token by its
+	// SHA256, so that looking one up takes the same time whatever the
+	// token
+	byToken map[[sha256.Size]byte]int
+
+	// longest is the longestClientToken of auths
+	longest int
+}
+
+func newFileTokenStore(auths []authorization) *fileTokenStore {
+	s := &fileTokenStore{
+		auths:   auths,
+		byToken: make(map[[sha256.Size]byte]int, len(auths)),
+		longest: longestClientToken(auths),
+	}
+	for i, auth := range auths {
+		if auth.ClientToken != "" {
+			s.byToken[sha256.Sum256([]byte(auth.ClientToken))] = i
+		}
+	}
+	return s
+}
+
+// Lookup returns the authorization of token. Plaintext tokens are
+// checked first since bcrypt hashed tokens are slow to compare.
+func (s *fileTokenStore) Lookup(token string) (authorization, error) {
+	if i, ok := s.byToken[sha256.Sum256([]byte(token))]; ok {
+		return s.auths[i], nil
+	}
+	for _, auth := range s.auths {
+		if auth.ClientTokenHash == "" {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(auth.ClientTokenHash), []byte(token)) == nil {
+			return auth, nil
+		}
+	}
+	return authorization{}, errInvalidToken
+}
+
+func (s *fileTokenStore) Authorizations() []authorization {
+	return s.auths
+}
+
+func (s *fileTokenStore) LongestToken() int {
+	return s.longest
+}
+
+// httpTokenStore looks up the authorizations fetched from an HTTP endpoint
+type httpTokenStore struct {
+	fileTokenStore
+}
+
+// newHTTPTokenStore fetches and validates the authorizations of
+// the token store endpoint
+func newHTTPTokenStore(c tokenStoreConfig, client *http.Client) (*httpTokenStore, error) {
+	resp, err := client.Get(c.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch authorizations from the token store")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token store %s returned status %s", c.URL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read authorizations from the token store")
+	}
+	var auths []authorization
+	err = yaml.Unmarshal(body, &auths)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse authorizations from the token store")
+	}
+	err = validateAuthorizations(auths)
+	if err != nil {
+		return nil, err
+	}
+	return &httpTokenStore{*newFileTokenStore(auths)}, nil
+}
+
+// validateAuthorizations validates each of auths and checks that no
+// client token is used twice
+func validateAuthorizations(auths []authorization) error {
+	var invalid authValidationErrors
+	for i, auth := range auths {
+		err := validateAuth(auth)
+		if err != nil {
+			invalid = append(invalid, errors.Wrapf(err, "error validating auth %d", i))
+		}
+	}
+	if len(invalid) > 0 {
+		return invalid
+	}
+	return findDuplicateClientToken(auths)
+}
+
+// authValidationErrors reports every invalid authorization of a
+// configuration at once, so that they can all be fixed before the
+// next load
+type authValidationErrors []error
+
+func (errs authValidationErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d invalid authorizations:\n%s", len(errs), strings.Join(msgs, "\n"))
+}
+
+// Unwrap lets errors.Is and errors.As match any of the errors
+func (errs authValidationErrors) Unwrap() []error {
+	return errs
+}
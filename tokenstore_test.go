@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPTokenStore(t *testing.T) {
+	const (
+		aliceToken = "3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4"
+		bobToken   = "9f8e7d6c5b4a3928170f6e5d43b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a1"
+	)
+	var (
+		mu    sync.Mutex
+		auths string
+	)
+	setAuths := func(token, user string) {
+		mu.Lock()
+		defer mu.Unlock()
+		auths = fmt.Sprintf(`[{"client_token":%q,"user":%q,"key":"fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu","signer":"extensions-ecdsa"}]`, token, user)
+	}
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if auths == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(auths))
+	}))
+	defer store.Close()
+
+	origConf, origCfgFile := currentConf(), cfgFile
+	defer func() {
+		setConf(origConf)
+		cfgFile = origCfgFile
+	}()
+	cfgFile = t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(cfgFile, []byte(fmt.Sprintf("autograph_base_url: http://localhost:8000/\ntoken_store:\n    url: %s\n", store.URL)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setAuths(aliceToken, "alice")
+	if _, err := reloadConf(); err != nil {
+		t.Fatalf("reloadConf() with a token store returned error: %v", err)
+	}
+	auth, err := authorize(aliceToken)
+	if err != nil || auth.User != "alice" {
+		t.Fatalf("authorize() returned %+v, %v expected alice", auth, err)
+	}
+
+	// the token store is fetched again on reload
+	setAuths(bobToken, "bob")
+	if _, err := reloadConf(); err != nil {
+		t.Fatalf("reloadConf() with a token store returned error: %v", err)
+	}
+	if _, err := authorize(aliceToken); err != errInvalidToken {
+		t.Fatalf("authorize() of a removed token returned error %v expected %v", err, errInvalidToken)
+	}
+	if auth, err := authorize(bobToken); err != nil || auth.User != "bob" {
+		t.Fatalf("authorize() returned %+v, %v expected bob", auth, err)
+	}
+
+	// a failing or invalid token store keeps the previous authorizations
+	setAuths("tooshort", "mallory")
+	if _, err := reloadConf(); err == nil {
+		t.Fatal("reloadConf() with invalid authorizations returned no error")
+	}
+	mu.Lock()
+	auths = ""
+	mu.Unlock()
+	if _, err := reloadConf(); err == nil {
+		t.Fatal("reloadConf() with a failing token store returned no error")
+	}
+	if auth, err := authorize(bobToken); err != nil || auth.User != "bob" {
+		t.Fatalf("authorize() after a failed reload returned %+v, %v expected bob", auth, err)
+	}
+}
+
+func TestHTTPTokenStoreDuplicateTokens(t *testing.T) {
+	auth := `{"client_token":"3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4","user":"alice","key":"fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu","signer":"extensions-ecdsa"}`
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[" + auth + "," + auth + "]"))
+	}))
+	defer store.Close()
+
+	_, err := newHTTPTokenStore(tokenStoreConfig{URL: store.URL}, store.Client())
+	if err == nil || !strings.Contains(err.Error(), "duplicate client token") {
+		t.Fatalf("newHTTPTokenStore() with duplicate tokens returned error %v", err)
+	}
+}
+
+func Test_loadAndValidateConfTokenStoreAndAuthorizations(t *testing.T) {
+	path := t.TempDir() + "/autograph-edge.yaml"
+	err := ioutil.WriteFile(path, []byte(`autograph_base_url: http://localhost:8000/
+token_store:
+    url: http://localhost:9999/authorizations
+authorizations:
+    - client_token: 3b1a6d0e7f5c4a3b2e1d0c9b8a7f6e5d4c3b2a19f8e7d6c5b4a3928170f6e5d4
+      user: bob
+      key: fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu
+      signer: extensions-ecdsa
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAndValidateConf(path, ""); err == nil {
+		t.Fatal("loadAndValidateConf() with both a token store and authorizations returned no error")
+	}
+}
+
+// BenchmarkFileTokenStoreLookup compares looking up the last of
+// hundreds of plaintext tokens in the index of the store to the
+// constant time comparison of every token it replaced
+func BenchmarkFileTokenStoreLookup(b *testing.B) {
+	auths := make([]authorization, 500)
+	for i := range auths {
+		auths[i] = authorization{ClientToken: fmt.Sprintf("%064x", i), User: "alice", Signer: "extensions-ecdsa"}
+	}
+	token := auths[len(auths)-1].ClientToken
+	store := newFileTokenStore(auths)
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.Lookup(token); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			found := false
+			for _, auth := range auths {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(auth.ClientToken)) == 1 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				b.Fatal("token not found")
+			}
+		}
+	})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errTokenExpired = errors.New("token is outside of its validity period")
+
+// checkValidity returns errTokenExpired when now is before the
+// ValidFrom or after the ValidUntil of auth. Tokens without them are
+// always valid.
+func (auth authorization) checkValidity(now time.Time) error {
+	if !auth.ValidFrom.IsZero() && now.Before(auth.ValidFrom) {
+		return errors.Wrapf(errTokenExpired, "token is valid from %s", auth.ValidFrom.UTC().Format(time.RFC3339))
+	}
+	if !auth.ValidUntil.IsZero() && now.After(auth.ValidUntil) {
+		return errors.Wrapf(errTokenExpired, "token was valid until %s", auth.ValidUntil.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
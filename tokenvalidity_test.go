@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerTokenValidity(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name           string
+		validFrom      time.Time
+		validUntil     time.Time
+		expectedStatus int
+	}{
+		{"before the window", now.Add(time.Hour), now.Add(2 * time.Hour), http.StatusUnauthorized},
+		{"in the window", now.Add(-time.Hour), now.Add(time.Hour), http.StatusCreated},
+		{"after the window", now.Add(-2 * time.Hour), now.Add(-time.Hour), http.StatusUnauthorized},
+		{"only valid until", time.Time{}, now.Add(time.Hour), http.StatusCreated},
+		{"no window", time.Time{}, time.Time{}, http.StatusCreated},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testConf := currentConf()
+			testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+			testConf.Authorizations[2].ValidFrom = tt.validFrom
+			testConf.Authorizations[2].ValidUntil = tt.validUntil
+			useTestConf(t, testConf)
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned")))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned %d %s expected %d", w.Code, w.Body.String(), tt.expectedStatus)
+			}
+			if tt.expectedStatus == http.StatusUnauthorized && !strings.Contains(w.Body.String(), `"code":"token_expired"`) {
+				t.Fatalf("returned %s expected the token_expired code", w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_checkAuthFieldsValidity(t *testing.T) {
+	auth := currentConf().Authorizations[2]
+	auth.ValidFrom = time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	auth.ValidUntil = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if field, err := checkAuthFields(auth); field != "valid_until" {
+		t.Fatalf("checkAuthFields() of a window ending before it starts failed on %q: %v", field, err)
+	}
+	auth.ValidUntil = time.Time{}
+	if field, err := checkAuthFields(auth); err != nil {
+		t.Fatalf("checkAuthFields() of a token only valid from a time failed on %q: %v", field, err)
+	}
+}
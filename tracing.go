@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/mozilla-services/autograph-edge"
+	defaultServiceName = "autograph-edge"
+)
+
+// tracingConfig configures the export of OpenTelemetry traces of the
+// signing requests. Tracing is disabled when no endpoint is set.
+type tracingConfig struct {
+	// Endpoint is the URL of the OTLP/HTTP traces collector,
+	// for example https://api.honeycomb.io/v1/traces
+	Endpoint string `yaml:"endpoint"`
+
+	// ServiceName is the service.name of the exported spans.
+	// Defaults to autograph-edge.
+	ServiceName string `yaml:"service_name"`
+
+	// Headers are sent with the exported spans, for example
+	// the x-honeycomb-team API key
+	Headers map[string]string `yaml:"headers"`
+}
+
+func (tc tracingConfig) enabled() bool {
+	return tc.Endpoint != ""
+}
+
+func (tc tracingConfig) validate() error {
+	u, err := url.Parse(tc.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid tracing endpoint %q: %v", tc.Endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tracing endpoint %q is not an http or https URL", tc.Endpoint)
+	}
+	return nil
+}
+
+// initTracing installs the global tracer provider exporting spans to
+// the configured endpoint, and the W3C trace context propagator. When
+// tracing is not enabled the default no-op provider and propagator
+// are kept. The returned function flushes the pending spans.
+func initTracing(tc tracingConfig) (shutdown func(context.Context) error, err error) {
+	if !tc.enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(tc.Endpoint),
+		otlptracehttp.WithHeaders(tc.Headers),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the tracing exporter: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tc.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// tracer returns the tracer of the edge spans. It is looked up on every
+// use so it follows the global provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// useSpanRecorder installs a tracer provider recording the spans
+// and the W3C trace context propagator for the duration of test t
+func useSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		// the globals delegate to the first provider and propagator
+		// set, so restore the no-op ones rather than the originals
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestSigHandlerTracing(t *testing.T) {
+	recorder := useSpanRecorder(t)
+	auth := currentConf().Authorizations[2]
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		traceparent := req.Header.Get("traceparent")
+		if !strings.HasPrefix(traceparent, "00-"+traceID+"-") {
+			t.Errorf("autograph request has traceparent %q expected the client trace %s", traceparent, traceID)
+		}
+		return newSignedFileResponse([]byte("signed")), nil
+	})
+
+	req := newMultipartSignRequest(t, auth.ClientToken, []byte("unsigned"))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusCreated)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %s has trace ID %s expected %s", span.Name(), span.SpanContext().TraceID(), traceID)
+		}
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"sign", "authorize", "read_input", "autograph"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("no %s span was recorded", name)
+		}
+		if name != "sign" && span.Parent().SpanID() != spans["sign"].SpanContext().SpanID() {
+			t.Errorf("span %s is not a child of the sign span", name)
+		}
+	}
+	if signer, _ := spanAttribute(spans["autograph"], "signer"); signer.AsString() != auth.Signer {
+		t.Errorf("autograph span has signer %q expected %q", signer.AsString(), auth.Signer)
+	}
+	if status, _ := spanAttribute(spans["autograph"], "upstream_status"); status.AsInt64() != http.StatusCreated {
+		t.Errorf("autograph span has upstream status %d expected %d", status.AsInt64(), http.StatusCreated)
+	}
+	if status, _ := spanAttribute(spans["sign"], "http.status_code"); status.AsInt64() != http.StatusCreated {
+		t.Errorf("sign span has status %d expected %d", status.AsInt64(), http.StatusCreated)
+	}
+}
+
+func TestSigHandlerTracingDisabled(t *testing.T) {
+	auth := currentConf().Authorizations[2]
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		if traceparent := req.Header.Get("traceparent"); traceparent != "" {
+			t.Errorf("autograph request has traceparent %q without tracing enabled", traceparent)
+		}
+		return newSignedFileResponse([]byte("signed")), nil
+	})
+
+	req := newMultipartSignRequest(t, auth.ClientToken, []byte("unsigned"))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusCreated)
+	}
+}
+
+func Test_initTracingDisabled(t *testing.T) {
+	origProvider := otel.GetTracerProvider()
+	shutdown, err := initTracing(tracingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otel.GetTracerProvider() != origProvider {
+		t.Fatal("initTracing() without an endpoint replaced the tracer provider")
+	}
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_tracingConfigValidate(t *testing.T) {
+	testcases := []struct {
+		endpoint string
+		valid    bool
+	}{
+		{"https://api.honeycomb.io/v1/traces", true},
+		{"http://otel-collector:4318/v1/traces", true},
+		{"otel-collector:4318", false},
+		{"https://", false},
+	}
+	for _, testcase := range testcases {
+		err := tracingConfig{Endpoint: testcase.endpoint}.validate()
+		if (err == nil) != testcase.valid {
+			t.Errorf("validate() of endpoint %q returned %v expected valid %t", testcase.endpoint, err, testcase.valid)
+		}
+	}
+}
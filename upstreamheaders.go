@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultUpstreamUserAgent names the edge version and instance in
+	// the logs of autograph
+	defaultUpstreamUserAgent = "autograph-edge/{version} ({instance})"
+
+	defaultUpstreamClientHeader = "X-Edge-Client"
+)
+
+// contextKeyEdgeClient is the identifier of the client IP sent to
+// autograph in a context
+var contextKeyEdgeClient = contextKey{name: "edgeClient"}
+
+// upstreamHeadersConfig sets the headers attributing the signing
+// requests to autograph to the edge instance and the original client.
+// The client tokens are never sent in them.
+type upstreamHeadersConfig struct {
+	// UserAgent is the User-Agent of the signing requests, where
+	// {version} is replaced by the edge version and {instance} by
+	// Instance. Defaults to autograph-edge/{version} ({instance}).
+	UserAgent string `yaml:"user_agent"`
+
+	// Instance names the edge instance in the user agent. Defaults to
+	// the hostname.
+	Instance string `yaml:"instance"`
+
+	// ClientHeader carries the IP of the client, found with the trusted
+	// proxies. Defaults to X-Edge-Client.
+	ClientHeader string `yaml:"client_header"`
+}
+
+func (hc upstreamHeadersConfig) validate() error {
+	for _, value := range []string{hc.UserAgent, hc.Instance} {
+		if strings.IndexFunc(value, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+			return fmt.Errorf("upstream header value %q contains control characters", value)
+		}
+	}
+	name := http.CanonicalHeaderKey(hc.ClientHeader)
+	if !isHeaderName(name) || stringInSlice(name, upstreamRequestHeaders) {
+		return fmt.Errorf("invalid upstream client header %q", hc.ClientHeader)
+	}
+	return nil
+}
+
+// edgeVersion returns the version of version.json, or unknown
+var edgeVersion = sync.OnceValue(func() string {
+	var version struct {
+		Version string `json:"version"`
+	}
+	if json.Unmarshal(jsonVersion, &version) != nil || version.Version == "" {
+		return "unknown"
+	}
+	return version.Version
+})
+
+// defaultInstance returns the hostname naming the edge instance
+func defaultInstance() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "unknown"
+	}
+	return hostname
+}
+
+// userAgent returns the User-Agent of the signing requests
+func (hc upstreamHeadersConfig) userAgent() string {
+	return strings.NewReplacer("{version}", edgeVersion(), "{instance}", hc.Instance).Replace(hc.UserAgent)
+}
+
+// forwardedFor returns the X-Forwarded-For of the signing request to
+// autograph for r: the valid IP addresses of the X-Forwarded-For
+// received, followed by the connecting address. Anything else the
+// client put in the header is dropped.
+func forwardedFor(r *http.Request) string {
+	var chain []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if ip := net.ParseIP(strings.TrimSpace(addr)); ip != nil {
+				chain = append(chain, ip.String())
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		chain = append(chain, ip.String())
+	}
+	return strings.Join(chain, ", ")
+}
+
+// withEdgeClient returns r with the IP of its client in its context,
+// to be sent to autograph in the client header
+func withEdgeClient(r *http.Request) *http.Request {
+	ip, err := clientIP(r)
+	if err != nil {
+		return r
+	}
+	return addToContext(r, contextKeyEdgeClient, ip.String())
+}
+
+// setUpstreamHeaders sets the user agent and the client header of ctx
+// on req
+func setUpstreamHeaders(ctx context.Context, req *http.Request) {
+	hc := currentConf().UpstreamHeaders
+	req.Header.Set("User-Agent", hc.userAgent())
+	if client, ok := ctx.Value(contextKeyEdgeClient).(string); ok && hc.ClientHeader != "" {
+		req.Header.Set(hc.ClientHeader, client)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerUpstreamHeaders(t *testing.T) {
+	c := currentConf()
+	c.TrustedProxies = 1
+	c.UpstreamHeaders = upstreamHeadersConfig{
+		UserAgent:    "edge/{version} on {instance}",
+		Instance:     "edge-1",
+		ClientHeader: "X-Original-Client",
+	}
+	useTestConf(t, c)
+
+	token := c.Authorizations[2].ClientToken
+	var upstream http.Header
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		upstream = req.Header.Clone()
+		return newSignedFileResponse([]byte("signed")), nil
+	})
+	req := newMultipartSignRequest(t, token, []byte("unsigned"))
+	req.RemoteAddr = "192.0.2.1:4321"
+	req.Header.Set("X-Forwarded-For", "not-an-ip, "+token+", 203.0.113.7")
+	w := httptest.NewRecorder()
+	sigHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+	}
+
+	expected := map[string]string{
+		"User-Agent":        "edge/" + edgeVersion() + " on edge-1",
+		"X-Forwarded-For":   "203.0.113.7, 192.0.2.1",
+		"X-Original-Client": "203.0.113.7",
+	}
+	for name, value := range expected {
+		if got := upstream.Get(name); got != value {
+			t.Errorf("upstream request has %s %q expected %q", name, got, value)
+		}
+	}
+	for name, values := range upstream {
+		for _, value := range values {
+			if strings.Contains(value, token) {
+				t.Errorf("upstream request header %s leaks the client token", name)
+			}
+		}
+	}
+}
+
+func Test_upstreamHeadersConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		hc      upstreamHeadersConfig
+		wantErr bool
+	}{
+		{"defaults", upstreamHeadersConfig{UserAgent: defaultUpstreamUserAgent, Instance: "edge-1", ClientHeader: defaultUpstreamClientHeader}, false},
+		{"control characters", upstreamHeadersConfig{UserAgent: "edge\r\nX-Injected: 1", ClientHeader: defaultUpstreamClientHeader}, true},
+		{"invalid client header", upstreamHeadersConfig{ClientHeader: "X Client"}, true},
+		{"client header set by the edge", upstreamHeadersConfig{ClientHeader: "authorization"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.hc.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
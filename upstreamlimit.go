@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var errUpstreamQueueFull = errors.New("upstream queue is full")
+
+var upstreamQueueLength = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "autograph_edge_upstream_queue_length",
+		Help: "Number of signing requests waiting for a slot to call autograph by user and signer of their token.",
+	},
+	[]string{"user", "signer"},
+)
+
+// upstreamQueueConfig bounds the signing requests waiting for one of
+// the max concurrent upstream slots
+type upstreamQueueConfig struct {
+	// MaxWait is how long a request waits for a slot before failing
+	// with a 503. Zero, the default, waits until the request timeout.
+	MaxWait time.Duration `yaml:"max_wait"`
+
+	// MaxLength is the maximum number of waiting requests, over which
+	// requests fail with a 503 at once. Zero, the default, is unlimited.
+	MaxLength int `yaml:"max_length"`
+
+	// PriorityAging raises the priority of a waiting request by one
+	// each time it has waited this long, so that the low priority
+	// requests are not starved. Defaults to 5s.
+	PriorityAging time.Duration `yaml:"priority_aging"`
+}
+
+func (qc upstreamQueueConfig) validate() error {
+	if qc.MaxWait < 0 || qc.MaxLength < 0 || qc.PriorityAging < 0 {
+		return fmt.Errorf("upstream queue settings %+v cannot be negative", qc)
+	}
+	return nil
+}
+
+// upstreamQueueKey identifies the token of a waiting request, which
+// the slots are shared fairly between, and the priority of the request
+type upstreamQueueKey struct {
+	// token is the client token or its hash
+	token    string
+	user     string
+	signer   string
+	priority upstreamPriority
+}
+
+func upstreamQueueKeyOf(auth authorization, priority upstreamPriority) upstreamQueueKey {
+	token := auth.ClientToken
+	if token == "" {
+		token = auth.ClientTokenHash
+	}
+	return upstreamQueueKey{token: token, user: auth.User, signer: auth.Signer, priority: priority}
+}
+
+// upstreamLimiter bounds the number of signing requests in flight to
+// autograph. The heartbeat calls don't go through it. Requests waiting
+// for a slot get the freed slots by priority, raised as they wait, and
+// are queued per token within a priority to get them round-robin
+// between the tokens, so that a busy token cannot starve the others.
+type upstreamLimiter struct {
+	sync.Mutex
+	pool *upstreamPool
+}
+
+// upstreamPool is the slots of a limit, guarded by the limiter mutex
+type upstreamPool struct {
+	limit   int
+	inUse   int
+	waiting int
+	// aging is the priority aging of the latest request
+	aging time.Duration
+	// levels queue the waiting requests of each priority
+	levels [upstreamPriorities]upstreamQueue
+}
+
+// upstreamQueue is the waiting requests of a priority by token
+type upstreamQueue struct {
+	queues map[string][]*upstreamWaiter
+	// tokens have waiting requests, in the order they get a slot
+	tokens []string
+}
+
+// upstreamWaiter is a queued request, whose ready channel is closed
+// when it is handed a slot
+type upstreamWaiter struct {
+	ready    chan struct{}
+	token    string
+	enqueued time.Time
+	// requested is the priority of the request and priority the one it
+	// was raised to while waiting
+	requested upstreamPriority
+	priority  upstreamPriority
+}
+
+var upstreamSlots = &upstreamLimiter{}
+
+// acquire waits for one of limit slots to call autograph, or for ctx to
+// be done or the max wait of q to pass. The returned release function
+// must be called once the call completes. A limit of zero or less never
+// waits.
+//
+// When a reload changes the limit, new requests get slots from a new
+// pool while those in flight release theirs to the old one.
+func (l *upstreamLimiter) acquire(ctx context.Context, limit int, q upstreamQueueConfig, key upstreamQueueKey) (release func(), err error) {
+	if limit <= 0 {
+		upstreamSlotsInUse.Inc()
+		return upstreamSlotsInUse.Dec, nil
+	}
+	l.Lock()
+	if l.pool == nil || l.pool.limit != limit {
+		l.pool = &upstreamPool{limit: limit}
+	}
+	pool := l.pool
+	pool.aging = q.PriorityAging
+	release = func() { l.release(pool) }
+	if pool.inUse < pool.limit && pool.waiting == 0 {
+		pool.inUse++
+		upstreamSlotsInUse.Inc()
+		l.Unlock()
+		return release, nil
+	}
+	if q.MaxLength > 0 && pool.waiting >= q.MaxLength {
+		l.Unlock()
+		return nil, errUpstreamQueueFull
+	}
+	w := &upstreamWaiter{
+		ready:     make(chan struct{}),
+		token:     key.token,
+		enqueued:  time.Now(),
+		requested: key.priority,
+		priority:  key.priority,
+	}
+	pool.enqueue(w)
+	l.Unlock()
+
+	upstreamQueueDepth.Inc()
+	defer upstreamQueueDepth.Dec()
+	queueLength := upstreamQueueLength.WithLabelValues(key.user, key.signer)
+	queueLength.Inc()
+	defer queueLength.Dec()
+	if q.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.MaxWait)
+		defer cancel()
+	}
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+	l.Lock()
+	removed := pool.remove(w)
+	l.Unlock()
+	if !removed {
+		// the slot was handed over as ctx was done
+		release()
+	}
+	return nil, ctx.Err()
+}
+
+// release hands the slot to the next waiting request of pool, which
+// keeps it in use, or frees it
+func (l *upstreamLimiter) release(pool *upstreamPool) {
+	l.Lock()
+	defer l.Unlock()
+	if w := pool.dequeue(); w != nil {
+		close(w.ready)
+		return
+	}
+	pool.inUse--
+	upstreamSlotsInUse.Dec()
+}
+
+func (p *upstreamPool) enqueue(w *upstreamWaiter) {
+	// raise the requests that waited long enough first, so that they
+	// keep their place ahead of w
+	p.age(w.enqueued)
+	p.levels[w.priority].push(w)
+	p.waiting++
+}
+
+// dequeue returns the next waiting request of the highest priority
+// with any, or nil
+func (p *upstreamPool) dequeue() *upstreamWaiter {
+	p.age(time.Now())
+	for priority := priorityHigh; priority >= priorityLow; priority-- {
+		if w := p.levels[priority].pop(); w != nil {
+			p.waiting--
+			return w
+		}
+	}
+	return nil
+}
+
+// remove drops w from its queue and returns whether it was still waiting
+func (p *upstreamPool) remove(w *upstreamWaiter) bool {
+	if !p.levels[w.priority].remove(w) {
+		return false
+	}
+	p.waiting--
+	return true
+}
+
+// age raises the waiting requests by one priority for each aging
+// period they have waited at now, up to the highest priority
+func (p *upstreamPool) age(now time.Time) {
+	if p.aging <= 0 {
+		return
+	}
+	agedPriority := func(w *upstreamWaiter) upstreamPriority {
+		priority := w.requested + upstreamPriority(now.Sub(w.enqueued)/p.aging)
+		if priority > priorityHigh {
+			return priorityHigh
+		}
+		return priority
+	}
+	for priority := priorityHigh - 1; priority >= priorityLow; priority-- {
+		for _, w := range p.levels[priority].take(func(w *upstreamWaiter) bool { return agedPriority(w) > w.priority }) {
+			w.priority = agedPriority(w)
+			p.levels[w.priority].push(w)
+		}
+	}
+}
+
+func (q *upstreamQueue) push(w *upstreamWaiter) {
+	if q.queues == nil {
+		q.queues = make(map[string][]*upstreamWaiter)
+	}
+	if len(q.queues[w.token]) == 0 {
+		q.tokens = append(q.tokens, w.token)
+	}
+	q.queues[w.token] = append(q.queues[w.token], w)
+}
+
+// pop returns the oldest waiting request of the next token, which goes
+// to the back of the round if it has more, or nil
+func (q *upstreamQueue) pop() *upstreamWaiter {
+	if len(q.tokens) == 0 {
+		return nil
+	}
+	token := q.tokens[0]
+	q.tokens = q.tokens[1:]
+	queue := q.queues[token]
+	w := queue[0]
+	if len(queue) > 1 {
+		q.queues[token] = queue[1:]
+		q.tokens = append(q.tokens, token)
+	} else {
+		delete(q.queues, token)
+	}
+	return w
+}
+
+// remove drops w from the queue of its token and returns whether it
+// was still waiting
+func (q *upstreamQueue) remove(w *upstreamWaiter) bool {
+	removed := q.take(func(queued *upstreamWaiter) bool { return queued == w })
+	return len(removed) > 0
+}
+
+// take drops the waiting requests matching from the queue and returns
+// them in the order of the tokens round, oldest first for each token
+func (q *upstreamQueue) take(matching func(*upstreamWaiter) bool) (taken []*upstreamWaiter) {
+	tokens := q.tokens[:0]
+	for _, token := range q.tokens {
+		var kept []*upstreamWaiter
+		for _, w := range q.queues[token] {
+			if matching(w) {
+				taken = append(taken, w)
+			} else {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) == 0 {
+			delete(q.queues, token)
+			continue
+		}
+		q.queues[token] = kept
+		tokens = append(tokens, token)
+	}
+	q.tokens = tokens
+	return taken
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func useTestUpstreamLimiter(t *testing.T) *upstreamLimiter {
+	origSlots := upstreamSlots
+	upstreamSlots = &upstreamLimiter{}
+	t.Cleanup(func() { upstreamSlots = origSlots })
+	return upstreamSlots
+}
+
+func Test_upstreamLimiterUnlimited(t *testing.T) {
+	l := &upstreamLimiter{}
+	for i := 0; i < 10; i++ {
+		if _, err := l.acquire(context.Background(), 0, upstreamQueueConfig{}, upstreamQueueKey{}); err != nil {
+			t.Fatalf("acquire %d without a limit returned error: %v", i, err)
+		}
+	}
+}
+
+func Test_upstreamLimiterTimeout(t *testing.T) {
+	l := &upstreamLimiter{}
+	release, err := l.acquire(context.Background(), 1, upstreamQueueConfig{}, upstreamQueueKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, 1, upstreamQueueConfig{}, upstreamQueueKey{})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("acquire over the limit returned %v expected %v", err, context.DeadlineExceeded)
+	}
+	release()
+	release, err = l.acquire(context.Background(), 1, upstreamQueueConfig{}, upstreamQueueKey{})
+	if err != nil {
+		t.Fatalf("acquire of a released slot returned error: %v", err)
+	}
+	release()
+}
+
+func TestSigHandlerMaxConcurrentUpstream(t *testing.T) {
+	useTestUpstreamLimiter(t)
+	c := currentConf()
+	c.MaxConcurrentUpstream = 2
+	useTestConf(t, c)
+
+	var inFlight, maxInFlight int32
+	var busy, queued sync.Map
+	busyBefore := testutil.ToFloat64(upstreamSlotsInUse)
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		busy.Store(testutil.ToFloat64(upstreamSlotsInUse)-busyBefore, true)
+		queued.Store(testutil.ToFloat64(upstreamQueueDepth), true)
+		time.Sleep(20 * time.Millisecond)
+		return newSignedFileResponse([]byte("signed")), nil
+	}).Times(8)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 8)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequest(t, c.Authorizations[2].ClientToken, []byte("unsigned")))
+			statuses[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusCreated {
+			t.Errorf("request %d returned unexpected status %v expected %v", i, status, http.StatusCreated)
+		}
+	}
+	if maxInFlight > 2 {
+		t.Fatalf("%d concurrent calls to autograph exceeded the limit of 2", maxInFlight)
+	}
+	if depth := testutil.ToFloat64(upstreamQueueDepth); depth != 0 {
+		t.Fatalf("upstream queue depth is %v after all requests completed", depth)
+	}
+	busy.Range(func(n, _ interface{}) bool {
+		if n.(float64) < 1 || n.(float64) > 2 {
+			t.Errorf("reported %v slots in use of 2 during a call", n)
+		}
+		return true
+	})
+	if _, ok := busy.Load(float64(2)); !ok {
+		t.Error("never reported the 2 slots in use under load")
+	}
+	sawQueue := false
+	queued.Range(func(n, _ interface{}) bool {
+		sawQueue = sawQueue || n.(float64) > 0
+		return true
+	})
+	if !sawQueue {
+		t.Error("never reported waiting requests under load")
+	}
+	if got := testutil.ToFloat64(upstreamSlotsInUse) - busyBefore; got != 0 {
+		t.Fatalf("reported %v slots in use after all requests completed", got)
+	}
+	if slots := testutil.ToFloat64(upstreamSlotsLimit); slots != 2 {
+		t.Fatalf("reported %v upstream slots expected 2", slots)
+	}
+}
+
+func TestUpstreamSlotsLimitReload(t *testing.T) {
+	l := useTestUpstreamLimiter(t)
+	c := currentConf()
+	for _, limit := range []int{3, 0, 3} {
+		c.MaxConcurrentUpstream = limit
+		useTestConf(t, c)
+		if slots := testutil.ToFloat64(upstreamSlotsLimit); slots != float64(limit) {
+			t.Fatalf("reported %v upstream slots after a reload to %d", slots, limit)
+		}
+		release, err := l.acquire(context.Background(), limit, upstreamQueueConfig{}, upstreamQueueKey{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if slots := testutil.ToFloat64(upstreamSlotsLimit); slots != float64(limit) {
+			t.Fatalf("reported %v upstream slots after a request at the limit of %d", slots, limit)
+		}
+	}
+}
+
+func TestSigHandlerUpstreamBusy(t *testing.T) {
+	l := useTestUpstreamLimiter(t)
+	c := currentConf()
+	c.MaxConcurrentUpstream = 1
+	c.RequestTimeout = 50 * time.Millisecond
+	useTestConf(t, c)
+	useMockAutographClient(t)
+
+	// hold the only slot, as a long-running signature would
+	release, err := l.acquire(context.Background(), 1, upstreamQueueConfig{}, upstreamQueueKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, c.Authorizations[2].ClientToken, []byte("unsigned")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusServiceUnavailable)
+	}
+	var resp errorResponse
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != "upstream_busy" {
+		t.Fatalf("returned unexpected code %q expected upstream_busy", resp.Code)
+	}
+}
+
+func Test_upstreamLimiterFairness(t *testing.T) {
+	l := &upstreamLimiter{}
+	release, err := l.acquire(context.Background(), 1, upstreamQueueConfig{}, upstreamQueueKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queue four requests of token a, then two of token b
+	granted := make(chan string, 6)
+	releases := make(chan func(), 6)
+	queue := func(token string, waiting int) {
+		go func() {
+			release, err := l.acquire(context.Background(), 1, upstreamQueueConfig{}, upstreamQueueKey{token: token, user: "alice", signer: token})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			granted <- token
+			releases <- release
+		}()
+		for testutil.ToFloat64(upstreamQueueDepth) < float64(waiting) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		queue("a", i)
+	}
+	queue("b", 5)
+	queue("b", 6)
+	if length := testutil.ToFloat64(upstreamQueueLength.WithLabelValues("alice", "a")); length != 4 {
+		t.Fatalf("queue length of token a is %v expected 4", length)
+	}
+
+	var order string
+	for i := 0; i < 6; i++ {
+		release()
+		select {
+		case token := <-granted:
+			order += token
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no waiting request was granted the released slot after %q", order)
+		}
+		release = <-releases
+	}
+	release()
+	if order != "ababaa" {
+		t.Fatalf("granted the slot in order %q expected ababaa", order)
+	}
+}
+
+func Test_upstreamLimiterQueueBounds(t *testing.T) {
+	l := &upstreamLimiter{}
+	q := upstreamQueueConfig{MaxWait: 20 * time.Millisecond, MaxLength: 1}
+	release, err := l.acquire(context.Background(), 1, q, upstreamQueueKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(context.Background(), 1, q, upstreamQueueKey{token: "a"})
+		waited <- err
+	}()
+	for testutil.ToFloat64(upstreamQueueDepth) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.acquire(context.Background(), 1, q, upstreamQueueKey{token: "b"}); err != errUpstreamQueueFull {
+		t.Fatalf("acquire with a full queue returned %v expected %v", err, errUpstreamQueueFull)
+	}
+	if err := <-waited; err != context.DeadlineExceeded {
+		t.Fatalf("acquire over the max wait returned %v expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+// queueTestRequests queues a request of each key on l, one after the
+// other, and returns the channel their tokens are sent to as they are
+// granted the slot they release at once
+func queueTestRequests(t *testing.T, l *upstreamLimiter, q upstreamQueueConfig, keys ...upstreamQueueKey) <-chan string {
+	granted := make(chan string, len(keys))
+	waiting := testutil.ToFloat64(upstreamQueueDepth)
+	for _, key := range keys {
+		key := key
+		go func() {
+			release, err := l.acquire(context.Background(), 1, q, key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			granted <- key.token
+			release()
+		}()
+		waiting++
+		for testutil.ToFloat64(upstreamQueueDepth) < waiting {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return granted
+}
+
+// grantedOrder returns the tokens of the n requests granted a slot
+func grantedOrder(t *testing.T, granted <-chan string, n int) (order string) {
+	for i := 0; i < n; i++ {
+		select {
+		case token := <-granted:
+			order += token
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no waiting request was granted the slot after %q", order)
+		}
+	}
+	return order
+}
+
+func Test_upstreamLimiterPriority(t *testing.T) {
+	l := &upstreamLimiter{}
+	q := upstreamQueueConfig{}
+	release, err := l.acquire(context.Background(), 1, q, upstreamQueueKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := queueTestRequests(t, l, q,
+		upstreamQueueKey{token: "a", priority: priorityLow},
+		upstreamQueueKey{token: "b", priority: priorityNormal},
+		upstreamQueueKey{token: "c", priority: priorityHigh},
+		upstreamQueueKey{token: "d", priority: priorityNormal},
+		upstreamQueueKey{token: "e", priority: priorityHigh},
+	)
+	release()
+	if order := grantedOrder(t, granted, 5); order != "cebda" {
+		t.Fatalf("granted the slot in order %q expected cebda", order)
+	}
+}
+
+func Test_upstreamLimiterPriorityAging(t *testing.T) {
+	l := &upstreamLimiter{}
+	q := upstreamQueueConfig{PriorityAging: 20 * time.Millisecond}
+	release, err := l.acquire(context.Background(), 1, q, upstreamQueueKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the low priority request waits long enough to be raised twice,
+	// ahead of the high priority requests coming after it
+	granted := queueTestRequests(t, l, q, upstreamQueueKey{token: "a", priority: priorityLow})
+	time.Sleep(3 * q.PriorityAging)
+	granted2 := queueTestRequests(t, l, q,
+		upstreamQueueKey{token: "b", priority: priorityHigh},
+		upstreamQueueKey{token: "c", priority: priorityNormal},
+	)
+	release()
+	if order := grantedOrder(t, granted, 1) + grantedOrder(t, granted2, 2); order != "abc" {
+		t.Fatalf("granted the slot in order %q expected abc", order)
+	}
+}
+
+func Test_requestPriority(t *testing.T) {
+	for _, tt := range []struct {
+		header      string
+		maxPriority string
+		expected    upstreamPriority
+	}{
+		{"", "", priorityNormal},
+		{"low", "", priorityLow},
+		{"HIGH", "high", priorityHigh},
+		{"high", "", priorityNormal},
+		{"high", "low", priorityLow},
+		{"", "low", priorityLow},
+		{"urgent", "high", priorityHigh},
+		{"urgent", "", priorityNormal},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/sign", nil)
+		if tt.header != "" {
+			r.Header.Set(priorityHeader, tt.header)
+		}
+		got := requestPriority(r, authorization{MaxPriority: tt.maxPriority})
+		if got != tt.expected {
+			t.Errorf("requestPriority() of %q with max priority %q = %s expected %s", tt.header, tt.maxPriority, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errUpstreamSignerNotAllowed = errors.New("signer of this token is misconfigured")
+
+// allowsUpstreamSigner returns whether requests can be forwarded to
+// the autograph signer id, which is any of them when c has no allowed
+// upstream signers
+func (c configuration) allowsUpstreamSigner(signer string) bool {
+	return len(c.AllowedUpstreamSigners) == 0 || stringInSlice(signer, c.AllowedUpstreamSigners)
+}
+
+// validateAllowedUpstreamSigners checks that the allowed upstream
+// signers are distinct signer ids
+func validateAllowedUpstreamSigners(signers []string) error {
+	for i, signer := range signers {
+		if signer == "" || strings.TrimSpace(signer) != signer {
+			return fmt.Errorf("allowed upstream signer %q is not a signer id", signer)
+		}
+		if stringInSlice(signer, signers[:i]) {
+			return fmt.Errorf("allowed upstream signer %q is listed twice", signer)
+		}
+	}
+	return nil
+}
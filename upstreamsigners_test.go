@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerAllowedUpstreamSigners(t *testing.T) {
+	testConf := currentConf()
+	testConf.AllowedUpstreamSigners = []string{"extensions-ecdsa"}
+	useTestConf(t, testConf)
+
+	t.Run("blocks tokens of other signers", func(t *testing.T) {
+		// no upstream call is expected
+		useMockAutographClient(t)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[2].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "signer_misconfigured") {
+			t.Fatalf("returned %d %s expected a 500 signer_misconfigured", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("forwards allowed signers", func(t *testing.T) {
+		clientMock := useMockAutographClient(t)
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil)
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, testConf.Authorizations[0].ClientToken, []byte("unsigned")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("returned %d %s expected a 201", w.Code, w.Body.String())
+		}
+	})
+
+	if warnings := lintConfig(testConf); len(warnings) != 1 || !strings.Contains(warnings[0], `"testapp-android" is not an allowed upstream signer`) {
+		t.Fatalf("lintConfig() returned %q expected a warning for the testapp-android token", warnings)
+	}
+}
+
+func Test_validateAllowedUpstreamSigners(t *testing.T) {
+	for _, tt := range []struct {
+		signers []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"extensions-ecdsa", "testapp-android"}, false},
+		{[]string{""}, true},
+		{[]string{" extensions-ecdsa"}, true},
+		{[]string{"extensions-ecdsa", "extensions-ecdsa"}, true},
+	} {
+		if err := validateAllowedUpstreamSigners(tt.signers); (err != nil) != tt.wantErr {
+			t.Errorf("validateAllowedUpstreamSigners(%q) error = %v, wantErr %v", tt.signers, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// upstreamTLSConfig configures mutual TLS for the connections to
+// autograph. The client certificate and key are set together, the CA
+// bundle can be set alone to verify autograph with a private CA.
+// CipherSuites and CurvePreferences restrict the TLS 1.2 cipher suites
+// and the key exchanges by their Go names, like
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 and X25519, and keep the Go
+// defaults when unset. SPKIPins are the base64 SHA256 digests of the
+// public keys autograph's certificate chain must contain one of, on top
+// of the CA verification.
+type upstreamTLSConfig struct {
+	ClientCert       string   `yaml:"client_cert"`
+	ClientKey        string   `yaml:"client_key"`
+	CABundle         string   `yaml:"ca_bundle"`
+	CipherSuites     []string `yaml:"cipher_suites"`
+	CurvePreferences []string `yaml:"curve_preferences"`
+	SPKIPins         []string `yaml:"spki_pins"`
+}
+
+// upstreamTLSCurves are the curve_preferences names
+var upstreamTLSCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+func (c upstreamTLSConfig) enabled() bool {
+	return c.ClientCert != "" || c.ClientKey != "" || c.CABundle != "" ||
+		len(c.CipherSuites) > 0 || len(c.CurvePreferences) > 0 || len(c.SPKIPins) > 0
+}
+
+// cipherSuiteIDs returns the IDs of the cipher suites named in
+// CipherSuites. Go's insecure suites are refused.
+func (c upstreamTLSConfig) cipherSuiteIDs() ([]uint16, error) {
+	if len(c.CipherSuites) == 0 {
+		return nil, nil
+	}
+	secure := make(map[string]uint16)
+	var names []string
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+		names = append(names, suite.Name)
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	ids := make([]uint16, 0, len(c.CipherSuites))
+	for _, name := range c.CipherSuites {
+		id, ok := secure[name]
+		switch {
+		case ok:
+			ids = append(ids, id)
+		case insecure[name]:
+			return nil, fmt.Errorf("upstream TLS cipher suite %q is insecure", name)
+		default:
+			return nil, fmt.Errorf("unknown upstream TLS cipher suite %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+	}
+	return ids, nil
+}
+
+// curveIDs returns the IDs of the curves named in CurvePreferences
+func (c upstreamTLSConfig) curveIDs() ([]tls.CurveID, error) {
+	if len(c.CurvePreferences) == 0 {
+		return nil, nil
+	}
+	ids := make([]tls.CurveID, 0, len(c.CurvePreferences))
+	for _, name := range c.CurvePreferences {
+		id, ok := upstreamTLSCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream TLS curve %q, expected one of X25519, P-256, P-384, P-521", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// spkiPins decodes SPKIPins
+func (c upstreamTLSConfig) spkiPins() ([][]byte, error) {
+	pins := make([][]byte, 0, len(c.SPKIPins))
+	for _, pin := range c.SPKIPins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("upstream TLS SPKI pin %q is not a base64 SHA256 digest", pin)
+		}
+		pins = append(pins, digest)
+	}
+	return pins, nil
+}
+
+// verifySPKIPins returns a VerifyPeerCertificate callback failing the
+// handshakes with autograph unless a certificate of its chain has the
+// public key of one of pins. The verified chains include the CA of the
+// bundle, so that pinning the key of a private CA works too. Since the
+// transport keeps no TLS session cache, every handshake is a full one
+// calling it.
+func verifySPKIPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		var certs []*x509.Certificate
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(certs) == 0 {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+		}
+		for _, cert := range certs {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(digest[:], pin) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no certificate of autograph matches the upstream TLS SPKI pins")
+	}
+}
+
+// newTLSConfig loads the certificates of c and resolves its cipher
+// suites, curves and pins
+func (c upstreamTLSConfig) newTLSConfig() (*tls.Config, error) {
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	suites, err := c.cipherSuiteIDs()
+	if err != nil {
+		return nil, err
+	}
+	tlsConf.CipherSuites = suites
+	curves, err := c.curveIDs()
+	if err != nil {
+		return nil, err
+	}
+	tlsConf.CurvePreferences = curves
+	if len(c.SPKIPins) > 0 {
+		pins, err := c.spkiPins()
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.VerifyPeerCertificate = verifySPKIPins(pins)
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return nil, fmt.Errorf("upstream TLS client cert and key must be set together")
+	}
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream TLS client cert %q and key %q: %v", c.ClientCert, c.ClientKey, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	if c.CABundle != "" {
+		bundle, err := ioutil.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream TLS CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("upstream TLS CA bundle %q contains no PEM certificates", c.CABundle)
+		}
+		tlsConf.RootCAs = pool
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key
+// to dir and returns their paths and the certificate
+func writeClientCert(t *testing.T, dir string) (certPath, keyPath string, cert *x509.Certificate) {
+	return writeTestCert(t, dir, "client", x509.ExtKeyUsageClientAuth, 1)
+}
+
+// writeTestCert writes a self-signed certificate for localhost with the
+// usage and serial and its key to dir as name.crt and name.key
+func writeTestCert(t *testing.T, dir, name string, usage x509.ExtKeyUsage, serial int64) (certPath, keyPath string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "autograph-edge"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, cert
+}
+
+func TestUpstreamTransportMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, clientCert := writeClientCert(t, dir)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	caPath := filepath.Join(dir, "ca.pem")
+	err := ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("client cert is presented", func(t *testing.T) {
+		transport, err := newUpstreamTransport(upstreamTLSConfig{ClientCert: certPath, ClientKey: keyPath, CABundle: caPath}, upstreamConnConfig{})
+		if err != nil {
+			t.Fatalf("newUpstreamTransport() returned error: %v", err)
+		}
+		client := &heartbeatClient{&http.Client{Transport: transport}}
+		resp, err := client.Get(upstream.URL + "/__heartbeat__")
+		if err != nil {
+			t.Fatalf("request with the client cert failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("upstream returned unexpected status %v expected %v", resp.StatusCode, http.StatusOK)
+		}
+	})
+
+	t.Run("request without a client cert is rejected", func(t *testing.T) {
+		transport, err := newUpstreamTransport(upstreamTLSConfig{CABundle: caPath}, upstreamConnConfig{})
+		if err != nil {
+			t.Fatalf("newUpstreamTransport() returned error: %v", err)
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(upstream.URL + "/__heartbeat__")
+		if err == nil {
+			resp.Body.Close()
+			t.Fatal("request without a client cert succeeded")
+		}
+	})
+}
+
+func TestUpstreamTransportSPKIPins(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, clientCert := writeClientCert(t, dir)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	upstream.StartTLS()
+	defer upstream.Close()
+	caPath := filepath.Join(dir, "ca.pem")
+	err := ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := func(cert *x509.Certificate) string {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(digest[:])
+	}
+
+	for _, tt := range []struct {
+		name    string
+		pins    []string
+		allowed bool
+	}{
+		{"pinned certificate", []string{pin(clientCert), pin(upstream.Certificate())}, true},
+		{"non-matching certificate", []string{pin(clientCert)}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := newUpstreamTransport(upstreamTLSConfig{ClientCert: certPath, ClientKey: keyPath, CABundle: caPath, SPKIPins: tt.pins}, upstreamConnConfig{})
+			if err != nil {
+				t.Fatalf("newUpstreamTransport() returned error: %v", err)
+			}
+			resp, err := (&http.Client{Transport: transport}).Get(upstream.URL + "/__heartbeat__")
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tt.allowed && err != nil {
+				t.Fatalf("request to the pinned upstream failed: %v", err)
+			}
+			if !tt.allowed && (err == nil || !strings.Contains(err.Error(), "SPKI pins")) {
+				t.Fatalf("request returned error %v expected a pin mismatch", err)
+			}
+		})
+	}
+}
+
+func Test_newUpstreamTransportErrors(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, _ := writeClientCert(t, dir)
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []upstreamTLSConfig{
+		{ClientCert: certPath},
+		{ClientCert: filepath.Join(dir, "missing.crt"), ClientKey: keyPath},
+		{ClientCert: certPath, ClientKey: filepath.Join(dir, "missing.key")},
+		{CABundle: filepath.Join(dir, "missing.pem")},
+		{CABundle: notPEM},
+		{SPKIPins: []string{"not base64!"}},
+		{SPKIPins: []string{"c2hvcnQ="}},
+	} {
+		if _, err := newUpstreamTransport(c, upstreamConnConfig{}); err == nil {
+			t.Errorf("newUpstreamTransport(%+v) returned no error", c)
+		}
+	}
+}
+
+func Test_upstreamTLSConfigCipherSuites(t *testing.T) {
+	certPath, keyPath, _ := writeClientCert(t, t.TempDir())
+	c := upstreamTLSConfig{
+		ClientCert:       certPath,
+		ClientKey:        keyPath,
+		CipherSuites:     []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		CurvePreferences: []string{"X25519", "P-256"},
+	}
+	tlsConf, err := c.newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConf.CipherSuites) != 2 || tlsConf.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || tlsConf.CipherSuites[1] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("newTLSConfig() set cipher suites %v", tlsConf.CipherSuites)
+	}
+	if len(tlsConf.CurvePreferences) != 2 || tlsConf.CurvePreferences[0] != tls.X25519 || tlsConf.CurvePreferences[1] != tls.CurveP256 {
+		t.Errorf("newTLSConfig() set curve preferences %v", tlsConf.CurvePreferences)
+	}
+	if len(tlsConf.Certificates) != 1 || tlsConf.MinVersion != tls.VersionTLS12 {
+		t.Errorf("newTLSConfig() did not keep the client cert and min version with cipher suites")
+	}
+
+	// unset keeps the defaults of Go
+	tlsConf, err = upstreamTLSConfig{CABundle: ""}.newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConf.CipherSuites != nil || tlsConf.CurvePreferences != nil {
+		t.Errorf("newTLSConfig() without names set cipher suites %v and curves %v", tlsConf.CipherSuites, tlsConf.CurvePreferences)
+	}
+
+	for _, c := range []upstreamTLSConfig{
+		{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_512_GCM_SHA256"}},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CurvePreferences: []string{"P-224"}},
+	} {
+		if !c.enabled() {
+			t.Errorf("enabled() of %+v returned false", c)
+		}
+		if _, err := c.newTLSConfig(); err == nil {
+			t.Errorf("newTLSConfig() of %+v returned no error", c)
+		}
+	}
+}
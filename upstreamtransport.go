@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// upstreamConnConfig tunes the connection pool of the calls to autograph
+type upstreamConnConfig struct {
+	// MaxIdleConns is the maximum number of idle connections kept
+	// open to all the backends. Defaults to 100.
+	MaxIdleConns int `yaml:"max_idle_conns"`
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections
+	// kept open to each backend. Defaults to 16.
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+
+	// IdleConnTimeout is how long an idle connection is kept open.
+	// Defaults to 90s.
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+}
+
+const (
+	defaultUpstreamMaxIdleConns        = 100
+	defaultUpstreamMaxIdleConnsPerHost = 16
+	defaultUpstreamIdleConnTimeout     = 90 * time.Second
+)
+
+// upstreamTransport is shared by the signing and heartbeat clients so
+// both present the client certificate and reuse their connections.
+// It is replaced at startup by newUpstreamTransport.
+var upstreamTransport http.RoundTripper = http.DefaultTransport
+
+// newUpstreamTransport returns the transport of the calls to autograph.
+// HTTP/2 is attempted on TLS connections, which Go doesn't do by default
+// when a TLS config is set, so that calls are multiplexed.
+func newUpstreamTransport(tlsConf upstreamTLSConfig, connConf upstreamConnConfig) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConns = connConf.MaxIdleConns
+	transport.MaxIdleConnsPerHost = connConf.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = connConf.IdleConnTimeout
+	if tlsConf.enabled() {
+		tlsClientConf, err := tlsConf.newTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsClientConf
+	}
+	return transport, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_newUpstreamTransportConnections(t *testing.T) {
+	rt, err := newUpstreamTransport(upstreamTLSConfig{}, upstreamConnConfig{
+		MaxIdleConns:        50,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := rt.(*http.Transport)
+	if transport == http.DefaultTransport {
+		t.Fatal("newUpstreamTransport() returned the shared default transport")
+	}
+	if !transport.ForceAttemptHTTP2 {
+		t.Fatal("newUpstreamTransport() returned a transport not attempting HTTP/2")
+	}
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 8 || transport.IdleConnTimeout != time.Minute {
+		t.Fatalf("newUpstreamTransport() returned pool settings %d, %d, %s expected 50, 8, 1m", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+func TestUpstreamTransportHTTP2(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("upstream received a %s request expected HTTP/2", r.Proto)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// a CA bundle sets a TLS config, which disables HTTP/2 unless forced
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	err := ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := newUpstreamTransport(upstreamTLSConfig{CABundle: caPath}, upstreamConnConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &heartbeatClient{&http.Client{Transport: transport}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(upstream.URL + "/__heartbeat__")
+		if err != nil {
+			t.Fatalf("heartbeat request %d failed: %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("heartbeat request %d used %s expected HTTP/2", i, resp.Proto)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// usageBuckets is the number of buckets a rolling usage window is
+// split into, so that counts leave the window in steps of window/60
+const usageBuckets = 60
+
+// usageKey is what the usage of signing requests is reported by. The
+// client token is not part of it so it can't leak from the report.
+type usageKey struct {
+	User   string
+	Signer string
+}
+
+// usageCounts are the signing requests of a user and signer and their
+// outcome, successful when the edge returned a status below 400
+type usageCounts struct {
+	Requests  int64 `json:"requests"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+}
+
+func (u *usageCounts) add(o usageCounts) {
+	u.Requests += o.Requests
+	u.Succeeded += o.Succeeded
+	u.Failed += o.Failed
+}
+
+// usageBucket counts the requests of the period starting at index times
+// the width of the buckets
+type usageBucket struct {
+	index  int64
+	counts map[usageKey]*usageCounts
+}
+
+// usageTracker counts the signing requests of each user and signer
+// since the process started, or over a rolling window when one is set
+type usageTracker struct {
+	sync.Mutex
+	start  time.Time
+	total  map[usageKey]*usageCounts
+	width  time.Duration
+	recent []usageBucket
+
+	// now returns the current time and can be replaced in tests
+	now func() time.Time
+}
+
+var signerUsage = newUsageTracker()
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		start: time.Now(),
+		total: make(map[usageKey]*usageCounts),
+		now:   time.Now,
+	}
+}
+
+// record counts a signing request of user and signer returning status.
+// Changing window drops the counts of the previous one.
+func (u *usageTracker) record(user, signer string, status int, window time.Duration) {
+	counts := usageCounts{Requests: 1}
+	if status < http.StatusBadRequest {
+		counts.Succeeded = 1
+	} else {
+		counts.Failed = 1
+	}
+	key := usageKey{User: user, Signer: signer}
+
+	u.Lock()
+	defer u.Unlock()
+	addUsage(u.total, key, counts)
+	if window <= 0 {
+		u.width, u.recent = 0, nil
+		return
+	}
+	index := u.prune(window)
+	if n := len(u.recent); n == 0 || u.recent[n-1].index != index {
+		u.recent = append(u.recent, usageBucket{index: index, counts: make(map[usageKey]*usageCounts)})
+	}
+	addUsage(u.recent[len(u.recent)-1].counts, key, counts)
+}
+
+// prune drops the buckets that left window and returns the index of
+// the current bucket. It must be called with the lock held.
+func (u *usageTracker) prune(window time.Duration) int64 {
+	if width := window / usageBuckets; width != u.width {
+		u.width, u.recent = width, nil
+	}
+	if u.width <= 0 {
+		u.width = 1
+	}
+	index := u.now().UnixNano() / int64(u.width)
+	kept := u.recent[:0]
+	for _, bucket := range u.recent {
+		if bucket.index > index-usageBuckets {
+			kept = append(kept, bucket)
+		}
+	}
+	u.recent = kept
+	return index
+}
+
+func addUsage(m map[usageKey]*usageCounts, key usageKey, counts usageCounts) {
+	existing, ok := m[key]
+	if !ok {
+		existing = &usageCounts{}
+		m[key] = existing
+	}
+	existing.add(counts)
+}
+
+// userUsage and signerUsageCounts are the entries of the usage report
+type userUsage struct {
+	User   string `json:"user"`
+	Signer string `json:"signer"`
+	usageCounts
+}
+
+type signerUsageCounts struct {
+	Signer string `json:"signer"`
+	usageCounts
+}
+
+// usageReport is returned by /__usage__
+type usageReport struct {
+	Since   time.Time           `json:"since"`
+	Window  string              `json:"window,omitempty"`
+	Users   []userUsage         `json:"users"`
+	Signers []signerUsageCounts `json:"signers"`
+}
+
+// report returns the counts since the process started, or those of
+// window when it is set, sorted by user and signer
+func (u *usageTracker) report(window time.Duration) usageReport {
+	u.Lock()
+	defer u.Unlock()
+	counts := u.total
+	report := usageReport{Since: u.start.UTC()}
+	if window > 0 {
+		u.prune(window)
+		counts = make(map[usageKey]*usageCounts)
+		for _, bucket := range u.recent {
+			for key, c := range bucket.counts {
+				addUsage(counts, key, *c)
+			}
+		}
+		report.Window = window.String()
+		if since := u.now().Add(-window); since.After(u.start) {
+			report.Since = since.UTC()
+		}
+	}
+
+	bySigner := make(map[string]*usageCounts)
+	report.Users = make([]userUsage, 0, len(counts))
+	for key, c := range counts {
+		report.Users = append(report.Users, userUsage{User: key.User, Signer: key.Signer, usageCounts: *c})
+		if _, ok := bySigner[key.Signer]; !ok {
+			bySigner[key.Signer] = &usageCounts{}
+		}
+		bySigner[key.Signer].add(*c)
+	}
+	sort.Slice(report.Users, func(i, j int) bool {
+		if report.Users[i].User != report.Users[j].User {
+			return report.Users[i].User < report.Users[j].User
+		}
+		return report.Users[i].Signer < report.Users[j].Signer
+	})
+	report.Signers = make([]signerUsageCounts, 0, len(bySigner))
+	for signer, c := range bySigner {
+		report.Signers = append(report.Signers, signerUsageCounts{Signer: signer, usageCounts: *c})
+	}
+	sort.Slice(report.Signers, func(i, j int) bool {
+		return report.Signers[i].Signer < report.Signers[j].Signer
+	})
+	return report
+}
+
+// usageHandler returns the signing requests of each user and signer
+// and of each signer. Requests without the admin token get a 404 like
+// configHandler.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	c := currentConf()
+	if r.Method != http.MethodGet || !isAdmin(r, c.AdminToken) {
+		notFoundHandler(w, r)
+		return
+	}
+	body, err := json.Marshal(signerUsage.report(c.UsageWindow))
+	if err != nil {
+		log.Errorf("failed to marshal usage report: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
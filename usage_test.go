@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestUsageHandler(t *testing.T) {
+	const adminToken = "0a6bf3e5d0c44a1f8e9b7c2d6f5a4e3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f"
+	testConf := currentConf()
+	testConf.AdminToken = adminToken
+	useTestConf(t, testConf)
+	origUsage := signerUsage
+	signerUsage = newUsageTracker()
+	t.Cleanup(func() { signerUsage = origUsage })
+
+	clientMock := useMockAutographClient(t)
+	gomock.InOrder(
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil),
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil),
+		clientMock.EXPECT().Do(gomock.Any()).Return(newAutographResponse(http.StatusBadRequest, "invalid apk"), nil),
+	)
+	apkAuth := testConf.Authorizations[2]
+	for _, token := range []string{testConf.Authorizations[0].ClientToken, apkAuth.ClientToken, apkAuth.ClientToken} {
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, token, []byte("unsigned")))
+	}
+
+	for _, token := range []string{"", apkAuth.ClientToken} {
+		req := httptest.NewRequest("GET", "http://localhost:8080/__usage__", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		usageHandler(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("returned %d without the admin token expected 404", w.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/__usage__", nil)
+	req.Header.Set("Authorization", adminToken)
+	w := httptest.NewRecorder()
+	usageHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("returned unexpected status %d expected 200", w.Code)
+	}
+	for _, auth := range testConf.Authorizations {
+		if strings.Contains(w.Body.String(), auth.ClientToken) {
+			t.Fatalf("usage report contains the client token of user %s signer %s", auth.User, auth.Signer)
+		}
+	}
+	var report usageReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	expectedUsers := []userUsage{
+		{User: "alice", Signer: testConf.Authorizations[0].Signer, usageCounts: usageCounts{Requests: 1, Succeeded: 1}},
+		{User: "alice", Signer: apkAuth.Signer, usageCounts: usageCounts{Requests: 2, Succeeded: 1, Failed: 1}},
+	}
+	if len(report.Users) != len(expectedUsers) {
+		t.Fatalf("reported users %+v expected %+v", report.Users, expectedUsers)
+	}
+	for i, expected := range expectedUsers {
+		if report.Users[i] != expected {
+			t.Errorf("reported %+v expected %+v", report.Users[i], expected)
+		}
+	}
+	if len(report.Signers) != 2 || report.Signers[1].Signer != apkAuth.Signer || report.Signers[1].Requests != 2 {
+		t.Errorf("unexpected signer usage %+v", report.Signers)
+	}
+	if report.Window != "" {
+		t.Errorf("reported window %q without a usage window", report.Window)
+	}
+}
+
+func Test_usageTrackerWindow(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	u := newUsageTracker()
+	u.start = now
+	u.now = func() time.Time { return now }
+
+	u.record("alice", "apk", http.StatusCreated, time.Hour)
+	now = now.Add(40 * time.Minute)
+	u.record("alice", "apk", http.StatusBadGateway, time.Hour)
+	now = now.Add(30 * time.Minute)
+	u.record("bob", "xpi", http.StatusCreated, time.Hour)
+
+	report := u.report(time.Hour)
+	if report.Window != "1h0m0s" || !report.Since.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("reported window %q since %s", report.Window, report.Since)
+	}
+	expected := []userUsage{
+		{User: "alice", Signer: "apk", usageCounts: usageCounts{Requests: 1, Failed: 1}},
+		{User: "bob", Signer: "xpi", usageCounts: usageCounts{Requests: 1, Succeeded: 1}},
+	}
+	if len(report.Users) != len(expected) || report.Users[0] != expected[0] || report.Users[1] != expected[1] {
+		t.Fatalf("reported %+v expected %+v", report.Users, expected)
+	}
+
+	// the counts since start are kept alongside the window
+	total := u.report(0)
+	if len(total.Users) != 2 || total.Users[0].Requests != 2 || !total.Since.Equal(u.start) {
+		t.Fatalf("reported %+v since %s expected all the requests since start", total.Users, total.Since)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if report := u.report(time.Hour); len(report.Users) != 0 {
+		t.Fatalf("reported %+v once the requests left the window", report.Users)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errValidityWindowNotAllowed = errors.New("validity window cannot be set for this token")
+	errInvalidValidityWindow    = errors.New("invalid validity window")
+)
+
+// maxValidityWindow bounds the validity of the certificates requested
+// with not_before and not_after
+const maxValidityWindow = 366 * 24 * time.Hour
+
+// validityWindowFields are the form fields of the validity window of
+// the generated certificate, forwarded to autograph in the options of
+// the same name
+var validityWindowFields = []string{"not_before", "not_after"}
+
+// allowedValidityWindow returns the validity window requested in the
+// not_before and not_after RFC3339 form values, or zero times when
+// neither is sent. Both must be sent, only tokens with
+// AllowValidityWindow can send them, and the window must end after now
+// and last at most maxValidityWindow.
+func allowedValidityWindow(auth authorization, r *http.Request, now time.Time) (notBefore, notAfter time.Time, err error) {
+	if r.MultipartForm == nil {
+		return
+	}
+	values := make(map[string]time.Time, len(validityWindowFields))
+	for _, field := range validityWindowFields {
+		sent, ok := r.MultipartForm.Value[field]
+		if !ok {
+			continue
+		}
+		if !auth.AllowValidityWindow {
+			return time.Time{}, time.Time{}, errors.Wrapf(errValidityWindowNotAllowed, "field %s", field)
+		}
+		if len(sent) != 1 {
+			return time.Time{}, time.Time{}, errors.Wrapf(errInvalidValidityWindow, "field %s must be a single timestamp", field)
+		}
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(sent[0]))
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Wrapf(errInvalidValidityWindow, "field %s must be an RFC3339 timestamp", field)
+		}
+		values[field] = t
+	}
+	switch {
+	case len(values) == 0:
+		return
+	case len(values) != len(validityWindowFields):
+		return time.Time{}, time.Time{}, errors.Wrap(errInvalidValidityWindow, "not_before and not_after must be sent together")
+	}
+	notBefore, notAfter = values["not_before"], values["not_after"]
+	switch {
+	case !notAfter.After(notBefore):
+		err = errors.Wrap(errInvalidValidityWindow, "not_after must be after not_before")
+	case !notAfter.After(now):
+		err = errors.Wrap(errInvalidValidityWindow, "not_after must be in the future")
+	case notAfter.Sub(notBefore) > maxValidityWindow:
+		err = errors.Wrapf(errInvalidValidityWindow, "window cannot be longer than %s", maxValidityWindow)
+	}
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return notBefore.UTC(), notAfter.UTC(), nil
+}
+
+// validityWindowOptions returns the autograph options of the validity
+// window of params, or nil when it has none
+func validityWindowOptions(params signingParams) map[string]interface{} {
+	if params.NotBefore.IsZero() {
+		return nil
+	}
+	return map[string]interface{}{
+		"not_before": params.NotBefore.Format(time.RFC3339),
+		"not_after":  params.NotAfter.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSigHandlerValidityWindow(t *testing.T) {
+	testConf := currentConf()
+	testConf.Authorizations = append([]authorization(nil), testConf.Authorizations...)
+	testConf.Authorizations[2].AllowValidityWindow = true
+	useTestConf(t, testConf)
+	notBefore := time.Now().UTC().Truncate(time.Second)
+	notAfter := notBefore.Add(30 * 24 * time.Hour)
+
+	testcases := []struct {
+		name            string
+		token           string
+		fields          map[string]string
+		expectedStatus  int
+		expectedCode    string
+		expectedOptions map[string]interface{}
+	}{
+		{
+			name:           "permitted window",
+			token:          testConf.Authorizations[2].ClientToken,
+			fields:         map[string]string{"not_before": notBefore.Format(time.RFC3339), "not_after": notAfter.Format(time.RFC3339)},
+			expectedStatus: http.StatusCreated,
+			expectedOptions: map[string]interface{}{
+				"not_before": notBefore.Format(time.RFC3339),
+				"not_after":  notAfter.Format(time.RFC3339),
+			},
+		},
+		{
+			name:           "permitted token without a window",
+			token:          testConf.Authorizations[2].ClientToken,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "forbidden for tokens without allow_validity_window",
+			token:          testConf.Authorizations[0].ClientToken,
+			fields:         map[string]string{"not_before": notBefore.Format(time.RFC3339), "not_after": notAfter.Format(time.RFC3339)},
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   "validity_window_not_allowed",
+		},
+		{
+			name:           "malformed timestamp",
+			token:          testConf.Authorizations[2].ClientToken,
+			fields:         map[string]string{"not_before": "2024-01-01", "not_after": notAfter.Format(time.RFC3339)},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_validity_window",
+		},
+		{
+			name:           "not_after before not_before",
+			token:          testConf.Authorizations[2].ClientToken,
+			fields:         map[string]string{"not_before": notAfter.Format(time.RFC3339), "not_after": notBefore.Format(time.RFC3339)},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_validity_window",
+		},
+		{
+			name:           "window too long",
+			token:          testConf.Authorizations[2].ClientToken,
+			fields:         map[string]string{"not_before": notBefore.Format(time.RFC3339), "not_after": notBefore.Add(2 * maxValidityWindow).Format(time.RFC3339)},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_validity_window",
+		},
+		{
+			name:           "not_after alone",
+			token:          testConf.Authorizations[2].ClientToken,
+			fields:         map[string]string{"not_after": notAfter.Format(time.RFC3339)},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_validity_window",
+		},
+	}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequests []struct {
+				Options map[string]interface{}
+			}
+			clientMock := useMockAutographClient(t)
+			if tt.expectedStatus == http.StatusCreated {
+				clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					if err := json.NewDecoder(req.Body).Decode(&upstreamRequests); err != nil {
+						t.Fatal(err)
+					}
+					return newSignedFileResponse([]byte("signed")), nil
+				})
+			}
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequestWithFields(t, tt.token, []byte("unsigned"), tt.fields))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("returned unexpected status %v expected %v: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusCreated {
+				var body errorResponse
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code != tt.expectedCode {
+					t.Fatalf("returned %+v (%v) expected the %s code", body, err, tt.expectedCode)
+				}
+				return
+			}
+			if len(upstreamRequests) != 1 {
+				t.Fatalf("upstream received %d requests expected 1", len(upstreamRequests))
+			}
+			if !reflect.DeepEqual(upstreamRequests[0].Options, tt.expectedOptions) {
+				t.Fatalf("upstream received options %+v expected %+v", upstreamRequests[0].Options, tt.expectedOptions)
+			}
+		})
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errVerifyNotSupported = errors.New("verification is not supported for the signature type of this token")
+	errVerifyNotEnabled   = errors.New("no verification certificate is configured for the signer of this token")
+)
+
+const (
+	// xpiManifestPath lists the digests of the files of a signed XPI
+	xpiManifestPath = "META-INF/manifest.mf"
+
+	// xpiSignatureFilePath has the digest of the manifest, and is the
+	// content signed by the PKCS7 signature
+	xpiSignatureFilePath = "META-INF/mozilla.sf"
+)
+
+// loadVerifyCertificates reads the PEM certificates autograph signs
+// with for each signer, which the signatures checked by /verify must
+// chain to
+func loadVerifyCertificates(paths map[string]string) (map[string]*x509.CertPool, error) {
+	roots := make(map[string]*x509.CertPool, len(paths))
+	for signer, path := range paths {
+		pemCerts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the verify certificates of signer %q: %v", signer, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("verify certificates %q of signer %q contain no PEM certificates", path, signer)
+		}
+		roots[signer] = pool
+	}
+	return roots, nil
+}
+
+// verifyResponse is the body returned by /verify. Valid is false with
+// the reason in Error when the artifact is not signed by the signer of
+// the token or was modified since.
+type verifyResponse struct {
+	Valid         bool   `json:"valid"`
+	Signer        string `json:"signer"`
+	SignatureType string `json:"signature_type"`
+
+	// Subject is the subject of the certificate of a valid signature
+	Subject string `json:"subject,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// verifyHandler checks the signature of the artifact in the input field
+// against the verification certificates of the signer of the token,
+// without calling autograph. Only the PKCS7 signature of XPIs is
+// checked.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := getLogger(r)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeSigningError(w, r, errInvalidMethod)
+		return
+	}
+	token, err := clientToken(r)
+	if err == nil && token == "" {
+		err = errMissingToken
+	}
+	if err != nil {
+		logger.Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	// verifying calls no signer, so it is allowed while the signer of
+	// the token is disabled
+	auth, err := authorize(token)
+	if errors.Is(err, errTokenExpired) {
+		logger.WithFields(log.Fields{"user": auth.User, "signer": auth.Signer}).Error(err)
+		writeSigningError(w, r, err)
+		return
+	}
+	if err != nil && !errors.Is(err, errSignerDisabled) {
+		logger.Error(err)
+		writeSigningError(w, r, errInvalidToken)
+		return
+	}
+	if len(auth.AllowedCIDRs) > 0 {
+		ip, err := clientIP(r)
+		if err != nil || !auth.allowsIP(ip) {
+			logger.WithFields(log.Fields{"user": auth.User, "client_ip": ip}).Error(errIPNotAllowed)
+			writeSigningError(w, r, errIPNotAllowed)
+			return
+		}
+	}
+	c := currentConf()
+	if auth.signatureType() != signatureTypeXPI {
+		logger.WithFields(log.Fields{"user": auth.User, "signer": auth.Signer}).Error(errVerifyNotSupported)
+		writeSigningError(w, r, errVerifyNotSupported)
+		return
+	}
+	roots, ok := c.verifyRoots[auth.Signer]
+	if !ok {
+		logger.WithFields(log.Fields{"user": auth.User, "signer": auth.Signer}).Error(errVerifyNotEnabled)
+		writeSigningError(w, r, errVerifyNotEnabled)
+		return
+	}
+
+	maxUploadBytes := c.maxUploadBytes(auth)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	err = parseLimitedMultipartForm(r, c.multipartLimits())
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, formError(err))
+		return
+	}
+	fd, _, err := r.FormFile("input")
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, formError(err))
+		return
+	}
+	input, err := ioutil.ReadAll(fd)
+	fd.Close()
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Error(err)
+		writeSigningError(w, r, errors.Wrap(errInvalidInput, err.Error()))
+		return
+	}
+
+	resp := verifyResponse{Signer: auth.Signer, SignatureType: auth.signatureType()}
+	cert, err := verifyXPI(input, roots, maxUploadBytes)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Valid = true
+		resp.Subject = cert.Subject.String()
+	}
+	logger.WithFields(log.Fields{
+		"user":   auth.User,
+		"signer": auth.Signer,
+		"valid":  resp.Valid,
+	}).Info("verified artifact")
+	body, err := json.Marshal(resp)
+	if err != nil {
+		logger.WithFields(log.Fields{"user": auth.User}).Errorf("failed to marshal verify response: %v", err)
+		writeSigningError(w, r, errInternal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// verifyXPI checks that every file of the signed XPI matches its digest
+// in the manifest, that the manifest matches the signature file, and
+// that the PKCS7 signature of the signature file is valid and made by
+// a certificate chaining to roots, which it returns. Files decompressing
+// to more than maxEntryBytes are rejected without being read.
+func verifyXPI(signedXPI []byte, roots *x509.CertPool, maxEntryBytes int64) (*x509.Certificate, error) {
+	zr, err := zip.NewReader(bytes.NewReader(signedXPI), int64(len(signedXPI)))
+	if err != nil {
+		return nil, fmt.Errorf("not a zip file: %v", err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		if f.UncompressedSize64 > uint64(maxEntryBytes) {
+			return nil, fmt.Errorf("%s is larger than %d bytes", f.Name, maxEntryBytes)
+		}
+		files[f.Name] = f
+	}
+	manifest, err := readZipFile(files, xpiManifestPath, maxEntryBytes)
+	if err != nil {
+		return nil, err
+	}
+	sigFile, err := readZipFile(files, xpiSignatureFilePath, maxEntryBytes)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := readZipFile(files, xpiPKCS7SignaturePath, maxEntryBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// the manifest lists all the files but itself and the PKCS7
+	// signature and signature file
+	listed := make(map[string]bool)
+	for _, section := range parseJARManifest(manifest) {
+		name := section["Name"]
+		if name == "" {
+			continue
+		}
+		listed[name] = true
+		// the files are hashed as they are decompressed rather than
+		// read in memory
+		rc, err := openZipFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+		err = checkJARDigest(section, "Digest", io.LimitReader(rc, maxEntryBytes))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	for name := range files {
+		switch {
+		case strings.HasSuffix(name, "/"), listed[name]:
+		case name == xpiManifestPath, name == xpiSignatureFilePath, name == xpiPKCS7SignaturePath:
+		default:
+			return nil, fmt.Errorf("%s is not listed in the manifest", name)
+		}
+	}
+	sections := parseJARManifest(sigFile)
+	if len(sections) == 0 {
+		return nil, fmt.Errorf("empty signature file")
+	}
+	if err = checkJARDigest(sections[0], "Digest-Manifest", bytes.NewReader(manifest)); err != nil {
+		return nil, fmt.Errorf("manifest: %v", err)
+	}
+	return verifyPKCS7(signature, sigFile, roots)
+}
+
+func openZipFile(files map[string]*zip.File, name string) (io.ReadCloser, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("missing %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", name, err)
+	}
+	return rc, nil
+}
+
+// readZipFile reads up to maxBytes of the content of name. The zip
+// reader fails on entries larger than the size of their header, which
+// verifyXPI checks against maxBytes.
+func readZipFile(files map[string]*zip.File, name string, maxBytes int64) ([]byte, error) {
+	rc, err := openZipFile(files, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(rc, maxBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return content, nil
+}
+
+// parseJARManifest returns the sections of a JAR manifest or signature
+// file as maps of their attributes, joining the continuation lines
+func parseJARManifest(manifest []byte) []map[string]string {
+	var (
+		sections []map[string]string
+		section  map[string]string
+		lastKey  string
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			section = nil
+		case strings.HasPrefix(line, " ") && section != nil:
+			section[lastKey] += line[1:]
+		default:
+			key, value, ok := strings.Cut(line, ": ")
+			if !ok {
+				continue
+			}
+			if section == nil {
+				section = make(map[string]string)
+				sections = append(sections, section)
+			}
+			section[key] = value
+			lastKey = key
+		}
+	}
+	return sections
+}
+
+// jarDigests are the digest attribute prefixes of JAR manifests, with
+// the strongest first
+var jarDigests = []struct {
+	prefix string
+	hash   crypto.Hash
+}{
+	{"SHA256-", crypto.SHA256},
+	{"SHA1-", crypto.SHA1},
+}
+
+// checkJARDigest checks content against the strongest digest of section
+// with the given attribute suffix, like SHA256-Digest
+func checkJARDigest(section map[string]string, suffix string, content io.Reader) error {
+	for _, d := range jarDigests {
+		encoded, ok := section[d.prefix+suffix]
+		if !ok {
+			continue
+		}
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid %s%s: %v", d.prefix, suffix, err)
+		}
+		h := d.hash.New()
+		if _, err = io.Copy(h, content); err != nil {
+			return fmt.Errorf("failed to read: %v", err)
+		}
+		if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+			return fmt.Errorf("%s%s does not match", d.prefix, suffix)
+		}
+		return nil
+	}
+	return fmt.Errorf("no supported digest")
+}
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	pkcs7DigestAlgorithms = map[string]crypto.Hash{
+		"1.3.14.3.2.26":          crypto.SHA1,
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+		"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+		"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+	}
+)
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7Attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// verifyPKCS7 checks the detached PKCS7 signature of content and that
+// its signing certificate chains to roots
+func verifyPKCS7(signature, content []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	var ci pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(signature, &ci); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("invalid PKCS7 signature")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("PKCS7 signature is not signed data")
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("invalid PKCS7 signed data: %v", err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("PKCS7 signature has %d signers expected 1", len(sd.SignerInfos))
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PKCS7 certificates: %v", err)
+	}
+	si := sd.SignerInfos[0]
+	var signer *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) && cert.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 {
+			signer = cert
+			continue
+		}
+		intermediates.AddCert(cert)
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("PKCS7 signature does not include its signing certificate")
+	}
+
+	hash, ok := pkcs7DigestAlgorithms[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported PKCS7 digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	signed := content
+	if len(si.AuthenticatedAttributes.FullBytes) > 0 {
+		// the attributes are signed as a SET rather than with their
+		// implicit tag, and include the digest of the content
+		signed = append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+		if err = checkPKCS7MessageDigest(signed, hash, content); err != nil {
+			return nil, err
+		}
+	}
+	algo, err := pkcs7SignatureAlgorithm(signer, hash)
+	if err != nil {
+		return nil, err
+	}
+	if err = signer.CheckSignature(algo, signed, si.EncryptedDigest); err != nil {
+		return nil, fmt.Errorf("invalid PKCS7 signature: %v", err)
+	}
+	_, err = signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PKCS7 signing certificate is not trusted: %v", err)
+	}
+	return signer, nil
+}
+
+func checkPKCS7MessageDigest(attributes []byte, hash crypto.Hash, content []byte) error {
+	var attrs []pkcs7Attribute
+	if _, err := asn1.UnmarshalWithParams(attributes, &attrs, "set"); err != nil {
+		return fmt.Errorf("invalid PKCS7 authenticated attributes: %v", err)
+	}
+	for _, attr := range attrs {
+		if !attr.Type.Equal(oidMessageDigest) {
+			continue
+		}
+		var digest []byte
+		if _, err := asn1.Unmarshal(attr.Value.Bytes, &digest); err != nil {
+			return fmt.Errorf("invalid PKCS7 message digest: %v", err)
+		}
+		h := hash.New()
+		io.Copy(h, bytes.NewReader(content))
+		if subtle.ConstantTimeCompare(h.Sum(nil), digest) != 1 {
+			return fmt.Errorf("PKCS7 message digest does not match the signature file")
+		}
+		return nil
+	}
+	return fmt.Errorf("PKCS7 authenticated attributes have no message digest")
+}
+
+// pkcs7SignatureAlgorithm returns the x509 signature algorithm of the
+// key of cert with hash
+func pkcs7SignatureAlgorithm(cert *x509.Certificate, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	algorithms := map[crypto.Hash][2]x509.SignatureAlgorithm{
+		crypto.SHA1:   {x509.SHA1WithRSA, x509.ECDSAWithSHA1},
+		crypto.SHA256: {x509.SHA256WithRSA, x509.ECDSAWithSHA256},
+		crypto.SHA384: {x509.SHA384WithRSA, x509.ECDSAWithSHA384},
+		crypto.SHA512: {x509.SHA512WithRSA, x509.ECDSAWithSHA512},
+	}[hash]
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return algorithms[0], nil
+	case *ecdsa.PublicKey:
+		return algorithms[1], nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported PKCS7 signing key %T", cert.PublicKey)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a certificate of a new key, signed by
+// parent or self-signed as a CA when parent is nil
+func newTestCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newPKCS7SignedXPI returns an XPI of files signed like autograph does,
+// with a detached PKCS7 signature of the signature file by key
+func newPKCS7SignedXPI(t *testing.T, files map[string]string, cert *x509.Certificate, key *ecdsa.PrivateKey) []byte {
+	var manifest bytes.Buffer
+	manifest.WriteString("Manifest-Version: 1.0\n\n")
+	for name, content := range files {
+		digest := sha256.Sum256([]byte(content))
+		fmt.Fprintf(&manifest, "Name: %s\nSHA256-Digest: %s\n\n", name, base64.StdEncoding.EncodeToString(digest[:]))
+	}
+	manifestDigest := sha256.Sum256(manifest.Bytes())
+	sigFile := fmt.Sprintf("Signature-Version: 1.0\nSHA256-Digest-Manifest: %s\n\n", base64.StdEncoding.EncodeToString(manifestDigest[:]))
+
+	sigFileDigest := sha256.Sum256([]byte(sigFile))
+	signature, err := key.Sign(rand.Reader, sigFileDigest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}}
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo:      pkcs7ContentInfo{ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: pkcs7IssuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:           sha256Algorithm,
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			EncryptedDigest:           signature,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs7, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	entries := map[string]string{
+		xpiManifestPath:       manifest.String(),
+		xpiSignatureFilePath:  sigFile,
+		xpiPKCS7SignaturePath: string(pkcs7),
+	}
+	for name, content := range files {
+		entries[name] = content
+	}
+	for name, content := range entries {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// replaceZipFile returns the zip with the content of name replaced
+func replaceZipFile(t *testing.T, zipFile []byte, name, content string) []byte {
+	zr, err := zip.NewReader(bytes.NewReader(zipFile), int64(len(zipFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		w, err := zw.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == name {
+			w.Write([]byte(content))
+			continue
+		}
+		w.Write([]byte(readTestZipFile(t, f)))
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readTestZipFile(t *testing.T, f *zip.File) string {
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(rc)
+	return buf.String()
+}
+
+func TestVerifyHandler(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "test addons CA", nil, nil)
+	cert, key := newTestCertificate(t, "test add-on", ca, caKey)
+	otherCA, otherCAKey := newTestCertificate(t, "other CA", nil, nil)
+	otherCert, otherKey := newTestCertificate(t, "other add-on", otherCA, otherCAKey)
+
+	c := currentConf()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	c.verifyRoots = map[string]*x509.CertPool{c.Authorizations[0].Signer: roots}
+	useTestConf(t, c)
+	files := map[string]string{
+		"manifest.json": `{"name": "test"}`,
+		"background.js": "console.log('hello')",
+	}
+	signedXPI := newPKCS7SignedXPI(t, files, cert, key)
+
+	for _, tt := range []struct {
+		name      string
+		input     []byte
+		wantValid bool
+		wantError string
+	}{
+		{"valid signature", signedXPI, true, ""},
+		{"tampered file", replaceZipFile(t, signedXPI, "background.js", "console.log('pwned')"), false, "background.js: SHA256-Digest does not match"},
+		{"tampered manifest", replaceZipFile(t, signedXPI, xpiManifestPath, "Manifest-Version: 1.0\n\n"), false, "is not listed in the manifest"},
+		{"untrusted signer", newPKCS7SignedXPI(t, files, otherCert, otherKey), false, "not trusted"},
+		{"unsigned", newSignedXPI(t, "manifest.json"), false, "missing META-INF/manifest.mf"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			verifyHandler(w, newMultipartSignRequest(t, c.Authorizations[0].ClientToken, tt.input))
+			if w.Code != http.StatusOK {
+				t.Fatalf("returned %d %s expected a 200", w.Code, w.Body.String())
+			}
+			var resp verifyResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Valid != tt.wantValid || !strings.Contains(resp.Error, tt.wantError) {
+				t.Fatalf("returned %+v expected valid %v and error %q", resp, tt.wantValid, tt.wantError)
+			}
+			if resp.Valid && resp.Subject != "CN=test add-on" {
+				t.Fatalf("returned subject %q expected CN=test add-on", resp.Subject)
+			}
+		})
+	}
+
+	t.Run("rejects files decompressing past the upload limit", func(t *testing.T) {
+		limited := c
+		limited.Authorizations = append([]authorization(nil), c.Authorizations...)
+		limited.Authorizations[0].MaxUploadBytes = 64 << 10
+		useTestConf(t, limited)
+		bomb := newPKCS7SignedXPI(t, map[string]string{"bomb.bin": strings.Repeat("\x00", 16<<20)}, cert, key)
+		if len(bomb) > 64<<10 {
+			t.Fatalf("compressed bomb is %d bytes expected it under the upload limit", len(bomb))
+		}
+		w := httptest.NewRecorder()
+		verifyHandler(w, newMultipartSignRequest(t, c.Authorizations[0].ClientToken, bomb))
+		var resp verifyResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("returned %d %s: %v", w.Code, w.Body.String(), err)
+		}
+		if resp.Valid || resp.Error != "bomb.bin is larger than 65536 bytes" {
+			t.Fatalf("returned %+v expected bomb.bin to be rejected", resp)
+		}
+	})
+
+	t.Run("signers without certificates cannot verify", func(t *testing.T) {
+		noRoots := c
+		noRoots.verifyRoots = nil
+		useTestConf(t, noRoots)
+		w := httptest.NewRecorder()
+		verifyHandler(w, newMultipartSignRequest(t, c.Authorizations[0].ClientToken, signedXPI))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "verify_not_enabled") {
+			t.Fatalf("returned %d %s expected a 400 verify_not_enabled", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("apk signers cannot verify", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		verifyHandler(w, newMultipartSignRequest(t, c.Authorizations[2].ClientToken, signedXPI))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "verify_not_supported") {
+			t.Fatalf("returned %d %s expected a 400 verify_not_supported", w.Code, w.Body.String())
+		}
+	})
+}
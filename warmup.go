@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// warmUpBackends calls the heartbeat of each distinct backend of
+// baseURLs at once, so that the connections to them are open and idle
+// in the pool of client before the first signing request. Failures are
+// logged and otherwise ignored, the connections being then opened by
+// the signing requests as usual.
+func warmUpBackends(baseURLs []string, client heartbeatRequester) {
+	var (
+		wg     sync.WaitGroup
+		warmed []string
+	)
+	for _, baseURL := range baseURLs {
+		if stringInSlice(baseURL, warmed) {
+			continue
+		}
+		warmed = append(warmed, baseURL)
+		wg.Add(1)
+		go func(baseURL string) {
+			defer wg.Done()
+			resp, err := client.Get(baseURL + "__heartbeat__")
+			if err != nil {
+				log.Warnf("failed to warm up the connection to autograph backend %s: %v", baseURL, err)
+				return
+			}
+			// the connection only goes back to the pool once the
+			// body is read
+			drainAndClose(resp)
+			log.Infof("warmed up the connection to autograph backend %s", baseURL)
+		}(baseURL)
+	}
+	wg.Wait()
+}
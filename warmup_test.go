@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mozilla-services/autograph-edge/mock_main"
+)
+
+func Test_warmUpBackends(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	hbMock := mock_main.NewMockheartbeatRequester(ctrl)
+	hbMock.EXPECT().Get("http://autograph-1:8000/__heartbeat__").Return(newAutographResponse(http.StatusOK, "{}"), nil).Times(1)
+	// backends that are down don't stop the others from warming up
+	hbMock.EXPECT().Get("http://autograph-2:8000/__heartbeat__").Return(nil, fmt.Errorf("connection refused")).Times(1)
+
+	warmUpBackends([]string{"http://autograph-1:8000/", "http://autograph-2:8000/", "http://autograph-1:8000/"}, hbMock)
+	ctrl.Finish()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// workerPoolConfig sizes the pool of workers calling autograph for the
+// signing requests
+type workerPoolConfig struct {
+	// Size is the number of workers. Zero, the default, calls autograph
+	// from the goroutine of each request.
+	Size int `yaml:"size"`
+
+	// QueueCapacity is the number of signing requests waiting for a
+	// worker, over which requests fail with a 503 at once. Defaults to
+	// the size of the pool.
+	QueueCapacity int `yaml:"queue_capacity"`
+}
+
+func (wc workerPoolConfig) validate() error {
+	if wc.Size < 0 || wc.QueueCapacity < 0 {
+		return fmt.Errorf("signing workers settings %+v cannot be negative", wc)
+	}
+	return nil
+}
+
+// signingJob is a call to autograph run by a worker, which sends the
+// error of the call to result
+type signingJob struct {
+	ctx    context.Context
+	run    func(context.Context) error
+	result chan error
+}
+
+// workerPool is a fixed number of workers pulling signing jobs from a
+// bounded queue. The workers exit once the queue is closed and drained.
+type workerPool struct {
+	config workerPoolConfig
+	jobs   chan *signingJob
+}
+
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		signingWorkerQueueDepth.Dec()
+		// the request went away while its job was queued
+		if err := job.ctx.Err(); err != nil {
+			job.result <- err
+			continue
+		}
+		signingWorkersBusy.Inc()
+		job.result <- job.run(job.ctx)
+		signingWorkersBusy.Dec()
+	}
+}
+
+// signingWorkerPool holds the worker pool of the live configuration.
+// The mutex guards sending to the queue of the pool against closing it.
+type signingWorkerPool struct {
+	sync.Mutex
+	pool *workerPool
+}
+
+var signingWorkers = &signingWorkerPool{}
+
+// configure starts the workers of wc when it changes. The workers of
+// the previous pool finish the jobs already queued before exiting.
+func (s *signingWorkerPool) configure(wc workerPoolConfig) {
+	s.Lock()
+	defer s.Unlock()
+	if s.pool != nil && s.pool.config == wc {
+		return
+	}
+	if s.pool != nil {
+		close(s.pool.jobs)
+		s.pool = nil
+	}
+	signingWorkersSize.Set(float64(wc.Size))
+	if wc.Size <= 0 {
+		return
+	}
+	s.pool = &workerPool{config: wc, jobs: make(chan *signingJob, wc.QueueCapacity)}
+	for i := 0; i < wc.Size; i++ {
+		go s.pool.work()
+	}
+}
+
+// run queues a job calling run with ctx and waits for its result, or
+// fails with errUpstreamBusy when the queue is full. Without workers,
+// run is called at once.
+func (s *signingWorkerPool) run(ctx context.Context, run func(context.Context) error) error {
+	s.Lock()
+	if s.pool == nil {
+		s.Unlock()
+		return run(ctx)
+	}
+	job := &signingJob{ctx: ctx, run: run, result: make(chan error, 1)}
+	signingWorkerQueueDepth.Inc()
+	select {
+	case s.pool.jobs <- job:
+	default:
+		signingWorkerQueueDepth.Dec()
+		s.Unlock()
+		return errors.Wrap(errUpstreamBusy, "signing worker queue is full")
+	}
+	s.Unlock()
+	// the job writes the signed file to the response, so it is waited
+	// for even once ctx is done, which ends its call to autograph
+	return <-job.result
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitForGauge polls until the gauge reports want
+func waitForGauge(t *testing.T, name string, get func() float64, want float64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for get() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %v expected %v", name, get(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSigHandlerSigningWorkers(t *testing.T) {
+	c := currentConf()
+	c.SigningWorkers = workerPoolConfig{Size: 3, QueueCapacity: 12}
+	useTestConf(t, c)
+
+	var inFlight, maxInFlight int32
+	var busy, queued sync.Map
+	clientMock := useMockAutographClient(t)
+	clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		busy.Store(testutil.ToFloat64(signingWorkersBusy), true)
+		queued.Store(testutil.ToFloat64(signingWorkerQueueDepth), true)
+		time.Sleep(20 * time.Millisecond)
+		return newSignedFileResponse([]byte("signed")), nil
+	}).Times(12)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 12)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			sigHandler(w, newMultipartSignRequest(t, c.Authorizations[2].ClientToken, []byte("unsigned")))
+			statuses[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusCreated {
+			t.Errorf("request %d returned unexpected status %v expected %v", i, status, http.StatusCreated)
+		}
+	}
+	if maxInFlight > 3 {
+		t.Fatalf("%d concurrent calls to autograph exceeded the 3 workers", maxInFlight)
+	}
+	busy.Range(func(n, _ interface{}) bool {
+		if n.(float64) < 1 || n.(float64) > 3 {
+			t.Errorf("reported %v busy workers of 3 during a call", n)
+		}
+		return true
+	})
+	if _, ok := busy.Load(float64(3)); !ok {
+		t.Error("never reported the 3 workers busy under load")
+	}
+	sawQueue := false
+	queued.Range(func(n, _ interface{}) bool {
+		sawQueue = sawQueue || n.(float64) > 0
+		return true
+	})
+	if !sawQueue {
+		t.Error("never reported queued jobs under load")
+	}
+	waitForGauge(t, "busy workers", func() float64 { return testutil.ToFloat64(signingWorkersBusy) }, 0)
+	if depth := testutil.ToFloat64(signingWorkerQueueDepth); depth != 0 {
+		t.Fatalf("reported %v queued jobs after all requests completed", depth)
+	}
+	if size := testutil.ToFloat64(signingWorkersSize); size != 3 {
+		t.Fatalf("reported %v signing workers expected 3", size)
+	}
+}
+
+func TestSigHandlerSigningWorkerQueueFull(t *testing.T) {
+	c := currentConf()
+	c.SigningWorkers = workerPoolConfig{Size: 1, QueueCapacity: 1}
+	useTestConf(t, c)
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	clientMock := useMockAutographClient(t)
+	gomock.InOrder(
+		clientMock.EXPECT().Do(gomock.Any()).DoAndReturn(func(*http.Request) (*http.Response, error) {
+			close(started)
+			<-unblock
+			return newSignedFileResponse([]byte("signed")), nil
+		}),
+		clientMock.EXPECT().Do(gomock.Any()).Return(newSignedFileResponse([]byte("signed")), nil),
+	)
+
+	// the first request keeps the only worker busy and the second one
+	// fills the queue
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+	sign := func(i int) {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		sigHandler(w, newMultipartSignRequest(t, c.Authorizations[2].ClientToken, []byte("unsigned")))
+		statuses[i] = w.Code
+	}
+	wg.Add(2)
+	go sign(0)
+	<-started
+	go sign(1)
+	waitForGauge(t, "queued jobs", func() float64 { return testutil.ToFloat64(signingWorkerQueueDepth) }, 1)
+
+	w := httptest.NewRecorder()
+	sigHandler(w, newMultipartSignRequest(t, c.Authorizations[2].ClientToken, []byte("unsigned")))
+	close(unblock)
+	wg.Wait()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("returned unexpected status %v expected %v", w.Code, http.StatusServiceUnavailable)
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != "upstream_busy" {
+		t.Fatalf("returned unexpected code %q expected upstream_busy", resp.Code)
+	}
+	for i, status := range statuses {
+		if status != http.StatusCreated {
+			t.Errorf("request %d returned unexpected status %v expected %v", i, status, http.StatusCreated)
+		}
+	}
+}
+
+func Test_signingWorkerPoolConfigure(t *testing.T) {
+	s := &signingWorkerPool{}
+	t.Cleanup(func() { s.configure(workerPoolConfig{}) })
+
+	// a job queued behind a busy worker of the previous pool still runs
+	// once the pool is replaced
+	s.configure(workerPoolConfig{Size: 1, QueueCapacity: 1})
+	unblock := make(chan struct{})
+	results := make(chan error, 2)
+	go func() {
+		results <- s.run(context.Background(), func(context.Context) error {
+			<-unblock
+			return nil
+		})
+	}()
+	waitForGauge(t, "busy workers", func() float64 { return testutil.ToFloat64(signingWorkersBusy) }, 1)
+	go func() {
+		results <- s.run(context.Background(), func(context.Context) error { return nil })
+	}()
+	waitForGauge(t, "queued jobs", func() float64 { return testutil.ToFloat64(signingWorkerQueueDepth) }, 1)
+
+	for _, size := range []int{2, 0, 2} {
+		s.configure(workerPoolConfig{Size: size, QueueCapacity: size})
+		if got := testutil.ToFloat64(signingWorkersSize); got != float64(size) {
+			t.Fatalf("reported %v signing workers after configuring %d", got, size)
+		}
+		if err := s.run(context.Background(), func(context.Context) error { return nil }); err != nil {
+			t.Fatalf("job with %d workers returned error: %v", size, err)
+		}
+	}
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("job of the previous pool returned error: %v", err)
+		}
+	}
+
+	t.Run("skips the jobs of requests that ended", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := s.run(ctx, func(context.Context) error {
+			t.Error("ran the job of a canceled request")
+			return nil
+		})
+		if err != context.Canceled {
+			t.Fatalf("returned %v expected %v", err, context.Canceled)
+		}
+	})
+}
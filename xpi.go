@@ -0,0 +1,44 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+var errIncompleteXPISignature = errors.New("autograph did not apply all requested signatures to the XPI")
+
+const (
+	// xpiPKCS7SignaturePath is where the PKCS7 signature is stored in a signed XPI
+	xpiPKCS7SignaturePath = "META-INF/mozilla.rsa"
+
+	// xpiCOSESignaturePath is where the COSE signature is stored in a signed XPI
+	xpiCOSESignaturePath = "META-INF/cose.sig"
+)
+
+// verifyXPISignatures checks that a signed XPI returned by autograph
+// contains both a PKCS7 and a COSE signature, so that a half-signed
+// add-on is never returned to the client
+func verifyXPISignatures(signedXPI []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(signedXPI), int64(len(signedXPI)))
+	if err != nil {
+		return errors.Wrap(errIncompleteXPISignature, err.Error())
+	}
+	var hasPKCS7, hasCOSE bool
+	for _, f := range zr.File {
+		switch f.Name {
+		case xpiPKCS7SignaturePath:
+			hasPKCS7 = true
+		case xpiCOSESignaturePath:
+			hasCOSE = true
+		}
+	}
+	if !hasPKCS7 {
+		return errors.Wrap(errIncompleteXPISignature, "missing PKCS7 signature")
+	}
+	if !hasCOSE {
+		return errors.Wrap(errIncompleteXPISignature, "missing COSE signature")
+	}
+	return nil
+}